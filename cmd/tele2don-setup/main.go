@@ -6,11 +6,15 @@ import (
 	"fmt"
 	"log"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/mattn/go-mastodon"
 )
 
 func main() {
+	writePath := flag.String("write", "", "append the endpoint to this TOML config file instead of printing it")
 	flag.Parse()
 
 	args := flag.Args()
@@ -18,50 +22,85 @@ func main() {
 	if len(args) != 1 {
 		log.Fatalln("Invalid input.")
 	}
+	if *writePath != "" && filepath.Ext(*writePath) != ".toml" {
+		log.Fatalln("Only TOML config files can be written.")
+	}
 
+	ctx := context.Background()
+	var endpoint string
 	switch args[0] {
 	case "mastodon":
-		appCfg := &mastodon.AppConfig{
-			ClientName: "tele2don",
-			Scopes:     "read write",
-			Website:    "https://github.com/merrkry/tele2don",
-		}
+		endpoint = setupMastodon(ctx)
+	case "telegram":
+		endpoint = setupTelegram(ctx)
+	default:
+		log.Fatalln("Unsupported platform.")
+	}
+
+	if *writePath == "" {
+		fmt.Println("Setup finished. Please add the following endpoint to tele2don config, and give it a name.")
+		fmt.Println()
+		fmt.Print(endpoint)
+		return
+	}
+
+	f, err := os.OpenFile(*writePath, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		log.Fatalln("Failed to open config file: ", err)
+	}
+	_, err = fmt.Fprintf(f, "\n%s", endpoint)
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		log.Fatalln("Failed to write config file: ", err)
+	}
+	fmt.Printf("Setup finished. The endpoint is added to %s, please give it a name and add it to routes.\n", *writePath)
+}
 
-		fmt.Println("Mastodon server address?")
-		fmt.Scanln(&appCfg.Server)
+func setupMastodon(ctx context.Context) string {
+	appCfg := &mastodon.AppConfig{
+		ClientName: "tele2don",
+		Scopes:     "read write",
+		Website:    "https://github.com/merrkry/tele2don",
+	}
 
-		app, err := mastodon.RegisterApp(context.Background(), appCfg)
-		if err != nil {
-			log.Fatalln("Failed to register Mastodon app: ", err)
-		}
+	fmt.Println("Mastodon server address?")
+	fmt.Scanln(&appCfg.Server)
 
-		authUri, err := url.Parse(app.AuthURI)
-		if err != nil {
-			log.Fatalln("Failed to parse auth URI: ", err)
-		}
+	app, err := mastodon.RegisterApp(ctx, appCfg)
+	if err != nil {
+		log.Fatalln("Failed to register Mastodon app: ", err)
+	}
 
-		fmt.Printf("Please open the following URL in your browser to authorize the application: %s\n", authUri)
-		fmt.Println("Authorization code?")
-		var userAuthCode string
-		fmt.Scanln(&userAuthCode)
+	authUri, err := url.Parse(app.AuthURI)
+	if err != nil {
+		log.Fatalln("Failed to parse auth URI: ", err)
+	}
 
-		mastodonCfg := &mastodon.Config{
-			Server:       appCfg.Server,
-			ClientID:     app.ClientID,
-			ClientSecret: app.ClientSecret,
-		}
-		client := mastodon.NewClient(mastodonCfg)
-		err = client.GetUserAccessToken(context.Background(), userAuthCode, app.RedirectURI)
-		if err != nil {
-			log.Fatalln("Failed to create Mastodon client: ", err)
-		}
+	fmt.Printf("Please open the following URL in your browser to authorize the application: %s\n", authUri)
+	fmt.Println("Authorization code?")
+	var userAuthCode string
+	fmt.Scanln(&userAuthCode)
 
-		fmt.Println("Application registered successfully. Please load the following environment variables with tele2don.")
-		fmt.Printf("MASTODON_SERVER=%s\n", appCfg.Server)
-		fmt.Printf("MASTODON_CLIENT_ID=%s\n", app.ClientID)
-		fmt.Printf("MASTODON_CLIENT_SECRET=%s\n", app.ClientSecret)
-		fmt.Printf("MASTODON_ACCESS_TOKEN=%s\n", client.Config.AccessToken)
-	default:
-		log.Fatalln("Unsupported platform.")
+	mastodonCfg := &mastodon.Config{
+		Server:       appCfg.Server,
+		ClientID:     app.ClientID,
+		ClientSecret: app.ClientSecret,
 	}
+	client := mastodon.NewClient(mastodonCfg)
+	err = client.GetUserAccessToken(ctx, userAuthCode, app.RedirectURI)
+	if err != nil {
+		log.Fatalln("Failed to create Mastodon client: ", err)
+	}
+
+	var b strings.Builder
+	b.WriteString("[[endpoints]]\n")
+	b.WriteString(`type = "mastodon"` + "\n")
+	b.WriteString("[endpoints.mastodon]\n")
+	fmt.Fprintf(&b, "server = %q\n", appCfg.Server)
+	fmt.Fprintf(&b, "client_id = %q\n", app.ClientID)
+	fmt.Fprintf(&b, "client_secret = %q\n", app.ClientSecret)
+	fmt.Fprintf(&b, "access_token = %q\n", client.Config.AccessToken)
+	return b.String()
 }
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	tg "github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+// setupTelegram validates a bot token, discovers the channel to bridge from a message the user forwards or posts,
+// and checks that the bot is allowed to manage messages in it.
+func setupTelegram(ctx context.Context) string {
+	fmt.Println("Telegram bot token? (from @BotFather)")
+	var token string
+	fmt.Scanln(&token)
+	token = strings.TrimSpace(token)
+
+	channels := make(chan *models.Chat)
+	since := int(time.Now().Unix())
+	bot, err := tg.New(token,
+		tg.WithSkipGetMe(),
+		tg.WithAllowedUpdates(tg.AllowedUpdates{"message", "channel_post"}),
+		tg.WithDefaultHandler(func(ctx context.Context, bot *tg.Bot, update *models.Update) {
+			chat := channelOfUpdate(update, since)
+			if chat == nil {
+				return
+			}
+			select {
+			case channels <- chat:
+			case <-ctx.Done():
+			}
+		}),
+		tg.WithErrorsHandler(func(err error) {
+			log.Println("Failed to get Telegram updates: ", err)
+		}),
+	)
+	if err != nil {
+		log.Fatalln("Failed to create Telegram bot: ", err)
+	}
+
+	me, err := bot.GetMe(ctx)
+	if err != nil {
+		log.Fatalln("Invalid Telegram bot token: ", err)
+	}
+	fmt.Printf("Authorized as @%s.\n", me.Username)
+
+	// getUpdates is refused while a webhook is set, so don't touch a webhook another instance might rely on.
+	webhook, err := bot.GetWebhookInfo(ctx)
+	if err != nil {
+		log.Fatalln("Failed to get Telegram webhook info: ", err)
+	}
+	if webhook.URL != "" {
+		log.Fatalf("The bot has a webhook set to %s, which prevents receiving updates here. Stop tele2don and delete it first.\n", webhook.URL)
+	}
+
+	fmt.Printf("Add @%s to the channel as an admin, then post a message in the channel, or forward one from it to the bot.\n", me.Username)
+	fmt.Println("Make sure tele2don is not running with the same bot, otherwise it receives the message instead.")
+	pollCtx, stopPolling := context.WithCancel(ctx)
+	go bot.Start(pollCtx)
+	chat := <-channels
+	stopPolling()
+	fmt.Printf("Found channel %q (%d).\n", chat.Title, chat.ID)
+
+	err = checkTelegramAdmin(ctx, bot, chat.ID, me.ID)
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	var b strings.Builder
+	b.WriteString("[[endpoints]]\n")
+	b.WriteString(`type = "telegram"` + "\n")
+	b.WriteString("[endpoints.telegram]\n")
+	fmt.Fprintf(&b, "bot_token = %q\n", token)
+	fmt.Fprintf(&b, "channel_id = %d\n", chat.ID)
+	return b.String()
+}
+
+// channelOfUpdate returns the channel an update is posted in, or forwarded from, if it's newer than since.
+// Older updates might be left over from before the setup, and are ignored.
+func channelOfUpdate(update *models.Update, since int) *models.Chat {
+	switch {
+	case update.ChannelPost != nil:
+		if update.ChannelPost.Date < since {
+			return nil
+		}
+		return &update.ChannelPost.Chat
+	case update.Message != nil && update.Message.ForwardOrigin != nil:
+		origin := update.Message.ForwardOrigin
+		if update.Message.Date < since || origin.Type != models.MessageOriginTypeChannel {
+			return nil
+		}
+		return &origin.MessageOriginChannel.Chat
+	}
+	return nil
+}
+
+// checkTelegramAdmin checks that the bot can post, edit and delete messages in the channel.
+func checkTelegramAdmin(ctx context.Context, bot *tg.Bot, chatID, botID int64) error {
+	member, err := bot.GetChatMember(ctx, &tg.GetChatMemberParams{ChatID: chatID, UserID: botID})
+	if err != nil {
+		return fmt.Errorf("failed to get bot permissions in the channel: %w", err)
+	}
+	if member.Type != models.ChatMemberTypeAdministrator {
+		return fmt.Errorf("the bot is not an admin of the channel")
+	}
+
+	var missing []string
+	admin := member.Administrator
+	if !admin.CanPostMessages {
+		missing = append(missing, "post messages")
+	}
+	if !admin.CanEditMessages {
+		missing = append(missing, "edit messages")
+	}
+	if !admin.CanDeleteMessages {
+		missing = append(missing, "delete messages")
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("the bot is missing admin rights in the channel: %s", strings.Join(missing, ", "))
+	}
+
+	return nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	tg "github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+func TestCheckTelegramAdmin(t *testing.T) {
+	admin := func(post, edit, del bool) map[string]any {
+		return map[string]any{
+			"status":              "administrator",
+			"user":                map[string]any{"id": 1, "is_bot": true, "first_name": "bot"},
+			"can_post_messages":   post,
+			"can_edit_messages":   edit,
+			"can_delete_messages": del,
+		}
+	}
+
+	tests := []struct {
+		name    string
+		member  map[string]any
+		wantErr string
+	}{
+		{"all rights", admin(true, true, true), ""},
+		{"missing one", admin(true, false, true), "missing admin rights in the channel: edit messages"},
+		{"missing all", admin(false, false, false), "missing admin rights in the channel: post messages, edit messages, delete messages"},
+		{"member", map[string]any{"status": "member", "user": map[string]any{"id": 1, "is_bot": true, "first_name": "bot"}}, "not an admin"},
+		{"left", map[string]any{"status": "left", "user": map[string]any{"id": 1, "is_bot": true, "first_name": "bot"}}, "not an admin"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if !strings.HasSuffix(r.URL.Path, "/getChatMember") {
+					t.Errorf("unexpected Bot API call %s", r.URL.Path)
+				}
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(map[string]any{"ok": true, "result": tt.member})
+			}))
+			defer srv.Close()
+			bot, err := tg.New("123:token", tg.WithServerURL(srv.URL), tg.WithSkipGetMe())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = checkTelegramAdmin(context.Background(), bot, -1001, 1)
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Errorf("checkTelegramAdmin() = %v, want no error", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("checkTelegramAdmin() = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestChannelOfUpdate(t *testing.T) {
+	channel := models.Chat{ID: -1001, Type: models.ChatTypeChannel, Title: "channel"}
+	const since = 1700000000
+
+	tests := []struct {
+		name   string
+		update *models.Update
+		want   int64
+	}{
+		{"channel post", &models.Update{ChannelPost: &models.Message{Date: since, Chat: channel}}, channel.ID},
+		{"old channel post", &models.Update{ChannelPost: &models.Message{Date: since - 1, Chat: channel}}, 0},
+		{"forwarded from channel", &models.Update{Message: &models.Message{Date: since, ForwardOrigin: &models.MessageOrigin{
+			Type:                 models.MessageOriginTypeChannel,
+			MessageOriginChannel: &models.MessageOriginChannel{Chat: channel},
+		}}}, channel.ID},
+		{"forwarded from user", &models.Update{Message: &models.Message{Date: since, ForwardOrigin: &models.MessageOrigin{
+			Type:              models.MessageOriginTypeUser,
+			MessageOriginUser: &models.MessageOriginUser{},
+		}}}, 0},
+		{"private message", &models.Update{Message: &models.Message{Date: since}}, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got int64
+			if chat := channelOfUpdate(tt.update, since); chat != nil {
+				got = chat.ID
+			}
+			if got != tt.want {
+				t.Errorf("channelOfUpdate() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"context"
+	"flag"
+	"fmt"
 	"log/slog"
 	"os"
 	"os/signal"
@@ -11,23 +13,52 @@ import (
 )
 
 func main() {
+	configPath := flag.String("config", "", "path to config file (.toml, .yaml or .json)")
+	flag.Parse()
+
 	slog.SetLogLoggerLevel(slog.LevelDebug)
 
-	stop := make(chan os.Signal, 1)
-	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	if *configPath == "" {
+		slog.Error("Missing required flag --config")
+		os.Exit(2)
+	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
+	if flag.NArg() > 0 {
+		var err error
+		switch flag.Arg(0) {
+		case "outbox":
+			err = runOutbox(*configPath, flag.Args()[1:])
+		default:
+			err = fmt.Errorf("unknown command %q", flag.Arg(0))
+		}
+		if err != nil {
+			slog.Error("Command failed", "err", err)
+			os.Exit(1)
+		}
+		return
+	}
 
-	b, err := service.LoadBridgeService(ctx)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	b, err := service.LoadBridgeService(ctx, *configPath)
 	if err != nil {
 		slog.Error("Failed to load bridge service", "err", err)
 		os.Exit(1)
 	}
 
-	slog.Info("Starting bridge service.")
-	go b.Start(ctx)
+	go func() {
+		<-ctx.Done()
+		// Restore default handling, so that a second signal kills the process right away.
+		stop()
+		slog.Info("Received shutdown signal, stopping the service.")
+	}()
 
-	<-stop
-	slog.Info("Received shutdown signal, stopping the service.")
+	slog.Info("Starting bridge service.")
+	err = b.Start(ctx)
+	if err != nil {
+		slog.Error("Bridge service stopped uncleanly", "err", err)
+		os.Exit(1)
+	}
+	slog.Info("Bridge service stopped.")
 }
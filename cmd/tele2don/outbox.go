@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/merrkry/tele2don/internal/model"
+	"github.com/merrkry/tele2don/internal/service"
+)
+
+const outboxUsage = "usage: tele2don --config <path> outbox list|replay <id>|discard <id>"
+
+// runOutbox inspects and manages deliveries in the outbox of a persistent cache.
+// It's safe to run while the bridge is running, replayed deliveries are picked up on its next poll.
+func runOutbox(configPath string, args []string) error {
+	if len(args) == 0 {
+		return errors.New(outboxUsage)
+	}
+
+	cfg, err := service.LoadConfig(configPath)
+	if err != nil {
+		return err
+	}
+	if cfg.Cache.Type != service.CacheTypeSQLite {
+		return fmt.Errorf("outbox is only persisted with %s cache", service.CacheTypeSQLite)
+	}
+	outbox, err := service.LoadOutbox(&cfg.Cache)
+	if err != nil {
+		return fmt.Errorf("failed to load outbox: %w", err)
+	}
+	defer outbox.Close()
+
+	switch args[0] {
+	case "list":
+		if len(args) != 1 {
+			return errors.New(outboxUsage)
+		}
+		return listDeliveries(outbox)
+
+	case "replay", "discard":
+		if len(args) != 2 {
+			return errors.New(outboxUsage)
+		}
+		id, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid delivery ID %q", args[1])
+		}
+		d, err := outbox.Get(service.DeliveryID(id))
+		if err != nil {
+			return fmt.Errorf("delivery %d: %w", id, err)
+		}
+
+		if args[0] == "discard" {
+			err = outbox.Remove(d.ID)
+			if err != nil || d.Update.Type != model.UpdateTypeDelete {
+				return err
+			}
+			return forgetDeletedMessage(&cfg.Cache, outbox, d.BID)
+		}
+		d.Dead = false
+		d.Attempts = 0
+		d.NextAttempt = time.Now()
+		return outbox.Update(d)
+
+	default:
+		return errors.New(outboxUsage)
+	}
+}
+
+// forgetDeletedMessage drops a bridge message kept for its dead deletions, once the last of them is discarded.
+func forgetDeletedMessage(cfg *service.CacheConfig, outbox service.Outbox, bid model.BridgeMessageID) error {
+	deliveries, err := outbox.List()
+	if err != nil {
+		return err
+	}
+	for _, d := range deliveries {
+		if d.BID == bid && d.Update.Type == model.UpdateTypeDelete {
+			return nil
+		}
+	}
+
+	cache, err := service.LoadBridgeCache(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to load cache: %w", err)
+	}
+	defer cache.Close()
+
+	err = cache.DeleteBridgeMessage(bid)
+	if err != nil && !errors.Is(err, service.ErrMessageNotFound) {
+		return err
+	}
+	return nil
+}
+
+func listDeliveries(outbox service.Outbox) error {
+	deliveries, err := outbox.List()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(w, "ID\tSTATE\tROUTE\tTARGET\tSOURCE\tTYPE\tATTEMPTS\tNEXT ATTEMPT\tLAST ERROR")
+	for _, d := range deliveries {
+		state, next := "pending", d.NextAttempt.Format(time.RFC3339)
+		if d.Dead {
+			state, next = "dead", "-"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\t%d\t%s\t%s\n",
+			d.ID, state, d.Route, d.Target, d.Update.UniqueEndpointMessageID, d.Update.Type, d.Attempts, next, d.LastError)
+	}
+
+	return w.Flush()
+}
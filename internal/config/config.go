@@ -0,0 +1,218 @@
+// Package config decodes configuration files into structs with json tags.
+//
+// TOML, YAML and JSON files are supported, chosen by file extension.
+// Before decoding, string values are preprocessed:
+//   - "${NAME}" is replaced with the value of environment variable NAME.
+//   - A key "foo_file" is replaced with key "foo", whose value is the content of the referenced file.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+const fileSuffix = "_file"
+
+// Load reads the config file at path and decodes it into v, which must be a pointer to struct.
+// Returned errors name the offending key, e.g. "endpoints[0].telegram.channel_id".
+func Load(path string, v any) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var raw any
+	switch ext := strings.ToLower(filepath.Ext(path)); ext {
+	case ".toml":
+		err = toml.Unmarshal(data, &raw)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &raw)
+	case ".json":
+		err = json.Unmarshal(data, &raw)
+	default:
+		return fmt.Errorf("unsupported config file extension %q", ext)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	raw, err = preprocess("", raw)
+	if err != nil {
+		return err
+	}
+
+	err = checkKeys("", raw, reflect.TypeOf(v))
+	if err != nil {
+		return err
+	}
+
+	// Re-encode as JSON, so that all formats share the same struct tags and decoding rules.
+	data, err = json.Marshal(raw)
+	if err != nil {
+		return err
+	}
+
+	err = json.NewDecoder(bytes.NewReader(data)).Decode(v)
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		field := indexPattern.ReplaceAllString(typeErr.Field, "[$1]")
+		return fmt.Errorf("%s: cannot use %s as %s", field, typeErr.Value, typeErr.Type)
+	}
+	return err
+}
+
+// indexPattern matches slice indices in field paths reported by encoding/json, e.g. "endpoints.0.type".
+var indexPattern = regexp.MustCompile(`\.(\d+)\b`)
+
+var envPattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+func preprocess(path string, value any) (any, error) {
+	switch value := value.(type) {
+	case map[string]any:
+		result := make(map[string]any, len(value))
+		for key, child := range value {
+			childPath := joinPath(path, key)
+
+			child, err := preprocess(childPath, child)
+			if err != nil {
+				return nil, err
+			}
+
+			if strings.HasSuffix(key, fileSuffix) {
+				target := strings.TrimSuffix(key, fileSuffix)
+				if _, ok := value[target]; ok {
+					return nil, fmt.Errorf("%s: cannot be set together with %s", childPath, joinPath(path, target))
+				}
+				filePath, ok := child.(string)
+				if !ok {
+					return nil, fmt.Errorf("%s: must be a file path", childPath)
+				}
+				content, err := os.ReadFile(filePath)
+				if err != nil {
+					return nil, fmt.Errorf("%s: %w", childPath, err)
+				}
+				key, child = target, strings.TrimRight(string(content), "\r\n")
+			}
+
+			result[key] = child
+		}
+		return result, nil
+
+	case []map[string]any: // arrays of tables in TOML
+		generic := make([]any, len(value))
+		for i, child := range value {
+			generic[i] = child
+		}
+		return preprocess(path, generic)
+
+	case []any:
+		result := make([]any, len(value))
+		for i, child := range value {
+			child, err := preprocess(path+"["+strconv.Itoa(i)+"]", child)
+			if err != nil {
+				return nil, err
+			}
+			result[i] = child
+		}
+		return result, nil
+
+	case string:
+		var missing []string
+		expanded := envPattern.ReplaceAllStringFunc(value, func(match string) string {
+			name := envPattern.FindStringSubmatch(match)[1]
+			env, ok := os.LookupEnv(name)
+			if !ok {
+				missing = append(missing, name)
+			}
+			return env
+		})
+		if len(missing) > 0 {
+			return nil, fmt.Errorf("%s: environment variable %s is not set", path, strings.Join(missing, ", "))
+		}
+		return expanded, nil
+
+	default:
+		return value, nil
+	}
+}
+
+var unmarshalerType = reflect.TypeFor[json.Unmarshaler]()
+
+// checkKeys rejects keys that don't correspond to any field, as they are most likely typos.
+// Values of types with custom decoding are validated here too, as errors from them don't carry key names.
+func checkKeys(path string, value any, t reflect.Type) error {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+
+	if reflect.PointerTo(t).Implements(unmarshalerType) {
+		data, err := json.Marshal(value)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		err = reflect.New(t).Interface().(json.Unmarshaler).UnmarshalJSON(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", path, err)
+		}
+		return nil
+	}
+
+	switch value := value.(type) {
+	case map[string]any:
+		if t.Kind() != reflect.Struct {
+			return nil
+		}
+		for key, child := range value {
+			field, ok := fieldByTag(t, key)
+			if !ok {
+				return fmt.Errorf("%s: unknown key", joinPath(path, key))
+			}
+			err := checkKeys(joinPath(path, key), child, field.Type)
+			if err != nil {
+				return err
+			}
+		}
+
+	case []any:
+		if t.Kind() != reflect.Slice && t.Kind() != reflect.Array {
+			return nil
+		}
+		for i, child := range value {
+			err := checkKeys(path+"["+strconv.Itoa(i)+"]", child, t.Elem())
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func fieldByTag(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == key {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+func joinPath(path, key string) string {
+	if path == "" {
+		return key
+	}
+	return path + "." + key
+}
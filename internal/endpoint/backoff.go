@@ -0,0 +1,29 @@
+package endpoint
+
+import (
+	"math/rand/v2"
+	"time"
+)
+
+// backoff computes exponentially growing delays between retries.
+// Delays are jittered, so that endpoints sharing a failed server don't retry in lockstep.
+type backoff struct {
+	min, max time.Duration
+	attempt  int
+}
+
+// next returns the delay before the next retry, which is randomized in [d/2, d],
+// where d doubles on every call until it reaches max.
+func (b *backoff) next() time.Duration {
+	d := b.max
+	if b.attempt < 32 { // avoid overflow
+		d = min(b.min<<b.attempt, b.max)
+	}
+	b.attempt++
+
+	return d/2 + rand.N(d/2+1)
+}
+
+func (b *backoff) reset() {
+	b.attempt = 0
+}
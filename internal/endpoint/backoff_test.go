@@ -0,0 +1,27 @@
+package endpoint
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoff(t *testing.T) {
+	b := &backoff{min: time.Second, max: 8 * time.Second}
+
+	for i, want := range []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 8 * time.Second} {
+		if d := b.next(); d < want/2 || d > want {
+			t.Errorf("delay %d = %v, want within [%v, %v]", i, d, want/2, want)
+		}
+	}
+
+	b.reset()
+	if d := b.next(); d > time.Second {
+		t.Errorf("delay after reset = %v, want at most %v", d, time.Second)
+	}
+
+	// Many attempts don't overflow.
+	b.attempt = 100
+	if d := b.next(); d < 4*time.Second || d > 8*time.Second {
+		t.Errorf("delay after many attempts = %v, want within the maximum", d)
+	}
+}
@@ -0,0 +1,392 @@
+package endpoint
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"time"
+	"unicode/utf8"
+
+	"github.com/merrkry/tele2don/internal/language"
+	"github.com/merrkry/tele2don/internal/markdown"
+	"github.com/merrkry/tele2don/internal/model"
+)
+
+const (
+	blueskyDefaultService = "https://bsky.social"
+	blueskyPostCollection = "app.bsky.feed.post"
+	blueskyMaxGraphemes   = 300
+	blueskyMaxImages      = 4
+	// blueskyMaxImageSize is the size limit of image blobs embedded in posts.
+	blueskyMaxImageSize = 1000000
+	// blueskyCorrectionPrefix starts replies posted for edits with BlueskyEditPolicyReply.
+	blueskyCorrectionPrefix = "Correction:\n\n"
+)
+
+// BlueskyEditPolicy decides how edits are applied, as Bluesky posts can't be edited.
+type BlueskyEditPolicy string
+
+const (
+	// BlueskyEditPolicyIgnore leaves posts as they are.
+	BlueskyEditPolicyIgnore BlueskyEditPolicy = "ignore"
+	// BlueskyEditPolicyRepost deletes the posts and posts the edited content again, losing likes and replies.
+	BlueskyEditPolicyRepost BlueskyEditPolicy = "repost"
+	// BlueskyEditPolicyReply posts the edited content as a reply to the posts.
+	BlueskyEditPolicyReply BlueskyEditPolicy = "reply"
+)
+
+type EndpointConfigBluesky struct {
+	// Service is the PDS of the account, defaults to https://bsky.social.
+	Service string `json:"service"`
+	// Identifier is the handle or DID of the account.
+	Identifier string `json:"identifier"`
+	// AppPassword is created in the settings of the account, don't use the account password.
+	AppPassword string `json:"app_password"`
+
+	// EditPolicy decides how edits are applied, defaults to ignore.
+	EditPolicy BlueskyEditPolicy `json:"edit_policy"`
+
+	// Language of posts, as ISO 639 code, if the source message doesn't tell and it can't be detected confidently.
+	Language string `json:"language"`
+	// LanguageConfidence is the minimum confidence of language detection, from 0 to 1.
+	// Defaults to 0.3.
+	LanguageConfidence float64 `json:"language_confidence"`
+}
+
+func (c *EndpointConfigBluesky) validate() error {
+	if c.Service == "" {
+		c.Service = blueskyDefaultService
+	}
+	u, err := url.Parse(c.Service)
+	if err != nil {
+		return fmt.Errorf("service: %w", err)
+	}
+	if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("service: must be an absolute http(s) URL, got %q", c.Service)
+	}
+	if c.Identifier == "" {
+		return fmt.Errorf("identifier: required")
+	}
+	if c.AppPassword == "" {
+		return fmt.Errorf("app_password: required")
+	}
+	if c.LanguageConfidence < 0 || c.LanguageConfidence > 1 {
+		return fmt.Errorf("language_confidence: must be between 0 and 1, got %v", c.LanguageConfidence)
+	}
+	switch c.EditPolicy {
+	case "":
+		c.EditPolicy = BlueskyEditPolicyIgnore
+	case BlueskyEditPolicyIgnore, BlueskyEditPolicyRepost, BlueskyEditPolicyReply:
+	default:
+		return fmt.Errorf("edit_policy: must be ignore, repost or reply, got %q", c.EditPolicy)
+	}
+	return nil
+}
+
+// EndpointBluesky posts to a Bluesky account, write-only. Message IDs are AT URIs of post records.
+type EndpointBluesky struct {
+	id         model.EndpointID
+	client     *blueskyClient
+	editPolicy BlueskyEditPolicy
+
+	language           string
+	languageConfidence float64
+
+	status statusTracker
+}
+
+func NewEndpointBluesky(id model.EndpointID) *EndpointBluesky {
+	return &EndpointBluesky{
+		id: id,
+	}
+}
+
+func (e *EndpointBluesky) ID() model.EndpointID {
+	return e.id
+}
+
+func (e *EndpointBluesky) Initialize(ctx context.Context, cfg *EndpointConfig) error {
+	e.client = newBlueskyClient(cfg.Bluesky.Service, cfg.Bluesky.Identifier, cfg.Bluesky.AppPassword, &e.status)
+	e.editPolicy = cfg.Bluesky.EditPolicy
+	e.language = cfg.Bluesky.Language
+	e.languageConfidence = cfg.Bluesky.LanguageConfidence
+	if e.languageConfidence == 0 {
+		e.languageConfidence = language.DefaultConfidence
+	}
+
+	err := e.client.login(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to log in to Bluesky: %w", err)
+	}
+
+	e.status.setInitialized()
+	return nil
+}
+
+func (e *EndpointBluesky) Status() Status {
+	return e.status.status()
+}
+
+// blueskyPost is an app.bsky.feed.post record.
+type blueskyPost struct {
+	Type      string             `json:"$type"`
+	Text      string             `json:"text"`
+	Facets    []blueskyFacet     `json:"facets,omitempty"`
+	CreatedAt string             `json:"createdAt"`
+	Langs     []string           `json:"langs,omitempty"`
+	Reply     *blueskyReplyRef   `json:"reply,omitempty"`
+	Embed     *blueskyImageEmbed `json:"embed,omitempty"`
+}
+
+type blueskyReplyRef struct {
+	Root   blueskyStrongRef `json:"root"`
+	Parent blueskyStrongRef `json:"parent"`
+}
+
+type blueskyImageEmbed struct {
+	Type   string         `json:"$type"`
+	Images []blueskyImage `json:"images"`
+}
+
+type blueskyImage struct {
+	Alt   string      `json:"alt"`
+	Image blueskyBlob `json:"image"`
+}
+
+// splitBlueskyPosts splits content into posts of a thread, each starting with the content warning.
+func splitBlueskyPosts(content *model.BridgeMessageContent, prefix string) []string {
+	cw := ""
+	if content.SpoilerText != "" {
+		cw = telegramCWPrefix + content.SpoilerText + "\n\n"
+	}
+	limit := max(blueskyMaxGraphemes-utf8.RuneCountInString(cw+prefix), 1)
+
+	texts := markdown.Split(content.MDText, limit, blueskyLength)
+	for i := range texts {
+		texts[i] = cw + prefix + texts[i]
+	}
+	return texts
+}
+
+// ApplyUpdateNew posts content as a thread, embedding images in the first post and dropping other attachments.
+func (e *EndpointBluesky) ApplyUpdateNew(ctx context.Context, content *model.BridgeMessageContent, replyTo model.EndpointMessageID) (_ []model.EndpointMessageRevision, err error) {
+	defer func() { err = classifyBlueskyError(err) }()
+
+	var reply *blueskyReplyRef
+	if replyTo != "" {
+		reply, err = e.replyRef(ctx, replyTo)
+		if err != nil {
+			// Losing the link is better than losing the message, e.g. if the parent was deleted.
+			slog.Warn("Failed to fetch Bluesky post to reply to, posting without reply", "uri", replyTo, "err", err)
+		}
+	}
+
+	embed, err := e.uploadImages(ctx, content.Attachments)
+	if err != nil {
+		return nil, fmt.Errorf("failed to upload images to Bluesky: %w", err)
+	}
+
+	return e.postThread(ctx, splitBlueskyPosts(content, ""), content, reply, embed)
+}
+
+// postThread posts texts as a thread, replying to reply if not nil, and embeds images in the first post.
+func (e *EndpointBluesky) postThread(ctx context.Context, texts []string, content *model.BridgeMessageContent, reply *blueskyReplyRef, embed *blueskyImageEmbed) ([]model.EndpointMessageRevision, error) {
+	var langs []string
+	if lang := e.postLanguage(content); lang != "" {
+		langs = []string{lang}
+	}
+
+	var revisions []model.EndpointMessageRevision
+	for i, md := range texts {
+		text := renderBlueskyText(md)
+		now := time.Now()
+		post := &blueskyPost{
+			Type:      blueskyPostCollection,
+			Text:      text.text,
+			Facets:    e.blueskyFacets(ctx, text),
+			CreatedAt: now.UTC().Format(time.RFC3339Nano),
+			Langs:     langs,
+			Reply:     reply,
+		}
+		if i == 0 {
+			post.Embed = embed
+		}
+
+		ref, err := e.client.createRecord(ctx, blueskyPostCollection, post)
+		if err != nil {
+			deleteIncomplete(ctx, e, revisions)
+			return nil, fmt.Errorf("failed to create Bluesky post: %w", err)
+		}
+
+		slog.Debug("Post created in Bluesky", "uri", ref.URI)
+
+		revisions = append(revisions, model.EndpointMessageRevision{
+			ID:        model.EndpointMessageID(ref.URI),
+			Timestamp: now,
+		})
+		root := ref
+		if reply != nil {
+			root = &reply.Root
+		}
+		reply = &blueskyReplyRef{Root: *root, Parent: *ref}
+	}
+
+	return revisions, nil
+}
+
+// replyRef builds the reference of a reply to the post, which also needs the root of its thread.
+func (e *EndpointBluesky) replyRef(ctx context.Context, id model.EndpointMessageID) (*blueskyReplyRef, error) {
+	uri, err := parseBlueskyURI(string(id))
+	if err != nil {
+		return nil, err
+	}
+
+	var parent blueskyPost
+	ref, err := e.client.getRecord(ctx, uri, &parent)
+	if err != nil {
+		return nil, err
+	}
+
+	root := *ref
+	if parent.Reply != nil {
+		root = parent.Reply.Root
+	}
+	return &blueskyReplyRef{Root: root, Parent: *ref}, nil
+}
+
+// uploadImages uploads photos as blobs to be embedded. Other attachments and images exceeding the size limit are dropped.
+func (e *EndpointBluesky) uploadImages(ctx context.Context, attachments []*model.Attachment) (*blueskyImageEmbed, error) {
+	var images []blueskyImage
+	for _, attachment := range attachments {
+		if attachment.Kind != model.AttachmentKindPhoto {
+			slog.Warn("Bluesky only supports images, dropping attachment", "kind", attachment.Kind)
+			continue
+		}
+		if len(images) == blueskyMaxImages {
+			slog.Warn("Too many images for a Bluesky post, extra ones will be dropped", "count", len(attachments))
+			break
+		}
+		if attachment.Size > blueskyMaxImageSize {
+			slog.Warn("Image is too large for Bluesky, dropping it", "size", attachment.Size)
+			continue
+		}
+
+		r, err := attachment.Open(ctx)
+		if err != nil {
+			return nil, err
+		}
+		// Sizes are not always known beforehand, read one byte more than allowed to tell.
+		data, err := io.ReadAll(io.LimitReader(r, blueskyMaxImageSize+1))
+		r.Close()
+		if err != nil {
+			return nil, err
+		}
+		if len(data) > blueskyMaxImageSize {
+			slog.Warn("Image is too large for Bluesky, dropping it", "size", attachment.Size)
+			continue
+		}
+
+		mimeType := attachment.MIMEType
+		if mimeType == "" {
+			mimeType = "image/jpeg"
+		}
+		blob, err := e.client.uploadBlob(ctx, data, mimeType)
+		if err != nil {
+			return nil, err
+		}
+
+		slog.Debug("Image uploaded to Bluesky", "size", len(data))
+		images = append(images, blueskyImage{Alt: attachment.AltText, Image: blob})
+	}
+
+	if len(images) == 0 {
+		return nil, nil
+	}
+	return &blueskyImageEmbed{Type: "app.bsky.embed.images", Images: images}, nil
+}
+
+// ApplyUpdateEdit applies edits according to the edit policy, as Bluesky posts can't be edited.
+func (e *EndpointBluesky) ApplyUpdateEdit(ctx context.Context, ids []model.EndpointMessageID, content *model.BridgeMessageContent) (_ []model.EndpointMessageRevision, err error) {
+	defer func() { err = classifyBlueskyError(err) }()
+
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("no Bluesky post to edit")
+	}
+
+	now := time.Now()
+	unchanged := make([]model.EndpointMessageRevision, 0, len(ids))
+	for _, id := range ids {
+		unchanged = append(unchanged, model.EndpointMessageRevision{ID: id, Timestamp: now})
+	}
+
+	switch e.editPolicy {
+	case BlueskyEditPolicyRepost:
+		// Keep the reply, and the images which can't be recovered from content.
+		uri, err := parseBlueskyURI(string(ids[0]))
+		if err != nil {
+			return nil, &PermanentError{Err: err}
+		}
+		var original blueskyPost
+		_, err = e.client.getRecord(ctx, uri, &original)
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch Bluesky post: %w", err)
+		}
+
+		revisions, err := e.postThread(ctx, splitBlueskyPosts(content, ""), content, original.Reply, original.Embed)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			err := e.ApplyUpdateDelete(ctx, id)
+			if err != nil {
+				slog.Warn("Failed to delete Bluesky post replaced by edit", "uri", id, "err", err)
+			}
+		}
+		return revisions, nil
+
+	case BlueskyEditPolicyReply:
+		reply, err := e.replyRef(ctx, ids[len(ids)-1])
+		if err != nil {
+			return nil, fmt.Errorf("failed to fetch Bluesky post to correct: %w", err)
+		}
+		corrections, err := e.postThread(ctx, splitBlueskyPosts(content, blueskyCorrectionPrefix), content, reply, nil)
+		if err != nil {
+			return nil, err
+		}
+		// Corrections are tracked along with the posts, so that they are deleted together.
+		return append(unchanged, corrections...), nil
+
+	default:
+		slog.Debug("Ignoring edit of Bluesky posts", "uri", ids[0])
+		return unchanged, nil
+	}
+}
+
+// postLanguage returns the language to post content with, empty if unknown.
+func (e *EndpointBluesky) postLanguage(content *model.BridgeMessageContent) string {
+	if content.Language != "" {
+		return content.Language
+	}
+	if detected := language.Detect(content, e.languageConfidence); detected != "" {
+		return detected
+	}
+	return e.language
+}
+
+func (e *EndpointBluesky) ApplyUpdateDelete(ctx context.Context, id model.EndpointMessageID) error {
+	uri, err := parseBlueskyURI(string(id))
+	if err != nil {
+		return &PermanentError{Err: err}
+	}
+
+	err = e.client.deleteRecord(ctx, uri.collection, uri.rkey)
+	if err != nil {
+		return classifyBlueskyError(fmt.Errorf("failed to delete Bluesky post: %w", err))
+	}
+
+	slog.Debug("Post deleted in Bluesky", "uri", id)
+
+	return nil
+}
@@ -0,0 +1,330 @@
+package endpoint
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// blueskyClient is a minimal XRPC client of a PDS, logged in with an app password.
+type blueskyClient struct {
+	service     string
+	identifier  string
+	appPassword string
+	httpClient  *http.Client
+	status      *statusTracker
+
+	refreshMu sync.Mutex
+
+	mu         sync.Mutex
+	did        string
+	accessJWT  string
+	refreshJWT string
+}
+
+func newBlueskyClient(service, identifier, appPassword string, status *statusTracker) *blueskyClient {
+	return &blueskyClient{
+		service:     strings.TrimSuffix(service, "/"),
+		identifier:  identifier,
+		appPassword: appPassword,
+		httpClient:  &http.Client{},
+		status:      status,
+	}
+}
+
+// blueskyError is an error response of XRPC.
+type blueskyError struct {
+	StatusCode int
+	ErrCode    string `json:"error"`
+	Message    string `json:"message"`
+	// RetryAfter is derived from the ratelimit-reset header of rate limited responses.
+	RetryAfter time.Duration
+}
+
+func (e *blueskyError) Error() string {
+	return fmt.Sprintf("bluesky: %d %s: %s", e.StatusCode, e.ErrCode, e.Message)
+}
+
+// classifyBlueskyError wraps errors of rate limiting and rejected requests for the bridge service.
+func classifyBlueskyError(err error) error {
+	var blueskyErr *blueskyError
+	if !errors.As(err, &blueskyErr) {
+		return err
+	}
+
+	return classifyHTTPStatus(err, blueskyErr.StatusCode, blueskyErr.RetryAfter)
+}
+
+func isExpiredToken(err error) bool {
+	var blueskyErr *blueskyError
+	return errors.As(err, &blueskyErr) && blueskyErr.ErrCode == "ExpiredToken"
+}
+
+type blueskySession struct {
+	DID        string `json:"did"`
+	Handle     string `json:"handle"`
+	AccessJWT  string `json:"accessJwt"`
+	RefreshJWT string `json:"refreshJwt"`
+}
+
+// login creates a session with the app password.
+func (c *blueskyClient) login(ctx context.Context) error {
+	var session blueskySession
+	err := c.send(ctx, http.MethodPost, "com.atproto.server.createSession", nil, "", jsonBody(map[string]string{
+		"identifier": c.identifier,
+		"password":   c.appPassword,
+	}), "application/json", &session)
+	if err != nil {
+		return err
+	}
+
+	c.setSession(&session)
+	return nil
+}
+
+// refresh renews the session with the refresh token, logging in again if the refresh token has expired as well.
+func (c *blueskyClient) refresh(ctx context.Context) error {
+	c.mu.Lock()
+	refreshJWT := c.refreshJWT
+	c.mu.Unlock()
+
+	var session blueskySession
+	err := c.send(ctx, http.MethodPost, "com.atproto.server.refreshSession", nil, refreshJWT, nil, "", &session)
+	if isExpiredToken(err) {
+		return c.login(ctx)
+	}
+	if err != nil {
+		return err
+	}
+
+	c.setSession(&session)
+	return nil
+}
+
+// refreshExpired returns a new access token, refreshing only once for concurrent callers as refresh tokens are single use.
+func (c *blueskyClient) refreshExpired(ctx context.Context, expired string) (string, error) {
+	c.refreshMu.Lock()
+	defer c.refreshMu.Unlock()
+
+	c.mu.Lock()
+	current := c.accessJWT
+	c.mu.Unlock()
+	if current != expired {
+		return current, nil
+	}
+
+	err := c.refresh(ctx)
+	if err != nil {
+		return "", err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.accessJWT, nil
+}
+
+func (c *blueskyClient) setSession(session *blueskySession) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.did = session.DID
+	c.accessJWT = session.AccessJWT
+	c.refreshJWT = session.RefreshJWT
+}
+
+// DID returns the DID of the logged in account.
+func (c *blueskyClient) DID() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.did
+}
+
+// call calls an XRPC query with params, or a procedure with input, refreshing an expired session once.
+func (c *blueskyClient) call(ctx context.Context, method string, params url.Values, input, output any) error {
+	httpMethod := http.MethodGet
+	var body func() io.Reader
+	contentType := ""
+	if input != nil {
+		httpMethod = http.MethodPost
+		body = jsonBody(input)
+		contentType = "application/json"
+	}
+	return c.callRaw(ctx, httpMethod, method, params, body, contentType, output)
+}
+
+func (c *blueskyClient) callRaw(ctx context.Context, httpMethod, method string, params url.Values, body func() io.Reader, contentType string, output any) error {
+	c.mu.Lock()
+	accessJWT := c.accessJWT
+	c.mu.Unlock()
+
+	err := c.send(ctx, httpMethod, method, params, accessJWT, body, contentType, output)
+	if !isExpiredToken(err) {
+		return err
+	}
+
+	accessJWT, err = c.refreshExpired(ctx, accessJWT)
+	if err != nil {
+		return fmt.Errorf("failed to refresh Bluesky session: %w", err)
+	}
+	return c.send(ctx, httpMethod, method, params, accessJWT, body, contentType, output)
+}
+
+// jsonBody returns a function creating readers of v as JSON, so that requests can be resent.
+func jsonBody(v any) func() io.Reader {
+	data, _ := json.Marshal(v)
+	return func() io.Reader {
+		return bytes.NewReader(data)
+	}
+}
+
+// send sends a single XRPC request, and turns responses other than 2xx into blueskyError.
+func (c *blueskyClient) send(ctx context.Context, httpMethod, method string, params url.Values, token string, body func() io.Reader, contentType string, output any) error {
+	u := c.service + "/xrpc/" + method
+	if len(params) > 0 {
+		u += "?" + params.Encode()
+	}
+
+	var r io.Reader
+	if body != nil {
+		r = body()
+	}
+	req, err := http.NewRequestWithContext(ctx, httpMethod, u, r)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return fmt.Errorf("bluesky: %s: %w", method, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		blueskyErr := &blueskyError{}
+		decodeErrorBody(resp.Body, blueskyErr)
+		blueskyErr.StatusCode = resp.StatusCode
+		if reset, err := strconv.ParseInt(resp.Header.Get("ratelimit-reset"), 10, 64); err == nil {
+			blueskyErr.RetryAfter = max(time.Until(time.Unix(reset, 0)), 0)
+		}
+		return blueskyErr
+	}
+
+	c.status.apiCallSucceeded()
+	if output == nil {
+		return nil
+	}
+	err = json.NewDecoder(resp.Body).Decode(output)
+	if err != nil {
+		return fmt.Errorf("failed to decode response of %s: %w", method, err)
+	}
+	return nil
+}
+
+// blueskyStrongRef references a specific version of a record.
+type blueskyStrongRef struct {
+	URI string `json:"uri"`
+	CID string `json:"cid"`
+}
+
+// blueskyBlob is a reference to an uploaded blob, kept as is to be embedded in records.
+type blueskyBlob = json.RawMessage
+
+func (c *blueskyClient) createRecord(ctx context.Context, collection string, record any) (*blueskyStrongRef, error) {
+	ref := &blueskyStrongRef{}
+	err := c.call(ctx, "com.atproto.repo.createRecord", nil, map[string]any{
+		"repo":       c.DID(),
+		"collection": collection,
+		"record":     record,
+	}, ref)
+	if err != nil {
+		return nil, err
+	}
+	return ref, nil
+}
+
+func (c *blueskyClient) deleteRecord(ctx context.Context, collection, rkey string) error {
+	return c.call(ctx, "com.atproto.repo.deleteRecord", nil, map[string]any{
+		"repo":       c.DID(),
+		"collection": collection,
+		"rkey":       rkey,
+	}, nil)
+}
+
+// getRecord fetches a record by its AT URI, and decodes its value into value.
+func (c *blueskyClient) getRecord(ctx context.Context, uri blueskyURI, value any) (*blueskyStrongRef, error) {
+	var resp struct {
+		blueskyStrongRef
+		Value json.RawMessage `json:"value"`
+	}
+	err := c.call(ctx, "com.atproto.repo.getRecord", url.Values{
+		"repo":       {uri.repo},
+		"collection": {uri.collection},
+		"rkey":       {uri.rkey},
+	}, nil, &resp)
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(resp.Value, value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode record %s: %w", uri, err)
+	}
+	return &resp.blueskyStrongRef, nil
+}
+
+// uploadBlob uploads data, and returns the blob to reference it in records.
+func (c *blueskyClient) uploadBlob(ctx context.Context, data []byte, mimeType string) (blueskyBlob, error) {
+	var resp struct {
+		Blob blueskyBlob `json:"blob"`
+	}
+	body := func() io.Reader { return bytes.NewReader(data) }
+	err := c.callRaw(ctx, http.MethodPost, "com.atproto.repo.uploadBlob", nil, body, mimeType, &resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Blob, nil
+}
+
+// resolveHandle resolves a handle into its DID.
+func (c *blueskyClient) resolveHandle(ctx context.Context, handle string) (string, error) {
+	var resp struct {
+		DID string `json:"did"`
+	}
+	err := c.call(ctx, "com.atproto.identity.resolveHandle", url.Values{"handle": {handle}}, nil, &resp)
+	return resp.DID, err
+}
+
+// blueskyURI is a parsed AT URI of a record, at://<repo>/<collection>/<rkey>.
+type blueskyURI struct {
+	repo, collection, rkey string
+}
+
+func parseBlueskyURI(s string) (blueskyURI, error) {
+	rest, ok := strings.CutPrefix(s, "at://")
+	parts := strings.Split(rest, "/")
+	if !ok || len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+		return blueskyURI{}, fmt.Errorf("invalid AT URI %q", s)
+	}
+	return blueskyURI{repo: parts[0], collection: parts[1], rkey: parts[2]}, nil
+}
+
+func (u blueskyURI) String() string {
+	return "at://" + u.repo + "/" + u.collection + "/" + u.rkey
+}
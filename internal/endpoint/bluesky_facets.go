@@ -0,0 +1,127 @@
+package endpoint
+
+import (
+	"context"
+	"log/slog"
+	"regexp"
+	"slices"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/go-telegram/bot/models"
+)
+
+var (
+	// blueskyURLPattern matches bare URLs, trailing punctuation is trimmed afterwards.
+	blueskyURLPattern = regexp.MustCompile(`https?://[^\s<>()\[\]]+`)
+	// blueskyMentionPattern matches mentions of handles, which are domain names.
+	blueskyMentionPattern = regexp.MustCompile(`(?:^|[\s(])(@(?:[a-zA-Z0-9](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?\.)+[a-zA-Z](?:[a-zA-Z0-9-]{0,61}[a-zA-Z0-9])?)`)
+	// blueskyTagPattern matches hashtags, which can't be only digits.
+	blueskyTagPattern = regexp.MustCompile(`(?:^|\s)(#[^\s\p{P}]*[^\s\p{P}\d][^\s\p{P}]*)`)
+)
+
+// blueskyFacet annotates a range of post text, with offsets in UTF-8 bytes.
+type blueskyFacet struct {
+	Index    blueskyByteSlice `json:"index"`
+	Features []map[string]any `json:"features"`
+}
+
+type blueskyByteSlice struct {
+	ByteStart int `json:"byteStart"`
+	ByteEnd   int `json:"byteEnd"`
+}
+
+func (f *blueskyFacet) overlaps(start, end int) bool {
+	return start < f.Index.ByteEnd && f.Index.ByteStart < end
+}
+
+// renderBlueskyText renders bridge Markdown as plain text, with links kept for blueskyFacets.
+func renderBlueskyText(md string) telegramText {
+	// Telegram entities carry the same information as facets, only with offsets in UTF-16.
+	text, entities, err := markdownToEntities(md)
+	if err != nil {
+		slog.Warn("Failed to render markdown for Bluesky, falling back to plain text", "err", err)
+		return telegramText{text: md}
+	}
+	return telegramText{text: text, entities: entities}
+}
+
+// blueskyLength counts code points of rendered text, an upper bound of the graphemes Bluesky counts.
+func blueskyLength(md string) int {
+	return utf8.RuneCountInString(renderBlueskyText(md).text)
+}
+
+// blueskyFacets creates facets for links, bare URLs, resolvable mentions and hashtags of text.
+func (e *EndpointBluesky) blueskyFacets(ctx context.Context, text telegramText) []blueskyFacet {
+	var facets []blueskyFacet
+	add := func(start, end int, feature map[string]any) {
+		for i := range facets {
+			if facets[i].overlaps(start, end) {
+				return
+			}
+		}
+		facets = append(facets, blueskyFacet{
+			Index:    blueskyByteSlice{ByteStart: start, ByteEnd: end},
+			Features: []map[string]any{feature},
+		})
+	}
+
+	offsets := utf16ToByteOffsets(text.text)
+	for _, entity := range text.entities {
+		if entity.Type != models.MessageEntityTypeTextLink || entity.Offset+entity.Length > len(offsets)-1 {
+			continue
+		}
+		add(offsets[entity.Offset], offsets[entity.Offset+entity.Length], map[string]any{
+			"$type": "app.bsky.richtext.facet#link",
+			"uri":   entity.URL,
+		})
+	}
+
+	for _, match := range blueskyURLPattern.FindAllStringIndex(text.text, -1) {
+		start, end := match[0], match[1]
+		end = start + len(strings.TrimRight(text.text[start:end], ".,;:!?'\""))
+		add(start, end, map[string]any{
+			"$type": "app.bsky.richtext.facet#link",
+			"uri":   text.text[start:end],
+		})
+	}
+
+	for _, match := range blueskyMentionPattern.FindAllStringSubmatchIndex(text.text, -1) {
+		start, end := match[2], match[3]
+		handle := text.text[start+1 : end]
+		did, err := e.client.resolveHandle(ctx, handle)
+		if err != nil {
+			slog.Debug("Failed to resolve Bluesky handle, leaving mention as text", "handle", handle, "err", err)
+			continue
+		}
+		add(start, end, map[string]any{
+			"$type": "app.bsky.richtext.facet#mention",
+			"did":   did,
+		})
+	}
+
+	for _, match := range blueskyTagPattern.FindAllStringSubmatchIndex(text.text, -1) {
+		start, end := match[2], match[3]
+		add(start, end, map[string]any{
+			"$type": "app.bsky.richtext.facet#tag",
+			"tag":   text.text[start+1 : end],
+		})
+	}
+
+	slices.SortFunc(facets, func(a, b blueskyFacet) int {
+		return a.Index.ByteStart - b.Index.ByteStart
+	})
+	return facets
+}
+
+// utf16ToByteOffsets maps every UTF-16 offset of s, up to its end, to the byte offset of its code point.
+func utf16ToByteOffsets(s string) []int {
+	offsets := make([]int, 0, len(s)+1)
+	for i, r := range s {
+		for range utf16.RuneLen(r) {
+			offsets = append(offsets, i)
+		}
+	}
+	return append(offsets, len(s))
+}
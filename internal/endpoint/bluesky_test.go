@@ -0,0 +1,394 @@
+package endpoint
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/merrkry/tele2don/internal/language"
+	"github.com/merrkry/tele2don/internal/model"
+)
+
+const testBlueskyDID = "did:plc:bridge"
+
+// fakePDS implements the XRPC methods used by the Bluesky endpoint, keeping records in memory.
+type fakePDS struct {
+	t *testing.T
+
+	mu      sync.Mutex
+	records map[string]blueskyPost
+	// created lists URIs of created records, in order.
+	created []string
+	deleted []string
+	// failCreate fails creating the record with this index, counting from 1, if set.
+	failCreate int
+}
+
+func newFakePDS(t *testing.T) (*fakePDS, *httptest.Server) {
+	pds := &fakePDS{t: t, records: make(map[string]blueskyPost)}
+	srv := httptest.NewServer(pds)
+	t.Cleanup(srv.Close)
+	return pds, srv
+}
+
+func (pds *fakePDS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	pds.mu.Lock()
+	defer pds.mu.Unlock()
+
+	method := strings.TrimPrefix(r.URL.Path, "/xrpc/")
+	if method != "com.atproto.server.createSession" && r.Header.Get("Authorization") != "Bearer access" {
+		pds.fail(w, http.StatusUnauthorized, "AuthMissing")
+		return
+	}
+
+	var input struct {
+		Collection string      `json:"collection"`
+		Rkey       string      `json:"rkey"`
+		Record     blueskyPost `json:"record"`
+	}
+	if r.Method == http.MethodPost {
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			pds.t.Errorf("invalid input of %s: %v", method, err)
+		}
+	}
+
+	switch method {
+	case "com.atproto.server.createSession":
+		pds.reply(w, blueskySession{DID: testBlueskyDID, AccessJWT: "access", RefreshJWT: "refresh"})
+
+	case "com.atproto.repo.createRecord":
+		if len(pds.created)+1 == pds.failCreate {
+			pds.failCreate = 0
+			pds.fail(w, http.StatusBadGateway, "UpstreamFailure")
+			return
+		}
+		uri := fmt.Sprintf("at://%s/%s/%d", testBlueskyDID, input.Collection, len(pds.created)+1)
+		pds.records[uri] = input.Record
+		pds.created = append(pds.created, uri)
+		pds.reply(w, blueskyStrongRef{URI: uri, CID: "cid" + uri})
+
+	case "com.atproto.repo.deleteRecord":
+		uri := fmt.Sprintf("at://%s/%s/%s", testBlueskyDID, input.Collection, input.Rkey)
+		delete(pds.records, uri)
+		pds.deleted = append(pds.deleted, uri)
+		pds.reply(w, map[string]any{})
+
+	case "com.atproto.repo.getRecord":
+		q := r.URL.Query()
+		uri := fmt.Sprintf("at://%s/%s/%s", q.Get("repo"), q.Get("collection"), q.Get("rkey"))
+		record, ok := pds.records[uri]
+		if !ok {
+			pds.fail(w, http.StatusBadRequest, "RecordNotFound")
+			return
+		}
+		pds.reply(w, map[string]any{"uri": uri, "cid": "cid" + uri, "value": record})
+
+	case "com.atproto.identity.resolveHandle":
+		if handle := r.URL.Query().Get("handle"); handle != "alice.bsky.social" {
+			pds.fail(w, http.StatusBadRequest, "InvalidRequest")
+			return
+		}
+		pds.reply(w, map[string]string{"did": "did:plc:alice"})
+
+	default:
+		pds.t.Errorf("unexpected request %s %s", r.Method, method)
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (pds *fakePDS) reply(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func (pds *fakePDS) fail(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	pds.reply(w, map[string]string{"error": code, "message": code})
+}
+
+func newTestBluesky(t *testing.T, editPolicy BlueskyEditPolicy) (*EndpointBluesky, *fakePDS) {
+	t.Helper()
+	pds, srv := newFakePDS(t)
+	e := NewEndpointBluesky("bluesky")
+	err := e.Initialize(context.Background(), &EndpointConfig{Bluesky: &EndpointConfigBluesky{
+		Service:     srv.URL,
+		Identifier:  "bridge.bsky.social",
+		AppPassword: "password",
+		EditPolicy:  editPolicy,
+		Language:    "en",
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e, pds
+}
+
+func TestBlueskyPostLanguage(t *testing.T) {
+	e, _ := newTestBluesky(t, BlueskyEditPolicyIgnore)
+	if e.languageConfidence != language.DefaultConfidence {
+		t.Errorf("default language confidence = %v, want %v", e.languageConfidence, language.DefaultConfidence)
+	}
+	e.language = "ja"
+
+	english := "The quick brown fox jumps over the lazy dog while the farmer watches from the house."
+	for _, tt := range []struct {
+		name       string
+		confidence float64
+		content    model.BridgeMessageContent
+		want       string
+	}{
+		{"source language", language.DefaultConfidence, model.BridgeMessageContent{MDText: english, Language: "de"}, "de"},
+		{"detected", language.DefaultConfidence, model.BridgeMessageContent{MDText: english}, "en"},
+		{"below configured confidence", 0.9, model.BridgeMessageContent{MDText: english}, "ja"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			e.languageConfidence = tt.confidence
+			if got := e.postLanguage(&tt.content); got != tt.want {
+				t.Errorf("postLanguage() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestUTF16ToByteOffsets(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []int
+	}{
+		{"", []int{0}},
+		{"ab", []int{0, 1, 2}},
+		// Two bytes in UTF-8, one unit in UTF-16.
+		{"éa", []int{0, 2, 3}},
+		// Three bytes in UTF-8, one unit in UTF-16.
+		{"漢a", []int{0, 3, 4}},
+		// Four bytes in UTF-8, a surrogate pair in UTF-16.
+		{"😀a", []int{0, 0, 4, 5}},
+	}
+
+	for _, tt := range tests {
+		if got := utf16ToByteOffsets(tt.in); !slices.Equal(got, tt.want) {
+			t.Errorf("utf16ToByteOffsets(%q) = %v, want %v", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestBlueskyFacets(t *testing.T) {
+	e, _ := newTestBluesky(t, "")
+
+	type facet struct {
+		text    string
+		feature string
+		value   string
+	}
+	tests := []struct {
+		name string
+		md   string
+		want []facet
+	}{
+		{
+			name: "link after emoji",
+			md:   "😀😀 [link](https://example.com)",
+			want: []facet{{"link", "link", "https://example.com"}},
+		},
+		{
+			name: "bare URL after CJK",
+			md:   "漢字 https://example.com/path, done",
+			want: []facet{{"https://example.com/path", "link", "https://example.com/path"}},
+		},
+		{
+			name: "mention after emoji",
+			md:   "😀 @alice.bsky.social hi",
+			want: []facet{{"@alice.bsky.social", "mention", "did:plc:alice"}},
+		},
+		{
+			name: "unresolved mention",
+			md:   "@nobody.example.com hi",
+			want: nil,
+		},
+		{
+			name: "mention inside a word",
+			md:   "mail@alice.bsky.social",
+			want: nil,
+		},
+		{
+			name: "hashtag after CJK",
+			md:   "漢字 #タグ and #123",
+			want: []facet{{"#タグ", "tag", "タグ"}},
+		},
+		{
+			name: "URL inside link",
+			md:   "[https://example.com label](https://example.org)",
+			want: []facet{{"https://example.com label", "link", "https://example.org"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			text := renderBlueskyText(tt.md)
+			var got []facet
+			for _, f := range e.blueskyFacets(context.Background(), text) {
+				feature := f.Features[0]
+				kind := strings.TrimPrefix(feature["$type"].(string), "app.bsky.richtext.facet#")
+				value := feature[map[string]string{"link": "uri", "mention": "did", "tag": "tag"}[kind]].(string)
+				got = append(got, facet{text.text[f.Index.ByteStart:f.Index.ByteEnd], kind, value})
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("facets of %q = %v, want %v", text.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBlueskyLength(t *testing.T) {
+	tests := []struct {
+		md   string
+		want int
+	}{
+		{"plain", 5},
+		// Links are facets, only their labels count.
+		{"**bold** [link](https://example.com)", 9},
+		{"漢字 😀", 4},
+	}
+
+	for _, tt := range tests {
+		if got := blueskyLength(tt.md); got != tt.want {
+			t.Errorf("blueskyLength(%q) = %d, want %d", tt.md, got, tt.want)
+		}
+	}
+}
+
+func TestSplitBlueskyPosts(t *testing.T) {
+	content := &model.BridgeMessageContent{
+		MDText:      strings.Repeat("漢字 ", 200),
+		SpoilerText: "spoiler",
+	}
+	posts := splitBlueskyPosts(content, blueskyCorrectionPrefix)
+	if len(posts) < 2 {
+		t.Fatalf("split into %d posts, want a thread", len(posts))
+	}
+	for i, post := range posts {
+		if n := utf8.RuneCountInString(renderBlueskyText(post).text); n > blueskyMaxGraphemes {
+			t.Errorf("post %d has %d characters, over the limit of %d", i, n, blueskyMaxGraphemes)
+		}
+		if !strings.HasPrefix(post, telegramCWPrefix+"spoiler\n\n"+blueskyCorrectionPrefix) {
+			t.Errorf("post %d doesn't start with the content warning and the prefix: %q", i, post)
+		}
+	}
+}
+
+func TestBlueskyThread(t *testing.T) {
+	e, pds := newTestBluesky(t, "")
+	ctx := context.Background()
+
+	content := &model.BridgeMessageContent{MDText: strings.Repeat("word ", 100)}
+	revisions, err := e.ApplyUpdateNew(ctx, content, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(revisions) != 2 {
+		t.Fatalf("posted %d posts, want a thread of 2", len(revisions))
+	}
+	first, second := pds.records[string(revisions[0].ID)], pds.records[string(revisions[1].ID)]
+	if first.Reply != nil {
+		t.Errorf("first post replies to %v", first.Reply)
+	}
+	if second.Reply == nil || second.Reply.Root.URI != string(revisions[0].ID) || second.Reply.Parent.URI != string(revisions[0].ID) {
+		t.Errorf("second post replies to %v, want the first one", second.Reply)
+	}
+	if !slices.Equal(first.Langs, []string{"en"}) {
+		t.Errorf("langs = %v, want the configured language", first.Langs)
+	}
+
+	// A reply to the thread keeps its root.
+	reply, err := e.ApplyUpdateNew(ctx, &model.BridgeMessageContent{MDText: "reply"}, revisions[1].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ref := pds.records[string(reply[0].ID)].Reply; ref == nil || ref.Root.URI != string(revisions[0].ID) || ref.Parent.URI != string(revisions[1].ID) {
+		t.Errorf("reply refers to %v, want root %s and parent %s", ref, revisions[0].ID, revisions[1].ID)
+	}
+
+	err = e.ApplyUpdateDelete(ctx, revisions[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := pds.records[string(revisions[0].ID)]; ok {
+		t.Errorf("post %s is not deleted", revisions[0].ID)
+	}
+
+	// A thread failing halfway is deleted.
+	pds.failCreate = len(pds.created) + 2
+	_, err = e.ApplyUpdateNew(ctx, content, "")
+	if err == nil {
+		t.Fatal("posting a thread succeeded despite a failure")
+	}
+	if last := pds.created[len(pds.created)-1]; !slices.Contains(pds.deleted, last) {
+		t.Errorf("first post %s of the failed thread is left behind", last)
+	}
+}
+
+func TestBlueskyEditPolicies(t *testing.T) {
+	tests := []struct {
+		policy BlueskyEditPolicy
+		// ids are the indexes of created posts returned by the edit, the original is 1.
+		ids     []int
+		deleted bool
+	}{
+		{BlueskyEditPolicyIgnore, []int{1}, false},
+		{BlueskyEditPolicyRepost, []int{2}, true},
+		{BlueskyEditPolicyReply, []int{1, 2}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			e, pds := newTestBluesky(t, tt.policy)
+			ctx := context.Background()
+
+			original, err := e.ApplyUpdateNew(ctx, &model.BridgeMessageContent{MDText: "original"}, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			revisions, err := e.ApplyUpdateEdit(ctx, []model.EndpointMessageID{original[0].ID}, &model.BridgeMessageContent{MDText: "edited"})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var ids []string
+			for _, revision := range revisions {
+				ids = append(ids, string(revision.ID))
+			}
+			var want []string
+			for _, i := range tt.ids {
+				want = append(want, pds.created[i-1])
+			}
+			if !slices.Equal(ids, want) {
+				t.Errorf("edit returned %v, want %v", ids, want)
+			}
+			if deleted := slices.Contains(pds.deleted, string(original[0].ID)); deleted != tt.deleted {
+				t.Errorf("original deleted = %v, want %v", deleted, tt.deleted)
+			}
+
+			switch tt.policy {
+			case BlueskyEditPolicyRepost:
+				if text := pds.records[pds.created[1]].Text; text != "edited" {
+					t.Errorf("reposted text = %q, want %q", text, "edited")
+				}
+			case BlueskyEditPolicyReply:
+				correction := pds.records[pds.created[1]]
+				if correction.Text != strings.TrimSpace(blueskyCorrectionPrefix)+"\n\nedited" {
+					t.Errorf("correction text = %q", correction.Text)
+				}
+				if correction.Reply == nil || correction.Reply.Parent.URI != string(original[0].ID) {
+					t.Errorf("correction replies to %v, want the original", correction.Reply)
+				}
+			}
+		})
+	}
+}
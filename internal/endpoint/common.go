@@ -1,22 +1,202 @@
 package endpoint
 
-import "fmt"
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/merrkry/tele2don/internal/model"
+)
 
 type EndpointType string
 
 const (
 	EndpointTypeMastodon EndpointType = "mastodon"
 	EndpointTypeTelegram EndpointType = "telegram"
+	EndpointTypeMatrix   EndpointType = "matrix"
+	EndpointTypeBluesky  EndpointType = "bluesky"
+	EndpointTypeMisskey  EndpointType = "misskey"
+	EndpointTypeDiscord  EndpointType = "discord"
+	EndpointTypeFeed     EndpointType = "feed"
 )
 
 type EndpointConfig struct {
+	// Name identifies the endpoint in routes and cache, defaults to its index in config.
+	Name string       `json:"name"`
 	Type EndpointType `json:"type"`
 
 	// As we don't have ADT in Golang, we simply combine all endpoint-specific fields together.
-	Mastodon *EndpointConfigMastodon
-	Telegram *EndpointConfigTelegram
+	Mastodon *EndpointConfigMastodon `json:"mastodon"`
+	Telegram *EndpointConfigTelegram `json:"telegram"`
+	Matrix   *EndpointConfigMatrix   `json:"matrix"`
+	Bluesky  *EndpointConfigBluesky  `json:"bluesky"`
+	Misskey  *EndpointConfigMisskey  `json:"misskey"`
+	Discord  *EndpointConfigDiscord  `json:"discord"`
+	Feed     *EndpointConfigFeed     `json:"feed"`
+}
+
+// Validate checks that the endpoint-specific config matching Type is present and complete.
+// Returned errors name the offending key, relative to the endpoint config.
+func (c *EndpointConfig) Validate() error {
+	var err error
+	switch c.Type {
+	case EndpointTypeMastodon:
+		if c.Mastodon == nil {
+			return fmt.Errorf("mastodon: required for endpoint type %s", c.Type)
+		}
+		err = c.Mastodon.validate()
+	case EndpointTypeTelegram:
+		if c.Telegram == nil {
+			return fmt.Errorf("telegram: required for endpoint type %s", c.Type)
+		}
+		err = c.Telegram.validate()
+	case EndpointTypeMatrix:
+		if c.Matrix == nil {
+			return fmt.Errorf("matrix: required for endpoint type %s", c.Type)
+		}
+		err = c.Matrix.validate()
+	case EndpointTypeBluesky:
+		if c.Bluesky == nil {
+			return fmt.Errorf("bluesky: required for endpoint type %s", c.Type)
+		}
+		err = c.Bluesky.validate()
+	case EndpointTypeMisskey:
+		if c.Misskey == nil {
+			return fmt.Errorf("misskey: required for endpoint type %s", c.Type)
+		}
+		err = c.Misskey.validate()
+	case EndpointTypeDiscord:
+		if c.Discord == nil {
+			return fmt.Errorf("discord: required for endpoint type %s", c.Type)
+		}
+		err = c.Discord.validate()
+	case EndpointTypeFeed:
+		if c.Feed == nil {
+			return fmt.Errorf("feed: required for endpoint type %s", c.Type)
+		}
+		err = c.Feed.validate()
+	case "":
+		return fmt.Errorf("type: required")
+	default:
+		return fmt.Errorf("type: unsupported endpoint type %q", c.Type)
+	}
+	if err != nil {
+		return fmt.Errorf("%s.%w", c.Type, err)
+	}
+
+	if c.Mastodon != nil && c.Type != EndpointTypeMastodon {
+		return fmt.Errorf("mastodon: not allowed for endpoint type %s", c.Type)
+	}
+	if c.Telegram != nil && c.Type != EndpointTypeTelegram {
+		return fmt.Errorf("telegram: not allowed for endpoint type %s", c.Type)
+	}
+	if c.Matrix != nil && c.Type != EndpointTypeMatrix {
+		return fmt.Errorf("matrix: not allowed for endpoint type %s", c.Type)
+	}
+	if c.Bluesky != nil && c.Type != EndpointTypeBluesky {
+		return fmt.Errorf("bluesky: not allowed for endpoint type %s", c.Type)
+	}
+	if c.Misskey != nil && c.Type != EndpointTypeMisskey {
+		return fmt.Errorf("misskey: not allowed for endpoint type %s", c.Type)
+	}
+	if c.Discord != nil && c.Type != EndpointTypeDiscord {
+		return fmt.Errorf("discord: not allowed for endpoint type %s", c.Type)
+	}
+	if c.Feed != nil && c.Type != EndpointTypeFeed {
+		return fmt.Errorf("feed: not allowed for endpoint type %s", c.Type)
+	}
+
+	return nil
+}
+
+// Target identifies the chat or account bridged by the endpoint, so that it can be set up only once.
+// It might contain credentials, never log it.
+func (c *EndpointConfig) Target() string {
+	switch c.Type {
+	case EndpointTypeMastodon:
+		return fmt.Sprintf("%s:%s:%s", c.Type, c.Mastodon.Server, c.Mastodon.AccessToken)
+	case EndpointTypeTelegram:
+		return fmt.Sprintf("%s:%s:%d", c.Type, c.Telegram.BotToken, c.Telegram.ChannelID)
+	case EndpointTypeMatrix:
+		return fmt.Sprintf("%s:%s:%s:%s", c.Type, c.Matrix.Homeserver, c.Matrix.AccessToken, c.Matrix.RoomID)
+	case EndpointTypeBluesky:
+		return fmt.Sprintf("%s:%s:%s", c.Type, c.Bluesky.Service, c.Bluesky.Identifier)
+	case EndpointTypeMisskey:
+		return fmt.Sprintf("%s:%s:%s", c.Type, c.Misskey.Server, c.Misskey.AccessToken)
+	case EndpointTypeDiscord:
+		return fmt.Sprintf("%s:%s:%s", c.Type, c.Discord.BotToken, c.Discord.ChannelID)
+	case EndpointTypeFeed:
+		return fmt.Sprintf("%s:%s", c.Type, c.Feed.StorePath)
+	default:
+		return ""
+	}
 }
 
 var (
 	ErrUnsupportedUpdate = fmt.Errorf("Update or message not supported")
 )
+
+// openRemoteFile downloads a file over HTTP, returning the response body as a stream.
+func openRemoteFile(ctx context.Context, fileURL string) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fileURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		// Download URLs might contain credentials (e.g. Telegram bot token), don't leak them into logs.
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return nil, fmt.Errorf("failed to download file: %w", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status %s when downloading file", resp.Status)
+	}
+
+	return resp.Body, nil
+}
+
+// classifyHTTPStatus marks err as permanent on 4xx responses, except for timeouts and rate limiting.
+func classifyHTTPStatus(err error, status int, retryAfter time.Duration) error {
+	switch {
+	case status == http.StatusTooManyRequests:
+		return &RetryAfterError{RetryAfter: retryAfter, Err: err}
+	case status == http.StatusRequestTimeout:
+		return err
+	case status >= 400 && status < 500:
+		return &PermanentError{Err: err}
+	default:
+		return err
+	}
+}
+
+// decodeErrorBody decodes the JSON body of an error response into v, ignoring malformed ones.
+func decodeErrorBody(body io.Reader, v any) {
+	_ = json.NewDecoder(io.LimitReader(body, 64<<10)).Decode(v)
+}
+
+type messageDeleter interface {
+	ID() model.EndpointID
+	ApplyUpdateDelete(ctx context.Context, id model.EndpointMessageID) error
+}
+
+// deleteIncomplete deletes the messages of a post that failed halfway, logging errors.
+func deleteIncomplete(ctx context.Context, ep messageDeleter, revisions []model.EndpointMessageRevision) {
+	for _, revision := range revisions {
+		err := ep.ApplyUpdateDelete(ctx, revision.ID)
+		if err != nil {
+			slog.Warn("Failed to clean up incomplete message", "eid", ep.ID(), "id", revision.ID, "err", err)
+		}
+	}
+}
@@ -0,0 +1,439 @@
+package endpoint
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/merrkry/tele2don/internal/markdown"
+	"github.com/merrkry/tele2don/internal/model"
+)
+
+const (
+	discordMaxMessageLength = 2000
+	discordMaxFiles         = 10
+	// discordMaxFileSize is the upload limit of servers without boosts.
+	discordMaxFileSize = 10 << 20
+	// Files whose name starts with this prefix are hidden behind a spoiler.
+	discordSpoilerFilePrefix = "SPOILER_"
+
+	discordMessageTypeDefault = 0
+	discordMessageTypeReply   = 19
+)
+
+var (
+	discordSnowflakePattern = regexp.MustCompile(`^\d+$`)
+	// discordSpoilerPattern matches a message body entirely hidden in a spoiler, which follows the content warning line.
+	discordSpoilerPattern = regexp.MustCompile(`(?s)^\|\|(.*)\|\|$`)
+)
+
+type EndpointConfigDiscord struct {
+	// BotToken authorizes the bot, which receives messages of the channel through the gateway.
+	// The bot needs the message content intent.
+	BotToken  string `json:"bot_token"`
+	ChannelID string `json:"channel_id"`
+	// WebhookURL is an execute-webhook URL of the channel. If set, messages are posted through it instead of as the bot.
+	WebhookURL string `json:"webhook_url"`
+	// Senders lists IDs of users whose messages are bridged. Messages of all users but ourselves are bridged if empty.
+	Senders []string `json:"senders"`
+}
+
+func (c *EndpointConfigDiscord) validate() error {
+	if c.BotToken == "" {
+		return fmt.Errorf("bot_token: required")
+	}
+	if !discordSnowflakePattern.MatchString(c.ChannelID) {
+		return fmt.Errorf("channel_id: must be a numeric channel ID, got %q", c.ChannelID)
+	}
+	if c.WebhookURL != "" {
+		u, err := url.Parse(c.WebhookURL)
+		if err != nil {
+			// The URL contains the webhook token, don't leak it.
+			return fmt.Errorf("webhook_url: invalid URL")
+		}
+		if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("webhook_url: must be an absolute http(s) URL")
+		}
+	}
+	for i, sender := range c.Senders {
+		if !discordSnowflakePattern.MatchString(sender) {
+			return fmt.Errorf("senders[%d]: must be a numeric user ID, got %q", i, sender)
+		}
+	}
+	return nil
+}
+
+// EndpointDiscord bridges messages of a Discord channel, posting as the bot or through a webhook.
+type EndpointDiscord struct {
+	id        model.EndpointID
+	client    *discordClient
+	channelID string
+	userID    string
+	webhookID string
+	senders   []string
+
+	status statusTracker
+
+	// Only accessed by the goroutine of the gateway.
+	lastSeenID string
+}
+
+func NewEndpointDiscord(id model.EndpointID) *EndpointDiscord {
+	return &EndpointDiscord{
+		id: id,
+	}
+}
+
+func (e *EndpointDiscord) ID() model.EndpointID {
+	return e.id
+}
+
+func (e *EndpointDiscord) Initialize(ctx context.Context, cfg *EndpointConfig) error {
+	e.client = newDiscordClient(cfg.Discord.BotToken, cfg.Discord.WebhookURL, &e.status)
+	e.channelID = cfg.Discord.ChannelID
+	e.senders = cfg.Discord.Senders
+
+	// Needed to tell our own messages apart from others in the channel.
+	userID, err := e.client.me(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to verify Discord bot token: %w", err)
+	}
+	e.userID = userID
+
+	if cfg.Discord.WebhookURL != "" {
+		webhookID, channelID, err := e.client.webhook(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to verify Discord webhook: %w", err)
+		}
+		if channelID != e.channelID {
+			return fmt.Errorf("webhook posts to Discord channel %s instead of %s", channelID, e.channelID)
+		}
+		e.webhookID = webhookID
+	}
+
+	e.status.setInitialized()
+	return nil
+}
+
+func (e *EndpointDiscord) Status() Status {
+	return e.status.status()
+}
+
+func (e *EndpointDiscord) convertMessage(message *discordMessage, updateType model.EndpointUpdateType) (*model.EndpointUpdate, error) {
+	// Our own messages are sent by the bridge.
+	if message.Author.ID == e.userID || (e.webhookID != "" && message.WebhookID == e.webhookID) {
+		return nil, ErrUnsupportedUpdate
+	}
+	if len(e.senders) > 0 && !slices.Contains(e.senders, message.Author.ID) {
+		return nil, ErrUnsupportedUpdate
+	}
+	// Other types are system messages, e.g. pins and joins.
+	if message.Type != discordMessageTypeDefault && message.Type != discordMessageTypeReply {
+		return nil, ErrUnsupportedUpdate
+	}
+
+	convertedUpdate := &model.EndpointUpdate{
+		Type: updateType,
+		UniqueEndpointMessageID: model.UniqueEndpointMessageID{
+			EID: e.id,
+			ID:  model.EndpointMessageID(message.ID),
+		},
+		Timestamp: message.Timestamp,
+		Content:   e.convertContent(message),
+	}
+	if updateType == model.UpdateTypeEdit {
+		if message.EditedTimestamp == nil {
+			// Updates without edits are embeds being resolved.
+			return nil, ErrUnsupportedUpdate
+		}
+		convertedUpdate.Timestamp = *message.EditedTimestamp
+	}
+	if updateType == model.UpdateTypeNew && message.MessageReference != nil && message.MessageReference.MessageID != "" {
+		convertedUpdate.Parent = &model.UniqueEndpointMessageID{
+			EID: e.id,
+			ID:  model.EndpointMessageID(message.MessageReference.MessageID),
+		}
+	}
+	return convertedUpdate, nil
+}
+
+func (e *EndpointDiscord) convertContent(message *discordMessage) *model.BridgeMessageContent {
+	content := &model.BridgeMessageContent{}
+	text := message.Content
+
+	// Content warnings are sent as a line followed by the body in a spoiler, the same as we render them.
+	if line, rest, ok := strings.Cut(text, "\n"); ok && strings.HasPrefix(line, telegramCWPrefix) {
+		if match := discordSpoilerPattern.FindStringSubmatch(strings.TrimSpace(rest)); match != nil {
+			content.SpoilerText = strings.TrimSpace(strings.TrimPrefix(line, telegramCWPrefix))
+			text = match[1]
+		}
+	}
+	content.MDText = discordToMarkdown(text, message)
+
+	for _, file := range message.Attachments {
+		var kind model.AttachmentKind
+		switch {
+		case file.ContentType == "image/gif":
+			kind = model.AttachmentKindAnimation
+		case strings.HasPrefix(file.ContentType, "image/"):
+			kind = model.AttachmentKindPhoto
+		case strings.HasPrefix(file.ContentType, "video/"):
+			kind = model.AttachmentKindVideo
+		default:
+			kind = model.AttachmentKindDocument
+		}
+
+		fileName := file.Filename
+		if strings.HasPrefix(fileName, discordSpoilerFilePrefix) {
+			content.Sensitive = true
+			fileName = strings.TrimPrefix(fileName, discordSpoilerFilePrefix)
+		}
+
+		content.Attachments = append(content.Attachments, &model.Attachment{
+			Kind:     kind,
+			MIMEType: file.ContentType,
+			Size:     file.Size,
+			FileName: fileName,
+			AltText:  file.Description,
+			Source:   file.URL,
+			Open:     e.AttachmentOpener(file.URL),
+		})
+	}
+
+	return content
+}
+
+// AttachmentOpener recreates the opener of an attachment from its CDN URL, which expires after a while.
+func (e *EndpointDiscord) AttachmentOpener(source string) model.AttachmentOpener {
+	return func(ctx context.Context) (io.ReadCloser, error) {
+		return openRemoteFile(ctx, source)
+	}
+}
+
+// discordLength counts characters of bridge Markdown as rendered for Discord, which counts UTF-16 code units.
+func discordLength(md string) int {
+	return len(utf16.Encode([]rune(renderDiscordText(md))))
+}
+
+// splitDiscordMessages splits content into messages within the length limit, each with the content warning.
+func splitDiscordMessages(content *model.BridgeMessageContent) []string {
+	cw := ""
+	if content.SpoilerText != "" {
+		cw = telegramCWPrefix + content.SpoilerText + "\n\n"
+	}
+	limit := discordMaxMessageLength
+	if cw != "" {
+		limit -= len(utf16.Encode([]rune(cw + "||||")))
+	}
+
+	texts := markdown.Split(content.MDText, max(limit, 1), discordLength)
+	for i, md := range texts {
+		texts[i] = renderDiscordText(md)
+		if cw != "" && texts[i] != "" {
+			texts[i] = cw + "||" + texts[i] + "||"
+		} else if cw != "" {
+			texts[i] = strings.TrimSpace(cw)
+		}
+	}
+	return texts
+}
+
+// messageParams returns parameters of a message with text, which is Discord markdown.
+func (e *EndpointDiscord) messageParams(text string) map[string]any {
+	// Messages need content or files, a zero-width space is the closest to nothing.
+	if strings.TrimSpace(text) == "" {
+		text = "\u200b"
+	}
+	return map[string]any{
+		"content": text,
+		// Don't ping anyone mentioned in bridged messages.
+		"allowed_mentions": map[string]any{"parse": []string{}},
+	}
+}
+
+// ApplyUpdateNew sends content as a chain of replies, with attachments on the first message.
+func (e *EndpointDiscord) ApplyUpdateNew(ctx context.Context, content *model.BridgeMessageContent, replyTo model.EndpointMessageID) (_ []model.EndpointMessageRevision, err error) {
+	defer func() { err = classifyDiscordError(err) }()
+
+	var revisions []model.EndpointMessageRevision
+	for i, text := range splitDiscordMessages(content) {
+		params := e.messageParams(text)
+		if replyTo != "" && e.webhookID == "" {
+			params["message_reference"] = map[string]any{
+				"message_id":         string(replyTo),
+				"fail_if_not_exists": false,
+			}
+		}
+
+		var files []discordFile
+		if i == 0 {
+			var closeFiles func()
+			files, closeFiles, err = e.openAttachments(ctx, content)
+			if err != nil {
+				return nil, fmt.Errorf("failed to open attachments for Discord: %w", err)
+			}
+			defer closeFiles()
+			if len(files) > 0 {
+				if strings.TrimSpace(text) == "" {
+					params["content"] = ""
+				}
+				params["attachments"] = attachmentParams(content, len(files))
+			}
+		}
+
+		message, err := e.client.createMessage(ctx, e.channelID, params, files)
+		if err != nil {
+			deleteIncomplete(ctx, e, revisions)
+			return nil, fmt.Errorf("failed to send message to Discord: %w", err)
+		}
+
+		slog.Debug("Message sent to Discord", "id", message.ID)
+
+		revisions = append(revisions, model.EndpointMessageRevision{
+			ID:        model.EndpointMessageID(message.ID),
+			Timestamp: message.Timestamp,
+		})
+		replyTo = model.EndpointMessageID(message.ID)
+	}
+
+	return revisions, nil
+}
+
+// openAttachments opens attachments within the limits of Discord to be uploaded, the returned function closes them.
+func (e *EndpointDiscord) openAttachments(ctx context.Context, content *model.BridgeMessageContent) ([]discordFile, func(), error) {
+	var closers []io.Closer
+	closeAll := func() {
+		for _, c := range closers {
+			c.Close()
+		}
+	}
+
+	var files []discordFile
+	for _, attachment := range content.Attachments {
+		if len(files) >= discordMaxFiles {
+			slog.Warn("Too many attachments for a Discord message, extra ones will be dropped", "count", len(content.Attachments))
+			break
+		}
+		if attachment.Size > discordMaxFileSize {
+			slog.Warn("Attachment too large for Discord, dropping it", "kind", attachment.Kind, "size", attachment.Size)
+			continue
+		}
+
+		r, err := attachment.Open(ctx)
+		if err != nil {
+			closeAll()
+			return nil, nil, err
+		}
+		closers = append(closers, r)
+
+		// Discord tells the file type from its extension.
+		fileName := attachment.FileName
+		if fileName == "" {
+			fileName = attachment.Kind.String()
+		}
+		fileName = path.Base(fileName)
+		if content.Sensitive {
+			fileName = discordSpoilerFilePrefix + fileName
+		}
+		files = append(files, discordFile{name: fileName, r: r})
+	}
+
+	return files, closeAll, nil
+}
+
+// attachmentParams describes the first count uploaded files, which carry the alt text of attachments.
+func attachmentParams(content *model.BridgeMessageContent, count int) []map[string]any {
+	params := make([]map[string]any, 0, count)
+	for _, attachment := range content.Attachments {
+		if len(params) >= count {
+			break
+		}
+		if attachment.Size > discordMaxFileSize {
+			continue
+		}
+		param := map[string]any{"id": len(params)}
+		if attachment.AltText != "" {
+			param["description"] = attachment.AltText
+		}
+		params = append(params, param)
+	}
+	return params
+}
+
+// ApplyUpdateEdit edits messages in place, keeping attachments of the first one.
+func (e *EndpointDiscord) ApplyUpdateEdit(ctx context.Context, ids []model.EndpointMessageID, content *model.BridgeMessageContent) (_ []model.EndpointMessageRevision, err error) {
+	defer func() { err = classifyDiscordError(err) }()
+
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("no Discord message to edit")
+	}
+
+	texts := splitDiscordMessages(content)
+
+	var revisions []model.EndpointMessageRevision
+	for i, text := range texts {
+		params := e.messageParams(text)
+
+		var message *discordMessage
+		if i < len(ids) {
+			message, err = e.client.editMessage(ctx, e.channelID, string(ids[i]), params)
+			if err != nil {
+				return nil, fmt.Errorf("failed to edit message in Discord: %w", err)
+			}
+			slog.Debug("Message edited in Discord", "id", message.ID)
+		} else {
+			if e.webhookID == "" {
+				params["message_reference"] = map[string]any{
+					"message_id":         string(revisions[i-1].ID),
+					"fail_if_not_exists": false,
+				}
+			}
+			message, err = e.client.createMessage(ctx, e.channelID, params, nil)
+			if err != nil {
+				return nil, fmt.Errorf("failed to send message to Discord: %w", err)
+			}
+			slog.Debug("Message sent to Discord", "id", message.ID)
+		}
+
+		revision := model.EndpointMessageRevision{
+			ID:        model.EndpointMessageID(message.ID),
+			Timestamp: message.Timestamp,
+		}
+		if i < len(ids) {
+			revision.ID = ids[i]
+			revision.Timestamp = time.Now()
+			if message.EditedTimestamp != nil {
+				revision.Timestamp = *message.EditedTimestamp
+			}
+		}
+		revisions = append(revisions, revision)
+	}
+
+	for _, id := range ids[min(len(texts), len(ids)):] {
+		err := e.ApplyUpdateDelete(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return revisions, nil
+}
+
+func (e *EndpointDiscord) ApplyUpdateDelete(ctx context.Context, id model.EndpointMessageID) error {
+	err := e.client.deleteMessage(ctx, e.channelID, string(id))
+	if err != nil {
+		return classifyDiscordError(fmt.Errorf("failed to delete message in Discord: %w", err))
+	}
+
+	slog.Debug("Message deleted in Discord", "id", id)
+
+	return nil
+}
@@ -0,0 +1,270 @@
+package endpoint
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const discordAPIBase = "https://discord.com/api/v10"
+
+// discordClient is a minimal client of the Discord REST API, sending as the bot or through a webhook.
+type discordClient struct {
+	apiBase    string
+	botToken   string
+	webhookURL string
+	httpClient *http.Client
+	status     *statusTracker
+}
+
+func newDiscordClient(botToken, webhookURL string, status *statusTracker) *discordClient {
+	return &discordClient{
+		apiBase:    discordAPIBase,
+		botToken:   botToken,
+		webhookURL: webhookURL,
+		httpClient: &http.Client{},
+		status:     status,
+	}
+}
+
+// discordError is an error response of the API.
+type discordError struct {
+	StatusCode int
+	Code       int    `json:"code"`
+	Message    string `json:"message"`
+	// RetryAfter is in seconds, and only set when rate limited.
+	RetryAfter float64 `json:"retry_after"`
+}
+
+func (e *discordError) Error() string {
+	return fmt.Sprintf("discord: %d %d: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// classifyDiscordError wraps errors of rate limiting and rejected requests for the bridge service.
+func classifyDiscordError(err error) error {
+	var discordErr *discordError
+	if !errors.As(err, &discordErr) {
+		return err
+	}
+
+	return classifyHTTPStatus(err, discordErr.StatusCode, time.Duration(discordErr.RetryAfter*float64(time.Second)))
+}
+
+// discordFile is a file uploaded along with a message.
+type discordFile struct {
+	name string
+	r    io.Reader
+}
+
+// do sends body as JSON, or as multipart payload_json with files, and decodes the response into result if not nil.
+func (c *discordClient) do(ctx context.Context, method, u string, body any, files []discordFile, result any) error {
+	var r io.Reader
+	contentType := ""
+	if len(files) > 0 {
+		var buf bytes.Buffer
+		w := multipart.NewWriter(&buf)
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		err = w.WriteField("payload_json", string(payload))
+		if err != nil {
+			return err
+		}
+		for i, file := range files {
+			part, err := w.CreateFormFile(fmt.Sprintf("files[%d]", i), file.name)
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(part, file.r)
+			if err != nil {
+				return err
+			}
+		}
+		err = w.Close()
+		if err != nil {
+			return err
+		}
+		r = &buf
+		contentType = w.FormDataContentType()
+	} else if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(data)
+		contentType = "application/json"
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, r)
+	if err != nil {
+		return err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if strings.HasPrefix(u, c.apiBase) {
+		req.Header.Set("Authorization", "Bot "+c.botToken)
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		// Webhook URLs contain their token, don't leak them into logs.
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return fmt.Errorf("discord: %s: %w", method, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		discordErr := &discordError{}
+		decodeErrorBody(resp.Body, discordErr)
+		discordErr.StatusCode = resp.StatusCode
+		if discordErr.RetryAfter == 0 {
+			if seconds, err := strconv.ParseFloat(resp.Header.Get("Retry-After"), 64); err == nil {
+				discordErr.RetryAfter = seconds
+			}
+		}
+		return discordErr
+	}
+
+	c.status.apiCallSucceeded()
+	if result == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	err = json.NewDecoder(resp.Body).Decode(result)
+	if err != nil {
+		return fmt.Errorf("failed to decode response of %s %s: %w", method, req.URL.Path, err)
+	}
+	return nil
+}
+
+// discordMessage is a message, as returned by the API and dispatched by the gateway.
+type discordMessage struct {
+	ID        string `json:"id"`
+	ChannelID string `json:"channel_id"`
+	Type      int    `json:"type"`
+	Author    struct {
+		ID       string `json:"id"`
+		Username string `json:"username"`
+	} `json:"author"`
+	WebhookID       string     `json:"webhook_id"`
+	Content         string     `json:"content"`
+	Timestamp       time.Time  `json:"timestamp"`
+	EditedTimestamp *time.Time `json:"edited_timestamp"`
+	Mentions        []struct {
+		ID       string `json:"id"`
+		Username string `json:"username"`
+	} `json:"mentions"`
+	Attachments      []discordAttachment `json:"attachments"`
+	MessageReference *struct {
+		MessageID string `json:"message_id"`
+	} `json:"message_reference"`
+}
+
+type discordAttachment struct {
+	ID          string `json:"id"`
+	Filename    string `json:"filename"`
+	Description string `json:"description"`
+	ContentType string `json:"content_type"`
+	Size        int64  `json:"size"`
+	URL         string `json:"url"`
+}
+
+// messagesURL returns the URL to post messages to, or of the message id if not empty.
+func (c *discordClient) messagesURL(channelID, id string) string {
+	if c.webhookURL != "" {
+		if id == "" {
+			// Without wait, webhooks don't return the message.
+			return c.webhookURL + "?wait=true"
+		}
+		return c.webhookURL + "/messages/" + url.PathEscape(id)
+	}
+	u := c.apiBase + "/channels/" + url.PathEscape(channelID) + "/messages"
+	if id != "" {
+		u += "/" + url.PathEscape(id)
+	}
+	return u
+}
+
+// me returns the user ID of the bot.
+func (c *discordClient) me(ctx context.Context) (string, error) {
+	var user struct {
+		ID string `json:"id"`
+	}
+	err := c.do(ctx, http.MethodGet, c.apiBase+"/users/@me", nil, nil, &user)
+	return user.ID, err
+}
+
+// webhook returns the ID and channel of the execute-webhook URL, which is authorized by the token in it.
+func (c *discordClient) webhook(ctx context.Context) (string, string, error) {
+	var webhook struct {
+		ID        string `json:"id"`
+		ChannelID string `json:"channel_id"`
+	}
+	err := c.do(ctx, http.MethodGet, c.webhookURL, nil, nil, &webhook)
+	return webhook.ID, webhook.ChannelID, err
+}
+
+// gatewayURL returns the URL to connect to the gateway.
+func (c *discordClient) gatewayURL(ctx context.Context) (string, error) {
+	var gateway struct {
+		URL string `json:"url"`
+	}
+	err := c.do(ctx, http.MethodGet, c.apiBase+"/gateway/bot", nil, nil, &gateway)
+	if err != nil {
+		return "", err
+	}
+	return gateway.URL + "/?v=10&encoding=json", nil
+}
+
+// channelMessages fetches messages of the channel after the message after, oldest first, or the latest one if after is empty.
+func (c *discordClient) channelMessages(ctx context.Context, channelID, after string, limit int) ([]*discordMessage, error) {
+	query := url.Values{"limit": {strconv.Itoa(limit)}}
+	if after != "" {
+		query.Set("after", after)
+	}
+	var messages []*discordMessage
+	err := c.do(ctx, http.MethodGet, c.apiBase+"/channels/"+url.PathEscape(channelID)+"/messages?"+query.Encode(), nil, nil, &messages)
+	if err != nil {
+		return nil, err
+	}
+	// Messages are returned newest first.
+	for i, j := 0, len(messages)-1; i < j; i, j = i+1, j-1 {
+		messages[i], messages[j] = messages[j], messages[i]
+	}
+	return messages, nil
+}
+
+func (c *discordClient) createMessage(ctx context.Context, channelID string, params map[string]any, files []discordFile) (*discordMessage, error) {
+	message := &discordMessage{}
+	err := c.do(ctx, http.MethodPost, c.messagesURL(channelID, ""), params, files, message)
+	if err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+func (c *discordClient) editMessage(ctx context.Context, channelID, id string, params map[string]any) (*discordMessage, error) {
+	message := &discordMessage{}
+	err := c.do(ctx, http.MethodPatch, c.messagesURL(channelID, id), params, nil, message)
+	if err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+func (c *discordClient) deleteMessage(ctx context.Context, channelID, id string) error {
+	return c.do(ctx, http.MethodDelete, c.messagesURL(channelID, id), nil, nil, nil)
+}
@@ -0,0 +1,345 @@
+package endpoint
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/merrkry/tele2don/internal/model"
+)
+
+const (
+	discordGatewayMinBackoff = time.Second
+	discordGatewayMaxBackoff = 5 * time.Minute
+	// A connection that stayed up this long is considered healthy, so backoff starts over after it drops.
+	discordGatewayHealthyDuration = time.Minute
+	discordBackfillPageSize       = 100
+
+	// discordGatewayIntents are GUILD_MESSAGES and MESSAGE_CONTENT, the latter is privileged and has to be enabled for the bot.
+	discordGatewayIntents = 1<<9 | 1<<15
+)
+
+// Opcodes of gateway payloads.
+const (
+	discordOpDispatch       = 0
+	discordOpHeartbeat      = 1
+	discordOpIdentify       = 2
+	discordOpReconnect      = 7
+	discordOpInvalidSession = 9
+	discordOpHello          = 10
+	discordOpHeartbeatACK   = 11
+)
+
+// discordGatewayPayload is a payload received from the gateway.
+type discordGatewayPayload struct {
+	Op int             `json:"op"`
+	D  json.RawMessage `json:"d"`
+	S  *int64          `json:"s"`
+	T  string          `json:"t"`
+}
+
+// discordGatewayCommand is a payload sent to the gateway.
+type discordGatewayCommand struct {
+	Op int `json:"op"`
+	D  any `json:"d"`
+}
+
+// ListenUpdates receives messages from the gateway, backfilling those missed while disconnected instead of resuming.
+func (e *EndpointDiscord) ListenUpdates(ctx context.Context, updatesChan chan<- *model.EndpointUpdate, wg *sync.WaitGroup) {
+	defer wg.Done()
+	e.status.setListening(true)
+	defer e.status.setListening(false)
+
+	retry := &backoff{min: discordGatewayMinBackoff, max: discordGatewayMaxBackoff}
+	tracking := false
+	for {
+		start := time.Now()
+
+		var err error
+		if !tracking {
+			err = e.fetchLastSeenMessage(ctx)
+		}
+		if err == nil {
+			err = e.connectGateway(ctx, updatesChan, tracking)
+			tracking = true
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		if time.Since(start) >= discordGatewayHealthyDuration {
+			retry.reset()
+		}
+		delay := retry.next()
+		slog.Warn("Discord gateway connection failed, reconnecting", "eid", e.id, "delay", delay, "err", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// fetchLastSeenMessage fetches the latest message of the channel, where backfill starts from.
+func (e *EndpointDiscord) fetchLastSeenMessage(ctx context.Context) error {
+	messages, err := e.client.channelMessages(ctx, e.channelID, "", 1)
+	if err != nil {
+		return fmt.Errorf("failed to fetch latest Discord message: %w", err)
+	}
+	if len(messages) > 0 {
+		e.lastSeenID = messages[0].ID
+	}
+
+	return nil
+}
+
+// connectGateway forwards events until the connection fails, the returned error is never nil.
+func (e *EndpointDiscord) connectGateway(ctx context.Context, updatesChan chan<- *model.EndpointUpdate, backfill bool) error {
+	gatewayURL, err := e.client.gatewayURL(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to fetch Discord gateway URL: %w", err)
+	}
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, gatewayURL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to connect to Discord gateway: %w", err)
+	}
+	defer conn.Close()
+	e.status.heartbeat()
+
+	// Unblock the reader on cancellation.
+	gatewayCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-gatewayCtx.Done()
+		conn.Close()
+	}()
+
+	// Only this goroutine writes to conn, the reader only reads.
+	payloads := make(chan *discordGatewayPayload)
+	readErr := make(chan error, 1)
+	go func() {
+		for {
+			payload := &discordGatewayPayload{}
+			err := conn.ReadJSON(payload)
+			if err != nil {
+				readErr <- err
+				return
+			}
+			select {
+			case <-gatewayCtx.Done():
+				return
+			case payloads <- payload:
+			}
+		}
+	}()
+
+	// The gateway starts with HELLO, telling the heartbeat interval.
+	var interval time.Duration
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case err := <-readErr:
+		return err
+	case payload := <-payloads:
+		var hello struct {
+			HeartbeatInterval int64 `json:"heartbeat_interval"`
+		}
+		if payload.Op != discordOpHello || json.Unmarshal(payload.D, &hello) != nil || hello.HeartbeatInterval <= 0 {
+			return fmt.Errorf("unexpected opcode %d instead of HELLO from Discord gateway", payload.Op)
+		}
+		interval = time.Duration(hello.HeartbeatInterval) * time.Millisecond
+	}
+
+	err = conn.WriteJSON(&discordGatewayCommand{Op: discordOpIdentify, D: map[string]any{
+		"token":   e.client.botToken,
+		"intents": discordGatewayIntents,
+		"properties": map[string]any{
+			"os":      "linux",
+			"browser": "tele2don",
+			"device":  "tele2don",
+		},
+	}})
+	if err != nil {
+		return err
+	}
+
+	if backfill {
+		err := e.backfill(ctx, updatesChan)
+		if err != nil {
+			return fmt.Errorf("failed to backfill Discord messages: %w", err)
+		}
+	}
+
+	// The first heartbeat is jittered, so that clients reconnecting at once don't heartbeat at once.
+	heartbeat := time.NewTimer(time.Duration(rand.Float64() * float64(interval)))
+	defer heartbeat.Stop()
+	var seq *int64
+	acked := true
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case err := <-readErr:
+			return err
+
+		case <-heartbeat.C:
+			// A connection without ACK of the last heartbeat is dead, even if it's still open.
+			if !acked {
+				return errors.New("Discord gateway didn't acknowledge heartbeat")
+			}
+			err := conn.WriteJSON(&discordGatewayCommand{Op: discordOpHeartbeat, D: seq})
+			if err != nil {
+				return err
+			}
+			acked = false
+			heartbeat.Reset(interval)
+
+		case payload := <-payloads:
+			e.status.heartbeat()
+			if payload.S != nil {
+				seq = payload.S
+			}
+
+			switch payload.Op {
+			case discordOpDispatch:
+				err := e.handleDispatch(ctx, payload, updatesChan)
+				if err != nil {
+					return err
+				}
+			case discordOpHeartbeat:
+				// The gateway might ask for a heartbeat right away.
+				err := conn.WriteJSON(&discordGatewayCommand{Op: discordOpHeartbeat, D: seq})
+				if err != nil {
+					return err
+				}
+			case discordOpHeartbeatACK:
+				acked = true
+			case discordOpReconnect:
+				return errors.New("Discord gateway asked to reconnect")
+			case discordOpInvalidSession:
+				return errors.New("Discord gateway invalidated session")
+			}
+		}
+	}
+}
+
+// handleDispatch converts a dispatched event of the channel and forwards it. Only errors of the connection are returned.
+func (e *EndpointDiscord) handleDispatch(ctx context.Context, payload *discordGatewayPayload, updatesChan chan<- *model.EndpointUpdate) error {
+	var convertedUpdates []*model.EndpointUpdate
+	switch payload.T {
+	case "READY":
+		slog.Info("Connected to Discord gateway", "eid", e.id)
+		return nil
+
+	case "MESSAGE_CREATE", "MESSAGE_UPDATE":
+		var message discordMessage
+		err := json.Unmarshal(payload.D, &message)
+		if err != nil {
+			slog.Error("Failed to decode Discord message", "err", err)
+			return nil
+		}
+		if message.ChannelID != e.channelID {
+			return nil
+		}
+
+		updateType := model.UpdateTypeEdit
+		if payload.T == "MESSAGE_CREATE" {
+			e.trackSeenMessage(&message)
+			updateType = model.UpdateTypeNew
+		}
+		convertedUpdate, err := e.convertMessage(&message, updateType)
+		if err != nil {
+			if !errors.Is(err, ErrUnsupportedUpdate) {
+				slog.Error("Failed to convert Discord message", "id", message.ID, "err", err)
+			}
+			return nil
+		}
+		convertedUpdates = append(convertedUpdates, convertedUpdate)
+
+	case "MESSAGE_DELETE", "MESSAGE_DELETE_BULK":
+		var deleted struct {
+			ID        string   `json:"id"`
+			IDs       []string `json:"ids"`
+			ChannelID string   `json:"channel_id"`
+		}
+		err := json.Unmarshal(payload.D, &deleted)
+		if err != nil {
+			slog.Error("Failed to decode Discord message deletion", "err", err)
+			return nil
+		}
+		if deleted.ChannelID != e.channelID {
+			return nil
+		}
+		if deleted.ID != "" {
+			deleted.IDs = append(deleted.IDs, deleted.ID)
+		}
+		// Deletions carry no timestamp.
+		now := time.Now()
+		for _, id := range deleted.IDs {
+			convertedUpdates = append(convertedUpdates, &model.EndpointUpdate{
+				Type: model.UpdateTypeDelete,
+				UniqueEndpointMessageID: model.UniqueEndpointMessageID{
+					EID: e.id,
+					ID:  model.EndpointMessageID(id),
+				},
+				Timestamp: now,
+			})
+		}
+
+	default:
+		return nil
+	}
+
+	for _, convertedUpdate := range convertedUpdates {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case updatesChan <- convertedUpdate:
+		}
+	}
+	return nil
+}
+
+// backfill fetches messages of the channel posted after the last seen one, oldest first.
+func (e *EndpointDiscord) backfill(ctx context.Context, updatesChan chan<- *model.EndpointUpdate) error {
+	for {
+		messages, err := e.client.channelMessages(ctx, e.channelID, e.lastSeenID, discordBackfillPageSize)
+		if err != nil {
+			return err
+		}
+		if len(messages) == 0 {
+			return nil
+		}
+
+		slog.Info("Backfilling Discord messages", "eid", e.id, "count", len(messages))
+
+		for _, message := range messages {
+			e.trackSeenMessage(message)
+			convertedUpdate, err := e.convertMessage(message, model.UpdateTypeNew)
+			if err != nil {
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case updatesChan <- convertedUpdate:
+			}
+		}
+	}
+}
+
+// trackSeenMessage records the latest message of the channel, so that backfill continues from it.
+func (e *EndpointDiscord) trackSeenMessage(message *discordMessage) {
+	// Snowflakes sort by time, the same way as note IDs.
+	if isNewerNoteID(message.ID, e.lastSeenID) {
+		e.lastSeenID = message.ID
+	}
+}
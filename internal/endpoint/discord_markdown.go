@@ -0,0 +1,344 @@
+package endpoint
+
+import (
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/merrkry/tele2don/internal/markdown"
+	"github.com/yuin/goldmark/ast"
+	east "github.com/yuin/goldmark/extension/ast"
+	"github.com/yuin/goldmark/util"
+)
+
+var (
+	// discordEscaper escapes characters which Discord would interpret as markdown anywhere in a line.
+	discordEscaper = strings.NewReplacer(
+		`\`, `\\`,
+		"*", `\*`,
+		"_", `\_`,
+		"~", `\~`,
+		"`", "\\`",
+		"|", `\|`,
+		"[", `\[`,
+		"]", `\]`,
+		"<", `\<`,
+	)
+	// discordLineStartPattern matches block syntax of Discord at the beginning of lines, i.e. quotes, headings,
+	// subtext and lists.
+	discordLineStartPattern = regexp.MustCompile(`(?m)^(?:>|#|-|\+|\d+\.)`)
+
+	// discordCodePattern matches code blocks and spans, whose content is left alone when converting from Discord.
+	discordCodePattern = regexp.MustCompile("(?s)```.*?```|`[^`]*`")
+	// discordUnderlinePattern matches __underline__, which is bold in bridge Markdown.
+	discordUnderlinePattern  = regexp.MustCompile(`__(\S(?:[^_]*\S)?)__`)
+	discordUserMentionRegexp = regexp.MustCompile(`<@!?(\d+)>`)
+	discordEmojiPattern      = regexp.MustCompile(`<a?(:\w+:)\d+>`)
+	discordTimestampPattern  = regexp.MustCompile(`<t:(-?\d+)(?::[tTdDfFR])?>`)
+	discordSubtextPattern    = regexp.MustCompile(`(?m)^-# `)
+)
+
+// renderDiscordText renders bridge Markdown for Discord, falling back to the mostly compatible raw Markdown.
+func renderDiscordText(md string) string {
+	text, err := markdownToDiscord(md)
+	if err != nil {
+		slog.Warn("Failed to render markdown for Discord, falling back to raw markdown", "err", err)
+		return md
+	}
+	return text
+}
+
+// discordTextBuilder renders goldmark AST as Discord markdown.
+type discordTextBuilder struct {
+	source []byte
+	text   *strings.Builder
+	// plain is text pending to be escaped, as text nodes are split at delimiters, and line starts are only known
+	// once the text around is written.
+	plain strings.Builder
+	// inCode is set inside code spans, which take text literally.
+	inCode bool
+}
+
+func markdownToDiscord(md string) (text string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic while rendering markdown: %v", r)
+		}
+	}()
+
+	doc, source := markdown.Parse(md)
+	b := &discordTextBuilder{source: source, text: &strings.Builder{}}
+	b.renderBlocks(doc, "\n\n")
+	b.flush()
+
+	return strings.TrimRight(b.text.String(), "\n"), nil
+}
+
+// write writes Discord markdown as is.
+func (b *discordTextBuilder) write(s string) {
+	b.flush()
+	b.text.WriteString(s)
+}
+
+// writeText buffers plain text, for flush to escape.
+func (b *discordTextBuilder) writeText(s string) {
+	b.plain.WriteString(s)
+}
+
+// flush writes pending plain text, escaping markdown outside of URLs.
+func (b *discordTextBuilder) flush() {
+	s := b.plain.String()
+	b.plain.Reset()
+
+	atLineStart := b.text.Len() == 0 || strings.HasSuffix(b.text.String(), "\n")
+	pos := 0
+	for _, match := range mastodonURLPattern.FindAllStringIndex(s, -1) {
+		b.text.WriteString(escapeDiscord(s[pos:match[0]], atLineStart && pos == 0))
+		b.text.WriteString(s[match[0]:match[1]])
+		pos = match[1]
+	}
+	b.text.WriteString(escapeDiscord(s[pos:], atLineStart && pos == 0))
+}
+
+// escapeDiscord escapes markdown of s. Block syntax at the beginning of s is only escaped if it's at a line start.
+func escapeDiscord(s string, atLineStart bool) string {
+	s = discordEscaper.Replace(s)
+
+	var b strings.Builder
+	pos := 0
+	for _, match := range discordLineStartPattern.FindAllStringIndex(s, -1) {
+		if match[0] == 0 && !atLineStart {
+			continue
+		}
+		b.WriteString(s[pos:match[0]])
+		// Ordered lists are escaped at the dot, as Discord takes escaped digits literally.
+		if s[match[1]-1] == '.' {
+			b.WriteString(s[match[0]:match[1]-1] + `\.`)
+		} else {
+			b.WriteString(`\` + s[match[0]:match[1]])
+		}
+		pos = match[1]
+	}
+	b.WriteString(s[pos:])
+	return b.String()
+}
+
+// sub returns what f renders, instead of writing it.
+func (b *discordTextBuilder) sub(f func()) string {
+	b.flush()
+	outer := b.text
+	b.text = &strings.Builder{}
+	f()
+	b.flush()
+	inner := b.text.String()
+	b.text = outer
+	return inner
+}
+
+func (b *discordTextBuilder) renderBlocks(parent ast.Node, separator string) {
+	for n := parent.FirstChild(); n != nil; n = n.NextSibling() {
+		if n != parent.FirstChild() {
+			b.write(separator)
+		}
+		b.renderBlock(n)
+	}
+}
+
+func (b *discordTextBuilder) renderBlock(n ast.Node) {
+	switch n := n.(type) {
+	case *ast.Paragraph, *ast.TextBlock:
+		b.renderInlines(n)
+
+	case *ast.Heading:
+		// Discord only has three levels of headings.
+		if n.Level <= 3 {
+			b.write(strings.Repeat("#", n.Level) + " ")
+			b.renderInlines(n)
+		} else {
+			b.wrap("**", func() { b.renderInlines(n) })
+		}
+
+	case *ast.ThematicBreak:
+		b.write("――――――――")
+
+	case *ast.FencedCodeBlock:
+		code := strings.TrimSuffix(b.lines(n), "\n")
+		fence := strings.Repeat("`", max(3, longestRun(code, '`')+1))
+		b.write(fence + string(n.Language(b.source)) + "\n" + code + "\n" + fence)
+
+	case *ast.CodeBlock:
+		code := strings.TrimSuffix(b.lines(n), "\n")
+		fence := strings.Repeat("`", max(3, longestRun(code, '`')+1))
+		b.write(fence + "\n" + code + "\n" + fence)
+
+	case *ast.Blockquote:
+		inner := b.sub(func() { b.renderBlocks(n, "\n\n") })
+		b.write("> " + strings.ReplaceAll(inner, "\n", "\n> "))
+
+	case *ast.List:
+		index := n.Start
+		for item := n.FirstChild(); item != nil; item = item.NextSibling() {
+			if item != n.FirstChild() {
+				b.write("\n")
+			}
+			if n.IsOrdered() {
+				b.write(strconv.Itoa(index) + ". ")
+				index++
+			} else {
+				b.write("- ")
+			}
+			inner := b.sub(func() { b.renderBlocks(item, "\n") })
+			b.write(strings.ReplaceAll(inner, "\n", "\n  "))
+		}
+
+	case *ast.HTMLBlock:
+		b.writeText(strings.TrimSuffix(b.lines(n), "\n"))
+
+	default:
+		if n.Type() == ast.TypeInline {
+			b.renderInline(n)
+		} else {
+			b.renderBlocks(n, "\n\n")
+		}
+	}
+}
+
+func (b *discordTextBuilder) lines(n ast.Node) string {
+	var s strings.Builder
+	lines := n.Lines()
+	for i := 0; i < lines.Len(); i++ {
+		line := lines.At(i)
+		s.Write(line.Value(b.source))
+	}
+	return s.String()
+}
+
+// wrap renders the content produced by f with mark around it, unless it's empty.
+func (b *discordTextBuilder) wrap(mark string, f func()) {
+	inner := b.sub(f)
+	var s strings.Builder
+	writeInlineMark(&s, mark, inner)
+	b.write(s.String())
+}
+
+func (b *discordTextBuilder) renderInlines(parent ast.Node) {
+	for n := parent.FirstChild(); n != nil; n = n.NextSibling() {
+		b.renderInline(n)
+	}
+}
+
+func (b *discordTextBuilder) renderInline(n ast.Node) {
+	switch n := n.(type) {
+	case *ast.Text:
+		value := n.Segment.Value(b.source)
+		if b.inCode {
+			b.write(string(value))
+		} else {
+			value = util.UnescapePunctuations(value)
+			value = util.ResolveNumericReferences(value)
+			value = util.ResolveEntityNames(value)
+			b.writeText(string(value))
+		}
+		if n.SoftLineBreak() || n.HardLineBreak() {
+			b.write("\n")
+		}
+
+	case *ast.String:
+		b.writeText(string(n.Value))
+
+	case *ast.Emphasis:
+		if n.Level >= 2 {
+			b.wrap("**", func() { b.renderInlines(n) })
+		} else {
+			b.wrap("*", func() { b.renderInlines(n) })
+		}
+
+	case *east.Strikethrough:
+		b.wrap("~~", func() { b.renderInlines(n) })
+
+	case *markdown.Spoiler:
+		b.wrap("||", func() { b.renderInlines(n) })
+
+	case *ast.CodeSpan:
+		code := b.sub(func() {
+			b.inCode = true
+			b.renderInlines(n)
+			b.inCode = false
+		})
+		var s strings.Builder
+		writeInlineCode(&s, code)
+		b.write(s.String())
+
+	case *ast.Link:
+		b.renderLink(n, string(n.Destination))
+
+	case *ast.Image:
+		b.renderLink(n, string(n.Destination))
+
+	case *ast.AutoLink:
+		b.write(string(n.Label(b.source)))
+
+	case *ast.RawHTML:
+		for i := 0; i < n.Segments.Len(); i++ {
+			segment := n.Segments.At(i)
+			b.writeText(string(segment.Value(b.source)))
+		}
+
+	default:
+		b.renderInlines(n)
+	}
+}
+
+func (b *discordTextBuilder) renderLink(n ast.Node, destination string) {
+	label := b.sub(func() { b.renderInlines(n) })
+	// Links whose text is the URL itself are detected by Discord, which only masks http(s) links.
+	if label == "" || label == destination || !strings.HasPrefix(destination, "http") {
+		if label == "" {
+			label = destination
+		}
+		b.write(label)
+		return
+	}
+	b.write("[" + label + "](" + markdownURLEscaper.Replace(destination) + ")")
+}
+
+// discordToMarkdown converts Discord markdown, mostly CommonMark, to bridge Markdown.
+func discordToMarkdown(content string, message *discordMessage) string {
+	usernames := make(map[string]string, len(message.Mentions))
+	for _, user := range message.Mentions {
+		usernames[user.ID] = user.Username
+	}
+
+	convert := func(s string) string {
+		s = discordUnderlinePattern.ReplaceAllString(s, "$1")
+		s = discordSubtextPattern.ReplaceAllString(s, "")
+		s = discordEmojiPattern.ReplaceAllString(s, "$1")
+		s = discordUserMentionRegexp.ReplaceAllStringFunc(s, func(match string) string {
+			id := discordUserMentionRegexp.FindStringSubmatch(match)[1]
+			if username, ok := usernames[id]; ok {
+				return "@" + escapeMarkdown(username, '@', unknownNeighbor)
+			}
+			return match
+		})
+		return discordTimestampPattern.ReplaceAllStringFunc(s, func(match string) string {
+			ts, err := strconv.ParseInt(discordTimestampPattern.FindStringSubmatch(match)[1], 10, 64)
+			if err != nil {
+				return match
+			}
+			return time.Unix(ts, 0).UTC().Format("2006-01-02 15:04 UTC")
+		})
+	}
+
+	var b strings.Builder
+	pos := 0
+	for _, match := range discordCodePattern.FindAllStringIndex(content, -1) {
+		b.WriteString(convert(content[pos:match[0]]))
+		b.WriteString(content[match[0]:match[1]])
+		pos = match[1]
+	}
+	b.WriteString(convert(content[pos:]))
+	return b.String()
+}
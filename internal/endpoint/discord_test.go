@@ -0,0 +1,450 @@
+package endpoint
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf16"
+
+	"github.com/gorilla/websocket"
+	"github.com/merrkry/tele2don/internal/model"
+)
+
+const (
+	testDiscordBotID     = "100"
+	testDiscordWebhookID = "200"
+	testDiscordChannelID = "300"
+	testDiscordToken     = "secret"
+	testDiscordWebhook   = "/api/webhooks/" + testDiscordWebhookID + "/token"
+)
+
+// discordRequest is a request received by fakeDiscord.
+type discordRequest struct {
+	method string
+	path   string
+	// authorized is whether the request carries the bot token.
+	authorized bool
+	params     map[string]any
+}
+
+// fakeDiscord implements the REST routes used by the Discord endpoint, and a gateway sending dispatch events.
+type fakeDiscord struct {
+	t *testing.T
+
+	mu       sync.Mutex
+	requests []discordRequest
+	nextID   int
+	// dispatches are sent to the gateway connection after IDENTIFY.
+	dispatches []discordGatewayPayload
+}
+
+func newFakeDiscord(t *testing.T) (*fakeDiscord, *httptest.Server) {
+	d := &fakeDiscord{t: t, nextID: 1000}
+	srv := httptest.NewServer(d)
+	t.Cleanup(srv.Close)
+	return d, srv
+}
+
+func (d *fakeDiscord) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/gateway/" {
+		d.serveGateway(w, r)
+		return
+	}
+
+	req := discordRequest{
+		method:     r.Method,
+		path:       r.URL.Path,
+		authorized: r.Header.Get("Authorization") == "Bot "+testDiscordToken,
+	}
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/") {
+		if err := json.Unmarshal([]byte(r.FormValue("payload_json")), &req.params); err != nil {
+			d.t.Errorf("invalid payload_json: %v", err)
+		}
+	} else if r.Body != nil && r.Method != http.MethodGet && r.Method != http.MethodDelete {
+		if err := json.NewDecoder(r.Body).Decode(&req.params); err != nil {
+			d.t.Errorf("invalid request body of %s %s: %v", r.Method, r.URL.Path, err)
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.requests = append(d.requests, req)
+
+	messages := "/api/v10/channels/" + testDiscordChannelID + "/messages"
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	switch {
+	case r.URL.Path == "/api/v10/users/@me":
+		d.reply(w, map[string]string{"id": testDiscordBotID})
+	case r.URL.Path == "/api/v10/gateway/bot":
+		d.reply(w, map[string]string{"url": "ws://" + r.Host + "/gateway"})
+	case r.URL.Path == messages && r.Method == http.MethodGet:
+		d.reply(w, []any{})
+	case r.URL.Path == testDiscordWebhook && r.Method == http.MethodGet:
+		d.reply(w, map[string]string{"id": testDiscordWebhookID, "channel_id": testDiscordChannelID})
+	case (r.URL.Path == messages || r.URL.Path == testDiscordWebhook) && r.Method == http.MethodPost:
+		d.nextID++
+		d.reply(w, map[string]any{"id": fmt.Sprint(d.nextID), "channel_id": testDiscordChannelID, "timestamp": now})
+	case r.Method == http.MethodPatch:
+		id := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+		d.reply(w, map[string]any{"id": id, "channel_id": testDiscordChannelID, "timestamp": now, "edited_timestamp": now})
+	case r.Method == http.MethodDelete:
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		d.t.Errorf("unexpected request %s %s", r.Method, r.URL.Path)
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (d *fakeDiscord) reply(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		d.t.Errorf("failed to encode response: %v", err)
+	}
+}
+
+func (d *fakeDiscord) serveGateway(w http.ResponseWriter, r *http.Request) {
+	conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+	if err != nil {
+		d.t.Errorf("failed to upgrade gateway connection: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	err = conn.WriteJSON(map[string]any{"op": discordOpHello, "d": map[string]any{"heartbeat_interval": 45000}})
+	if err != nil {
+		return
+	}
+	var identify struct {
+		Op int `json:"op"`
+		D  struct {
+			Token   string `json:"token"`
+			Intents int    `json:"intents"`
+		} `json:"d"`
+	}
+	if err := conn.ReadJSON(&identify); err != nil {
+		return
+	}
+	if identify.Op != discordOpIdentify || identify.D.Token != testDiscordToken || identify.D.Intents != discordGatewayIntents {
+		d.t.Errorf("unexpected IDENTIFY %+v", identify)
+	}
+
+	d.mu.Lock()
+	dispatches := d.dispatches
+	d.mu.Unlock()
+	for i, payload := range dispatches {
+		seq := int64(i + 1)
+		payload.Op = discordOpDispatch
+		payload.S = &seq
+		if err := conn.WriteJSON(payload); err != nil {
+			return
+		}
+	}
+
+	// Keep the connection open until the client goes away.
+	for {
+		if _, _, err := conn.ReadMessage(); err != nil {
+			return
+		}
+	}
+}
+
+func (d *fakeDiscord) messageRequests() []discordRequest {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var requests []discordRequest
+	for _, req := range d.requests {
+		if req.method != http.MethodGet {
+			requests = append(requests, req)
+		}
+	}
+	return requests
+}
+
+// newTestDiscordEndpoint initializes an endpoint against the fake, posting through a webhook if webhook is set.
+func newTestDiscordEndpoint(t *testing.T, srv *httptest.Server, webhook bool) *EndpointDiscord {
+	t.Helper()
+	e := NewEndpointDiscord("discord")
+	cfg := &EndpointConfigDiscord{BotToken: testDiscordToken, ChannelID: testDiscordChannelID}
+	if webhook {
+		cfg.WebhookURL = srv.URL + testDiscordWebhook
+	}
+	if err := cfg.validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Initialize always talks to discord.com, so the client is pointed at the fake before verifying credentials.
+	e.client = newDiscordClient(cfg.BotToken, cfg.WebhookURL, &e.status)
+	e.client.apiBase = srv.URL + "/api/v10"
+	e.channelID = cfg.ChannelID
+
+	userID, err := e.client.me(context.Background())
+	if err != nil {
+		t.Fatalf("me: %v", err)
+	}
+	e.userID = userID
+	if webhook {
+		webhookID, channelID, err := e.client.webhook(context.Background())
+		if err != nil || channelID != testDiscordChannelID {
+			t.Fatalf("webhook: %q, %v", channelID, err)
+		}
+		e.webhookID = webhookID
+	}
+	return e
+}
+
+func discordDispatch(t *testing.T, typ string, d any) discordGatewayPayload {
+	t.Helper()
+	data, err := json.Marshal(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return discordGatewayPayload{T: typ, D: data}
+}
+
+func discordTestMessage(id, authorID, content string) map[string]any {
+	return map[string]any{
+		"id":         id,
+		"channel_id": testDiscordChannelID,
+		"type":       discordMessageTypeDefault,
+		"author":     map[string]any{"id": authorID, "username": "user" + authorID},
+		"content":    content,
+		"timestamp":  "2024-01-01T00:00:00Z",
+	}
+}
+
+func TestDiscordListenUpdates(t *testing.T) {
+	d, srv := newFakeDiscord(t)
+	e := newTestDiscordEndpoint(t, srv, true)
+
+	reply := discordTestMessage("2", "400", "a reply")
+	reply["type"] = discordMessageTypeReply
+	reply["message_reference"] = map[string]any{"message_id": "1"}
+	edited := discordTestMessage("1", "400", "edited **text**")
+	edited["edited_timestamp"] = "2024-01-01T00:01:00Z"
+	// Embeds being resolved are updates without edited_timestamp.
+	embed := discordTestMessage("1", "400", "edited **text**")
+	otherChannel := discordTestMessage("9", "400", "elsewhere")
+	otherChannel["channel_id"] = "999"
+	webhookMessage := discordTestMessage("8", testDiscordWebhookID, "bridged")
+	webhookMessage["webhook_id"] = testDiscordWebhookID
+
+	d.dispatches = []discordGatewayPayload{
+		discordDispatch(t, "READY", map[string]any{}),
+		discordDispatch(t, "MESSAGE_CREATE", discordTestMessage("1", "400", "hello *world*")),
+		discordDispatch(t, "MESSAGE_CREATE", discordTestMessage("7", testDiscordBotID, "sent by the bot")),
+		discordDispatch(t, "MESSAGE_CREATE", webhookMessage),
+		discordDispatch(t, "MESSAGE_CREATE", otherChannel),
+		discordDispatch(t, "MESSAGE_CREATE", reply),
+		discordDispatch(t, "MESSAGE_UPDATE", embed),
+		discordDispatch(t, "MESSAGE_UPDATE", edited),
+		discordDispatch(t, "MESSAGE_DELETE", map[string]any{"id": "2", "channel_id": testDiscordChannelID}),
+		discordDispatch(t, "MESSAGE_DELETE_BULK", map[string]any{"ids": []string{"5", "6"}, "channel_id": testDiscordChannelID}),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	updates := make(chan *model.EndpointUpdate, 16)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go e.ListenUpdates(ctx, updates, &wg)
+
+	want := []struct {
+		typ    model.EndpointUpdateType
+		id     model.EndpointMessageID
+		text   string
+		parent model.EndpointMessageID
+	}{
+		{model.UpdateTypeNew, "1", "hello *world*", ""},
+		{model.UpdateTypeNew, "2", "a reply", "1"},
+		{model.UpdateTypeEdit, "1", "edited **text**", ""},
+		{model.UpdateTypeDelete, "2", "", ""},
+		{model.UpdateTypeDelete, "5", "", ""},
+		{model.UpdateTypeDelete, "6", "", ""},
+	}
+	var got []*model.EndpointUpdate
+	for len(got) < len(want) {
+		select {
+		case update := <-updates:
+			got = append(got, update)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %d updates, want %d", len(got), len(want))
+		}
+	}
+	cancel()
+	wg.Wait()
+
+	for i, w := range want {
+		update := got[i]
+		if update.Type != w.typ || update.ID != w.id || update.EID != "discord" {
+			t.Errorf("update %d = %v %s/%s, want %v %s", i, update.Type, update.EID, update.ID, w.typ, w.id)
+			continue
+		}
+		if w.text != "" && (update.Content == nil || update.Content.MDText != w.text) {
+			t.Errorf("update %d content = %+v, want %q", i, update.Content, w.text)
+		}
+		var parent model.EndpointMessageID
+		if update.Parent != nil {
+			parent = update.Parent.ID
+		}
+		if parent != w.parent {
+			t.Errorf("update %d parent = %q, want %q", i, parent, w.parent)
+		}
+	}
+	if got[2].Timestamp != time.Date(2024, 1, 1, 0, 1, 0, 0, time.UTC) {
+		t.Errorf("edit timestamp = %v, want edited_timestamp", got[2].Timestamp)
+	}
+	select {
+	case update := <-updates:
+		t.Errorf("unexpected update %v %s", update.Type, update.ID)
+	default:
+	}
+}
+
+// longMarkdownText returns bridge Markdown of paragraphs adding up to about n characters.
+func longMarkdownText(n int) string {
+	var paragraphs []string
+	for i := 0; len(strings.Join(paragraphs, "\n\n")) < n; i++ {
+		paragraphs = append(paragraphs, strings.Repeat(fmt.Sprintf("word%d ", i%10), 50))
+	}
+	return strings.Join(paragraphs, "\n\n")
+}
+
+func TestDiscordSendSplitsMessages(t *testing.T) {
+	for _, webhook := range []bool{false, true} {
+		t.Run(fmt.Sprintf("webhook=%v", webhook), func(t *testing.T) {
+			d, srv := newFakeDiscord(t)
+			e := newTestDiscordEndpoint(t, srv, webhook)
+
+			revisions, err := e.ApplyUpdateNew(context.Background(), &model.BridgeMessageContent{MDText: longMarkdownText(4500)}, "42")
+			if err != nil {
+				t.Fatalf("ApplyUpdateNew: %v", err)
+			}
+
+			requests := d.messageRequests()
+			if len(requests) != 3 || len(revisions) != 3 {
+				t.Fatalf("sent %d messages with %d revisions, want 3", len(requests), len(revisions))
+			}
+			var total int
+			for i, req := range requests {
+				wantPath := "/api/v10/channels/" + testDiscordChannelID + "/messages"
+				if webhook {
+					wantPath = testDiscordWebhook
+				}
+				if req.method != http.MethodPost || req.path != wantPath {
+					t.Errorf("message %d sent by %s %s, want POST %s", i, req.method, req.path, wantPath)
+				}
+				// Webhook URLs are authorized by their token, the bot token must not leak to them.
+				if req.authorized == webhook {
+					t.Errorf("message %d authorized = %v, want %v", i, req.authorized, !webhook)
+				}
+
+				content, _ := req.params["content"].(string)
+				length := len(utf16.Encode([]rune(content)))
+				if length > discordMaxMessageLength {
+					t.Errorf("message %d is %d characters long", i, length)
+				}
+				total += length
+
+				reference, hasReference := req.params["message_reference"].(map[string]any)
+				switch {
+				case webhook && hasReference:
+					t.Errorf("message %d replies through a webhook", i)
+				case !webhook && i == 0 && reference["message_id"] != "42":
+					t.Errorf("first message replies to %v, want 42", reference["message_id"])
+				case !webhook && i > 0 && reference["message_id"] != string(revisions[i-1].ID):
+					t.Errorf("message %d replies to %v, want %s", i, reference["message_id"], revisions[i-1].ID)
+				}
+			}
+			if total < 4000 {
+				t.Errorf("sent %d characters in total, want all of the text", total)
+			}
+		})
+	}
+}
+
+func TestDiscordLength(t *testing.T) {
+	tests := []struct {
+		md   string
+		want int
+	}{
+		{"plain", 5},
+		// Markup is sent as is, and counts.
+		{"**bold** [link](https://example.com)", 36},
+		{"漢字 😀", 5},
+	}
+
+	for _, tt := range tests {
+		if got := discordLength(tt.md); got != tt.want {
+			t.Errorf("discordLength(%q) = %d, want %d", tt.md, got, tt.want)
+		}
+	}
+}
+
+func TestDiscordEditAndDelete(t *testing.T) {
+	for _, webhook := range []bool{false, true} {
+		t.Run(fmt.Sprintf("webhook=%v", webhook), func(t *testing.T) {
+			d, srv := newFakeDiscord(t)
+			e := newTestDiscordEndpoint(t, srv, webhook)
+			messagePath := func(id string) string {
+				if webhook {
+					return testDiscordWebhook + "/messages/" + id
+				}
+				return "/api/v10/channels/" + testDiscordChannelID + "/messages/" + id
+			}
+
+			// Shrinking the text deletes trailing messages.
+			ids := []model.EndpointMessageID{"1", "2", "3"}
+			revisions, err := e.ApplyUpdateEdit(context.Background(), ids, &model.BridgeMessageContent{MDText: "short"})
+			if err != nil {
+				t.Fatalf("ApplyUpdateEdit: %v", err)
+			}
+			if len(revisions) != 1 || revisions[0].ID != "1" {
+				t.Errorf("revisions = %+v, want 1", revisions)
+			}
+
+			// Growing it posts new ones.
+			revisions, err = e.ApplyUpdateEdit(context.Background(), ids[:1], &model.BridgeMessageContent{MDText: longMarkdownText(2500)})
+			if err != nil {
+				t.Fatalf("ApplyUpdateEdit: %v", err)
+			}
+			if len(revisions) != 2 || revisions[0].ID != "1" {
+				t.Errorf("revisions = %+v, want 1 and a new message", revisions)
+			}
+
+			err = e.ApplyUpdateDelete(context.Background(), "1")
+			if err != nil {
+				t.Fatalf("ApplyUpdateDelete: %v", err)
+			}
+
+			postPath := "/api/v10/channels/" + testDiscordChannelID + "/messages"
+			if webhook {
+				postPath = testDiscordWebhook
+			}
+			want := []struct{ method, path string }{
+				{http.MethodPatch, messagePath("1")},
+				{http.MethodDelete, messagePath("2")},
+				{http.MethodDelete, messagePath("3")},
+				{http.MethodPatch, messagePath("1")},
+				{http.MethodPost, postPath},
+				{http.MethodDelete, messagePath("1")},
+			}
+			requests := d.messageRequests()
+			if len(requests) != len(want) {
+				t.Fatalf("sent %d requests, want %d", len(requests), len(want))
+			}
+			for i, w := range want {
+				if requests[i].method != w.method || requests[i].path != w.path {
+					t.Errorf("request %d = %s %s, want %s %s", i, requests[i].method, requests[i].path, w.method, w.path)
+				}
+				if requests[i].authorized == webhook {
+					t.Errorf("request %d authorized = %v, want %v", i, requests[i].authorized, !webhook)
+				}
+			}
+		})
+	}
+}
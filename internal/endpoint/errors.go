@@ -0,0 +1,33 @@
+package endpoint
+
+import (
+	"fmt"
+	"time"
+)
+
+// RetryAfterError is returned when the platform rate limits requests, and tells when to retry.
+type RetryAfterError struct {
+	RetryAfter time.Duration
+	Err        error
+}
+
+func (e *RetryAfterError) Error() string {
+	return fmt.Sprintf("%v (retry after %s)", e.Err, e.RetryAfter)
+}
+
+func (e *RetryAfterError) Unwrap() error {
+	return e.Err
+}
+
+// PermanentError is returned for failures that retrying won't resolve, e.g. rejected content or missing permissions.
+type PermanentError struct {
+	Err error
+}
+
+func (e *PermanentError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *PermanentError) Unwrap() error {
+	return e.Err
+}
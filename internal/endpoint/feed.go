@@ -0,0 +1,431 @@
+package endpoint
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/merrkry/tele2don/internal/config"
+	"github.com/merrkry/tele2don/internal/model"
+)
+
+const (
+	defaultFeedMaxEntries = 50
+	defaultFeedAtomPath   = "/atom.xml"
+	defaultFeedRSSPath    = "/rss.xml"
+	// feedPruneInterval is how often entries past retention are dropped, if there are no updates meanwhile.
+	feedPruneInterval = time.Hour
+)
+
+type EndpointConfigFeed struct {
+	Title string `json:"title"`
+	// URL is the public address of the Atom feed, which identifies the feed and its entries.
+	URL string `json:"url"`
+	// Link is the website the feed belongs to, it defaults to URL.
+	Link        string `json:"link"`
+	Description string `json:"description"`
+
+	// StorePath is the file keeping entries across restarts.
+	StorePath string `json:"store_path"`
+	// MaxEntries is the number of latest entries in the feed, older ones are dropped.
+	MaxEntries int `json:"max_entries"`
+	// Retention drops entries published longer ago than it. Entries are only dropped by MaxEntries if 0.
+	Retention config.Duration `json:"retention"`
+
+	// Listen is the local address serving the feeds at AtomPath and RSSPath, disabled if empty.
+	Listen   string `json:"listen"`
+	AtomPath string `json:"atom_path"`
+	RSSPath  string `json:"rss_path"`
+	// AtomFile and RSSFile are written on every change, e.g. to be served by a web server. Disabled if empty.
+	AtomFile string `json:"atom_file"`
+	RSSFile  string `json:"rss_file"`
+}
+
+func (c *EndpointConfigFeed) validate() error {
+	if c.Title == "" {
+		return fmt.Errorf("title: required")
+	}
+	u, err := url.Parse(c.URL)
+	if err != nil {
+		return fmt.Errorf("url: %w", err)
+	}
+	if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("url: must be an absolute http(s) URL, got %q", c.URL)
+	}
+	if c.Link != "" {
+		u, err := url.Parse(c.Link)
+		if err != nil {
+			return fmt.Errorf("link: %w", err)
+		}
+		if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+			return fmt.Errorf("link: must be an absolute http(s) URL, got %q", c.Link)
+		}
+	}
+	if c.StorePath == "" {
+		return fmt.Errorf("store_path: required")
+	}
+	if c.MaxEntries < 0 {
+		return fmt.Errorf("max_entries: must not be negative")
+	}
+	if c.Retention < 0 {
+		return fmt.Errorf("retention: must not be negative")
+	}
+	if c.Listen == "" && c.AtomFile == "" && c.RSSFile == "" {
+		return fmt.Errorf("listen: required unless atom_file or rss_file is set")
+	}
+	if c.Listen != "" {
+		if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+			return fmt.Errorf("listen: %w", err)
+		}
+		if c.AtomPath == "" {
+			c.AtomPath = defaultFeedAtomPath
+		}
+		if c.RSSPath == "" {
+			c.RSSPath = defaultFeedRSSPath
+		}
+		if !strings.HasPrefix(c.AtomPath, "/") {
+			return fmt.Errorf("atom_path: must start with /")
+		}
+		if !strings.HasPrefix(c.RSSPath, "/") {
+			return fmt.Errorf("rss_path: must start with /")
+		}
+		if c.AtomPath == c.RSSPath {
+			return fmt.Errorf("rss_path: must differ from atom_path")
+		}
+	}
+	return nil
+}
+
+// feedEntry is a bridged message kept in the feed. Content is kept as bridge Markdown, and rendered when publishing.
+type feedEntry struct {
+	ID          string    `json:"id"`
+	Published   time.Time `json:"published"`
+	Updated     time.Time `json:"updated"`
+	MDText      string    `json:"md_text"`
+	SpoilerText string    `json:"spoiler_text,omitempty"`
+	Language    string    `json:"language,omitempty"`
+	// Attachments is the number of attachments, which are not included in the feed.
+	Attachments int `json:"attachments,omitempty"`
+}
+
+// feedStore is the persisted state of the feed.
+type feedStore struct {
+	// NextID numbers entries, so that IDs are never reused, even after entries are dropped.
+	NextID int64 `json:"next_id"`
+	// Updated is the last time the feed changed.
+	Updated time.Time `json:"updated"`
+	// Entries are ordered newest first.
+	Entries []*feedEntry `json:"entries"`
+}
+
+// EndpointFeed publishes bridged messages as Atom and RSS feeds. It's write-only, as feeds have nothing to bridge back.
+// Message IDs are numbers of the entries.
+type EndpointFeed struct {
+	id  model.EndpointID
+	cfg *EndpointConfigFeed
+
+	maxEntries int
+	retention  time.Duration
+
+	status statusTracker
+
+	mu    sync.Mutex
+	store *feedStore
+	// atom and rss are the rendered feeds, served over HTTP.
+	atom, rss []byte
+}
+
+func NewEndpointFeed(id model.EndpointID) *EndpointFeed {
+	return &EndpointFeed{
+		id: id,
+	}
+}
+
+func (e *EndpointFeed) ID() model.EndpointID {
+	return e.id
+}
+
+func (e *EndpointFeed) Initialize(ctx context.Context, cfg *EndpointConfig) error {
+	e.cfg = cfg.Feed
+	e.maxEntries = cfg.Feed.MaxEntries
+	if e.maxEntries == 0 {
+		e.maxEntries = defaultFeedMaxEntries
+	}
+	e.retention = time.Duration(cfg.Feed.Retention)
+
+	store, err := loadFeedStore(cfg.Feed.StorePath)
+	if err != nil {
+		return err
+	}
+	e.store = store
+
+	// Feeds are published right away, so that config changes show up without waiting for a message.
+	e.prune(e.store, time.Now())
+	err = e.publish()
+	if err != nil {
+		return err
+	}
+
+	e.status.setInitialized()
+	return nil
+}
+
+func (e *EndpointFeed) Status() Status {
+	return e.status.status()
+}
+
+// loadFeedStore loads entries kept at path, a missing file is an empty feed.
+func loadFeedStore(path string) (*feedStore, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return &feedStore{NextID: 1, Updated: time.Now()}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read feed store: %w", err)
+	}
+
+	store := &feedStore{}
+	err = json.Unmarshal(data, store)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode feed store %s: %w", path, err)
+	}
+	return store, nil
+}
+
+// prune drops entries of store past retention, or exceeding the maximum number of entries.
+func (e *EndpointFeed) prune(store *feedStore, now time.Time) {
+	if len(store.Entries) > e.maxEntries {
+		store.Entries = store.Entries[:e.maxEntries]
+	}
+	if e.retention > 0 {
+		store.Entries = slices.DeleteFunc(store.Entries, func(entry *feedEntry) bool {
+			return now.Sub(entry.Published) > e.retention
+		})
+	}
+}
+
+// expired reports whether the oldest entry is past retention, which happens without any update.
+func (e *EndpointFeed) expired(now time.Time) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	entries := e.store.Entries
+	return e.retention > 0 && len(entries) > 0 && now.Sub(entries[len(entries)-1].Published) > e.retention
+}
+
+// change applies f to a copy of the store, then persists it and publishes the feeds.
+// The store is left as it was if it can't be persisted, so that retried deliveries don't apply f twice.
+func (e *EndpointFeed) change(f func(store *feedStore, now time.Time)) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	now := time.Now()
+	store := &feedStore{
+		NextID:  e.store.NextID,
+		Updated: now,
+		Entries: make([]*feedEntry, 0, len(e.store.Entries)+1),
+	}
+	for _, entry := range e.store.Entries {
+		entryCopy := *entry
+		store.Entries = append(store.Entries, &entryCopy)
+	}
+	f(store, now)
+	e.prune(store, now)
+
+	data, err := json.Marshal(store)
+	if err != nil {
+		return err
+	}
+	err = writeFileAtomic(e.cfg.StorePath, data, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to write feed store: %w", err)
+	}
+	e.store = store
+
+	// The change is kept anyway, feeds are published again on the next one.
+	err = e.publish()
+	if err != nil {
+		slog.Error("Failed to publish feed", "eid", e.id, "err", err)
+	}
+	return nil
+}
+
+// publish renders the feeds, and writes them to files if configured. The caller must hold mu.
+func (e *EndpointFeed) publish() error {
+	atom, err := renderAtomFeed(e.cfg, e.store)
+	if err != nil {
+		return fmt.Errorf("failed to render Atom feed: %w", err)
+	}
+	rss, err := renderRSSFeed(e.cfg, e.store)
+	if err != nil {
+		return fmt.Errorf("failed to render RSS feed: %w", err)
+	}
+	e.atom, e.rss = atom, rss
+
+	if e.cfg.AtomFile != "" {
+		err := writeFileAtomic(e.cfg.AtomFile, atom, 0o644)
+		if err != nil {
+			return fmt.Errorf("failed to write Atom feed: %w", err)
+		}
+	}
+	if e.cfg.RSSFile != "" {
+		err := writeFileAtomic(e.cfg.RSSFile, rss, 0o644)
+		if err != nil {
+			return fmt.Errorf("failed to write RSS feed: %w", err)
+		}
+	}
+	return nil
+}
+
+// ApplyUpdateNew adds content as the newest entry. Replies are added as entries of their own, as feeds have no threads.
+func (e *EndpointFeed) ApplyUpdateNew(ctx context.Context, content *model.BridgeMessageContent, replyTo model.EndpointMessageID) ([]model.EndpointMessageRevision, error) {
+	var entry *feedEntry
+	err := e.change(func(store *feedStore, now time.Time) {
+		entry = &feedEntry{
+			ID:        strconv.FormatInt(store.NextID, 10),
+			Published: now,
+		}
+		entry.setContent(content, now)
+		store.NextID++
+		store.Entries = slices.Insert(store.Entries, 0, entry)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	slog.Debug("Entry added to feed", "id", entry.ID)
+
+	return []model.EndpointMessageRevision{{ID: model.EndpointMessageID(entry.ID), Timestamp: entry.Published}}, nil
+}
+
+func (entry *feedEntry) setContent(content *model.BridgeMessageContent, now time.Time) {
+	entry.Updated = now
+	entry.MDText = content.MDText
+	entry.SpoilerText = content.SpoilerText
+	entry.Language = content.Language
+	entry.Attachments = len(content.Attachments)
+}
+
+// ApplyUpdateEdit updates the entry in place. Edits of entries already dropped from the feed are ignored.
+func (e *EndpointFeed) ApplyUpdateEdit(ctx context.Context, ids []model.EndpointMessageID, content *model.BridgeMessageContent) ([]model.EndpointMessageRevision, error) {
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("no feed entry to edit")
+	}
+
+	var updated time.Time
+	err := e.change(func(store *feedStore, now time.Time) {
+		updated = now
+		for _, entry := range store.Entries {
+			if entry.ID == string(ids[0]) {
+				entry.setContent(content, now)
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	slog.Debug("Entry updated in feed", "id", ids[0])
+
+	return []model.EndpointMessageRevision{{ID: ids[0], Timestamp: updated}}, nil
+}
+
+// ApplyUpdateDelete drops the entry from the feed.
+func (e *EndpointFeed) ApplyUpdateDelete(ctx context.Context, id model.EndpointMessageID) error {
+	err := e.change(func(store *feedStore, now time.Time) {
+		store.Entries = slices.DeleteFunc(store.Entries, func(entry *feedEntry) bool {
+			return entry.ID == string(id)
+		})
+	})
+	if err != nil {
+		return err
+	}
+
+	slog.Debug("Entry deleted from feed", "id", id)
+
+	return nil
+}
+
+// Run serves the feeds over HTTP if configured, and drops entries as they expire until ctx is done.
+func (e *EndpointFeed) Run(ctx context.Context, wg *sync.WaitGroup) {
+	defer wg.Done()
+	e.status.setListening(true)
+	defer e.status.setListening(false)
+
+	if e.cfg.Listen != "" {
+		stop, err := e.serveHTTP()
+		if err != nil {
+			slog.Error("Failed to serve feed", "eid", e.id, "err", err)
+			return
+		}
+		defer stop()
+	}
+
+	ticker := time.NewTicker(feedPruneInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			if !e.expired(now) {
+				continue
+			}
+			err := e.change(func(store *feedStore, now time.Time) {})
+			if err != nil {
+				slog.Error("Failed to drop expired feed entries", "eid", e.id, "err", err)
+			}
+		}
+	}
+}
+
+// serveHTTP serves the feeds in the background, and returns the function to stop serving.
+func (e *EndpointFeed) serveHTTP() (func(), error) {
+	listener, err := net.Listen("tcp", e.cfg.Listen)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", e.cfg.Listen, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET "+e.cfg.AtomPath, e.handleFeed("application/atom+xml; charset=utf-8", func() []byte { return e.atom }))
+	mux.HandleFunc("GET "+e.cfg.RSSPath, e.handleFeed("application/rss+xml; charset=utf-8", func() []byte { return e.rss }))
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Feed server failed", "eid", e.id, "err", err)
+		}
+	}()
+	slog.Info("Serving feed", "eid", e.id, "addr", listener.Addr(), "atom", e.cfg.AtomPath, "rss", e.cfg.RSSPath)
+
+	return func() {
+		server.Close()
+	}, nil
+}
+
+// handleFeed serves the feed returned by feed, supporting conditional requests by the time the feed was updated.
+func (e *EndpointFeed) handleFeed(contentType string, feed func() []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		e.mu.Lock()
+		data, updated := feed(), e.store.Updated
+		e.mu.Unlock()
+
+		w.Header().Set("Content-Type", contentType)
+		http.ServeContent(w, r, "", updated, bytes.NewReader(data))
+	}
+}
@@ -0,0 +1,199 @@
+package endpoint
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"html"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/merrkry/tele2don/internal/markdown"
+)
+
+// feedTitleLength is the length of entry titles taken from the text, in characters.
+const feedTitleLength = 80
+
+type atomFeed struct {
+	XMLName  xml.Name    `xml:"http://www.w3.org/2005/Atom feed"`
+	ID       string      `xml:"id"`
+	Title    string      `xml:"title"`
+	Subtitle string      `xml:"subtitle,omitempty"`
+	Updated  string      `xml:"updated"`
+	Links    []atomLink  `xml:"link"`
+	Author   atomAuthor  `xml:"author"`
+	Entries  []atomEntry `xml:"entry"`
+}
+
+type atomLink struct {
+	Rel  string `xml:"rel,attr,omitempty"`
+	Type string `xml:"type,attr,omitempty"`
+	Href string `xml:"href,attr"`
+}
+
+type atomAuthor struct {
+	Name string `xml:"name"`
+}
+
+type atomEntry struct {
+	ID        string      `xml:"id"`
+	Title     string      `xml:"title"`
+	Published string      `xml:"published"`
+	Updated   string      `xml:"updated"`
+	Content   atomContent `xml:"content"`
+}
+
+type atomContent struct {
+	Type string `xml:"type,attr"`
+	Lang string `xml:"http://www.w3.org/XML/1998/namespace lang,attr,omitempty"`
+	Body string `xml:",chardata"`
+}
+
+type rssFeed struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Channel rssChannel `xml:"channel"`
+}
+
+type rssChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	LastBuildDate string    `xml:"lastBuildDate"`
+	Items         []rssItem `xml:"item"`
+}
+
+type rssItem struct {
+	Title       string  `xml:"title"`
+	Description string  `xml:"description"`
+	PubDate     string  `xml:"pubDate"`
+	GUID        rssGUID `xml:"guid"`
+}
+
+type rssGUID struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	ID          string `xml:",chardata"`
+}
+
+// feedLink returns the website of the feed.
+func feedLink(cfg *EndpointConfigFeed) string {
+	if cfg.Link != "" {
+		return cfg.Link
+	}
+	return cfg.URL
+}
+
+// feedEntryID identifies the entry globally, as required by Atom.
+func feedEntryID(cfg *EndpointConfigFeed, entry *feedEntry) string {
+	return cfg.URL + "#" + entry.ID
+}
+
+// feedEntryTitle returns the content warning as title of the entry, or the beginning of the text if there is none.
+func feedEntryTitle(entry *feedEntry) string {
+	if entry.SpoilerText != "" {
+		return telegramCWPrefix + entry.SpoilerText
+	}
+
+	title, _, _ := strings.Cut(markdown.PlainText(entry.MDText), "\n")
+	if utf8.RuneCountInString(title) > feedTitleLength {
+		title = string([]rune(title)[:feedTitleLength-1]) + "…"
+	}
+	if title == "" {
+		title = entry.Published.UTC().Format("2006-01-02 15:04")
+	}
+	return title
+}
+
+// feedEntryHTML renders the entry as HTML. Raw HTML in the text is omitted and unsafe links are dropped by goldmark,
+// so the result is safe to be shown by feed readers. Content warnings hide the text in a collapsed section.
+func feedEntryHTML(entry *feedEntry) (string, error) {
+	var buf bytes.Buffer
+	err := markdown.Markdown().Convert([]byte(entry.MDText), &buf)
+	if err != nil {
+		return "", err
+	}
+	body := strings.TrimSpace(buf.String())
+
+	if entry.Attachments > 0 {
+		body += fmt.Sprintf("\n<p><em>%d attachment(s) not included.</em></p>", entry.Attachments)
+	}
+	if entry.SpoilerText != "" {
+		body = fmt.Sprintf("<details><summary>%s</summary>\n%s\n</details>", html.EscapeString(entry.SpoilerText), body)
+	}
+	return body, nil
+}
+
+func renderAtomFeed(cfg *EndpointConfigFeed, store *feedStore) ([]byte, error) {
+	feed := &atomFeed{
+		ID:       cfg.URL,
+		Title:    cfg.Title,
+		Subtitle: cfg.Description,
+		Updated:  store.Updated.UTC().Format(time.RFC3339),
+		Links: []atomLink{
+			{Rel: "self", Type: "application/atom+xml", Href: cfg.URL},
+			{Rel: "alternate", Href: feedLink(cfg)},
+		},
+		// Atom requires an author, entries are all posted by the owner of the feed.
+		Author: atomAuthor{Name: cfg.Title},
+	}
+	for _, entry := range store.Entries {
+		body, err := feedEntryHTML(entry)
+		if err != nil {
+			return nil, err
+		}
+		feed.Entries = append(feed.Entries, atomEntry{
+			ID:        feedEntryID(cfg, entry),
+			Title:     feedEntryTitle(entry),
+			Published: entry.Published.UTC().Format(time.RFC3339),
+			Updated:   entry.Updated.UTC().Format(time.RFC3339),
+			Content:   atomContent{Type: "html", Lang: entry.Language, Body: body},
+		})
+	}
+
+	return marshalFeed(feed)
+}
+
+func renderRSSFeed(cfg *EndpointConfigFeed, store *feedStore) ([]byte, error) {
+	description := cfg.Description
+	if description == "" {
+		// RSS requires a description of the channel.
+		description = cfg.Title
+	}
+	feed := &rssFeed{
+		Version: "2.0",
+		Channel: rssChannel{
+			Title:         cfg.Title,
+			Link:          feedLink(cfg),
+			Description:   description,
+			LastBuildDate: store.Updated.UTC().Format(time.RFC1123Z),
+		},
+	}
+	for _, entry := range store.Entries {
+		body, err := feedEntryHTML(entry)
+		if err != nil {
+			return nil, err
+		}
+		feed.Channel.Items = append(feed.Channel.Items, rssItem{
+			Title:       feedEntryTitle(entry),
+			Description: body,
+			PubDate:     entry.Published.UTC().Format(time.RFC1123Z),
+			GUID:        rssGUID{ID: feedEntryID(cfg, entry)},
+		})
+	}
+
+	return marshalFeed(feed)
+}
+
+func marshalFeed(feed any) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(xml.Header)
+	encoder := xml.NewEncoder(&buf)
+	encoder.Indent("", "  ")
+	err := encoder.Encode(feed)
+	if err != nil {
+		return nil, err
+	}
+	buf.WriteByte('\n')
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,164 @@
+package endpoint
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/merrkry/tele2don/internal/config"
+	"github.com/merrkry/tele2don/internal/model"
+)
+
+func TestFeedEntryHTML(t *testing.T) {
+	tests := []struct {
+		name    string
+		entry   feedEntry
+		want    []string
+		notWant []string
+	}{
+		{
+			name:  "formatting",
+			entry: feedEntry{MDText: "**bold** [link](https://example.com)"},
+			want:  []string{"<strong>bold</strong>", `<a href="https://example.com">link</a>`},
+		},
+		{
+			name:    "raw HTML",
+			entry:   feedEntry{MDText: "<script>alert(1)</script>\n\nhi <img src=x onerror=alert(1)>"},
+			want:    []string{"hi"},
+			notWant: []string{"<script", "<img", "onerror"},
+		},
+		{
+			name:    "javascript link",
+			entry:   feedEntry{MDText: "[click](javascript:alert(1))"},
+			want:    []string{"click"},
+			notWant: []string{"javascript:"},
+		},
+		{
+			name:    "content warning",
+			entry:   feedEntry{MDText: "hidden", SpoilerText: "<spoiler>"},
+			want:    []string{"<details><summary>&lt;spoiler&gt;</summary>\n<p>hidden</p>\n</details>"},
+			notWant: []string{"<spoiler>"},
+		},
+		{
+			name:  "attachments",
+			entry: feedEntry{MDText: "text", Attachments: 2},
+			want:  []string{"<em>2 attachment(s) not included.</em>"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := feedEntryHTML(&tt.entry)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(got, want) {
+					t.Errorf("feedEntryHTML() = %q, want it to contain %q", got, want)
+				}
+			}
+			for _, notWant := range tt.notWant {
+				if strings.Contains(got, notWant) {
+					t.Errorf("feedEntryHTML() = %q, want it not to contain %q", got, notWant)
+				}
+			}
+		})
+	}
+}
+
+func TestFeedPrune(t *testing.T) {
+	now := time.Now()
+	entries := func(ages ...time.Duration) []*feedEntry {
+		var entries []*feedEntry
+		for i, age := range ages {
+			entries = append(entries, &feedEntry{ID: string(rune('a' + i)), Published: now.Add(-age)})
+		}
+		return entries
+	}
+
+	tests := []struct {
+		name       string
+		maxEntries int
+		retention  time.Duration
+		entries    []*feedEntry
+		want       string
+	}{
+		{"within limits", 3, 0, entries(0, time.Hour, 2*time.Hour), "abc"},
+		{"max entries", 2, 0, entries(0, time.Hour, 2*time.Hour), "ab"},
+		{"retention", 3, 90 * time.Minute, entries(0, time.Hour, 2*time.Hour), "ab"},
+		{"both", 1, 90 * time.Minute, entries(0, time.Hour, 2*time.Hour), "a"},
+		{"all expired", 3, time.Minute, entries(time.Hour, 2*time.Hour), ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &EndpointFeed{maxEntries: tt.maxEntries, retention: tt.retention}
+			store := &feedStore{Entries: tt.entries}
+			e.prune(store, now)
+			var got string
+			for _, entry := range store.Entries {
+				got += entry.ID
+			}
+			if got != tt.want {
+				t.Errorf("entries after pruning = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFeedFiles(t *testing.T) {
+	dir := t.TempDir()
+	cfg := &EndpointConfigFeed{
+		Title:      "test",
+		URL:        "https://example.com/atom.xml",
+		StorePath:  filepath.Join(dir, "store.json"),
+		MaxEntries: 2,
+		Retention:  config.Duration(time.Hour),
+		AtomFile:   filepath.Join(dir, "atom.xml"),
+		RSSFile:    filepath.Join(dir, "rss.xml"),
+	}
+	e := NewEndpointFeed("feed")
+	err := e.Initialize(context.Background(), &EndpointConfig{Feed: cfg})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, text := range []string{"first", "second", "third"} {
+		_, err := e.ApplyUpdateNew(context.Background(), &model.BridgeMessageContent{MDText: text}, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The store is internal state, published feeds are meant to be read by others.
+	for path, want := range map[string]os.FileMode{cfg.StorePath: 0o600, cfg.AtomFile: 0o644, cfg.RSSFile: 0o644} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := info.Mode().Perm(); got != want {
+			t.Errorf("mode of %s = %v, want %v", filepath.Base(path), got, want)
+		}
+	}
+
+	atom, err := os.ReadFile(cfg.AtomFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(atom), "first") || !strings.Contains(string(atom), "second") || !strings.Contains(string(atom), "third") {
+		t.Errorf("Atom feed doesn't hold the 2 latest entries: %s", atom)
+	}
+
+	// Entries survive a restart.
+	restarted := NewEndpointFeed("feed")
+	err = restarted.Initialize(context.Background(), &EndpointConfig{Feed: cfg})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(restarted.store.Entries) != 2 || restarted.store.NextID != 4 {
+		t.Errorf("restored %d entries and next ID %d, want 2 and 4", len(restarted.store.Entries), restarted.store.NextID)
+	}
+}
@@ -2,28 +2,123 @@ package endpoint
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"log/slog"
+	"mime"
+	"net/http"
 	"net/url"
-	"sync"
+	"path"
+	"regexp"
+	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	m "github.com/mattn/go-mastodon"
+	"github.com/merrkry/tele2don/internal/language"
+	"github.com/merrkry/tele2don/internal/markdown"
 	"github.com/merrkry/tele2don/internal/model"
 
 	htmltomarkdown "github.com/JohannesKaufmann/html-to-markdown/v2"
 )
 
+const (
+	mastodonMaxAttachments    = 4
+	mastodonMediaPollInterval = time.Second
+
+	// Limits of vanilla Mastodon, used if the instance doesn't report its own.
+	mastodonDefaultMaxCharacters    = 500
+	mastodonDefaultCharactersPerURL = 23
+)
+
+// mastodonURLPattern roughly matches URLs counted with fixed length in statuses.
+// Brackets are excluded so that URLs of Markdown links don't swallow the closing one.
+var mastodonURLPattern = regexp.MustCompile(`https?://[^\s<>()\[\]]+`)
+
 type EndpointConfigMastodon struct {
-	InstanceURL  url.URL
-	ClientID     string
-	ClientSecret string
-	AccessToken  string
+	Server       string `json:"server"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	AccessToken  string `json:"access_token"`
+
+	// Sources opts in statuses other than our own ones, which are always bridged.
+	Sources EndpointConfigMastodonSources `json:"sources"`
+
+	// Visibility of statuses posted by the bridge. If empty, the visibility of the source message is kept,
+	// or the default of the account is used if the source has none.
+	Visibility model.Visibility `json:"visibility"`
+	// BridgeVisibilities lists visibilities of statuses to bridge, defaults to public and unlisted.
+	BridgeVisibilities []model.Visibility `json:"bridge_visibilities"`
+
+	// Language of statuses posted by the bridge, as ISO 639 code, if the source message doesn't tell
+	// and it can't be detected confidently. The default of the account is used if empty.
+	Language string `json:"language"`
+	// LanguageConfidence is the minimum confidence of language detection, from 0 to 1.
+	// Defaults to 0.3.
+	LanguageConfidence float64 `json:"language_confidence"`
+}
+
+type EndpointConfigMastodonSources struct {
+	// Boosts bridges statuses boosted by us.
+	Boosts bool `json:"boosts"`
+	// RepliesToOthers bridges our replies to statuses of other accounts.
+	RepliesToOthers bool `json:"replies_to_others"`
+	// Hashtag bridges public statuses with the hashtag, written without "#".
+	Hashtag string `json:"hashtag"`
+	// ListID bridges statuses from accounts in the list.
+	ListID string `json:"list_id"`
+}
+
+func (c *EndpointConfigMastodon) validate() error {
+	u, err := url.Parse(c.Server)
+	if err != nil {
+		return fmt.Errorf("server: %w", err)
+	}
+	if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("server: must be an absolute http(s) URL, got %q", c.Server)
+	}
+	if c.AccessToken == "" {
+		return fmt.Errorf("access_token: required")
+	}
+	if c.Visibility != "" && !c.Visibility.Valid() {
+		return fmt.Errorf("visibility: unsupported visibility %q", c.Visibility)
+	}
+	if c.LanguageConfidence < 0 || c.LanguageConfidence > 1 {
+		return fmt.Errorf("language_confidence: must be between 0 and 1, got %v", c.LanguageConfidence)
+	}
+	for i, visibility := range c.BridgeVisibilities {
+		if !visibility.Valid() {
+			return fmt.Errorf("bridge_visibilities[%d]: unsupported visibility %q", i, visibility)
+		}
+	}
+	if strings.HasPrefix(c.Sources.Hashtag, "#") || strings.ContainsFunc(c.Sources.Hashtag, unicode.IsSpace) {
+		return fmt.Errorf("sources.hashtag: must be a single tag without \"#\", got %q", c.Sources.Hashtag)
+	}
+	return nil
 }
 
 type EndpointMastodon struct {
-	id     model.EndpointID
-	client *m.Client
+	id        model.EndpointID
+	client    *m.Client
+	accountID m.ID
+
+	sourcesConfig      EndpointConfigMastodonSources
+	visibility         model.Visibility
+	bridgeVisibilities []model.Visibility
+	language           string
+	languageConfidence float64
+
+	maxCharacters    int
+	charactersPerURL int
+
+	transport *mastodonTransport
+	status    statusTracker
+
+	// Only accessed by the goroutine of the user stream.
+	lastSeenID    m.ID
+	lastSeenKnown bool
 }
 
 func NewEndpointMastodon(id model.EndpointID) *EndpointMastodon {
@@ -38,43 +133,110 @@ func (e *EndpointMastodon) ID() model.EndpointID {
 
 func (e *EndpointMastodon) Initialize(ctx context.Context, cfg *EndpointConfig) error {
 	clientConfig := &m.Config{
-		Server:       cfg.Mastodon.InstanceURL.String(),
+		Server:       cfg.Mastodon.Server,
 		ClientID:     cfg.Mastodon.ClientID,
 		ClientSecret: cfg.Mastodon.ClientSecret,
 		AccessToken:  cfg.Mastodon.AccessToken,
 	}
 
 	e.client = m.NewClient(clientConfig)
+	e.transport = &mastodonTransport{base: http.DefaultTransport, status: &e.status}
+	e.client.Transport = e.transport
+	e.sourcesConfig = cfg.Mastodon.Sources
+	e.visibility = cfg.Mastodon.Visibility
+	e.bridgeVisibilities = cfg.Mastodon.BridgeVisibilities
+	if e.bridgeVisibilities == nil {
+		e.bridgeVisibilities = []model.Visibility{model.VisibilityPublic, model.VisibilityUnlisted}
+	}
+	e.language = cfg.Mastodon.Language
+	e.languageConfidence = cfg.Mastodon.LanguageConfidence
+	if e.languageConfidence == 0 {
+		e.languageConfidence = language.DefaultConfidence
+	}
 
-	// TODO: validate
+	// Needed to tell our own statuses apart from others in the home timeline.
+	account, err := e.client.GetAccountCurrentUser(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to verify Mastodon account credentials: %w", err)
+	}
+	e.accountID = account.ID
 
+	e.maxCharacters = mastodonDefaultMaxCharacters
+	e.charactersPerURL = mastodonDefaultCharactersPerURL
+	err = e.fetchStatusLimits(ctx)
+	if err != nil {
+		slog.Warn("Failed to fetch status limits from Mastodon, using defaults", "eid", e.id, "maxCharacters", e.maxCharacters, "err", err)
+	}
+
+	e.status.setInitialized()
 	return nil
 }
 
-func (e *EndpointMastodon) ListenUpdates(ctx context.Context, updatesChan chan<- *model.EndpointUpdate, wg *sync.WaitGroup) {
-	defer wg.Done()
+func (e *EndpointMastodon) Status() Status {
+	return e.status.status()
+}
 
-	eventChan, err := e.client.StreamingUser(ctx)
+// fetchStatusLimits reads status length limits from instance configuration.
+// go-mastodon doesn't wrap GET /api/v2/instance, so we do it manually.
+func (e *EndpointMastodon) fetchStatusLimits(ctx context.Context) error {
+	instanceURL, err := url.JoinPath(e.client.Config.Server, "/api/v2/instance")
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	for {
-		select {
-		case <-ctx.Done():
-			return
-		case event := <-eventChan:
-			if event == nil {
-				continue
-			}
-			convertedUpdate, err := e.convertEvent(event)
-			if err != nil {
-				slog.Error("Failed to convert Mastodon event", "err", err)
-				continue
-			}
-			updatesChan <- convertedUpdate
-		}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, instanceURL, nil)
+	if err != nil {
+		return err
 	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s when fetching instance", resp.Status)
+	}
+
+	var instance struct {
+		Configuration struct {
+			Statuses struct {
+				MaxCharacters            int `json:"max_characters"`
+				CharactersReservedPerURL int `json:"characters_reserved_per_url"`
+			} `json:"statuses"`
+		} `json:"configuration"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&instance)
+	if err != nil {
+		return fmt.Errorf("failed to decode instance: %w", err)
+	}
+
+	statuses := instance.Configuration.Statuses
+	if statuses.MaxCharacters > 0 {
+		e.maxCharacters = statuses.MaxCharacters
+	}
+	if statuses.CharactersReservedPerURL > 0 {
+		e.charactersPerURL = statuses.CharactersReservedPerURL
+	}
+
+	return nil
+}
+
+// statusLength counts characters like Mastodon, where every URL takes a fixed number of characters.
+func (e *EndpointMastodon) statusLength(s string) int {
+	length := utf8.RuneCountInString(s)
+	for _, u := range mastodonURLPattern.FindAllString(s, -1) {
+		length += e.charactersPerURL - utf8.RuneCountInString(u)
+	}
+	return length
+}
+
+// splitStatus splits content into statuses within the instance limit, to be posted as a thread.
+// The content warning is repeated in every status, and counts towards the limit.
+func (e *EndpointMastodon) splitStatus(content *model.BridgeMessageContent) []string {
+	limit := max(e.maxCharacters-e.statusLength(content.SpoilerText), 1)
+	return markdown.Split(content.MDText, limit, e.statusLength)
 }
 
 func (e *EndpointMastodon) convertEvent(event m.Event) (*model.EndpointUpdate, error) {
@@ -94,12 +256,18 @@ func (e *EndpointMastodon) convertEvent(event m.Event) (*model.EndpointUpdate, e
 		convertedUpdate.ID = model.EndpointMessageID(event.Status.ID)
 		convertedUpdate.Timestamp = event.Status.CreatedAt
 
-		convertedContent, err := htmltomarkdown.ConvertString(event.Status.Content)
+		convertedContent, err := e.convertStatus(event.Status)
 		if err != nil {
 			return nil, err
 		}
-		convertedUpdate.Content = &model.BridgeMessageContent{
-			MDText: convertedContent,
+		convertedUpdate.Content = convertedContent
+
+		// InReplyToID is decoded from JSON into interface{}, it's a string ID or nil.
+		if parentID, ok := event.Status.InReplyToID.(string); ok && parentID != "" {
+			convertedUpdate.Parent = &model.UniqueEndpointMessageID{
+				EID: e.id,
+				ID:  model.EndpointMessageID(parentID),
+			}
 		}
 
 	case *m.UpdateEditEvent:
@@ -107,17 +275,17 @@ func (e *EndpointMastodon) convertEvent(event m.Event) (*model.EndpointUpdate, e
 		convertedUpdate.ID = model.EndpointMessageID(event.Status.ID)
 		convertedUpdate.Timestamp = event.Status.EditedAt
 
-		convertedContent, err := htmltomarkdown.ConvertString(event.Status.Content)
+		convertedContent, err := e.convertStatus(event.Status)
 		if err != nil {
 			return nil, err
 		}
-		convertedUpdate.Content = &model.BridgeMessageContent{
-			MDText: convertedContent,
-		}
+		convertedUpdate.Content = convertedContent
 
 	case *m.DeleteEvent:
-		// convertedUpdate.Type = model.UpdateTypeDelete
-		return nil, ErrUnsupportedUpdate
+		convertedUpdate.Type = model.UpdateTypeDelete
+		convertedUpdate.ID = model.EndpointMessageID(event.ID)
+		// Deletion events carry no timestamp.
+		convertedUpdate.Timestamp = time.Now()
 
 	default:
 		return nil, ErrUnsupportedUpdate
@@ -126,35 +294,305 @@ func (e *EndpointMastodon) convertEvent(event m.Event) (*model.EndpointUpdate, e
 	return convertedUpdate, nil
 }
 
-func (e *EndpointMastodon) ApplyUpdateNew(ctx context.Context, content *model.BridgeMessageContent) (model.EndpointMessageID, time.Time, error) {
-	status, err := e.client.PostStatus(ctx, &m.Toot{
-		Status: content.MDText,
-		// TODO: detect language
-	})
+func (e *EndpointMastodon) convertStatus(status *m.Status) (*model.BridgeMessageContent, error) {
+	// Boosts carry no content of their own.
+	if status.Reblog != nil {
+		content, err := e.convertStatus(status.Reblog)
+		if err != nil {
+			return nil, err
+		}
+		content.MDText = fmt.Sprintf("Boosted [@%s](%s):\n\n%s", status.Reblog.Account.Acct, status.Reblog.URL, content.MDText)
+		return content, nil
+	}
+
+	convertedText, err := htmltomarkdown.ConvertString(status.Content)
+	if err != nil {
+		return nil, err
+	}
+
+	content := &model.BridgeMessageContent{
+		MDText:      convertedText,
+		Visibility:  model.Visibility(status.Visibility),
+		SpoilerText: status.SpoilerText,
+		Sensitive:   status.Sensitive,
+		Language:    status.Language,
+	}
+
+	for _, attachment := range status.MediaAttachments {
+		mediaURL := attachment.URL
+		if mediaURL == "" {
+			mediaURL = attachment.RemoteURL
+		}
+		if mediaURL == "" {
+			slog.Warn("Skipping Mastodon attachment without URL", "id", attachment.ID)
+			continue
+		}
+
+		var kind model.AttachmentKind
+		switch attachment.Type {
+		case "image":
+			kind = model.AttachmentKindPhoto
+		case "video":
+			kind = model.AttachmentKindVideo
+		case "gifv":
+			kind = model.AttachmentKindAnimation
+		default:
+			kind = model.AttachmentKindDocument
+		}
+
+		fileName := ""
+		if u, err := url.Parse(mediaURL); err == nil {
+			fileName = path.Base(u.Path)
+		}
+
+		content.Attachments = append(content.Attachments, &model.Attachment{
+			Kind:     kind,
+			MIMEType: mime.TypeByExtension(path.Ext(fileName)),
+			AltText:  attachment.Description,
+			FileName: fileName,
+			Source:   mediaURL,
+			Open:     e.AttachmentOpener(mediaURL),
+		})
+	}
+
+	return content, nil
+}
+
+// AttachmentOpener recreates the opener of an attachment received from this endpoint, whose source is the media URL.
+func (e *EndpointMastodon) AttachmentOpener(source string) model.AttachmentOpener {
+	return func(ctx context.Context) (io.ReadCloser, error) {
+		return openRemoteFile(ctx, source)
+	}
+}
+
+// ApplyUpdateNew posts content as a thread of self-replies if it exceeds the instance limit.
+// Attachments are added to the first status.
+func (e *EndpointMastodon) ApplyUpdateNew(ctx context.Context, content *model.BridgeMessageContent, replyTo model.EndpointMessageID) (_ []model.EndpointMessageRevision, err error) {
+	defer func() { err = e.classifyError(err) }()
 
+	mediaIDs, err := e.uploadAttachments(ctx, content.Attachments)
 	if err != nil {
-		return "", time.Time{}, fmt.Errorf("failed to post status to Mastodon: %w", err)
+		return nil, fmt.Errorf("failed to upload attachments to Mastodon: %w", err)
 	}
 
-	slog.Debug("Status posted to Mastodon", "id", status.ID)
+	lang := e.postLanguage(content)
+
+	var revisions []model.EndpointMessageRevision
+	for i, text := range e.splitStatus(content) {
+		toot := &m.Toot{
+			Status:      text,
+			InReplyToID: m.ID(replyTo),
+			Visibility:  string(e.postVisibility(content)),
+			SpoilerText: content.SpoilerText,
+			Language:    lang,
+		}
+		if i == 0 {
+			toot.MediaIDs = mediaIDs
+			toot.Sensitive = content.Sensitive
+		}
+
+		status, err := e.client.PostStatus(ctx, toot)
+		if err != nil {
+			deleteIncomplete(ctx, e, revisions)
+			return nil, fmt.Errorf("failed to post status to Mastodon: %w", err)
+		}
+
+		slog.Debug("Status posted to Mastodon", "id", status.ID)
+
+		revisions = append(revisions, model.EndpointMessageRevision{
+			ID:        model.EndpointMessageID(status.ID),
+			Timestamp: status.CreatedAt,
+		})
+		replyTo = model.EndpointMessageID(status.ID)
+	}
 
-	return model.EndpointMessageID(status.ID), status.CreatedAt, nil
+	return revisions, nil
 }
 
-func (e *EndpointMastodon) ApplyUpdateEdit(ctx context.Context, id model.EndpointMessageID, content *model.BridgeMessageContent) (time.Time, error) {
-	status, err := e.client.UpdateStatus(ctx, &m.Toot{
-		Status: content.MDText,
-	}, m.ID(id))
+// ApplyUpdateEdit edits statuses of the thread in place, posting or deleting trailing ones if the number of them changes.
+func (e *EndpointMastodon) ApplyUpdateEdit(ctx context.Context, ids []model.EndpointMessageID, content *model.BridgeMessageContent) (_ []model.EndpointMessageRevision, err error) {
+	defer func() { err = e.classifyError(err) }()
+
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("no Mastodon status to edit")
+	}
+
+	texts := e.splitStatus(content)
+	lang := e.postLanguage(content)
+
+	var revisions []model.EndpointMessageRevision
+	for i, text := range texts {
+		if i >= len(ids) {
+			status, err := e.client.PostStatus(ctx, &m.Toot{
+				Status:      text,
+				InReplyToID: m.ID(revisions[i-1].ID),
+				Visibility:  string(e.postVisibility(content)),
+				SpoilerText: content.SpoilerText,
+				Language:    lang,
+			})
+			if err != nil {
+				return nil, fmt.Errorf("failed to post status to Mastodon: %w", err)
+			}
+
+			slog.Debug("Status posted to Mastodon", "id", status.ID)
+
+			revisions = append(revisions, model.EndpointMessageRevision{
+				ID:        model.EndpointMessageID(status.ID),
+				Timestamp: status.CreatedAt,
+			})
+			continue
+		}
+
+		// Visibility can't be changed by editing.
+		toot := &m.Toot{
+			Status:      text,
+			SpoilerText: content.SpoilerText,
+			Language:    lang,
+		}
+		if i == 0 {
+			toot.Sensitive = content.Sensitive
+		}
+
+		// Editing a status without media_ids drops its attachments, so keep the existing ones.
+		// Telegram doesn't emit media replacements as edits with new files anyway.
+		if i == 0 && len(content.Attachments) > 0 {
+			current, err := e.client.GetStatus(ctx, m.ID(ids[i]))
+			if err != nil {
+				return nil, fmt.Errorf("failed to fetch status from Mastodon: %w", err)
+			}
+			for _, attachment := range current.MediaAttachments {
+				toot.MediaIDs = append(toot.MediaIDs, attachment.ID)
+			}
+		}
+
+		status, err := e.client.UpdateStatus(ctx, toot, m.ID(ids[i]))
+
+		if err != nil {
+			return nil, fmt.Errorf("failed to edit status in Mastodon: %w", err)
+		}
+
+		slog.Debug("Status edited in Mastodon", "id", status.ID)
 
+		revisions = append(revisions, model.EndpointMessageRevision{
+			ID:        ids[i],
+			Timestamp: status.EditedAt,
+		})
+	}
+
+	for _, id := range ids[min(len(texts), len(ids)):] {
+		err := e.ApplyUpdateDelete(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return revisions, nil
+}
+
+// postVisibility returns the visibility to post content with, empty for the default of the account.
+func (e *EndpointMastodon) postVisibility(content *model.BridgeMessageContent) model.Visibility {
+	if e.visibility != "" {
+		return e.visibility
+	}
+	return content.Visibility
+}
+
+// postLanguage returns the language to post content with, empty for the default of the account.
+func (e *EndpointMastodon) postLanguage(content *model.BridgeMessageContent) string {
+	if content.Language != "" {
+		return content.Language
+	}
+	if detected := language.Detect(content, e.languageConfidence); detected != "" {
+		return detected
+	}
+	return e.language
+}
+
+// uploadAttachments uploads attachments through media API, and waits until they are ready to be attached.
+func (e *EndpointMastodon) uploadAttachments(ctx context.Context, attachments []*model.Attachment) ([]m.ID, error) {
+	if len(attachments) > mastodonMaxAttachments {
+		slog.Warn("Too many attachments for a Mastodon status, extra ones will be dropped", "count", len(attachments))
+		attachments = attachments[:mastodonMaxAttachments]
+	}
+
+	var mediaIDs []m.ID
+	for _, attachment := range attachments {
+		r, err := attachment.Open(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		uploaded, err := e.client.UploadMediaFromMedia(ctx, &m.Media{
+			File:        r,
+			Description: attachment.AltText,
+		})
+		r.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		// Large files, e.g. videos, are processed asynchronously and have no URL until finished.
+		if uploaded.URL == "" {
+			err = e.waitForMedia(ctx, uploaded.ID)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		slog.Debug("Media uploaded to Mastodon", "id", uploaded.ID, "kind", attachment.Kind)
+		mediaIDs = append(mediaIDs, uploaded.ID)
+	}
+
+	return mediaIDs, nil
+}
+
+// waitForMedia polls the media until it's processed by the server.
+// go-mastodon doesn't wrap GET /api/v1/media/:id, so we do it manually.
+func (e *EndpointMastodon) waitForMedia(ctx context.Context, id m.ID) error {
+	mediaURL, err := url.JoinPath(e.client.Config.Server, "/api/v1/media", string(id))
 	if err != nil {
-		return time.Time{}, fmt.Errorf("failed to edit status in Mastodon: %w", err)
+		return err
 	}
 
-	slog.Debug("Status edited in Mastodon", "id", status.ID)
+	ticker := time.NewTicker(mastodonMediaPollInterval)
+	defer ticker.Stop()
+
+	for {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, mediaURL, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Authorization", "Bearer "+e.client.Config.AccessToken)
+
+		resp, err := e.client.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		switch resp.StatusCode {
+		case http.StatusOK:
+			return nil
+		case http.StatusPartialContent: // still processing
+		default:
+			return fmt.Errorf("unexpected status %s when polling media %s", resp.Status, id)
+		}
 
-	return status.EditedAt, nil
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
 }
 
 func (e *EndpointMastodon) ApplyUpdateDelete(ctx context.Context, id model.EndpointMessageID) error {
-	return ErrUnsupportedUpdate
+	err := e.client.DeleteStatus(ctx, m.ID(id))
+	if err != nil {
+		return fmt.Errorf("failed to delete status in Mastodon: %w", err)
+	}
+
+	slog.Debug("Status deleted in Mastodon", "id", id)
+
+	return nil
 }
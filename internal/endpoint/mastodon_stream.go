@@ -0,0 +1,297 @@
+package endpoint
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	m "github.com/mattn/go-mastodon"
+	"github.com/merrkry/tele2don/internal/model"
+)
+
+const (
+	mastodonStreamMinBackoff = time.Second
+	mastodonStreamMaxBackoff = 5 * time.Minute
+	// A stream that stayed up this long is considered healthy, so backoff starts over after it drops.
+	mastodonStreamHealthyDuration = time.Minute
+	mastodonBackfillPageSize      = 40
+)
+
+var errMastodonStreamClosed = errors.New("stream closed")
+
+// mastodonSource is a stream to take statuses from.
+type mastodonSource struct {
+	name string
+	open func(ctx context.Context) (chan m.Event, error)
+	// user is set for the stream of the account itself, whose gaps are backfilled.
+	// Only own statuses are taken from it, and own statuses are only taken from it.
+	user bool
+}
+
+func (e *EndpointMastodon) sources() []*mastodonSource {
+	sources := []*mastodonSource{{
+		name: "user",
+		open: e.client.StreamingUser,
+		user: true,
+	}}
+
+	if e.sourcesConfig.Hashtag != "" {
+		sources = append(sources, &mastodonSource{
+			name: "hashtag",
+			open: func(ctx context.Context) (chan m.Event, error) {
+				return e.client.StreamingHashtag(ctx, e.sourcesConfig.Hashtag, false)
+			},
+		})
+	}
+	if e.sourcesConfig.ListID != "" {
+		sources = append(sources, &mastodonSource{
+			name: "list",
+			open: func(ctx context.Context) (chan m.Event, error) {
+				return e.client.StreamingList(ctx, m.ID(e.sourcesConfig.ListID))
+			},
+		})
+	}
+
+	return sources
+}
+
+// ListenUpdates streams updates from all sources, reconnecting with backoff whenever a stream fails.
+// Own statuses posted while disconnected are fetched through REST after reconnecting.
+func (e *EndpointMastodon) ListenUpdates(ctx context.Context, updatesChan chan<- *model.EndpointUpdate, wg *sync.WaitGroup) {
+	defer wg.Done()
+	e.status.setListening(true)
+	defer e.status.setListening(false)
+
+	var streamWg sync.WaitGroup
+	for _, source := range e.sources() {
+		streamWg.Add(1)
+		go func() {
+			defer streamWg.Done()
+			e.superviseStream(ctx, source, updatesChan)
+		}()
+	}
+	streamWg.Wait()
+}
+
+func (e *EndpointMastodon) superviseStream(ctx context.Context, source *mastodonSource, updatesChan chan<- *model.EndpointUpdate) {
+	retry := &backoff{min: mastodonStreamMinBackoff, max: mastodonStreamMaxBackoff}
+	for {
+		start := time.Now()
+
+		err := e.stream(ctx, source, updatesChan)
+		if ctx.Err() != nil {
+			return
+		}
+
+		if time.Since(start) >= mastodonStreamHealthyDuration {
+			retry.reset()
+		}
+		delay := retry.next()
+		slog.Warn("Mastodon stream failed, reconnecting", "eid", e.id, "source", source.name, "delay", delay, "err", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// fetchLastSeenStatus fetches the latest own status, which is where backfill starts from.
+// Statuses posted before startup are never backfilled.
+func (e *EndpointMastodon) fetchLastSeenStatus(ctx context.Context) error {
+	statuses, err := e.client.GetAccountStatuses(ctx, e.accountID, &m.Pagination{Limit: 1})
+	if err != nil {
+		return fmt.Errorf("failed to fetch latest Mastodon status: %w", err)
+	}
+	if len(statuses) > 0 {
+		e.trackSeenStatus(statuses[0])
+	}
+	e.lastSeenKnown = true
+
+	return nil
+}
+
+// stream forwards events until the stream fails, the returned error is never nil.
+// Every time the user stream connects, statuses missed since the last seen one are backfilled.
+func (e *EndpointMastodon) stream(ctx context.Context, source *mastodonSource, updatesChan chan<- *model.EndpointUpdate) error {
+	streamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var connected chan struct{}
+	if source.user {
+		connected = make(chan struct{}, 1)
+		streamCtx = withStreamConnected(streamCtx, func() {
+			select {
+			case connected <- struct{}{}:
+			default:
+			}
+		})
+	}
+
+	eventChan, err := source.open(streamCtx)
+	if err != nil {
+		return err
+	}
+	// go-mastodon reconnects internally without backoff, and blocks on sending errors after we stop reading.
+	// Drain the channel until it's closed on cancellation, so its goroutine doesn't leak.
+	defer func() {
+		go func() {
+			for range eventChan {
+			}
+		}()
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case <-connected:
+			// Overlaps with the stream are deduplicated by the bridge.
+			err := e.backfill(ctx, source, updatesChan)
+			if err != nil {
+				return fmt.Errorf("failed to backfill Mastodon statuses: %w", err)
+			}
+
+		case event, ok := <-eventChan:
+			if !ok {
+				return errMastodonStreamClosed
+			}
+
+			var status *m.Status
+			switch event := event.(type) {
+			case *m.ErrorEvent:
+				// Malformed events don't affect the connection.
+				var syntaxErr *json.SyntaxError
+				var typeErr *json.UnmarshalTypeError
+				if errors.As(event.Err, &syntaxErr) || errors.As(event.Err, &typeErr) {
+					slog.Error("Failed to decode Mastodon event", "err", event.Err)
+					continue
+				}
+				return event.Err
+			case *m.UpdateEvent:
+				status = event.Status
+				if source.user {
+					e.trackSeenStatus(status)
+				}
+			case *m.UpdateEditEvent:
+				status = event.Status
+			}
+			if status != nil && !e.acceptStatus(source, status) {
+				continue
+			}
+
+			convertedUpdate, err := e.convertEvent(event)
+			if err != nil {
+				slog.Error("Failed to convert Mastodon event", "err", err)
+				continue
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case updatesChan <- convertedUpdate:
+			}
+		}
+	}
+}
+
+// acceptStatus reports whether a status from source should be bridged, according to configured sources.
+func (e *EndpointMastodon) acceptStatus(source *mastodonSource, status *m.Status) bool {
+	own := status.Account.ID == e.accountID
+	// Visibility of boosts is that of the boosted status.
+	visibility := model.Visibility(status.Visibility)
+	if status.Reblog != nil {
+		visibility = model.Visibility(status.Reblog.Visibility)
+	}
+	if !slices.Contains(e.bridgeVisibilities, visibility) {
+		return false
+	}
+
+	if !source.user {
+		return !own
+	}
+	if !own {
+		return false
+	}
+
+	if status.Reblog != nil {
+		return e.sourcesConfig.Boosts
+	}
+	if replyTo, ok := status.InReplyToAccountID.(string); ok && replyTo != "" && m.ID(replyTo) != e.accountID {
+		return e.sourcesConfig.RepliesToOthers
+	}
+	return true
+}
+
+// backfill fetches own statuses posted after the last seen one, oldest first.
+// On the first connection, it only looks up the latest status instead.
+// Statuses are stamped with their latest revision, so that those already received through the stream are dropped
+// by the bridge, and those edited since are applied as edits instead of being posted again.
+func (e *EndpointMastodon) backfill(ctx context.Context, source *mastodonSource, updatesChan chan<- *model.EndpointUpdate) error {
+	if !e.lastSeenKnown {
+		return e.fetchLastSeenStatus(ctx)
+	}
+
+	minID := e.lastSeenID
+	for {
+		statuses, err := e.client.GetAccountStatuses(ctx, e.accountID, &m.Pagination{
+			MinID: minID,
+			Limit: mastodonBackfillPageSize,
+		})
+		if err != nil {
+			return err
+		}
+		if len(statuses) == 0 {
+			return nil
+		}
+
+		slog.Info("Backfilling Mastodon statuses", "eid", e.id, "count", len(statuses))
+
+		// Statuses are returned newest first.
+		for i := len(statuses) - 1; i >= 0; i-- {
+			e.trackSeenStatus(statuses[i])
+			if !e.acceptStatus(source, statuses[i]) {
+				continue
+			}
+
+			convertedUpdate, err := e.convertEvent(&m.UpdateEvent{Status: statuses[i]})
+			if err != nil {
+				slog.Error("Failed to convert Mastodon status", "id", statuses[i].ID, "err", err)
+				continue
+			}
+			if !statuses[i].EditedAt.IsZero() {
+				convertedUpdate.Timestamp = statuses[i].EditedAt
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case updatesChan <- convertedUpdate:
+			}
+		}
+		minID = statuses[0].ID
+	}
+}
+
+// trackSeenStatus records the latest own status, so that backfill continues from it.
+func (e *EndpointMastodon) trackSeenStatus(status *m.Status) {
+	if status == nil || status.Account.ID != e.accountID {
+		return
+	}
+	if isNewerStatusID(status.ID, e.lastSeenID) {
+		e.lastSeenID = status.ID
+	}
+}
+
+// isNewerStatusID compares status IDs, which are numeric strings growing over time.
+func isNewerStatusID(a, b m.ID) bool {
+	if len(a) != len(b) {
+		return len(a) > len(b)
+	}
+	return a > b
+}
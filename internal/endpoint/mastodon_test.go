@@ -0,0 +1,416 @@
+package endpoint
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	m "github.com/mattn/go-mastodon"
+	"github.com/merrkry/tele2don/internal/model"
+)
+
+// fakeMastodon implements the REST and streaming routes used by the Mastodon endpoint.
+type fakeMastodon struct {
+	mu            sync.Mutex
+	maxCharacters int
+	// failPost fails posting the status with the given 1-based index.
+	failPost int
+	posts    []map[string]string
+	deleted  []string
+
+	// statuses are own statuses, oldest first.
+	statuses []map[string]any
+	// fetched receives a value whenever own statuses are fetched.
+	fetched chan struct{}
+	// streams handle connections to the user stream in turn, later ones are kept open.
+	streams     []func(w http.ResponseWriter, r *http.Request)
+	connections int
+}
+
+// addStatus adds an own status with the given ID, and returns it.
+func (f *fakeMastodon) addStatus(id int) map[string]any {
+	status := map[string]any{
+		"id":         fmt.Sprint(id),
+		"created_at": time.Now(),
+		"content":    fmt.Sprintf("<p>status %d</p>", id),
+		"visibility": "public",
+		"account":    map[string]any{"id": "1"},
+	}
+	f.mu.Lock()
+	f.statuses = append(f.statuses, status)
+	f.mu.Unlock()
+	return status
+}
+
+func newFakeMastodon(t *testing.T, maxCharacters int) (*fakeMastodon, *httptest.Server) {
+	f := &fakeMastodon{maxCharacters: maxCharacters, fetched: make(chan struct{}, 10)}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /api/v1/accounts/verify_credentials", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{"id": "1", "acct": "me"})
+	})
+	mux.HandleFunc("GET /api/v1/accounts/1/statuses", func(w http.ResponseWriter, r *http.Request) {
+		minID, _ := strconv.Atoi(r.FormValue("min_id"))
+		limit, _ := strconv.Atoi(r.FormValue("limit"))
+		f.mu.Lock()
+		// Newest first, closest to min_id if given.
+		var statuses []map[string]any
+		for _, status := range f.statuses {
+			if id, _ := strconv.Atoi(status["id"].(string)); id > minID {
+				statuses = append([]map[string]any{status}, statuses...)
+			}
+		}
+		if minID > 0 {
+			statuses = statuses[max(len(statuses)-limit, 0):]
+		} else {
+			statuses = statuses[:min(len(statuses), limit)]
+		}
+		f.mu.Unlock()
+		json.NewEncoder(w).Encode(statuses)
+		select {
+		case f.fetched <- struct{}{}:
+		default:
+		}
+	})
+	mux.HandleFunc("GET /api/v1/streaming/user", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		var handle func(w http.ResponseWriter, r *http.Request)
+		if f.connections < len(f.streams) {
+			handle = f.streams[f.connections]
+		}
+		f.connections++
+		f.mu.Unlock()
+		if handle != nil {
+			handle(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		<-r.Context().Done()
+	})
+	mux.HandleFunc("GET /api/v2/instance", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]any{
+			"configuration": map[string]any{
+				"statuses": map[string]any{"max_characters": f.maxCharacters, "characters_reserved_per_url": 23},
+			},
+		})
+	})
+	mux.HandleFunc("POST /api/v1/statuses", func(w http.ResponseWriter, r *http.Request) {
+		r.ParseForm()
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if len(f.posts)+1 == f.failPost {
+			http.Error(w, `{"error":"failed"}`, http.StatusInternalServerError)
+			return
+		}
+		post := map[string]string{}
+		for key := range r.PostForm {
+			post[key] = r.PostForm.Get(key)
+		}
+		f.posts = append(f.posts, post)
+		json.NewEncoder(w).Encode(map[string]any{
+			"id":         fmt.Sprint(len(f.posts)),
+			"created_at": time.Now(),
+		})
+	})
+	mux.HandleFunc("DELETE /api/v1/statuses/{id}", func(w http.ResponseWriter, r *http.Request) {
+		f.mu.Lock()
+		f.deleted = append(f.deleted, r.PathValue("id"))
+		f.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string]any{"id": r.PathValue("id")})
+	})
+
+	srv := httptest.NewServer(mux)
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+func newTestMastodon(t *testing.T, srv *httptest.Server) *EndpointMastodon {
+	e := NewEndpointMastodon("mastodon")
+	err := e.Initialize(context.Background(), &EndpointConfig{Mastodon: &EndpointConfigMastodon{
+		Server:      srv.URL,
+		AccessToken: "token",
+		Visibility:  model.VisibilityPublic,
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestMastodonStatusLength(t *testing.T) {
+	e := &EndpointMastodon{charactersPerURL: 23}
+
+	tests := []struct {
+		text string
+		want int
+	}{
+		{"plain", 5},
+		{"漢字 😀", 4},
+		{"see https://example.com/a/very/long/path/that/counts/as/23", 4 + 23},
+		{"[link](https://example.com)", 8 + 23},
+	}
+
+	for _, tt := range tests {
+		if got := e.statusLength(tt.text); got != tt.want {
+			t.Errorf("statusLength(%q) = %d, want %d", tt.text, got, tt.want)
+		}
+	}
+}
+
+func TestMastodonThread(t *testing.T) {
+	f, srv := newFakeMastodon(t, 50)
+	e := newTestMastodon(t, srv)
+	if e.maxCharacters != 50 {
+		t.Fatalf("max characters = %d, want the 50 of the instance", e.maxCharacters)
+	}
+
+	content := &model.BridgeMessageContent{
+		MDText:      strings.Repeat("Some words in a sentence. ", 8),
+		SpoilerText: "cw",
+	}
+	revisions, err := e.ApplyUpdateNew(context.Background(), content, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(f.posts) < 2 || len(revisions) != len(f.posts) {
+		t.Fatalf("posted %d statuses with %d revisions, want a thread", len(f.posts), len(revisions))
+	}
+	for i, post := range f.posts {
+		if n := utf8.RuneCountInString(post["status"] + post["spoiler_text"]); n > 50 {
+			t.Errorf("status %d has %d characters, over the limit", i, n)
+		}
+		if post["spoiler_text"] != "cw" {
+			t.Errorf("status %d has content warning %q", i, post["spoiler_text"])
+		}
+		var wantReplyTo string
+		if i > 0 {
+			wantReplyTo = string(revisions[i-1].ID)
+		}
+		if post["in_reply_to_id"] != wantReplyTo {
+			t.Errorf("status %d replies to %q, want %q", i, post["in_reply_to_id"], wantReplyTo)
+		}
+	}
+}
+
+func TestMastodonThreadCleanup(t *testing.T) {
+	f, srv := newFakeMastodon(t, 50)
+	e := newTestMastodon(t, srv)
+	f.failPost = 3
+
+	content := &model.BridgeMessageContent{MDText: strings.Repeat("Some words in a sentence. ", 8)}
+	_, err := e.ApplyUpdateNew(context.Background(), content, "")
+	if err == nil {
+		t.Fatal("ApplyUpdateNew() succeeded, want an error")
+	}
+	if got := strings.Join(f.deleted, ","); got != "1,2" {
+		t.Errorf("deleted statuses %q, want the partial thread 1,2", got)
+	}
+}
+
+func TestMastodonDefaultLimits(t *testing.T) {
+	_, srv := newFakeMastodon(t, 0)
+	e := newTestMastodon(t, srv)
+	if e.maxCharacters != mastodonDefaultMaxCharacters || e.charactersPerURL != 23 {
+		t.Errorf("limits = %d and %d per URL, want defaults", e.maxCharacters, e.charactersPerURL)
+	}
+}
+
+func TestMastodonVisibility(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		visibility model.Visibility
+		content    model.Visibility
+		want       string
+	}{
+		{"follows source", "", model.VisibilityUnlisted, "unlisted"},
+		{"fixed", model.VisibilityPublic, model.VisibilityUnlisted, "public"},
+		{"no source visibility", "", "", ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			f, srv := newFakeMastodon(t, 500)
+			e := newTestMastodon(t, srv)
+			e.visibility = tt.visibility
+
+			_, err := e.ApplyUpdateNew(context.Background(), &model.BridgeMessageContent{MDText: "text", Visibility: tt.content}, "")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := f.posts[0]["visibility"]; got != tt.want {
+				t.Errorf("posted with visibility %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMastodonContentWarning(t *testing.T) {
+	f, srv := newFakeMastodon(t, 50)
+	e := newTestMastodon(t, srv)
+
+	content := &model.BridgeMessageContent{
+		MDText:      strings.Repeat("Some words in a sentence. ", 4),
+		SpoilerText: "cw",
+		Sensitive:   true,
+	}
+	_, err := e.ApplyUpdateNew(context.Background(), content, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(f.posts) < 2 {
+		t.Fatalf("posted %d statuses, want a thread", len(f.posts))
+	}
+	// Only the first status carries media.
+	for i, post := range f.posts {
+		if post["spoiler_text"] != "cw" || (post["sensitive"] == "true") != (i == 0) {
+			t.Errorf("status %d posted with content warning %q and sensitive %q", i, post["spoiler_text"], post["sensitive"])
+		}
+	}
+
+	converted, err := e.convertStatus(&m.Status{Content: "<p>body</p>", Visibility: "unlisted", SpoilerText: "cw", Sensitive: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if converted.MDText != "body" || converted.Visibility != model.VisibilityUnlisted || converted.SpoilerText != "cw" || !converted.Sensitive {
+		t.Errorf("convertStatus() = %+v", converted)
+	}
+}
+
+func TestMastodonAcceptStatus(t *testing.T) {
+	own := func(visibility string) *m.Status {
+		return &m.Status{Account: m.Account{ID: "1"}, Visibility: visibility}
+	}
+	other := &m.Status{Account: m.Account{ID: "2"}, Visibility: "public"}
+	boost := &m.Status{Account: m.Account{ID: "1"}, Reblog: other}
+	replyToSelf := &m.Status{Account: m.Account{ID: "1"}, Visibility: "public", InReplyToAccountID: "1"}
+	replyToOther := &m.Status{Account: m.Account{ID: "1"}, Visibility: "public", InReplyToAccountID: "2"}
+
+	user := &mastodonSource{name: "user", user: true}
+	hashtag := &mastodonSource{name: "hashtag"}
+	all := EndpointConfigMastodonSources{Boosts: true, RepliesToOthers: true}
+
+	tests := []struct {
+		name    string
+		sources EndpointConfigMastodonSources
+		source  *mastodonSource
+		status  *m.Status
+		want    bool
+	}{
+		{"own", EndpointConfigMastodonSources{}, user, own("public"), true},
+		{"own unlisted", EndpointConfigMastodonSources{}, user, own("unlisted"), true},
+		{"own private", all, user, own("private"), false},
+		{"own direct", all, user, own("direct"), false},
+		{"followed account", all, user, other, false},
+		{"boost", EndpointConfigMastodonSources{}, user, boost, false},
+		{"boost enabled", all, user, boost, true},
+		{"reply to self", EndpointConfigMastodonSources{}, user, replyToSelf, true},
+		{"reply to other", EndpointConfigMastodonSources{}, user, replyToOther, false},
+		{"reply to other enabled", all, user, replyToOther, true},
+		{"other from hashtag", EndpointConfigMastodonSources{Hashtag: "tag"}, hashtag, other, true},
+		// Own statuses come from the user stream, so they aren't bridged twice.
+		{"own from hashtag", EndpointConfigMastodonSources{Hashtag: "tag"}, hashtag, own("public"), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			e := &EndpointMastodon{
+				accountID:          "1",
+				sourcesConfig:      tt.sources,
+				bridgeVisibilities: []model.Visibility{model.VisibilityPublic, model.VisibilityUnlisted},
+			}
+			if got := e.acceptStatus(tt.source, tt.status); got != tt.want {
+				t.Errorf("acceptStatus() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMastodonSources(t *testing.T) {
+	_, srv := newFakeMastodon(t, 500)
+	e := newTestMastodon(t, srv)
+
+	for _, tt := range []struct {
+		sources EndpointConfigMastodonSources
+		want    string
+	}{
+		{EndpointConfigMastodonSources{}, "user"},
+		{EndpointConfigMastodonSources{Boosts: true}, "user"},
+		{EndpointConfigMastodonSources{Hashtag: "tag", ListID: "1"}, "user,hashtag,list"},
+	} {
+		e.sourcesConfig = tt.sources
+		var names []string
+		for _, source := range e.sources() {
+			names = append(names, source.name)
+		}
+		if got := strings.Join(names, ","); got != tt.want {
+			t.Errorf("sources of %+v = %s, want %s", tt.sources, got, tt.want)
+		}
+	}
+}
+
+// TestMastodonStreamBackfill disconnects the user stream twice, once ended by the server and reconnected by go-mastodon,
+// and once failing, reconnected after backoff. Statuses posted in between are backfilled.
+func TestMastodonStreamBackfill(t *testing.T) {
+	f, srv := newFakeMastodon(t, 500)
+	f.addStatus(10)
+	f.streams = []func(w http.ResponseWriter, r *http.Request){
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			// Statuses before the one seen after connecting aren't backfilled.
+			<-f.fetched
+			data, _ := json.Marshal(f.addStatus(11))
+			fmt.Fprintf(w, "event: update\ndata: %s\n\n", data)
+		},
+		func(w http.ResponseWriter, r *http.Request) {
+			f.addStatus(12)
+			http.Error(w, `{"error":"unavailable"}`, http.StatusBadGateway)
+		},
+	}
+	e := newTestMastodon(t, srv)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	updatesChan := make(chan *model.EndpointUpdate)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go e.ListenUpdates(ctx, updatesChan, &wg)
+	t.Cleanup(func() {
+		cancel()
+		wg.Wait()
+	})
+
+	// Backfill runs as soon as the stream reconnects, after a single backoff delay.
+	var got []string
+	timeout := time.After(4 * time.Second)
+	for len(got) < 2 {
+		select {
+		case update := <-updatesChan:
+			got = append(got, string(update.ID))
+		case <-timeout:
+			t.Fatalf("received statuses %v, want 11 and 12", got)
+		}
+	}
+	if strings.Join(got, ",") != "11,12" {
+		t.Errorf("received statuses %v, want 11 and 12", got)
+	}
+
+	f.mu.Lock()
+	connections := f.connections
+	f.mu.Unlock()
+	if connections < 3 {
+		t.Errorf("stream connected %d times, want 3", connections)
+	}
+	select {
+	case update := <-updatesChan:
+		t.Errorf("received status %s again", update.ID)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,110 @@
+package endpoint
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	m "github.com/mattn/go-mastodon"
+)
+
+// mastodonTransport records when the rate limit resets, as go-mastodon doesn't expose response headers.
+// It also tracks successful requests, and data received from streams as heartbeats.
+type mastodonTransport struct {
+	base   http.RoundTripper
+	status *statusTracker
+
+	mu    sync.Mutex
+	reset time.Time
+}
+
+func (t *mastodonTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		t.status.apiCallSucceeded()
+		// Mastodon sends heartbeat comments on idle streams, which go-mastodon doesn't surface.
+		if strings.Contains(req.URL.Path, "/api/v1/streaming") {
+			resp.Body = &heartbeatReader{ReadCloser: resp.Body, status: t.status}
+			if connected, ok := req.Context().Value(mastodonStreamConnectedKey{}).(func()); ok {
+				connected()
+			}
+		}
+	}
+	if resp.StatusCode != http.StatusTooManyRequests {
+		return resp, err
+	}
+
+	// The header is an ISO 8601 timestamp. If it's missing, we still know that we are rate limited.
+	reset, parseErr := time.Parse(time.RFC3339, resp.Header.Get("X-RateLimit-Reset"))
+	if parseErr != nil {
+		reset = time.Now()
+	}
+	t.mu.Lock()
+	t.reset = reset
+	t.mu.Unlock()
+
+	return resp, err
+}
+
+type mastodonStreamConnectedKey struct{}
+
+// withStreamConnected returns a context whose stream requests call connected whenever they connect,
+// including reconnections made internally by go-mastodon.
+func withStreamConnected(ctx context.Context, connected func()) context.Context {
+	return context.WithValue(ctx, mastodonStreamConnectedKey{}, connected)
+}
+
+// retryAfter returns how long to wait until the rate limit resets, or 0 if we are not rate limited.
+func (t *mastodonTransport) retryAfter() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return max(time.Until(t.reset), 0)
+}
+
+// heartbeatReader records a heartbeat whenever data is read from a stream.
+type heartbeatReader struct {
+	io.ReadCloser
+	status *statusTracker
+}
+
+func (r *heartbeatReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if n > 0 {
+		r.status.heartbeat()
+	}
+	return n, err
+}
+
+// classifyError tells retryable failures apart from permanent ones for the outbox.
+// go-mastodon retries rate limited requests internally until the context expires,
+// so any failure while rate limited is reported with the time the limit resets.
+func (e *EndpointMastodon) classifyError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if retryAfter := e.transport.retryAfter(); retryAfter > 0 {
+		return &RetryAfterError{RetryAfter: retryAfter, Err: err}
+	}
+
+	// Only statuses meaning that the request itself is rejected are permanent,
+	// others like 409 or 425 might be transient, e.g. while the instance is processing media.
+	var apiErr *m.APIError
+	if errors.As(err, &apiErr) {
+		switch apiErr.StatusCode {
+		case http.StatusTooManyRequests:
+			return &RetryAfterError{Err: err}
+		case http.StatusBadRequest, http.StatusUnauthorized, http.StatusForbidden, http.StatusNotFound, http.StatusUnprocessableEntity:
+			return &PermanentError{Err: err}
+		}
+	}
+
+	return err
+}
@@ -0,0 +1,49 @@
+package endpoint
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+
+	m "github.com/mattn/go-mastodon"
+)
+
+func TestMastodonClassifyError(t *testing.T) {
+	e := &EndpointMastodon{transport: &mastodonTransport{}}
+
+	for _, tt := range []struct {
+		status     int
+		permanent  bool
+		retryAfter bool
+	}{
+		{http.StatusBadRequest, true, false},
+		{http.StatusUnauthorized, true, false},
+		{http.StatusForbidden, true, false},
+		{http.StatusNotFound, true, false},
+		{http.StatusUnprocessableEntity, true, false},
+		{http.StatusRequestTimeout, false, false},
+		{http.StatusConflict, false, false},
+		{http.StatusTooEarly, false, false},
+		{http.StatusTooManyRequests, false, true},
+		{http.StatusInternalServerError, false, false},
+		{http.StatusServiceUnavailable, false, false},
+	} {
+		t.Run(fmt.Sprint(tt.status), func(t *testing.T) {
+			err := e.classifyError(fmt.Errorf("failed to post status: %w", &m.APIError{StatusCode: tt.status}))
+
+			var permanent *PermanentError
+			if got := errors.As(err, &permanent); got != tt.permanent {
+				t.Errorf("permanent = %v, want %v", got, tt.permanent)
+			}
+			var retryAfter *RetryAfterError
+			if got := errors.As(err, &retryAfter); got != tt.retryAfter {
+				t.Errorf("retry after = %v, want %v", got, tt.retryAfter)
+			}
+		})
+	}
+
+	if err := e.classifyError(nil); err != nil {
+		t.Errorf("classifyError(nil) = %v", err)
+	}
+}
@@ -0,0 +1,498 @@
+package endpoint
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io"
+	"log/slog"
+	"net/url"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/merrkry/tele2don/internal/markdown"
+	"github.com/merrkry/tele2don/internal/model"
+
+	htmltomarkdown "github.com/JohannesKaufmann/html-to-markdown/v2"
+)
+
+const matrixHTMLFormat = "org.matrix.custom.html"
+
+var (
+	// matrixReplyFallbackPattern matches the quote of the parent prepended to replies by older clients.
+	matrixReplyFallbackPattern = regexp.MustCompile(`(?s)^<mx-reply>.*?</mx-reply>`)
+	// matrixSpoilerPattern matches a message body entirely hidden in a spoiler, whose reason is the content warning.
+	matrixSpoilerPattern = regexp.MustCompile(`(?s)^<span data-mx-spoiler="([^"]+)">(.*)</span>$`)
+	// matrixInlineSpoilerPattern matches inline spoilers, which become ||spoilers|| in bridge Markdown.
+	matrixInlineSpoilerPattern = regexp.MustCompile(`(?s)<span data-mx-spoiler(?:="[^"]*")?>(.*?)</span>`)
+)
+
+type EndpointConfigMatrix struct {
+	// Homeserver is the base URL of the client-server API, e.g. https://matrix.example.
+	Homeserver  string `json:"homeserver"`
+	AccessToken string `json:"access_token"`
+	// RoomID is the ID of the bridged room, starting with "!". The account joins it on startup.
+	RoomID string `json:"room_id"`
+	// Senders lists users whose messages are bridged. Messages of all users but ourselves are bridged if empty.
+	Senders []string `json:"senders"`
+}
+
+func (c *EndpointConfigMatrix) validate() error {
+	u, err := url.Parse(c.Homeserver)
+	if err != nil {
+		return fmt.Errorf("homeserver: %w", err)
+	}
+	if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("homeserver: must be an absolute http(s) URL, got %q", c.Homeserver)
+	}
+	if c.AccessToken == "" {
+		return fmt.Errorf("access_token: required")
+	}
+	if !strings.HasPrefix(c.RoomID, "!") {
+		return fmt.Errorf("room_id: must be a room ID starting with \"!\", got %q", c.RoomID)
+	}
+	for i, sender := range c.Senders {
+		if !strings.HasPrefix(sender, "@") {
+			return fmt.Errorf("senders[%d]: must be a user ID starting with \"@\", got %q", i, sender)
+		}
+	}
+	return nil
+}
+
+type EndpointMatrix struct {
+	id      model.EndpointID
+	client  *matrixClient
+	roomID  string
+	userID  string
+	senders []string
+
+	status statusTracker
+}
+
+func NewEndpointMatrix(id model.EndpointID) *EndpointMatrix {
+	return &EndpointMatrix{
+		id: id,
+	}
+}
+
+func (e *EndpointMatrix) ID() model.EndpointID {
+	return e.id
+}
+
+func (e *EndpointMatrix) Initialize(ctx context.Context, cfg *EndpointConfig) error {
+	e.client = newMatrixClient(cfg.Matrix.Homeserver, cfg.Matrix.AccessToken, &e.status)
+	e.roomID = cfg.Matrix.RoomID
+	e.senders = cfg.Matrix.Senders
+
+	// Needed to tell our own messages apart from others in the room.
+	userID, err := e.client.whoami(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to verify Matrix access token: %w", err)
+	}
+	e.userID = userID
+
+	err = e.client.joinRoom(ctx, e.roomID)
+	if err != nil {
+		return fmt.Errorf("failed to join Matrix room %s: %w", e.roomID, err)
+	}
+
+	e.status.setInitialized()
+	return nil
+}
+
+func (e *EndpointMatrix) Status() Status {
+	return e.status.status()
+}
+
+// matrixMessageContent is the content of m.room.message events, and of redactions in room versions 11 and later.
+type matrixMessageContent struct {
+	MsgType       string           `json:"msgtype"`
+	Body          string           `json:"body"`
+	Format        string           `json:"format,omitempty"`
+	FormattedBody string           `json:"formatted_body,omitempty"`
+	FileName      string           `json:"filename,omitempty"`
+	URL           string           `json:"url,omitempty"`
+	Info          *matrixMediaInfo `json:"info,omitempty"`
+
+	RelatesTo  *matrixRelatesTo      `json:"m.relates_to,omitempty"`
+	NewContent *matrixMessageContent `json:"m.new_content,omitempty"`
+
+	Redacts string `json:"redacts,omitempty"`
+}
+
+type matrixMediaInfo struct {
+	MIMEType string `json:"mimetype,omitempty"`
+	Size     int64  `json:"size,omitempty"`
+}
+
+type matrixRelatesTo struct {
+	RelType   string           `json:"rel_type,omitempty"`
+	EventID   string           `json:"event_id,omitempty"`
+	InReplyTo *matrixInReplyTo `json:"m.in_reply_to,omitempty"`
+}
+
+type matrixInReplyTo struct {
+	EventID string `json:"event_id"`
+}
+
+func (e *EndpointMatrix) convertEvent(ctx context.Context, event *matrixEvent) (*model.EndpointUpdate, error) {
+	// Skip echoes of what we sent.
+	if event.Sender == e.userID {
+		return nil, ErrUnsupportedUpdate
+	}
+
+	var content matrixMessageContent
+	err := json.Unmarshal(event.Content, &content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode content of Matrix event %s: %w", event.EventID, err)
+	}
+
+	convertedUpdate := &model.EndpointUpdate{
+		UniqueEndpointMessageID: model.UniqueEndpointMessageID{
+			EID: e.id,
+		},
+		Timestamp: time.UnixMilli(event.OriginServerTS),
+	}
+
+	switch event.Type {
+	case "m.room.redaction":
+		// Redactions by anyone, e.g. moderators, are bridged, unknown messages are ignored by the bridge.
+		redacts := event.Redacts
+		if redacts == "" {
+			redacts = content.Redacts
+		}
+		if redacts == "" {
+			return nil, ErrUnsupportedUpdate
+		}
+		convertedUpdate.Type = model.UpdateTypeDelete
+		convertedUpdate.ID = model.EndpointMessageID(redacts)
+
+	case "m.room.message":
+		if len(e.senders) > 0 && !slices.Contains(e.senders, event.Sender) {
+			return nil, ErrUnsupportedUpdate
+		}
+
+		if content.RelatesTo != nil && content.RelatesTo.RelType == "m.replace" {
+			if content.NewContent == nil || content.RelatesTo.EventID == "" {
+				return nil, ErrUnsupportedUpdate
+			}
+			// Homeservers don't check who edits an event, so edits by others than the original sender are dropped.
+			original, err := e.client.getEvent(ctx, e.roomID, content.RelatesTo.EventID)
+			if err != nil {
+				return nil, fmt.Errorf("failed to fetch edited Matrix event %s: %w", content.RelatesTo.EventID, err)
+			}
+			if original.Sender != event.Sender {
+				return nil, ErrUnsupportedUpdate
+			}
+			convertedUpdate.Type = model.UpdateTypeEdit
+			convertedUpdate.ID = model.EndpointMessageID(content.RelatesTo.EventID)
+			content = *content.NewContent
+		} else {
+			convertedUpdate.Type = model.UpdateTypeNew
+			convertedUpdate.ID = model.EndpointMessageID(event.EventID)
+			if content.RelatesTo != nil && content.RelatesTo.InReplyTo != nil && content.RelatesTo.InReplyTo.EventID != "" {
+				convertedUpdate.Parent = &model.UniqueEndpointMessageID{
+					EID: e.id,
+					ID:  model.EndpointMessageID(content.RelatesTo.InReplyTo.EventID),
+				}
+			}
+		}
+
+		convertedContent, err := e.convertMessage(&content, convertedUpdate.Parent != nil)
+		if err != nil {
+			return nil, err
+		}
+		convertedUpdate.Content = convertedContent
+
+	default:
+		return nil, ErrUnsupportedUpdate
+	}
+
+	return convertedUpdate, nil
+}
+
+func (e *EndpointMatrix) convertMessage(content *matrixMessageContent, isReply bool) (*model.BridgeMessageContent, error) {
+	var kind model.AttachmentKind
+	switch content.MsgType {
+	case "m.text", "m.notice", "m.emote":
+	case "m.image":
+		kind = model.AttachmentKindPhoto
+	case "m.video":
+		kind = model.AttachmentKindVideo
+	case "m.file", "m.audio":
+		kind = model.AttachmentKindDocument
+	default:
+		return nil, ErrUnsupportedUpdate
+	}
+
+	// Body of media is their file name, unless a separate file name is given, which makes the body a caption.
+	text := content.Body
+	formattedBody := content.FormattedBody
+	if kind != 0 && (content.FileName == "" || content.FileName == content.Body) {
+		text, formattedBody = "", ""
+	}
+
+	// Plain text is converted through HTML as well, so that Markdown syntax in it is escaped.
+	if content.Format != matrixHTMLFormat || formattedBody == "" {
+		if isReply {
+			text = stripMatrixReplyFallback(text)
+		}
+		formattedBody = strings.ReplaceAll(html.EscapeString(text), "\n", "<br>")
+	}
+	formattedBody = matrixReplyFallbackPattern.ReplaceAllString(formattedBody, "")
+
+	converted := &model.BridgeMessageContent{}
+	if match := matrixSpoilerPattern.FindStringSubmatch(strings.TrimSpace(formattedBody)); match != nil {
+		converted.SpoilerText = html.UnescapeString(match[1])
+		formattedBody = match[2]
+	}
+
+	formattedBody = matrixInlineSpoilerPattern.ReplaceAllString(formattedBody, "||$1||")
+
+	mdText, err := htmltomarkdown.ConvertString(formattedBody)
+	if err != nil {
+		return nil, err
+	}
+	converted.MDText = mdText
+
+	if kind != 0 && content.URL != "" {
+		attachment := &model.Attachment{
+			Kind:     kind,
+			FileName: content.FileName,
+			Source:   content.URL,
+			Open:     e.AttachmentOpener(content.URL),
+		}
+		if attachment.FileName == "" {
+			attachment.FileName = content.Body
+		}
+		if content.Info != nil {
+			attachment.MIMEType = content.Info.MIMEType
+			attachment.Size = content.Info.Size
+		}
+		converted.Attachments = append(converted.Attachments, attachment)
+	}
+
+	return converted, nil
+}
+
+// stripMatrixReplyFallback removes the "> " quote of the parent prepended to replies by older clients.
+func stripMatrixReplyFallback(text string) string {
+	if !strings.HasPrefix(text, "> ") {
+		return text
+	}
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		if line == "" {
+			return strings.Join(lines[i+1:], "\n")
+		}
+		if !strings.HasPrefix(line, "> ") {
+			break
+		}
+	}
+	return text
+}
+
+// AttachmentOpener recreates the opener of an attachment received from this endpoint, whose source is the mxc:// URI.
+func (e *EndpointMatrix) AttachmentOpener(source string) model.AttachmentOpener {
+	return func(ctx context.Context) (io.ReadCloser, error) {
+		return e.client.download(ctx, source)
+	}
+}
+
+// renderMatrixText renders content as the Markdown body and HTML formatted body of a message.
+func renderMatrixText(content *model.BridgeMessageContent) (string, string, error) {
+	var buf bytes.Buffer
+	err := markdown.Markdown().Convert([]byte(content.MDText), &buf)
+	if err != nil {
+		return "", "", err
+	}
+	// Matrix has its own attribute for spoilers.
+	formattedBody := strings.ReplaceAll(strings.TrimSpace(buf.String()), `<span class="spoiler">`, "<span data-mx-spoiler>")
+
+	body := content.MDText
+	if content.SpoilerText != "" {
+		body = telegramCWPrefix + content.SpoilerText + "\n\n" + body
+		formattedBody = fmt.Sprintf(`<span data-mx-spoiler="%s">%s</span>`, html.EscapeString(content.SpoilerText), formattedBody)
+	}
+	return body, formattedBody, nil
+}
+
+// ApplyUpdateNew sends content as a text message, or as media messages with the text as caption of the first one.
+func (e *EndpointMatrix) ApplyUpdateNew(ctx context.Context, content *model.BridgeMessageContent, replyTo model.EndpointMessageID) (_ []model.EndpointMessageRevision, err error) {
+	defer func() { err = classifyMatrixError(err) }()
+
+	body, formattedBody, err := renderMatrixText(content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render Matrix message: %w", err)
+	}
+
+	messages := []*matrixMessageContent{{
+		MsgType:       "m.text",
+		Body:          body,
+		Format:        matrixHTMLFormat,
+		FormattedBody: formattedBody,
+	}}
+	if len(content.Attachments) > 0 {
+		messages, err = e.uploadAttachments(ctx, content.Attachments)
+		if err != nil {
+			return nil, fmt.Errorf("failed to upload attachments to Matrix: %w", err)
+		}
+		if strings.TrimSpace(content.MDText) != "" || content.SpoilerText != "" {
+			messages[0].Body = body
+			messages[0].Format = matrixHTMLFormat
+			messages[0].FormattedBody = formattedBody
+		}
+	}
+	if replyTo != "" {
+		messages[0].RelatesTo = &matrixRelatesTo{InReplyTo: &matrixInReplyTo{EventID: string(replyTo)}}
+	}
+
+	var revisions []model.EndpointMessageRevision
+	for _, message := range messages {
+		eventID, err := e.client.sendMessage(ctx, e.roomID, message)
+		if err != nil {
+			deleteIncomplete(ctx, e, revisions)
+			return nil, fmt.Errorf("failed to send message to Matrix: %w", err)
+		}
+
+		slog.Debug("Message sent to Matrix", "id", eventID)
+
+		// The homeserver doesn't return the timestamp of sent events.
+		revisions = append(revisions, model.EndpointMessageRevision{
+			ID:        model.EndpointMessageID(eventID),
+			Timestamp: time.Now(),
+		})
+	}
+
+	return revisions, nil
+}
+
+// uploadAttachments uploads attachments, and returns media messages to send them, without caption.
+func (e *EndpointMatrix) uploadAttachments(ctx context.Context, attachments []*model.Attachment) ([]*matrixMessageContent, error) {
+	var messages []*matrixMessageContent
+	for _, attachment := range attachments {
+		r, err := attachment.Open(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		// Media messages need a file name, clients tell the file type from its MIME type anyway.
+		fileName := attachment.FileName
+		if fileName == "" {
+			fileName = attachment.Kind.String()
+		}
+
+		uri, err := e.client.upload(ctx, r, attachment.Size, attachment.MIMEType, fileName)
+		r.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		slog.Debug("Media uploaded to Matrix", "uri", uri, "kind", attachment.Kind)
+
+		messages = append(messages, &matrixMessageContent{
+			MsgType:  matrixMsgType(attachment),
+			Body:     fileName,
+			FileName: fileName,
+			URL:      uri,
+			Info: &matrixMediaInfo{
+				MIMEType: attachment.MIMEType,
+				Size:     attachment.Size,
+			},
+		})
+	}
+
+	return messages, nil
+}
+
+func matrixMsgType(attachment *model.Attachment) string {
+	switch attachment.Kind {
+	case model.AttachmentKindPhoto:
+		return "m.image"
+	case model.AttachmentKindVideo:
+		return "m.video"
+	case model.AttachmentKindAnimation:
+		// GIFs are images in Matrix, while Telegram converts animations to silent videos.
+		if strings.HasPrefix(attachment.MIMEType, "image/") {
+			return "m.image"
+		}
+		return "m.video"
+	default:
+		return "m.file"
+	}
+}
+
+// ApplyUpdateEdit replaces the text or caption of the first message, media can't be edited.
+func (e *EndpointMatrix) ApplyUpdateEdit(ctx context.Context, ids []model.EndpointMessageID, content *model.BridgeMessageContent) (_ []model.EndpointMessageRevision, err error) {
+	defer func() { err = classifyMatrixError(err) }()
+
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("no Matrix message to edit")
+	}
+
+	body, formattedBody, err := renderMatrixText(content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to render Matrix message: %w", err)
+	}
+
+	// The new content replaces the original one entirely, so media fields are copied from the original message.
+	original, err := e.client.getEvent(ctx, e.roomID, string(ids[0]))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch message from Matrix: %w", err)
+	}
+	var newContent map[string]any
+	err = json.Unmarshal(original.Content, &newContent)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode content of Matrix event %s: %w", ids[0], err)
+	}
+	delete(newContent, "m.relates_to")
+	delete(newContent, "m.new_content")
+
+	fileName, isMedia := newContent["filename"].(string)
+	if isMedia && strings.TrimSpace(content.MDText) == "" && content.SpoilerText == "" {
+		newContent["body"] = fileName
+		delete(newContent, "format")
+		delete(newContent, "formatted_body")
+	} else {
+		newContent["body"] = body
+		newContent["format"] = matrixHTMLFormat
+		newContent["formatted_body"] = formattedBody
+	}
+
+	eventID, err := e.client.sendMessage(ctx, e.roomID, map[string]any{
+		"msgtype":        newContent["msgtype"],
+		"body":           "* " + body,
+		"m.new_content":  newContent,
+		"m.relates_to":   &matrixRelatesTo{RelType: "m.replace", EventID: string(ids[0])},
+		"format":         matrixHTMLFormat,
+		"formatted_body": "* " + formattedBody,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to edit message in Matrix: %w", err)
+	}
+
+	slog.Debug("Message edited in Matrix", "id", ids[0], "edit", eventID)
+
+	// Media messages following the first one are kept as they are.
+	now := time.Now()
+	revisions := make([]model.EndpointMessageRevision, 0, len(ids))
+	for _, id := range ids {
+		revisions = append(revisions, model.EndpointMessageRevision{ID: id, Timestamp: now})
+	}
+	return revisions, nil
+}
+
+func (e *EndpointMatrix) ApplyUpdateDelete(ctx context.Context, id model.EndpointMessageID) error {
+	err := e.client.redact(ctx, e.roomID, string(id))
+	if err != nil {
+		return classifyMatrixError(fmt.Errorf("failed to redact message in Matrix: %w", err))
+	}
+
+	slog.Debug("Message redacted in Matrix", "id", id)
+
+	return nil
+}
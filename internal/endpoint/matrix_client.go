@@ -0,0 +1,277 @@
+package endpoint
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// matrixClient is a minimal client of the Matrix client-server API.
+type matrixClient struct {
+	homeserver  string
+	accessToken string
+	httpClient  *http.Client
+	status      *statusTracker
+
+	// Transaction IDs only need to be unique per access token, a counter prefixed by startup time is enough.
+	txnPrefix  string
+	txnCounter atomic.Int64
+}
+
+func newMatrixClient(homeserver, accessToken string, status *statusTracker) *matrixClient {
+	return &matrixClient{
+		homeserver:  strings.TrimSuffix(homeserver, "/"),
+		accessToken: accessToken,
+		// Requests are bounded by contexts instead, as sync long polls take a while.
+		httpClient: &http.Client{},
+		status:     status,
+		txnPrefix:  fmt.Sprintf("tele2don.%d", time.Now().UnixNano()),
+	}
+}
+
+// matrixError is an error response of the homeserver.
+type matrixError struct {
+	StatusCode   int
+	ErrCode      string `json:"errcode"`
+	Message      string `json:"error"`
+	RetryAfterMS int64  `json:"retry_after_ms"`
+}
+
+func (e *matrixError) Error() string {
+	return fmt.Sprintf("matrix: %d %s: %s", e.StatusCode, e.ErrCode, e.Message)
+}
+
+// classifyMatrixError wraps errors of rate limiting and rejected requests for the bridge service.
+func classifyMatrixError(err error) error {
+	var matrixErr *matrixError
+	if !errors.As(err, &matrixErr) {
+		return err
+	}
+
+	status := matrixErr.StatusCode
+	if matrixErr.ErrCode == "M_LIMIT_EXCEEDED" {
+		status = http.StatusTooManyRequests
+	}
+	return classifyHTTPStatus(err, status, time.Duration(matrixErr.RetryAfterMS)*time.Millisecond)
+}
+
+func (c *matrixClient) nextTxnID() string {
+	return fmt.Sprintf("%s.%d", c.txnPrefix, c.txnCounter.Add(1))
+}
+
+// do sends a request to the homeserver, encoding body as JSON, and decodes the JSON response into result if not nil.
+func (c *matrixClient) do(ctx context.Context, method, path string, query url.Values, body, result any) error {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(data)
+	}
+
+	req, err := c.newRequest(ctx, method, path, query, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := c.send(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if result == nil {
+		return nil
+	}
+	err = json.NewDecoder(resp.Body).Decode(result)
+	if err != nil {
+		return fmt.Errorf("failed to decode response of %s: %w", path, err)
+	}
+	return nil
+}
+
+func (c *matrixClient) newRequest(ctx context.Context, method, path string, query url.Values, body io.Reader) (*http.Request, error) {
+	u := c.homeserver + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.accessToken)
+	return req, nil
+}
+
+// send sends req, and turns responses other than 2xx into matrixError.
+func (c *matrixClient) send(req *http.Request) (*http.Response, error) {
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		// Strip the URL, which is noisy in logs.
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return nil, fmt.Errorf("matrix: %s %s: %w", req.Method, req.URL.Path, err)
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		matrixErr := &matrixError{}
+		decodeErrorBody(resp.Body, matrixErr)
+		matrixErr.StatusCode = resp.StatusCode
+		if matrixErr.ErrCode == "" {
+			matrixErr.ErrCode = "M_UNKNOWN"
+		}
+		return nil, matrixErr
+	}
+
+	c.status.apiCallSucceeded()
+	return resp, nil
+}
+
+func (c *matrixClient) whoami(ctx context.Context) (string, error) {
+	var resp struct {
+		UserID string `json:"user_id"`
+	}
+	err := c.do(ctx, http.MethodGet, "/_matrix/client/v3/account/whoami", nil, nil, &resp)
+	return resp.UserID, err
+}
+
+// joinRoom joins the room, which is a no-op if we are already in it.
+func (c *matrixClient) joinRoom(ctx context.Context, roomID string) error {
+	return c.do(ctx, http.MethodPost, "/_matrix/client/v3/rooms/"+url.PathEscape(roomID)+"/join", nil, struct{}{}, nil)
+}
+
+// matrixEvent is a room event, with content left undecoded as its schema depends on the type.
+type matrixEvent struct {
+	Type           string          `json:"type"`
+	EventID        string          `json:"event_id"`
+	Sender         string          `json:"sender"`
+	OriginServerTS int64           `json:"origin_server_ts"`
+	Content        json.RawMessage `json:"content"`
+	// Redacts is the target of redactions in room versions before 11, later ones put it in content.
+	Redacts string `json:"redacts"`
+}
+
+type matrixSyncResponse struct {
+	NextBatch string `json:"next_batch"`
+	Rooms     struct {
+		Join map[string]struct {
+			Timeline struct {
+				Events  []matrixEvent `json:"events"`
+				Limited bool          `json:"limited"`
+			} `json:"timeline"`
+		} `json:"join"`
+	} `json:"rooms"`
+}
+
+// sync long polls new events after since, waiting up to timeout if there are none.
+func (c *matrixClient) sync(ctx context.Context, since, filter string, timeout time.Duration) (*matrixSyncResponse, error) {
+	query := url.Values{
+		"timeout": {fmt.Sprint(timeout.Milliseconds())},
+		"filter":  {filter},
+	}
+	if since != "" {
+		query.Set("since", since)
+	}
+
+	resp := &matrixSyncResponse{}
+	err := c.do(ctx, http.MethodGet, "/_matrix/client/v3/sync", query, nil, resp)
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// getEvent fetches a single event of the room.
+func (c *matrixClient) getEvent(ctx context.Context, roomID, eventID string) (*matrixEvent, error) {
+	event := &matrixEvent{}
+	err := c.do(ctx, http.MethodGet, "/_matrix/client/v3/rooms/"+url.PathEscape(roomID)+"/event/"+url.PathEscape(eventID), nil, nil, event)
+	if err != nil {
+		return nil, err
+	}
+	return event, nil
+}
+
+// sendMessage sends an m.room.message event, and returns its event ID.
+func (c *matrixClient) sendMessage(ctx context.Context, roomID string, content any) (string, error) {
+	var resp struct {
+		EventID string `json:"event_id"`
+	}
+	path := "/_matrix/client/v3/rooms/" + url.PathEscape(roomID) + "/send/m.room.message/" + url.PathEscape(c.nextTxnID())
+	err := c.do(ctx, http.MethodPut, path, nil, content, &resp)
+	return resp.EventID, err
+}
+
+func (c *matrixClient) redact(ctx context.Context, roomID, eventID string) error {
+	path := "/_matrix/client/v3/rooms/" + url.PathEscape(roomID) + "/redact/" + url.PathEscape(eventID) + "/" + url.PathEscape(c.nextTxnID())
+	return c.do(ctx, http.MethodPut, path, nil, struct{}{}, nil)
+}
+
+// upload uploads media, and returns its mxc:// URI.
+func (c *matrixClient) upload(ctx context.Context, r io.Reader, size int64, mimeType, fileName string) (string, error) {
+	query := url.Values{}
+	if fileName != "" {
+		query.Set("filename", fileName)
+	}
+	req, err := c.newRequest(ctx, http.MethodPost, "/_matrix/media/v3/upload", query, r)
+	if err != nil {
+		return "", err
+	}
+	if size > 0 {
+		req.ContentLength = size
+	}
+	if mimeType == "" {
+		mimeType = "application/octet-stream"
+	}
+	req.Header.Set("Content-Type", mimeType)
+
+	resp, err := c.send(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var uploaded struct {
+		ContentURI string `json:"content_uri"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&uploaded)
+	if err != nil {
+		return "", fmt.Errorf("failed to decode upload response: %w", err)
+	}
+	return uploaded.ContentURI, nil
+}
+
+// download opens media by its mxc:// URI through the authenticated media API.
+func (c *matrixClient) download(ctx context.Context, mxc string) (io.ReadCloser, error) {
+	serverAndID, ok := strings.CutPrefix(mxc, "mxc://")
+	server, mediaID, ok2 := strings.Cut(serverAndID, "/")
+	if !ok || !ok2 || server == "" || mediaID == "" {
+		return nil, fmt.Errorf("invalid Matrix content URI %q", mxc)
+	}
+
+	path := "/_matrix/client/v1/media/download/" + url.PathEscape(server) + "/" + url.PathEscape(mediaID)
+	req, err := c.newRequest(ctx, http.MethodGet, path, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := c.send(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download file: %w", err)
+	}
+	return resp.Body, nil
+}
@@ -0,0 +1,102 @@
+package endpoint
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/merrkry/tele2don/internal/model"
+)
+
+const (
+	// matrixSyncTimeout is how long a sync long poll waits for new events.
+	matrixSyncTimeout = 30 * time.Second
+	// matrixSyncRequestTimeout bounds a sync request, leaving the homeserver some slack over matrixSyncTimeout.
+	matrixSyncRequestTimeout = matrixSyncTimeout + 30*time.Second
+	matrixSyncMinBackoff     = time.Second
+	matrixSyncMaxBackoff     = 5 * time.Minute
+	// matrixSyncTimelineLimit is the number of events returned per sync, more of them are skipped as a gap.
+	matrixSyncTimelineLimit = 100
+)
+
+// syncFilter restricts sync responses to messages and redactions of the bridged room.
+func (e *EndpointMatrix) syncFilter() string {
+	none := map[string]any{"types": []string{}}
+	filter := map[string]any{
+		"presence":     none,
+		"account_data": none,
+		"room": map[string]any{
+			"rooms":        []string{e.roomID},
+			"state":        map[string]any{"types": []string{}, "lazy_load_members": true},
+			"ephemeral":    none,
+			"account_data": none,
+			"timeline": map[string]any{
+				"types": []string{"m.room.message", "m.room.redaction"},
+				"limit": matrixSyncTimelineLimit,
+			},
+		},
+	}
+	data, _ := json.Marshal(filter)
+	return string(data)
+}
+
+// ListenUpdates syncs events of the room, retrying with backoff whenever a sync fails.
+func (e *EndpointMatrix) ListenUpdates(ctx context.Context, updatesChan chan<- *model.EndpointUpdate, wg *sync.WaitGroup) {
+	defer wg.Done()
+	e.status.setListening(true)
+	defer e.status.setListening(false)
+
+	filter := e.syncFilter()
+	retry := &backoff{min: matrixSyncMinBackoff, max: matrixSyncMaxBackoff}
+	since := ""
+	for {
+		// The initial sync returns recent history, which is only used to find where to continue from.
+		timeout := matrixSyncTimeout
+		if since == "" {
+			timeout = 0
+		}
+		syncCtx, cancel := context.WithTimeout(ctx, matrixSyncRequestTimeout)
+		resp, err := e.client.sync(syncCtx, since, filter, timeout)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		if err != nil {
+			delay := retry.next()
+			slog.Warn("Matrix sync failed, retrying", "eid", e.id, "delay", delay, "err", err)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(delay):
+			}
+			continue
+		}
+		retry.reset()
+		e.status.heartbeat()
+
+		if since != "" {
+			room := resp.Rooms.Join[e.roomID]
+			if room.Timeline.Limited {
+				slog.Warn("Matrix sync skipped events of the room", "eid", e.id)
+			}
+			for i := range room.Timeline.Events {
+				convertedUpdate, err := e.convertEvent(ctx, &room.Timeline.Events[i])
+				if errors.Is(err, ErrUnsupportedUpdate) {
+					continue
+				} else if err != nil {
+					slog.Error("Failed to convert Matrix event", "id", room.Timeline.Events[i].EventID, "err", err)
+					continue
+				}
+				select {
+				case <-ctx.Done():
+					return
+				case updatesChan <- convertedUpdate:
+				}
+			}
+		}
+		since = resp.NextBatch
+	}
+}
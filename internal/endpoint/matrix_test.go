@@ -0,0 +1,337 @@
+package endpoint
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/merrkry/tele2don/internal/model"
+)
+
+const (
+	testMatrixUserID = "@bridge:example.org"
+	testMatrixRoomID = "!room:example.org"
+	testMatrixToken  = "secret"
+)
+
+// fakeHomeserver implements the routes of the client-server API used by the Matrix endpoint.
+type fakeHomeserver struct {
+	t *testing.T
+
+	mu       sync.Mutex
+	joined   []string
+	events   map[string]*matrixEvent
+	sent     []map[string]any
+	redacted []string
+	// timeline is returned by the first incremental sync, later ones block until the request ends.
+	timeline []matrixEvent
+	syncs    int
+}
+
+func newFakeHomeserver(t *testing.T) (*fakeHomeserver, *httptest.Server) {
+	hs := &fakeHomeserver{t: t, events: make(map[string]*matrixEvent)}
+	srv := httptest.NewServer(hs)
+	t.Cleanup(srv.Close)
+	return hs, srv
+}
+
+func (hs *fakeHomeserver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Authorization") != "Bearer "+testMatrixToken {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"errcode": "M_UNKNOWN_TOKEN", "error": "unknown token"})
+		return
+	}
+
+	hs.mu.Lock()
+	defer hs.mu.Unlock()
+
+	roomPrefix := "/_matrix/client/v3/rooms/" + testMatrixRoomID + "/"
+	path := r.URL.Path
+	switch {
+	case path == "/_matrix/client/v3/account/whoami":
+		hs.reply(w, map[string]string{"user_id": testMatrixUserID})
+
+	case path == roomPrefix+"join" && r.Method == http.MethodPost:
+		hs.joined = append(hs.joined, testMatrixRoomID)
+		hs.reply(w, map[string]string{"room_id": testMatrixRoomID})
+
+	case strings.HasPrefix(path, roomPrefix+"send/m.room.message/") && r.Method == http.MethodPut:
+		var content map[string]any
+		if err := json.NewDecoder(r.Body).Decode(&content); err != nil {
+			hs.t.Errorf("invalid message content: %v", err)
+		}
+		eventID := fmt.Sprintf("$event%d", len(hs.sent)+1)
+		raw, _ := json.Marshal(content)
+		hs.events[eventID] = &matrixEvent{Type: "m.room.message", EventID: eventID, Sender: testMatrixUserID, Content: raw}
+		hs.sent = append(hs.sent, content)
+		hs.reply(w, map[string]string{"event_id": eventID})
+
+	case strings.HasPrefix(path, roomPrefix+"event/"):
+		event, ok := hs.events[strings.TrimPrefix(path, roomPrefix+"event/")]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			hs.reply(w, map[string]string{"errcode": "M_NOT_FOUND", "error": "event not found"})
+			return
+		}
+		hs.reply(w, event)
+
+	case strings.HasPrefix(path, roomPrefix+"redact/") && r.Method == http.MethodPut:
+		eventID, _, _ := strings.Cut(strings.TrimPrefix(path, roomPrefix+"redact/"), "/")
+		hs.redacted = append(hs.redacted, eventID)
+		hs.reply(w, map[string]string{"event_id": "$redaction"})
+
+	case path == "/_matrix/client/v3/sync":
+		hs.sync(w, r)
+
+	default:
+		hs.t.Errorf("unexpected request %s %s", r.Method, path)
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+func (hs *fakeHomeserver) sync(w http.ResponseWriter, r *http.Request) {
+	hs.syncs++
+	resp := matrixSyncResponse{NextBatch: fmt.Sprintf("batch%d", hs.syncs)}
+	switch since := r.URL.Query().Get("since"); {
+	case since == "":
+		// The initial sync returns history, which must not be bridged.
+		hs.addTimeline(&resp, []matrixEvent{textEvent("$history", "@alice:example.org", "old")})
+	case hs.timeline != nil:
+		for i := range hs.timeline {
+			hs.events[hs.timeline[i].EventID] = &hs.timeline[i]
+		}
+		hs.addTimeline(&resp, hs.timeline)
+		hs.timeline = nil
+	default:
+		hs.mu.Unlock()
+		<-r.Context().Done()
+		hs.mu.Lock()
+		return
+	}
+	hs.reply(w, resp)
+}
+
+func (hs *fakeHomeserver) addTimeline(resp *matrixSyncResponse, events []matrixEvent) {
+	room := resp.Rooms.Join[testMatrixRoomID]
+	room.Timeline.Events = events
+	if resp.Rooms.Join == nil {
+		resp.Rooms.Join = make(map[string]struct {
+			Timeline struct {
+				Events  []matrixEvent `json:"events"`
+				Limited bool          `json:"limited"`
+			} `json:"timeline"`
+		})
+	}
+	resp.Rooms.Join[testMatrixRoomID] = room
+}
+
+func (hs *fakeHomeserver) reply(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		hs.t.Errorf("failed to encode response: %v", err)
+	}
+}
+
+func textEvent(eventID, sender, body string) matrixEvent {
+	content, _ := json.Marshal(map[string]any{"msgtype": "m.text", "body": body})
+	return matrixEvent{Type: "m.room.message", EventID: eventID, Sender: sender, OriginServerTS: 1700000000000, Content: content}
+}
+
+func rawEvent(typ, eventID, sender string, content map[string]any) matrixEvent {
+	raw, _ := json.Marshal(content)
+	return matrixEvent{Type: typ, EventID: eventID, Sender: sender, OriginServerTS: 1700000000000, Content: raw}
+}
+
+func newTestMatrixEndpoint(t *testing.T, homeserver string) *EndpointMatrix {
+	t.Helper()
+	e := NewEndpointMatrix("matrix")
+	err := e.Initialize(context.Background(), &EndpointConfig{Matrix: &EndpointConfigMatrix{
+		Homeserver:  homeserver,
+		AccessToken: testMatrixToken,
+		RoomID:      testMatrixRoomID,
+	}})
+	if err != nil {
+		t.Fatalf("Initialize: %v", err)
+	}
+	return e
+}
+
+func TestMatrixInitialize(t *testing.T) {
+	hs, srv := newFakeHomeserver(t)
+	e := newTestMatrixEndpoint(t, srv.URL)
+
+	if e.userID != testMatrixUserID {
+		t.Errorf("user ID = %q, want %q", e.userID, testMatrixUserID)
+	}
+	if len(hs.joined) != 1 {
+		t.Errorf("joined the room %d times, want 1", len(hs.joined))
+	}
+	if !e.Status().Initialized {
+		t.Error("endpoint is not initialized")
+	}
+
+	bad := NewEndpointMatrix("matrix")
+	err := bad.Initialize(context.Background(), &EndpointConfig{Matrix: &EndpointConfigMatrix{
+		Homeserver:  srv.URL,
+		AccessToken: "wrong",
+		RoomID:      testMatrixRoomID,
+	}})
+	if err == nil {
+		t.Error("Initialize succeeded with an invalid access token")
+	}
+}
+
+func TestMatrixSendEditRedact(t *testing.T) {
+	hs, srv := newFakeHomeserver(t)
+	e := newTestMatrixEndpoint(t, srv.URL)
+	ctx := context.Background()
+
+	revisions, err := e.ApplyUpdateNew(ctx, &model.BridgeMessageContent{MDText: "hello **world**"}, "$parent")
+	if err != nil {
+		t.Fatalf("ApplyUpdateNew: %v", err)
+	}
+	if len(revisions) != 1 || revisions[0].ID != "$event1" {
+		t.Fatalf("revisions = %+v, want $event1", revisions)
+	}
+	sent := hs.sent[0]
+	if sent["body"] != "hello **world**" || sent["formatted_body"] != "<p>hello <strong>world</strong></p>" {
+		t.Errorf("sent %v", sent)
+	}
+	inReplyTo, _ := sent["m.relates_to"].(map[string]any)["m.in_reply_to"].(map[string]any)
+	if inReplyTo["event_id"] != "$parent" {
+		t.Errorf("reply relation = %v, want $parent", sent["m.relates_to"])
+	}
+
+	revisions, err = e.ApplyUpdateEdit(ctx, []model.EndpointMessageID{"$event1"}, &model.BridgeMessageContent{MDText: "edited"})
+	if err != nil {
+		t.Fatalf("ApplyUpdateEdit: %v", err)
+	}
+	if len(revisions) != 1 || revisions[0].ID != "$event1" {
+		t.Errorf("revisions = %+v, want $event1", revisions)
+	}
+	edit := hs.sent[1]
+	relatesTo, _ := edit["m.relates_to"].(map[string]any)
+	if relatesTo["rel_type"] != "m.replace" || relatesTo["event_id"] != "$event1" {
+		t.Errorf("edit relation = %v", edit["m.relates_to"])
+	}
+	newContent, _ := edit["m.new_content"].(map[string]any)
+	if newContent["body"] != "edited" || newContent["msgtype"] != "m.text" {
+		t.Errorf("new content = %v", newContent)
+	}
+	if _, ok := newContent["m.relates_to"]; ok {
+		t.Error("new content keeps the reply relation of the original message")
+	}
+
+	err = e.ApplyUpdateDelete(ctx, "$event1")
+	if err != nil {
+		t.Fatalf("ApplyUpdateDelete: %v", err)
+	}
+	if len(hs.redacted) != 1 || hs.redacted[0] != "$event1" {
+		t.Errorf("redacted %v, want [$event1]", hs.redacted)
+	}
+
+	// Editing an unknown event is rejected for good.
+	_, err = e.ApplyUpdateEdit(ctx, []model.EndpointMessageID{"$unknown"}, &model.BridgeMessageContent{MDText: "x"})
+	var permanent *PermanentError
+	if !errors.As(err, &permanent) {
+		t.Errorf("ApplyUpdateEdit of unknown event = %v, want PermanentError", err)
+	}
+}
+
+func TestMatrixListenUpdates(t *testing.T) {
+	hs, srv := newFakeHomeserver(t)
+	e := newTestMatrixEndpoint(t, srv.URL)
+
+	hs.mu.Lock()
+	hs.timeline = []matrixEvent{
+		textEvent("$own", testMatrixUserID, "sent by the bridge"),
+		textEvent("$new", "@alice:example.org", "a_b *c*"),
+		rawEvent("m.room.message", "$reply", "@alice:example.org", map[string]any{
+			"msgtype":      "m.text",
+			"body":         "> <@bob:example.org> parent\n\nreply",
+			"m.relates_to": map[string]any{"m.in_reply_to": map[string]any{"event_id": "$new"}},
+		}),
+		rawEvent("m.room.message", "$edit", "@alice:example.org", map[string]any{
+			"msgtype":       "m.text",
+			"body":          "* edited",
+			"m.new_content": map[string]any{"msgtype": "m.text", "body": "edited"},
+			"m.relates_to":  map[string]any{"rel_type": "m.replace", "event_id": "$new"},
+		}),
+		// Edits by others than the original sender are ignored, including edits of our own messages.
+		rawEvent("m.room.message", "$forged", "@mallory:example.org", map[string]any{
+			"msgtype":       "m.text",
+			"body":          "* forged",
+			"m.new_content": map[string]any{"msgtype": "m.text", "body": "forged"},
+			"m.relates_to":  map[string]any{"rel_type": "m.replace", "event_id": "$new"},
+		}),
+		rawEvent("m.room.message", "$forged-own", "@mallory:example.org", map[string]any{
+			"msgtype":       "m.text",
+			"body":          "* forged",
+			"m.new_content": map[string]any{"msgtype": "m.text", "body": "forged"},
+			"m.relates_to":  map[string]any{"rel_type": "m.replace", "event_id": "$own"},
+		}),
+		// Room versions 11 and later put the target of redactions in content.
+		rawEvent("m.room.redaction", "$redaction", "@mod:example.org", map[string]any{"redacts": "$reply"}),
+		rawEvent("m.room.member", "$member", "@alice:example.org", map[string]any{"membership": "join"}),
+	}
+	hs.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	updates := make(chan *model.EndpointUpdate, 16)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go e.ListenUpdates(ctx, updates, &wg)
+
+	var got []*model.EndpointUpdate
+	for len(got) < 4 {
+		select {
+		case update := <-updates:
+			got = append(got, update)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received %d updates, want 4", len(got))
+		}
+	}
+	cancel()
+	wg.Wait()
+
+	want := []struct {
+		typ    model.EndpointUpdateType
+		id     model.EndpointMessageID
+		text   string
+		parent model.EndpointMessageID
+	}{
+		{model.UpdateTypeNew, "$new", `a\_b \*c*`, ""},
+		{model.UpdateTypeNew, "$reply", "reply", "$new"},
+		{model.UpdateTypeEdit, "$new", "edited", ""},
+		{model.UpdateTypeDelete, "$reply", "", ""},
+	}
+	for i, w := range want {
+		update := got[i]
+		if update.Type != w.typ || update.ID != w.id || update.EID != "matrix" {
+			t.Errorf("update %d = %v %s/%s, want %v %s", i, update.Type, update.EID, update.ID, w.typ, w.id)
+			continue
+		}
+		if w.text != "" && (update.Content == nil || update.Content.MDText != w.text) {
+			t.Errorf("update %d content = %+v, want %q", i, update.Content, w.text)
+		}
+		var parent model.EndpointMessageID
+		if update.Parent != nil {
+			parent = update.Parent.ID
+		}
+		if parent != w.parent {
+			t.Errorf("update %d parent = %q, want %q", i, parent, w.parent)
+		}
+	}
+	select {
+	case update := <-updates:
+		t.Errorf("unexpected update %v %s", update.Type, update.ID)
+	default:
+	}
+}
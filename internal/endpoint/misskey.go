@@ -0,0 +1,426 @@
+package endpoint
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"path"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/merrkry/tele2don/internal/markdown"
+	"github.com/merrkry/tele2don/internal/model"
+)
+
+const (
+	misskeyMaxFiles = 16
+	// misskeyDefaultMaxNoteTextLength is the limit of vanilla Misskey, used if the server doesn't report its own.
+	misskeyDefaultMaxNoteTextLength = 3000
+)
+
+type EndpointConfigMisskey struct {
+	// Server is the base URL of the Misskey (or fork, e.g. Sharkey) server.
+	Server      string `json:"server"`
+	AccessToken string `json:"access_token"`
+
+	// Visibility of notes posted by the bridge. If empty, the visibility of the source message is kept,
+	// or notes are public if the source has none.
+	Visibility model.Visibility `json:"visibility"`
+	// BridgeVisibilities lists visibilities of notes to bridge, defaults to public and unlisted (home).
+	BridgeVisibilities []model.Visibility `json:"bridge_visibilities"`
+}
+
+func (c *EndpointConfigMisskey) validate() error {
+	u, err := url.Parse(c.Server)
+	if err != nil {
+		return fmt.Errorf("server: %w", err)
+	}
+	if (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("server: must be an absolute http(s) URL, got %q", c.Server)
+	}
+	if c.AccessToken == "" {
+		return fmt.Errorf("access_token: required")
+	}
+	if c.Visibility != "" && !c.Visibility.Valid() {
+		return fmt.Errorf("visibility: unsupported visibility %q", c.Visibility)
+	}
+	for i, visibility := range c.BridgeVisibilities {
+		if !visibility.Valid() {
+			return fmt.Errorf("bridge_visibilities[%d]: unsupported visibility %q", i, visibility)
+		}
+	}
+	return nil
+}
+
+// EndpointMisskey bridges our own notes, except pure renotes and replies to others.
+type EndpointMisskey struct {
+	id     model.EndpointID
+	client *misskeyClient
+	userID string
+
+	visibility         model.Visibility
+	bridgeVisibilities []model.Visibility
+
+	maxNoteTextLength int
+	// canEdit is set if the server implements notes/edit, which vanilla Misskey doesn't.
+	canEdit bool
+
+	status statusTracker
+
+	// Only accessed by the goroutine of the stream.
+	lastSeenID string
+	subscribed []string
+}
+
+func NewEndpointMisskey(id model.EndpointID) *EndpointMisskey {
+	return &EndpointMisskey{
+		id: id,
+	}
+}
+
+func (e *EndpointMisskey) ID() model.EndpointID {
+	return e.id
+}
+
+func (e *EndpointMisskey) Initialize(ctx context.Context, cfg *EndpointConfig) error {
+	e.client = newMisskeyClient(cfg.Misskey.Server, cfg.Misskey.AccessToken, &e.status)
+	e.visibility = cfg.Misskey.Visibility
+	e.bridgeVisibilities = cfg.Misskey.BridgeVisibilities
+	if e.bridgeVisibilities == nil {
+		e.bridgeVisibilities = []model.Visibility{model.VisibilityPublic, model.VisibilityUnlisted}
+	}
+
+	// Needed to tell our own notes apart from others in the home timeline.
+	userID, err := e.client.i(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to verify Misskey access token: %w", err)
+	}
+	e.userID = userID
+
+	e.maxNoteTextLength, err = e.client.maxNoteTextLength(ctx)
+	if err != nil || e.maxNoteTextLength <= 0 {
+		e.maxNoteTextLength = misskeyDefaultMaxNoteTextLength
+		slog.Warn("Failed to fetch note length limit from Misskey, using default", "eid", e.id, "maxNoteTextLength", e.maxNoteTextLength, "err", err)
+	}
+
+	e.canEdit, err = e.client.hasEndpoint(ctx, "notes/edit")
+	if err != nil {
+		slog.Warn("Failed to check whether Misskey supports editing, assuming not", "eid", e.id, "err", err)
+	}
+
+	e.status.setInitialized()
+	return nil
+}
+
+func (e *EndpointMisskey) Status() Status {
+	return e.status.status()
+}
+
+// misskeyVisibilities maps Misskey visibilities to the bridge ones, which follow Mastodon.
+var misskeyVisibilities = map[string]model.Visibility{
+	"public":    model.VisibilityPublic,
+	"home":      model.VisibilityUnlisted,
+	"followers": model.VisibilityPrivate,
+	"specified": model.VisibilityDirect,
+}
+
+// acceptNote reports whether a note should be bridged.
+func (e *EndpointMisskey) acceptNote(note *misskeyNote) bool {
+	if note.UserID != e.userID {
+		return false
+	}
+	if !slices.Contains(e.bridgeVisibilities, misskeyVisibilities[note.Visibility]) {
+		return false
+	}
+	// Renotes without text or files carry no content of their own.
+	if note.RenoteID != nil && note.Text == nil && len(note.Files) == 0 {
+		return false
+	}
+	if note.Reply != nil && note.Reply.UserID != e.userID {
+		return false
+	}
+	return true
+}
+
+func (e *EndpointMisskey) convertNote(note *misskeyNote, updateType model.EndpointUpdateType) *model.EndpointUpdate {
+	convertedUpdate := &model.EndpointUpdate{
+		Type: updateType,
+		UniqueEndpointMessageID: model.UniqueEndpointMessageID{
+			EID: e.id,
+			ID:  model.EndpointMessageID(note.ID),
+		},
+		Timestamp: note.CreatedAt,
+		Content:   e.convertContent(note),
+	}
+	if updateType == model.UpdateTypeEdit {
+		// Forks without updatedAt still need a new revision, or the edit would be taken as a duplicate.
+		convertedUpdate.Timestamp = time.Now()
+		if note.UpdatedAt != nil {
+			convertedUpdate.Timestamp = *note.UpdatedAt
+		}
+	}
+	if updateType == model.UpdateTypeNew && note.ReplyID != nil {
+		convertedUpdate.Parent = &model.UniqueEndpointMessageID{
+			EID: e.id,
+			ID:  model.EndpointMessageID(*note.ReplyID),
+		}
+	}
+	return convertedUpdate
+}
+
+func (e *EndpointMisskey) convertContent(note *misskeyNote) *model.BridgeMessageContent {
+	content := &model.BridgeMessageContent{
+		Visibility: misskeyVisibilities[note.Visibility],
+	}
+	if note.Text != nil {
+		content.MDText = mfmToMarkdown(*note.Text)
+	}
+	if note.CW != nil {
+		content.SpoilerText = *note.CW
+	}
+
+	// Quoted notes are linked, like Misskey shows quotes on platforms without them.
+	if note.Renote != nil {
+		quoteURL := e.client.server + "/notes/" + note.Renote.ID
+		if note.Renote.URI != nil {
+			quoteURL = *note.Renote.URI
+		}
+		content.MDText = strings.TrimSpace(content.MDText + "\n\nRN: " + quoteURL)
+	}
+
+	for _, file := range note.Files {
+		var kind model.AttachmentKind
+		switch {
+		case file.Type == "image/gif":
+			kind = model.AttachmentKindAnimation
+		case strings.HasPrefix(file.Type, "image/"):
+			kind = model.AttachmentKindPhoto
+		case strings.HasPrefix(file.Type, "video/"):
+			kind = model.AttachmentKindVideo
+		default:
+			kind = model.AttachmentKindDocument
+		}
+
+		attachment := &model.Attachment{
+			Kind:     kind,
+			MIMEType: file.Type,
+			Size:     file.Size,
+			FileName: file.Name,
+			Source:   file.URL,
+			Open:     e.AttachmentOpener(file.URL),
+		}
+		if file.Comment != nil {
+			attachment.AltText = *file.Comment
+		}
+		content.Sensitive = content.Sensitive || file.IsSensitive
+		content.Attachments = append(content.Attachments, attachment)
+	}
+
+	return content
+}
+
+// AttachmentOpener recreates the opener of an attachment received from this endpoint, whose source is the file URL.
+func (e *EndpointMisskey) AttachmentOpener(source string) model.AttachmentOpener {
+	return func(ctx context.Context) (io.ReadCloser, error) {
+		return openRemoteFile(ctx, source)
+	}
+}
+
+// noteLength counts characters of bridge Markdown as rendered for Misskey, which counts code points.
+func noteLength(md string) int {
+	return utf8.RuneCountInString(renderMFM(md))
+}
+
+// splitNote splits content into notes within the server limit, to be posted as a thread.
+func (e *EndpointMisskey) splitNote(content *model.BridgeMessageContent) []string {
+	return markdown.Split(content.MDText, e.maxNoteTextLength, noteLength)
+}
+
+// noteParams returns parameters of notes/create and notes/edit for text, which is bridge Markdown.
+func (e *EndpointMisskey) noteParams(content *model.BridgeMessageContent, text string) map[string]any {
+	params := map[string]any{
+		"text": renderMFM(text),
+	}
+	if content.SpoilerText != "" {
+		params["cw"] = content.SpoilerText
+	}
+
+	visibility := e.visibility
+	if visibility == "" {
+		visibility = content.Visibility
+	}
+	for misskeyVisibility, v := range misskeyVisibilities {
+		if v == visibility {
+			params["visibility"] = misskeyVisibility
+		}
+	}
+	return params
+}
+
+// ApplyUpdateNew posts content as a thread, with attachments on the first note.
+func (e *EndpointMisskey) ApplyUpdateNew(ctx context.Context, content *model.BridgeMessageContent, replyTo model.EndpointMessageID) (_ []model.EndpointMessageRevision, err error) {
+	defer func() { err = classifyMisskeyError(err) }()
+
+	fileIDs, err := e.uploadAttachments(ctx, content)
+	if err != nil {
+		return nil, fmt.Errorf("failed to upload attachments to Misskey: %w", err)
+	}
+
+	var revisions []model.EndpointMessageRevision
+	for i, text := range e.splitNote(content) {
+		params := e.noteParams(content, text)
+		if replyTo != "" {
+			params["replyId"] = string(replyTo)
+		}
+		if i == 0 && len(fileIDs) > 0 {
+			params["fileIds"] = fileIDs
+		}
+		// Notes need text or files, a zero-width space is the closest to nothing.
+		if strings.TrimSpace(text) == "" && params["fileIds"] == nil {
+			params["text"] = "\u200b"
+		}
+
+		note, err := e.client.createNote(ctx, params, "")
+		if err != nil {
+			deleteIncomplete(ctx, e, revisions)
+			return nil, fmt.Errorf("failed to create note in Misskey: %w", err)
+		}
+
+		slog.Debug("Note created in Misskey", "id", note.ID)
+
+		revisions = append(revisions, model.EndpointMessageRevision{
+			ID:        model.EndpointMessageID(note.ID),
+			Timestamp: note.CreatedAt,
+		})
+		replyTo = model.EndpointMessageID(note.ID)
+	}
+
+	return revisions, nil
+}
+
+// ApplyUpdateEdit edits notes of the thread, unless the server doesn't support editing.
+func (e *EndpointMisskey) ApplyUpdateEdit(ctx context.Context, ids []model.EndpointMessageID, content *model.BridgeMessageContent) (_ []model.EndpointMessageRevision, err error) {
+	defer func() { err = classifyMisskeyError(err) }()
+
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("no Misskey note to edit")
+	}
+
+	if !e.canEdit {
+		slog.Debug("Ignoring edit, as Misskey server doesn't support editing", "id", ids[0])
+		now := time.Now()
+		revisions := make([]model.EndpointMessageRevision, 0, len(ids))
+		for _, id := range ids {
+			revisions = append(revisions, model.EndpointMessageRevision{ID: id, Timestamp: now})
+		}
+		return revisions, nil
+	}
+
+	texts := e.splitNote(content)
+
+	var revisions []model.EndpointMessageRevision
+	for i, text := range texts {
+		params := e.noteParams(content, text)
+		editID := ""
+		if i >= len(ids) {
+			params["replyId"] = string(revisions[i-1].ID)
+		} else {
+			editID = string(ids[i])
+			// Editing replaces the note, so keep its files and reply.
+			current, err := e.client.showNote(ctx, editID)
+			if err != nil {
+				return nil, fmt.Errorf("failed to fetch note from Misskey: %w", err)
+			}
+			fileIDs := make([]string, 0, len(current.Files))
+			for _, file := range current.Files {
+				fileIDs = append(fileIDs, file.ID)
+			}
+			if len(fileIDs) > 0 {
+				params["fileIds"] = fileIDs
+			}
+			if current.ReplyID != nil {
+				params["replyId"] = *current.ReplyID
+			}
+			// Edits can't change the visibility.
+			params["visibility"] = current.Visibility
+		}
+
+		note, err := e.client.createNote(ctx, params, editID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to edit note in Misskey: %w", err)
+		}
+
+		slog.Debug("Note edited in Misskey", "id", note.ID)
+
+		revision := model.EndpointMessageRevision{
+			ID:        model.EndpointMessageID(note.ID),
+			Timestamp: note.CreatedAt,
+		}
+		if i < len(ids) {
+			revision.ID = ids[i]
+			revision.Timestamp = time.Now()
+			if note.UpdatedAt != nil {
+				revision.Timestamp = *note.UpdatedAt
+			}
+		}
+		revisions = append(revisions, revision)
+	}
+
+	for _, id := range ids[min(len(texts), len(ids)):] {
+		err := e.ApplyUpdateDelete(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return revisions, nil
+}
+
+// uploadAttachments uploads attachments to the drive of the account, and returns their file IDs.
+func (e *EndpointMisskey) uploadAttachments(ctx context.Context, content *model.BridgeMessageContent) ([]string, error) {
+	attachments := content.Attachments
+	if len(attachments) > misskeyMaxFiles {
+		slog.Warn("Too many attachments for a Misskey note, extra ones will be dropped", "count", len(attachments))
+		attachments = attachments[:misskeyMaxFiles]
+	}
+
+	var fileIDs []string
+	for _, attachment := range attachments {
+		r, err := attachment.Open(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		// Misskey tells the file type from its content, the name is only shown.
+		fileName := attachment.FileName
+		if fileName == "" {
+			fileName = attachment.Kind.String()
+		}
+
+		fileID, err := e.client.uploadFile(ctx, r, path.Base(fileName), attachment.AltText, content.Sensitive)
+		r.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		slog.Debug("File uploaded to Misskey", "id", fileID, "kind", attachment.Kind)
+		fileIDs = append(fileIDs, fileID)
+	}
+
+	return fileIDs, nil
+}
+
+func (e *EndpointMisskey) ApplyUpdateDelete(ctx context.Context, id model.EndpointMessageID) error {
+	err := e.client.deleteNote(ctx, string(id))
+	if err != nil {
+		return classifyMisskeyError(fmt.Errorf("failed to delete note in Misskey: %w", err))
+	}
+
+	slog.Debug("Note deleted in Misskey", "id", id)
+
+	return nil
+}
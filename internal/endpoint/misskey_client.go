@@ -0,0 +1,280 @@
+package endpoint
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// misskeyClient is a minimal client of the Misskey API, whose calls are POSTs carrying the token as "i".
+type misskeyClient struct {
+	server      string
+	accessToken string
+	httpClient  *http.Client
+	status      *statusTracker
+}
+
+func newMisskeyClient(server, accessToken string, status *statusTracker) *misskeyClient {
+	return &misskeyClient{
+		server:      strings.TrimSuffix(server, "/"),
+		accessToken: accessToken,
+		httpClient:  &http.Client{},
+		status:      status,
+	}
+}
+
+// misskeyError is an error response of the API.
+type misskeyError struct {
+	StatusCode int
+	Code       string `json:"code"`
+	Message    string `json:"message"`
+	// RetryAfter is derived from the Retry-After header of rate limited responses.
+	RetryAfter time.Duration
+}
+
+func (e *misskeyError) Error() string {
+	return fmt.Sprintf("misskey: %d %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// classifyMisskeyError wraps errors of rate limiting and rejected requests for the bridge service.
+func classifyMisskeyError(err error) error {
+	var misskeyErr *misskeyError
+	if !errors.As(err, &misskeyErr) {
+		return err
+	}
+
+	status := misskeyErr.StatusCode
+	if misskeyErr.Code == "RATE_LIMIT_EXCEEDED" {
+		status = http.StatusTooManyRequests
+	}
+	return classifyHTTPStatus(err, status, misskeyErr.RetryAfter)
+}
+
+// call calls an API endpoint with params as JSON body, and decodes the JSON response into result if not nil.
+func (c *misskeyClient) call(ctx context.Context, endpoint string, params map[string]any, result any) error {
+	body := map[string]any{"i": c.accessToken}
+	for k, v := range params {
+		body[k] = v
+	}
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.server+"/api/"+endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	return c.send(req, endpoint, result)
+}
+
+// send sends req, and turns responses other than 2xx into misskeyError.
+func (c *misskeyClient) send(req *http.Request, endpoint string, result any) error {
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return fmt.Errorf("misskey: %s: %w", endpoint, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		var errResp struct {
+			Error misskeyError `json:"error"`
+		}
+		decodeErrorBody(resp.Body, &errResp)
+		misskeyErr := &errResp.Error
+		misskeyErr.StatusCode = resp.StatusCode
+		if seconds, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil {
+			misskeyErr.RetryAfter = time.Duration(seconds) * time.Second
+		}
+		return misskeyErr
+	}
+
+	c.status.apiCallSucceeded()
+	// Some endpoints, e.g. notes/delete, respond with 204 and no body.
+	if result == nil || resp.StatusCode == http.StatusNoContent {
+		return nil
+	}
+	err = json.NewDecoder(resp.Body).Decode(result)
+	if err != nil {
+		return fmt.Errorf("failed to decode response of %s: %w", endpoint, err)
+	}
+	return nil
+}
+
+// misskeyNote is a note, as returned by the API and the streaming API.
+type misskeyNote struct {
+	ID        string     `json:"id"`
+	CreatedAt time.Time  `json:"createdAt"`
+	UpdatedAt *time.Time `json:"updatedAt"`
+	UserID    string     `json:"userId"`
+	User      struct {
+		Username string  `json:"username"`
+		Host     *string `json:"host"`
+	} `json:"user"`
+	Text       *string       `json:"text"`
+	CW         *string       `json:"cw"`
+	Visibility string        `json:"visibility"`
+	ReplyID    *string       `json:"replyId"`
+	Reply      *misskeyNote  `json:"reply"`
+	RenoteID   *string       `json:"renoteId"`
+	Renote     *misskeyNote  `json:"renote"`
+	Files      []misskeyFile `json:"files"`
+	// URI is set for remote notes only.
+	URI *string `json:"uri"`
+}
+
+type misskeyFile struct {
+	ID          string  `json:"id"`
+	Name        string  `json:"name"`
+	Type        string  `json:"type"`
+	Size        int64   `json:"size"`
+	URL         string  `json:"url"`
+	Comment     *string `json:"comment"`
+	IsSensitive bool    `json:"isSensitive"`
+}
+
+// i fetches the account of the access token, and returns its user ID.
+func (c *misskeyClient) i(ctx context.Context) (string, error) {
+	var resp struct {
+		ID string `json:"id"`
+	}
+	err := c.call(ctx, "i", nil, &resp)
+	return resp.ID, err
+}
+
+// maxNoteTextLength fetches the note length limit of the server.
+func (c *misskeyClient) maxNoteTextLength(ctx context.Context) (int, error) {
+	var resp struct {
+		MaxNoteTextLength int `json:"maxNoteTextLength"`
+	}
+	err := c.call(ctx, "meta", map[string]any{"detail": false}, &resp)
+	return resp.MaxNoteTextLength, err
+}
+
+// hasEndpoint reports whether the server has an API endpoint, e.g. notes/edit which only some forks implement.
+func (c *misskeyClient) hasEndpoint(ctx context.Context, endpoint string) (bool, error) {
+	// Unknown endpoints are responded with null.
+	var resp *struct{}
+	err := c.call(ctx, "endpoint", map[string]any{"endpoint": endpoint}, &resp)
+	return resp != nil, err
+}
+
+func (c *misskeyClient) showNote(ctx context.Context, noteID string) (*misskeyNote, error) {
+	note := &misskeyNote{}
+	err := c.call(ctx, "notes/show", map[string]any{"noteId": noteID}, note)
+	if err != nil {
+		return nil, err
+	}
+	return note, nil
+}
+
+// userNotes fetches notes of the user newer than sinceID, or the latest ones if sinceID is empty.
+func (c *misskeyClient) userNotes(ctx context.Context, userID, sinceID string, limit int) ([]*misskeyNote, error) {
+	params := map[string]any{
+		"userId":      userID,
+		"limit":       limit,
+		"withReplies": true,
+	}
+	if sinceID != "" {
+		params["sinceId"] = sinceID
+	}
+	var notes []*misskeyNote
+	err := c.call(ctx, "users/notes", params, &notes)
+	return notes, err
+}
+
+// createNote creates a note with params of notes/create, or edits the note editID with params of notes/edit.
+func (c *misskeyClient) createNote(ctx context.Context, params map[string]any, editID string) (*misskeyNote, error) {
+	endpoint := "notes/create"
+	if editID != "" {
+		endpoint = "notes/edit"
+		params["editId"] = editID
+	}
+	var resp struct {
+		CreatedNote *misskeyNote `json:"createdNote"`
+	}
+	err := c.call(ctx, endpoint, params, &resp)
+	if err != nil {
+		return nil, err
+	}
+	if resp.CreatedNote == nil {
+		return nil, fmt.Errorf("misskey: %s: no note in response", endpoint)
+	}
+	return resp.CreatedNote, nil
+}
+
+func (c *misskeyClient) deleteNote(ctx context.Context, noteID string) error {
+	return c.call(ctx, "notes/delete", map[string]any{"noteId": noteID}, nil)
+}
+
+// uploadFile uploads a file to the drive of the account, and returns its ID.
+func (c *misskeyClient) uploadFile(ctx context.Context, r io.Reader, fileName, comment string, sensitive bool) (string, error) {
+	var body bytes.Buffer
+	w := multipart.NewWriter(&body)
+	fields := map[string]string{
+		"i":           c.accessToken,
+		"isSensitive": strconv.FormatBool(sensitive),
+	}
+	if comment != "" {
+		fields["comment"] = comment
+	}
+	for k, v := range fields {
+		err := w.WriteField(k, v)
+		if err != nil {
+			return "", err
+		}
+	}
+	part, err := w.CreateFormFile("file", fileName)
+	if err != nil {
+		return "", err
+	}
+	_, err = io.Copy(part, r)
+	if err != nil {
+		return "", err
+	}
+	err = w.Close()
+	if err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.server+"/api/drive/files/create", &body)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", w.FormDataContentType())
+
+	var file misskeyFile
+	err = c.send(req, "drive/files/create", &file)
+	return file.ID, err
+}
+
+// streamingURL returns the URL of the streaming API, authenticated with the access token.
+func (c *misskeyClient) streamingURL() (string, error) {
+	u, err := url.Parse(c.server + "/streaming")
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "https":
+		u.Scheme = "wss"
+	case "http":
+		u.Scheme = "ws"
+	}
+	u.RawQuery = url.Values{"i": {c.accessToken}}.Encode()
+	return u.String(), nil
+}
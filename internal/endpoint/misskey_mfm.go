@@ -0,0 +1,534 @@
+package endpoint
+
+import (
+	"fmt"
+	"log/slog"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/merrkry/tele2don/internal/markdown"
+	"github.com/yuin/goldmark/ast"
+	east "github.com/yuin/goldmark/extension/ast"
+	"github.com/yuin/goldmark/util"
+)
+
+var (
+	// mfmSpecialPattern matches text that MFM would parse as syntax, which is escaped with <plain>.
+	// Mentions, hashtags, URLs and emoji codes are left alone, as they are expected to work in bridged text.
+	mfmSpecialPattern = regexp.MustCompile("\\*+|_+|~~+|`+|\\$\\[|<|\\[|\\]|\\?\\[")
+	// mfmItalicPattern matches *italic* and _italic_, which MFM only recognizes around alphanumeric text.
+	mfmItalicPattern = regexp.MustCompile(`^(\*|_)([a-zA-Z0-9\s]+?)(\*|_)`)
+	mfmLinkPattern   = regexp.MustCompile(`^\??\[([^\]\n]+)\]\(<?(https?://[^)\s>]+)>?\)`)
+	mfmAngleURL      = regexp.MustCompile(`^<(https?://[^>\s]+)>`)
+	// mfmRawPattern matches URLs, mentions, hashtags and emoji codes, which are kept as is.
+	mfmRawPattern = regexp.MustCompile(`^(?:https?://[\w/:%#@$&?!~.=+\-,;']+|@[\w-]+(?:@[\w.-]+\w)?|#[^\s.,!?'"#:/\[\]【】()「」（）<>]+|:[\w+-]+:)`)
+	// mfmFunctionPattern matches the name and arguments of $[name.args content].
+	mfmFunctionPattern = regexp.MustCompile(`^\$\[([a-z0-9_]+)(?:\.([\w.,=-]*))?\s`)
+)
+
+// renderMFM renders bridge Markdown as MFM, falling back to the raw Markdown.
+func renderMFM(md string) string {
+	text, err := markdownToMFM(md)
+	if err != nil {
+		slog.Warn("Failed to render markdown for Misskey, falling back to plain text", "err", err)
+		return md
+	}
+	return text
+}
+
+// mfmBuilder renders goldmark AST as MFM.
+type mfmBuilder struct {
+	source []byte
+	text   *strings.Builder
+	// plain is text pending to be escaped, as text nodes are split at delimiters, which can't be escaped on their own.
+	plain  strings.Builder
+	inCode bool
+}
+
+func markdownToMFM(md string) (text string, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic while rendering markdown: %v", r)
+		}
+	}()
+
+	doc, source := markdown.Parse(md)
+	b := &mfmBuilder{source: source, text: &strings.Builder{}}
+	b.renderBlocks(doc, "\n\n")
+	b.flush()
+
+	return strings.TrimRight(b.text.String(), "\n"), nil
+}
+
+func (b *mfmBuilder) renderBlocks(parent ast.Node, separator string) {
+	for n := parent.FirstChild(); n != nil; n = n.NextSibling() {
+		if n != parent.FirstChild() {
+			b.write(separator)
+		}
+		b.renderBlock(n)
+	}
+}
+
+// write writes MFM as is.
+func (b *mfmBuilder) write(s string) {
+	b.flush()
+	b.text.WriteString(s)
+}
+
+// sub renders f separately and returns the result.
+func (b *mfmBuilder) sub(f func()) string {
+	b.flush()
+	outer := b.text
+	b.text = &strings.Builder{}
+	f()
+	b.flush()
+	inner := b.text.String()
+	b.text = outer
+	return inner
+}
+
+func (b *mfmBuilder) renderBlock(n ast.Node) {
+	switch n := n.(type) {
+	case *ast.Paragraph, *ast.TextBlock:
+		b.renderInlines(n)
+
+	case *ast.Heading:
+		b.wrap("**", "**", func() { b.renderInlines(n) })
+
+	case *ast.ThematicBreak:
+		b.write("――――――――")
+
+	case *ast.FencedCodeBlock:
+		b.write("```" + string(n.Language(b.source)) + "\n")
+		b.write(strings.TrimSuffix(b.lines(n), "\n"))
+		b.write("\n```")
+
+	case *ast.CodeBlock:
+		b.write("```\n" + strings.TrimSuffix(b.lines(n), "\n") + "\n```")
+
+	case *ast.Blockquote:
+		inner := b.sub(func() { b.renderBlocks(n, "\n\n") })
+		b.write("> " + strings.ReplaceAll(inner, "\n", "\n> "))
+
+	case *ast.List:
+		// MFM has no lists.
+		index := n.Start
+		for item := n.FirstChild(); item != nil; item = item.NextSibling() {
+			if item != n.FirstChild() {
+				b.write("\n")
+			}
+			if n.IsOrdered() {
+				b.write(strconv.Itoa(index) + ". ")
+				index++
+			} else {
+				b.write("• ")
+			}
+			b.renderBlocks(item, "\n")
+		}
+
+	case *ast.HTMLBlock:
+		b.writeText(strings.TrimSuffix(b.lines(n), "\n"))
+
+	default:
+		if n.Type() == ast.TypeInline {
+			b.renderInline(n)
+		} else {
+			b.renderBlocks(n, "\n\n")
+		}
+	}
+}
+
+func (b *mfmBuilder) lines(n ast.Node) string {
+	var s strings.Builder
+	lines := n.Lines()
+	for i := 0; i < lines.Len(); i++ {
+		line := lines.At(i)
+		s.Write(line.Value(b.source))
+	}
+	return s.String()
+}
+
+// wrap renders the content produced by f between open and close, unless it's empty.
+func (b *mfmBuilder) wrap(open, close string, f func()) {
+	inner := b.sub(f)
+	if inner == "" {
+		return
+	}
+	b.write(open + inner + close)
+}
+
+// writeText buffers plain text until it's escaped by flush.
+func (b *mfmBuilder) writeText(s string) {
+	b.plain.WriteString(s)
+}
+
+// flush writes pending plain text, escaping MFM syntax in it.
+// URLs are left alone, so that Misskey still detects them.
+func (b *mfmBuilder) flush() {
+	s := b.plain.String()
+	b.plain.Reset()
+	pos := 0
+	for _, match := range mastodonURLPattern.FindAllStringIndex(s, -1) {
+		b.text.WriteString(escapeMFM(s[pos:match[0]]))
+		b.text.WriteString(s[match[0]:match[1]])
+		pos = match[1]
+	}
+	b.text.WriteString(escapeMFM(s[pos:]))
+}
+
+func (b *mfmBuilder) renderInlines(parent ast.Node) {
+	for n := parent.FirstChild(); n != nil; n = n.NextSibling() {
+		b.renderInline(n)
+	}
+}
+
+func (b *mfmBuilder) renderInline(n ast.Node) {
+	switch n := n.(type) {
+	case *ast.Text:
+		value := n.Segment.Value(b.source)
+		if b.inCode {
+			b.write(string(value))
+		} else {
+			value = util.UnescapePunctuations(value)
+			value = util.ResolveNumericReferences(value)
+			value = util.ResolveEntityNames(value)
+			b.writeText(string(value))
+		}
+		if n.SoftLineBreak() || n.HardLineBreak() {
+			b.write("\n")
+		}
+
+	case *ast.String:
+		b.writeText(string(n.Value))
+
+	case *ast.Emphasis:
+		// <i> works around any text, unlike *italic*.
+		if n.Level >= 2 {
+			b.wrap("**", "**", func() { b.renderInlines(n) })
+		} else {
+			b.wrap("<i>", "</i>", func() { b.renderInlines(n) })
+		}
+
+	case *east.Strikethrough:
+		b.wrap("~~", "~~", func() { b.renderInlines(n) })
+
+	case *markdown.Spoiler:
+		b.wrap("$[blur ", "]", func() { b.renderInlines(n) })
+
+	case *ast.CodeSpan:
+		code := b.sub(func() {
+			b.inCode = true
+			b.renderInlines(n)
+			b.inCode = false
+		})
+		// Inline code can't contain backticks or line breaks in MFM.
+		if strings.ContainsAny(code, "`\n") {
+			b.write("<plain>" + code + "</plain>")
+		} else {
+			b.write("`" + code + "`")
+		}
+
+	case *ast.Link:
+		b.renderLink(n, string(n.Destination))
+
+	case *ast.Image:
+		b.renderLink(n, string(n.Destination))
+
+	case *ast.AutoLink:
+		b.write(string(n.Label(b.source)))
+
+	case *ast.RawHTML:
+		for i := 0; i < n.Segments.Len(); i++ {
+			segment := n.Segments.At(i)
+			b.writeText(string(segment.Value(b.source)))
+		}
+
+	default:
+		b.renderInlines(n)
+	}
+}
+
+func (b *mfmBuilder) renderLink(n ast.Node, destination string) {
+	label := b.sub(func() { b.renderInlines(n) })
+	// Links whose text is the URL itself are detected by Misskey.
+	if label == "" || label == destination || !strings.HasPrefix(destination, "http") {
+		b.write(label)
+		if label == "" {
+			b.write(destination)
+		}
+		return
+	}
+	b.write("[" + label + "](" + destination + ")")
+}
+
+// mfmToMarkdown converts MFM text of a note to bridge Markdown.
+// Functions without a Markdown equivalent, e.g. $[x2 text], fall back to their plain content.
+func mfmToMarkdown(s string) string {
+	p := &mfmParser{src: s}
+	md, _ := p.parse("", true)
+	return md
+}
+
+// mfmParser is a recursive descent parser of MFM, rendering bridge Markdown as it goes.
+// Unclosed syntax is taken as plain text, like Misskey does.
+type mfmParser struct {
+	src string
+	pos int
+}
+
+func (p *mfmParser) rest() string {
+	return p.src[p.pos:]
+}
+
+// neighbor returns the character of the source at i for escapeMarkdown, which is only known if it's a line break,
+// as syntax is converted to other markup.
+func (p *mfmParser) neighbor(i int) rune {
+	switch {
+	case i < 0 || i >= len(p.src):
+		return 0
+	case p.src[i] == '\n':
+		return '\n'
+	default:
+		return unknownNeighbor
+	}
+}
+
+func (p *mfmParser) atLineStart() bool {
+	return p.pos == 0 || p.src[p.pos-1] == '\n'
+}
+
+// parse renders input until the closing delimiter end, which is consumed, or until the end of input if end is empty.
+// It returns false if end is never found, leaving the position unchanged. Block syntax is only parsed if block is set.
+func (p *mfmParser) parse(end string, block bool) (string, bool) {
+	start := p.pos
+	var out, plain strings.Builder
+	// Plain text is escaped along with the characters around it, up to plainEnd.
+	plainStart := p.pos
+	flush := func(plainEnd int) {
+		out.WriteString(escapeMarkdown(plain.String(), p.neighbor(plainStart-1), p.neighbor(plainEnd)))
+		plain.Reset()
+	}
+
+	for p.pos < len(p.src) {
+		rest := p.rest()
+		if end != "" && strings.HasPrefix(rest, end) {
+			flush(p.pos)
+			p.pos += len(end)
+			return out.String(), true
+		}
+
+		syntaxStart := p.pos
+		if md, ok := p.parseSyntax(block); ok {
+			flush(syntaxStart)
+			out.WriteString(md)
+			continue
+		}
+
+		// Plain text runs until the next character that might start syntax, or a closing delimiter.
+		next := 1
+		for next < len(rest) && !strings.ContainsRune("*_~`$[]?<>@#:h\n", rune(rest[next])) {
+			next++
+		}
+		if plain.Len() == 0 {
+			plainStart = p.pos
+		}
+		plain.WriteString(rest[:next])
+		p.pos += next
+	}
+
+	if end != "" {
+		p.pos = start
+		return "", false
+	}
+	flush(p.pos)
+	return out.String(), true
+}
+
+// parseSyntax parses the syntax at the current position, if any, and returns it rendered as Markdown.
+func (p *mfmParser) parseSyntax(block bool) (string, bool) {
+	rest := p.rest()
+
+	if block && p.atLineStart() {
+		if md, ok := p.parseBlock(); ok {
+			return md, true
+		}
+	}
+
+	// Simple pairs of delimiters, whose content is MFM as well.
+	for _, pair := range [][3]string{
+		{"**", "**", "**"}, {"__", "__", "**"}, {"<b>", "</b>", "**"},
+		{"<i>", "</i>", "*"}, {"~~", "~~", "~~"}, {"<s>", "</s>", "~~"},
+		{"<small>", "</small>", ""}, {"<center>", "</center>", ""},
+	} {
+		if !strings.HasPrefix(rest, pair[0]) {
+			continue
+		}
+		p.pos += len(pair[0])
+		inner, ok := p.parse(pair[1], false)
+		if !ok {
+			p.pos -= len(pair[0])
+			break
+		}
+		if pair[2] == "" {
+			return inner, true
+		}
+		var b strings.Builder
+		writeInlineMark(&b, pair[2], inner)
+		return b.String(), true
+	}
+
+	switch {
+	case strings.HasPrefix(rest, "<plain>"):
+		content, _, ok := strings.Cut(rest[len("<plain>"):], "</plain>")
+		if ok {
+			before := p.neighbor(p.pos - 1)
+			p.pos += len("<plain>") + len(content) + len("</plain>")
+			return escapeMarkdown(content, before, p.neighbor(p.pos)), true
+		}
+
+	case strings.HasPrefix(rest, "`") && !strings.HasPrefix(rest, "```"):
+		content, _, ok := strings.Cut(rest[1:], "`")
+		if ok && content != "" && !strings.Contains(content, "\n") {
+			p.pos += len(content) + 2
+			var b strings.Builder
+			writeInlineCode(&b, content)
+			return b.String(), true
+		}
+
+	case strings.HasPrefix(rest, "$["):
+		return p.parseFunction()
+	}
+
+	if match := mfmItalicPattern.FindStringSubmatch(rest); match != nil && match[1] == match[3] && strings.TrimSpace(match[2]) != "" {
+		// Intraword delimiters are not italic, e.g. snake_case.
+		if p.pos == 0 || !isAlphanumeric(p.src[p.pos-1]) {
+			p.pos += len(match[0])
+			var b strings.Builder
+			writeInlineMark(&b, "*", match[2])
+			return b.String(), true
+		}
+	}
+
+	if match := mfmLinkPattern.FindStringSubmatch(rest); match != nil {
+		p.pos += len(match[0])
+		var b strings.Builder
+		writeLink(&b, mfmToMarkdown(match[1]), match[2])
+		return b.String(), true
+	}
+	if match := mfmAngleURL.FindStringSubmatch(rest); match != nil {
+		p.pos += len(match[0])
+		return match[1], true
+	}
+	if match := mfmRawPattern.FindString(rest); match != "" && (p.pos == 0 || !isAlphanumeric(p.src[p.pos-1])) {
+		if strings.HasPrefix(match, "http") {
+			match = strings.TrimRight(match, ".,;:!?'")
+		}
+		p.pos += len(match)
+		return match, true
+	}
+
+	return "", false
+}
+
+// parseBlock parses quotes and code blocks, which must start at the beginning of a line.
+func (p *mfmParser) parseBlock() (string, bool) {
+	rest := p.rest()
+
+	if strings.HasPrefix(rest, "```") {
+		lang, body, ok := strings.Cut(rest[3:], "\n")
+		if !ok || strings.Contains(lang, "`") {
+			return "", false
+		}
+		code, _, ok := strings.Cut(body, "\n```")
+		if !ok {
+			return "", false
+		}
+		p.pos += 3 + len(lang) + 1 + len(code) + len("\n```")
+		fence := strings.Repeat("`", max(3, longestRun(code, '`')+1))
+		return fence + lang + "\n" + code + "\n" + fence, true
+	}
+
+	if strings.HasPrefix(rest, ">") {
+		var lines []string
+		for strings.HasPrefix(p.rest(), ">") {
+			line, _, _ := strings.Cut(p.rest(), "\n")
+			p.pos += len(line)
+			if p.pos < len(p.src) {
+				p.pos++
+			}
+			line = strings.TrimPrefix(line, ">")
+			lines = append(lines, strings.TrimPrefix(line, " "))
+		}
+		inner := strings.TrimRight(mfmToMarkdown(strings.Join(lines, "\n")), "\n")
+		// The quote swallowed the line break after it, which still separates it from what follows.
+		md := "> " + strings.ReplaceAll(inner, "\n", "\n> ")
+		if p.pos < len(p.src) {
+			md += "\n\n"
+		}
+		return md, true
+	}
+
+	return "", false
+}
+
+// parseFunction parses $[name.args content], falling back to the content for functions without Markdown equivalent.
+func (p *mfmParser) parseFunction() (string, bool) {
+	match := mfmFunctionPattern.FindStringSubmatch(p.rest())
+	if match == nil {
+		return "", false
+	}
+	start := p.pos
+	p.pos += len(match[0])
+	inner, ok := p.parse("]", false)
+	if !ok {
+		p.pos = start
+		return "", false
+	}
+
+	var b strings.Builder
+	switch match[1] {
+	case "blur":
+		writeInlineMark(&b, "||", inner)
+	case "ruby":
+		// $[ruby base reading]
+		base, reading, ok := strings.Cut(inner, " ")
+		if ok {
+			b.WriteString(base + " (" + reading + ")")
+		} else {
+			b.WriteString(inner)
+		}
+	case "unixtime":
+		if ts, err := strconv.ParseInt(strings.TrimSpace(inner), 10, 64); err == nil {
+			b.WriteString(time.Unix(ts, 0).UTC().Format("2006-01-02 15:04 UTC"))
+		} else {
+			b.WriteString(inner)
+		}
+	default:
+		b.WriteString(inner)
+	}
+	return b.String(), true
+}
+
+// escapeMFM wraps MFM syntax of s in <plain>.
+// Single * and _ between alphanumerics, e.g. in snake_case, are not syntax and are kept as is.
+func escapeMFM(s string) string {
+	var b strings.Builder
+	pos := 0
+	for _, match := range mfmSpecialPattern.FindAllStringIndex(s, -1) {
+		start, end := match[0], match[1]
+		if end-start == 1 && (s[start] == '*' || s[start] == '_') &&
+			start > 0 && isAlphanumeric(s[start-1]) && end < len(s) && isAlphanumeric(s[end]) {
+			continue
+		}
+		b.WriteString(s[pos:start] + "<plain>" + s[start:end] + "</plain>")
+		pos = end
+	}
+	b.WriteString(s[pos:])
+	return b.String()
+}
+
+func isAlphanumeric(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
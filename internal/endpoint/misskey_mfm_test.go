@@ -0,0 +1,162 @@
+package endpoint
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/merrkry/tele2don/internal/markdown"
+)
+
+func TestMFMToMarkdown(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"plain", "hello world", "hello world"},
+		{"bold", "**bold** and <b>tag</b>", "**bold** and **tag**"},
+		{"italic", "*italic* and <i>tag</i>", "*italic* and *tag*"},
+		{"strike", "~~strike~~ and <s>tag</s>", "~~strike~~ and ~~tag~~"},
+		{"snake case", "snake_case and a*b*c", "snake_case and a\\*b\\*c"},
+		{"code", "`code`\n```go\nblock\n```", "`code`\n```go\nblock\n```"},
+		{"link", "[label](https://example.com) and ?[silent](https://example.com)", "[label](https://example.com) and [silent](https://example.com)"},
+		{"raw", "https://example.com/a_b @user@example.com #tag_x :emoji_x:", "https://example.com/a_b @user@example.com #tag_x :emoji_x:"},
+		{"quote", "> quoted\nafter", "> quoted\n\nafter"},
+		{"blur", "$[blur secret]", "||secret||"},
+		{"nested functions", "$[x2 $[blur **big**]] tail", "||**big**|| tail"},
+		{"ruby", "$[ruby 漢字 かんじ]", "漢字 (かんじ)"},
+		{"unixtime", "$[unixtime 0]", "1970-01-01 00:00 UTC"},
+		{"unclosed bold", "**open", `\*\*open`},
+		{"unclosed function", "$[blur open", "$[blur open"},
+		{"unclosed tag", "<i>open", "<i>open"},
+		{"plain tag", "<plain>**not bold** $[x2 x]</plain>", `\*\*not bold\*\* $[x2 x]`},
+		{"small and center", "<small>small</small> <center>center</center>", "small center"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := mfmToMarkdown(tt.in); got != tt.want {
+				t.Errorf("mfmToMarkdown(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMarkdownToMFM(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"plain", "hello world", "hello world"},
+		{"bold", "**bold**", "**bold**"},
+		{"italic", "*italic* word", "<i>italic</i> word"},
+		{"strike", "~~strike~~", "~~strike~~"},
+		{"spoiler", "||secret||", "$[blur secret]"},
+		{"code", "`a*b`", "`a*b`"},
+		{"code with backtick", "`` a`b ``", "<plain>a`b</plain>"},
+		{"link", "[label](https://example.com)", "[label](https://example.com)"},
+		{"bare link", "[https://example.com](https://example.com)", "https://example.com"},
+		{"url", "see https://example.com/a_b_c", "see https://example.com/a_b_c"},
+		{"heading", "# title", "**title**"},
+		{"list", "- a\n- b", "• a\n• b"},
+		{"quote", "> quoted", "> quoted"},
+		{"snake case", "snake_case", "snake_case"},
+		{"escaped syntax", `\*\*not bold\*\* $[x2 x]`, "<plain>**</plain>not bold<plain>**</plain> <plain>$[</plain>x2 x<plain>]</plain>"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := markdownToMFM(tt.in)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("markdownToMFM(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNoteLength(t *testing.T) {
+	tests := []struct {
+		md   string
+		want int
+	}{
+		{"plain", 5},
+		{"**bold** [link](https://example.com)", 36},
+		{"||secret||", 14},
+		{"漢字 😀", 4},
+	}
+
+	for _, tt := range tests {
+		if got := noteLength(tt.md); got != tt.want {
+			t.Errorf("noteLength(%q) = %d, want %d", tt.md, got, tt.want)
+		}
+	}
+}
+
+func TestEscapeMFM(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"hello", "hello"},
+		{"snake_case", "snake_case"},
+		{"a*b", "a*b"},
+		{"_leading", "<plain>_</plain>leading"},
+		{"trailing*", "trailing<plain>*</plain>"},
+		{"__init__", "<plain>__</plain>init<plain>__</plain>"},
+		{"**bold**", "<plain>**</plain>bold<plain>**</plain>"},
+		{"~~strike~~", "<plain>~~</plain>strike<plain>~~</plain>"},
+		{"a ~ b", "a ~ b"},
+		{"`code`", "<plain>`</plain>code<plain>`</plain>"},
+		{"$[x2 big]", "<plain>$[</plain>x2 big<plain>]</plain>"},
+		{"<b>", "<plain><</plain>b>"},
+		{"[a](b)", "<plain>[</plain>a<plain>]</plain>(b)"},
+		{"?[a](b)", "<plain>?[</plain>a<plain>]</plain>(b)"},
+		{"@user #tag :emoji:", "@user #tag :emoji:"},
+	}
+
+	for _, tt := range tests {
+		if got := escapeMFM(tt.in); got != tt.want {
+			t.Errorf("escapeMFM(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+// TestMFMRoundTrip checks that bridge Markdown renders the same after converting it to MFM and back.
+// Escapes might differ, e.g. for syntax that is only escaped in MFM.
+func TestMFMRoundTrip(t *testing.T) {
+	render := func(md string) string {
+		var buf bytes.Buffer
+		err := markdown.Markdown().Convert([]byte(md), &buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+
+	for _, md := range []string{
+		"hello world",
+		"**bold** and *italic* and ~~strike~~",
+		"||secret||",
+		"`code`",
+		"[label](https://example.com)",
+		"snake_case and __init__ and 2 * 3",
+		`\*\*not bold\*\* and \[not a link](x)`,
+		"$[x2 not a function] and <b>not a tag</b>",
+		"```go\nfunc() {}\n```",
+		"> quoted",
+		"@user@example.com #tag :emoji: https://example.com/a_b",
+	} {
+		mfm, err := markdownToMFM(md)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := mfmToMarkdown(mfm)
+		if render(got) != render(md) {
+			t.Errorf("round trip of %q through %q = %q", md, mfm, got)
+		}
+	}
+}
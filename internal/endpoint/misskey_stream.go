@@ -0,0 +1,340 @@
+package endpoint
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/merrkry/tele2don/internal/model"
+)
+
+const (
+	misskeyStreamMinBackoff = time.Second
+	misskeyStreamMaxBackoff = 5 * time.Minute
+	// Backoff starts over after a stream stayed up this long.
+	misskeyStreamHealthyDuration = time.Minute
+	// Misskey doesn't send anything on idle streams, so we ping it and expect pongs in time.
+	misskeyStreamPingInterval = 30 * time.Second
+	misskeyStreamReadTimeout  = 2 * misskeyStreamPingInterval
+	misskeyBackfillPageSize   = 100
+	// misskeyNoteSubscriptions is the number of recent notes watched for edits and deletions,
+	// which Misskey only streams for notes subscribed one by one.
+	misskeyNoteSubscriptions = 100
+	// misskeyHomeChannelID identifies our connection to the homeTimeline channel in stream messages.
+	misskeyHomeChannelID = "home"
+)
+
+// misskeyStreamMessage is a message of the streaming API, in both directions.
+type misskeyStreamMessage struct {
+	Type string `json:"type"`
+	Body any    `json:"body"`
+}
+
+// misskeyStreamEvent is the body of channel and noteUpdated messages received from the streaming API.
+type misskeyStreamEvent struct {
+	ID   string          `json:"id"`
+	Type string          `json:"type"`
+	Body json.RawMessage `json:"body"`
+}
+
+// ListenUpdates streams our own notes from the home timeline, backfilling those missed while disconnected.
+func (e *EndpointMisskey) ListenUpdates(ctx context.Context, updatesChan chan<- *model.EndpointUpdate, wg *sync.WaitGroup) {
+	defer wg.Done()
+	e.status.setListening(true)
+	defer e.status.setListening(false)
+
+	retry := &backoff{min: misskeyStreamMinBackoff, max: misskeyStreamMaxBackoff}
+	tracking := false
+	for {
+		start := time.Now()
+
+		var err error
+		if !tracking {
+			err = e.fetchLastSeenNote(ctx)
+		}
+		if err == nil {
+			err = e.stream(ctx, updatesChan, tracking)
+			tracking = true
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		if time.Since(start) >= misskeyStreamHealthyDuration {
+			retry.reset()
+		}
+		delay := retry.next()
+		slog.Warn("Misskey stream failed, reconnecting", "eid", e.id, "delay", delay, "err", err)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// fetchLastSeenNote fetches our latest note, where backfill starts from.
+func (e *EndpointMisskey) fetchLastSeenNote(ctx context.Context) error {
+	notes, err := e.client.userNotes(ctx, e.userID, "", 1)
+	if err != nil {
+		return fmt.Errorf("failed to fetch latest Misskey note: %w", err)
+	}
+	if len(notes) > 0 {
+		e.lastSeenID = notes[0].ID
+	}
+
+	return nil
+}
+
+// stream forwards our notes until the connection fails, always returning an error.
+func (e *EndpointMisskey) stream(ctx context.Context, updatesChan chan<- *model.EndpointUpdate, backfill bool) error {
+	streamURL, err := e.client.streamingURL()
+	if err != nil {
+		return err
+	}
+	conn, _, err := websocket.DefaultDialer.DialContext(ctx, streamURL, nil)
+	if err != nil {
+		return fmt.Errorf("failed to connect to Misskey stream: %w", err)
+	}
+	defer conn.Close()
+	e.status.heartbeat()
+
+	streamCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		<-streamCtx.Done()
+		conn.Close()
+	}()
+
+	err = conn.WriteJSON(&misskeyStreamMessage{Type: "connect", Body: map[string]any{
+		"channel": "homeTimeline",
+		"id":      misskeyHomeChannelID,
+		"params":  map[string]any{},
+	}})
+	if err != nil {
+		return err
+	}
+	// Subscriptions are lost with the connection.
+	for _, id := range e.subscribed {
+		err = conn.WriteJSON(&misskeyStreamMessage{Type: "subNote", Body: map[string]any{"id": id}})
+		if err != nil {
+			return err
+		}
+	}
+
+	messages := make(chan []byte)
+	readErr := make(chan error, 1)
+	conn.SetReadDeadline(time.Now().Add(misskeyStreamReadTimeout))
+	conn.SetPongHandler(func(string) error {
+		e.status.heartbeat()
+		return conn.SetReadDeadline(time.Now().Add(misskeyStreamReadTimeout))
+	})
+	go func() {
+		for {
+			_, data, err := conn.ReadMessage()
+			if err != nil {
+				readErr <- err
+				return
+			}
+			conn.SetReadDeadline(time.Now().Add(misskeyStreamReadTimeout))
+			select {
+			case <-streamCtx.Done():
+				return
+			case messages <- data:
+			}
+		}
+	}()
+
+	if backfill {
+		err := e.backfill(ctx, conn, updatesChan)
+		if err != nil {
+			return fmt.Errorf("failed to backfill Misskey notes: %w", err)
+		}
+	}
+
+	ping := time.NewTicker(misskeyStreamPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+
+		case err := <-readErr:
+			return err
+
+		case <-ping.C:
+			err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(misskeyStreamPingInterval))
+			if err != nil {
+				return err
+			}
+
+		case data := <-messages:
+			e.status.heartbeat()
+			err := e.handleStreamMessage(ctx, conn, data, updatesChan)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// handleStreamMessage converts a message of the stream and forwards it. Only errors of the stream are returned.
+func (e *EndpointMisskey) handleStreamMessage(ctx context.Context, conn *websocket.Conn, data []byte, updatesChan chan<- *model.EndpointUpdate) error {
+	var message struct {
+		Type string             `json:"type"`
+		Body misskeyStreamEvent `json:"body"`
+	}
+	err := json.Unmarshal(data, &message)
+	if err != nil {
+		// Malformed messages don't affect the connection.
+		slog.Error("Failed to decode Misskey stream message", "err", err)
+		return nil
+	}
+
+	var convertedUpdate *model.EndpointUpdate
+	switch {
+	case message.Type == "channel" && message.Body.ID == misskeyHomeChannelID && message.Body.Type == "note":
+		var note misskeyNote
+		err := json.Unmarshal(message.Body.Body, &note)
+		if err != nil {
+			slog.Error("Failed to decode Misskey note", "err", err)
+			return nil
+		}
+		e.trackSeenNote(&note)
+		if !e.acceptNote(&note) {
+			return nil
+		}
+		err = e.subscribe(conn, note.ID)
+		if err != nil {
+			return err
+		}
+		convertedUpdate = e.convertNote(&note, model.UpdateTypeNew)
+
+	case message.Type == "noteUpdated" && message.Body.Type == "deleted":
+		e.unsubscribe(conn, message.Body.ID)
+		var deleted struct {
+			DeletedAt time.Time `json:"deletedAt"`
+		}
+		_ = json.Unmarshal(message.Body.Body, &deleted)
+		if deleted.DeletedAt.IsZero() {
+			deleted.DeletedAt = time.Now()
+		}
+		convertedUpdate = &model.EndpointUpdate{
+			Type: model.UpdateTypeDelete,
+			UniqueEndpointMessageID: model.UniqueEndpointMessageID{
+				EID: e.id,
+				ID:  model.EndpointMessageID(message.Body.ID),
+			},
+			Timestamp: deleted.DeletedAt,
+		}
+
+	case message.Type == "noteUpdated" && message.Body.Type == "updated":
+		// Forks differ in what they send along with edits, so the note is fetched as a whole.
+		note, err := e.client.showNote(ctx, message.Body.ID)
+		if err != nil {
+			slog.Error("Failed to fetch edited Misskey note", "id", message.Body.ID, "err", err)
+			return nil
+		}
+		if !e.acceptNote(note) {
+			return nil
+		}
+		convertedUpdate = e.convertNote(note, model.UpdateTypeEdit)
+
+	default:
+		return nil
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case updatesChan <- convertedUpdate:
+	}
+	return nil
+}
+
+// subscribe watches the note for edits and deletions, dropping the oldest subscription if there are too many.
+func (e *EndpointMisskey) subscribe(conn *websocket.Conn, id string) error {
+	if slices.Contains(e.subscribed, id) {
+		return nil
+	}
+	if len(e.subscribed) >= misskeyNoteSubscriptions {
+		e.unsubscribe(conn, e.subscribed[0])
+	}
+	e.subscribed = append(e.subscribed, id)
+	return conn.WriteJSON(&misskeyStreamMessage{Type: "subNote", Body: map[string]any{"id": id}})
+}
+
+// unsubscribe stops watching the note. Errors are left for the reader to notice, as the note is gone either way.
+func (e *EndpointMisskey) unsubscribe(conn *websocket.Conn, id string) {
+	i := slices.Index(e.subscribed, id)
+	if i < 0 {
+		return
+	}
+	e.subscribed = slices.Delete(e.subscribed, i, i+1)
+	_ = conn.WriteJSON(&misskeyStreamMessage{Type: "unsubNote", Body: map[string]any{"id": id}})
+}
+
+// backfill fetches our notes posted after the last seen one, oldest first.
+func (e *EndpointMisskey) backfill(ctx context.Context, conn *websocket.Conn, updatesChan chan<- *model.EndpointUpdate) error {
+	for {
+		notes, err := e.client.userNotes(ctx, e.userID, e.lastSeenID, misskeyBackfillPageSize)
+		if err != nil {
+			return err
+		}
+		if len(notes) == 0 {
+			return nil
+		}
+
+		slog.Info("Backfilling Misskey notes", "eid", e.id, "count", len(notes))
+
+		// Forks disagree on the order of notes fetched with sinceId.
+		slices.SortFunc(notes, func(a, b *misskeyNote) int {
+			if a.ID == b.ID {
+				return 0
+			}
+			if isNewerNoteID(a.ID, b.ID) {
+				return 1
+			}
+			return -1
+		})
+		for _, note := range notes {
+			e.trackSeenNote(note)
+			if !e.acceptNote(note) {
+				continue
+			}
+			err := e.subscribe(conn, note.ID)
+			if err != nil {
+				return err
+			}
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case updatesChan <- e.convertNote(note, model.UpdateTypeNew):
+			}
+		}
+	}
+}
+
+// trackSeenNote records our latest note, so that backfill continues from it.
+func (e *EndpointMisskey) trackSeenNote(note *misskeyNote) {
+	if note.UserID != e.userID {
+		return
+	}
+	if isNewerNoteID(note.ID, e.lastSeenID) {
+		e.lastSeenID = note.ID
+	}
+}
+
+// isNewerNoteID compares note IDs, which are generated by the server to sort by time, whatever the format.
+func isNewerNoteID(a, b string) bool {
+	if len(a) != len(b) {
+		return len(a) > len(b)
+	}
+	return a > b
+}
@@ -0,0 +1,62 @@
+package endpoint
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Status reports the health of an endpoint.
+type Status struct {
+	Initialized bool
+	// Listening is set while ListenUpdates is running, or Run for write-only endpoints.
+	Listening bool
+	// LastAPICall is the time of the last successful request to the platform API.
+	LastAPICall time.Time
+	// LastHeartbeat is the last sign of life of the listener, e.g. data received from a stream or a finished long poll.
+	// It's set when the listener starts, so that a listener that never receives anything becomes stale.
+	LastHeartbeat time.Time
+}
+
+// statusTracker records Status concurrently with the listener and API requests.
+// Times are stored as unix nanoseconds, 0 for never.
+type statusTracker struct {
+	initialized   atomic.Bool
+	listening     atomic.Bool
+	lastAPICall   atomic.Int64
+	lastHeartbeat atomic.Int64
+}
+
+func (t *statusTracker) setInitialized() {
+	t.initialized.Store(true)
+}
+
+func (t *statusTracker) setListening(listening bool) {
+	if listening {
+		t.heartbeat()
+	}
+	t.listening.Store(listening)
+}
+
+func (t *statusTracker) apiCallSucceeded() {
+	t.lastAPICall.Store(time.Now().UnixNano())
+}
+
+func (t *statusTracker) heartbeat() {
+	t.lastHeartbeat.Store(time.Now().UnixNano())
+}
+
+func (t *statusTracker) status() Status {
+	return Status{
+		Initialized:   t.initialized.Load(),
+		Listening:     t.listening.Load(),
+		LastAPICall:   unixNanoTime(t.lastAPICall.Load()),
+		LastHeartbeat: unixNanoTime(t.lastHeartbeat.Load()),
+	}
+}
+
+func unixNanoTime(ns int64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
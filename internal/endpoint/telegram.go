@@ -2,32 +2,134 @@ package endpoint
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"log/slog"
+	"net"
+	"net/url"
+	"regexp"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
+	"unicode"
+	"unicode/utf16"
 
 	tg "github.com/go-telegram/bot"
 	"github.com/go-telegram/bot/models"
+	"github.com/merrkry/tele2don/internal/config"
+	"github.com/merrkry/tele2don/internal/markdown"
 	"github.com/merrkry/tele2don/internal/model"
 )
 
 type EndpointConfigTelegram struct {
-	BotToken  string
-	ChannelID int64
+	BotToken  string `json:"bot_token"`
+	ChannelID int64  `json:"channel_id"`
+
+	// DeletionProbeChatID is a chat where recent channel posts are forwarded to check if they still exist.
+	// Detection of deletions in the channel is disabled if it's 0.
+	DeletionProbeChatID   int64           `json:"deletion_probe_chat_id"`
+	DeletionProbeInterval config.Duration `json:"deletion_probe_interval"`
+	// DeletionProbeWindow is the number of recent posts to probe.
+	DeletionProbeWindow int `json:"deletion_probe_window"`
+	// DeletionProbeStorePath is the file keeping probed posts across restarts.
+	// If empty, posts from before a restart are no longer probed.
+	DeletionProbeStorePath string `json:"deletion_probe_store_path"`
+
+	// Webhook receives updates pushed by Telegram instead of long polling, if its url is set.
+	// Endpoints sharing a bot must use the same webhook.
+	Webhook EndpointConfigTelegramWebhook `json:"webhook"`
+}
+
+type EndpointConfigTelegramWebhook struct {
+	// URL is the public HTTPS address registered to Telegram, e.g. behind a reverse proxy.
+	URL string `json:"url"`
+	// Listen is the local address serving the webhook.
+	Listen string `json:"listen"`
+	// Path of the webhook on the local server, it defaults to the path of URL.
+	Path string `json:"path"`
+	// SecretToken is sent by Telegram in every request, to tell them from forged ones.
+	SecretToken      string `json:"secret_token"`
+	DeleteOnShutdown bool   `json:"delete_on_shutdown"`
 }
 
-// TODO: track recent messages in order to detect message deletion
+// telegramSecretTokenPattern is the format of secret tokens accepted by setWebhook.
+var telegramSecretTokenPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,256}$`)
+
+func (c *EndpointConfigTelegramWebhook) validate() error {
+	u, err := url.Parse(c.URL)
+	if err != nil || u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("url: must be an https URL")
+	}
+	if c.Path == "" {
+		c.Path = u.Path
+		if c.Path == "" {
+			c.Path = "/"
+		}
+	}
+	if !strings.HasPrefix(c.Path, "/") {
+		return fmt.Errorf("path: must start with /")
+	}
+	if c.Listen == "" {
+		return fmt.Errorf("listen: required")
+	}
+	if _, _, err := net.SplitHostPort(c.Listen); err != nil {
+		return fmt.Errorf("listen: %w", err)
+	}
+	if !telegramSecretTokenPattern.MatchString(c.SecretToken) {
+		return fmt.Errorf("secret_token: must be 1-256 characters of A-Z, a-z, 0-9, _ and -")
+	}
+	return nil
+}
+
+func (c *EndpointConfigTelegram) validate() error {
+	if c.BotToken == "" {
+		return fmt.Errorf("bot_token: required")
+	}
+	if c.ChannelID == 0 {
+		return fmt.Errorf("channel_id: required")
+	}
+	if c.DeletionProbeInterval < 0 {
+		return fmt.Errorf("deletion_probe_interval: must not be negative")
+	}
+	if c.DeletionProbeWindow < 0 {
+		return fmt.Errorf("deletion_probe_window: must not be negative")
+	}
+	if c.Webhook.URL != "" {
+		if err := c.Webhook.validate(); err != nil {
+			return fmt.Errorf("webhook.%w", err)
+		}
+	}
+	return nil
+}
+
+const (
+	telegramMaxMediaGroupSize = 10
+	// Limits of text and captions, in UTF-16 code units of the text without formatting.
+	telegramMaxTextLength    = 4096
+	telegramMaxCaptionLength = 1024
+)
+
 type EndpointTelegram struct {
 	id        model.EndpointID
-	bot       *tg.Bot
+	bots      *TelegramBots
+	bot       *telegramBot
 	channelID int64
+
+	probeChatID   int64
+	probeInterval time.Duration
+	recent        *recentMessages
+	albums        albumBuffer
+
+	status statusTracker
 }
 
-func NewEndpointTelegram(id model.EndpointID, channelID int64) *EndpointTelegram {
+// NewEndpointTelegram creates an endpoint for a channel, bots are shared with other endpoints through bots.
+func NewEndpointTelegram(id model.EndpointID, channelID int64, bots *TelegramBots) *EndpointTelegram {
 	return &EndpointTelegram{
 		id:        id,
+		bots:      bots,
 		channelID: channelID,
 	}
 }
@@ -38,26 +140,65 @@ func (e *EndpointTelegram) ID() model.EndpointID {
 
 func (e *EndpointTelegram) Initialize(ctx context.Context, cfg *EndpointConfig) error {
 	var err error
-	e.bot, err = tg.New(cfg.Telegram.BotToken)
+	e.bot, err = e.bots.get(cfg.Telegram.BotToken, cfg.Telegram.Webhook)
+	if err != nil {
+		return err
+	}
+
+	e.probeChatID = cfg.Telegram.DeletionProbeChatID
+	e.probeInterval = time.Duration(cfg.Telegram.DeletionProbeInterval)
+	if e.probeInterval <= 0 {
+		e.probeInterval = defaultDeletionProbeInterval
+	}
+	window := cfg.Telegram.DeletionProbeWindow
+	if window <= 0 {
+		window = defaultDeletionProbeWindow
+	}
+	e.recent, err = loadRecentMessages(cfg.Telegram.DeletionProbeStorePath, window)
 	if err != nil {
-		return fmt.Errorf("failed to initialize Telegram bot: %w", err)
+		return err
 	}
+
+	e.status.setInitialized()
 	return nil
 }
 
+// Status combines the state of the endpoint with API calls and polling of its bot, which might be shared.
+func (e *EndpointTelegram) Status() Status {
+	status := e.status.status()
+	if e.bot != nil {
+		bot := e.bot.status.status()
+		status.LastAPICall = bot.LastAPICall
+		if bot.LastHeartbeat.After(status.LastHeartbeat) {
+			status.LastHeartbeat = bot.LastHeartbeat
+		}
+	}
+	return status
+}
+
 func (e *EndpointTelegram) ListenUpdates(ctx context.Context, updatesChan chan<- *model.EndpointUpdate, wg *sync.WaitGroup) {
 	defer wg.Done()
+	e.status.setListening(true)
+	defer e.status.setListening(false)
 
 	e.bot.RegisterHandlerMatchFunc(e.isSupportedUpdate, func(ctx context.Context, bot *tg.Bot, update *models.Update) {
-		convertedUpdate, err := e.convertUpdate(update)
+		err := e.forwardUpdate(ctx, update, updatesChan)
 		if err != nil {
 			slog.Error("Failed to convert update", "err", err)
-			return
 		}
-		updatesChan <- convertedUpdate
 	})
 
-	e.bot.Start(ctx)
+	var probeWg sync.WaitGroup
+	if e.probeChatID != 0 {
+		probeWg.Add(1)
+		go func() {
+			defer probeWg.Done()
+			e.probeDeletions(ctx, updatesChan)
+		}()
+	}
+
+	e.bot.start(ctx)
+	probeWg.Wait()
 }
 
 func (e *EndpointTelegram) isSupportedUpdate(update *models.Update) bool {
@@ -65,7 +206,15 @@ func (e *EndpointTelegram) isSupportedUpdate(update *models.Update) bool {
 		return false
 	}
 
-	return update.ChannelPost != nil || update.EditedChannelPost != nil
+	// The bot might be shared with endpoints of other channels.
+	switch {
+	case update.ChannelPost != nil:
+		return update.ChannelPost.Chat.ID == e.channelID
+	case update.EditedChannelPost != nil:
+		return update.EditedChannelPost.Chat.ID == e.channelID
+	default:
+		return false
+	}
 }
 
 func (e *EndpointTelegram) convertUpdate(update *models.Update) (*model.EndpointUpdate, error) {
@@ -83,53 +232,488 @@ func (e *EndpointTelegram) convertUpdate(update *models.Update) (*model.Endpoint
 		convertedUpdate.Type = model.UpdateTypeNew
 		convertedUpdate.Timestamp = time.Unix(int64(update.ChannelPost.Date), 0)
 		convertedUpdate.ID = model.EndpointMessageID(strconv.FormatInt(int64(update.ChannelPost.ID), 10))
-		convertedUpdate.Content = &model.BridgeMessageContent{
-			MDText: update.ChannelPost.Text, // TODO: convert tg entities
+		convertedUpdate.Content = e.convertMessage(update.ChannelPost)
+		// Replies to messages in other chats can't be bridged.
+		if parent := update.ChannelPost.ReplyToMessage; parent != nil && parent.Chat.ID == e.channelID {
+			convertedUpdate.Parent = &model.UniqueEndpointMessageID{
+				EID: e.id,
+				ID:  model.EndpointMessageID(strconv.FormatInt(int64(parent.ID), 10)),
+			}
 		}
 	} else if update.EditedChannelPost != nil { // edited message
 		convertedUpdate.Type = model.UpdateTypeEdit
 		convertedUpdate.Timestamp = time.Unix(int64(update.EditedChannelPost.EditDate), 0)
 		convertedUpdate.ID = model.EndpointMessageID(strconv.FormatInt(int64(update.EditedChannelPost.ID), 10))
-		convertedUpdate.Content = &model.BridgeMessageContent{
-			MDText: update.EditedChannelPost.Text, // TODO: convert tg entities
-		}
+		convertedUpdate.Content = e.convertMessage(update.EditedChannelPost)
 	}
 
 	return convertedUpdate, nil
 }
 
-func (e *EndpointTelegram) ApplyUpdateNew(ctx context.Context, content *model.BridgeMessageContent) (model.EndpointMessageID, time.Time, error) {
-	msg, err := e.bot.SendMessage(ctx, &tg.SendMessageParams{
-		ChatID: e.channelID,
-		Text:   content.MDText,
-	})
+func (e *EndpointTelegram) convertMessage(msg *models.Message) *model.BridgeMessageContent {
+	text, entities := msg.Text, msg.Entities
+	if msg.Caption != "" {
+		text, entities = msg.Caption, msg.CaptionEntities
+	}
+	cw, text, entities := splitContentWarning(text, entities)
 
-	if err != nil {
-		return "", time.Time{}, fmt.Errorf("failed to send message to Telegram: %w", err)
+	content := &model.BridgeMessageContent{
+		MDText:      entitiesToMarkdown(text, entities),
+		SpoilerText: cw,
+		Sensitive:   msg.HasMediaSpoiler,
 	}
 
-	slog.Debug("Message sent to Telegram", "id", msg.ID)
+	// Each message carries at most one media. Albums are delivered as separate messages sharing the same MediaGroupID,
+	// which are merged by forwardUpdate.
+	switch {
+	case len(msg.Photo) > 0:
+		// Photo sizes are sorted in ascending order, pick the original one.
+		photo := msg.Photo[len(msg.Photo)-1]
+		content.Attachments = append(content.Attachments, &model.Attachment{
+			Kind:     model.AttachmentKindPhoto,
+			MIMEType: "image/jpeg",
+			Size:     int64(photo.FileSize),
+			Source:   photo.FileID,
+			Open:     e.fileOpener(photo.FileID),
+		})
+	case msg.Video != nil:
+		content.Attachments = append(content.Attachments, &model.Attachment{
+			Kind:     model.AttachmentKindVideo,
+			MIMEType: msg.Video.MimeType,
+			Size:     msg.Video.FileSize,
+			FileName: msg.Video.FileName,
+			Source:   msg.Video.FileID,
+			Open:     e.fileOpener(msg.Video.FileID),
+		})
+	case msg.Animation != nil: // Document is also set for animations, so this must be checked first
+		content.Attachments = append(content.Attachments, &model.Attachment{
+			Kind:     model.AttachmentKindAnimation,
+			MIMEType: msg.Animation.MimeType,
+			Size:     msg.Animation.FileSize,
+			FileName: msg.Animation.FileName,
+			Source:   msg.Animation.FileID,
+			Open:     e.fileOpener(msg.Animation.FileID),
+		})
+	case msg.Document != nil:
+		content.Attachments = append(content.Attachments, &model.Attachment{
+			Kind:     model.AttachmentKindDocument,
+			MIMEType: msg.Document.MimeType,
+			Size:     msg.Document.FileSize,
+			FileName: msg.Document.FileName,
+			Source:   msg.Document.FileID,
+			Open:     e.fileOpener(msg.Document.FileID),
+		})
+	}
+
+	return content
+}
+
+// AttachmentOpener recreates the opener of an attachment received from this endpoint, whose source is the file ID.
+func (e *EndpointTelegram) AttachmentOpener(source string) model.AttachmentOpener {
+	return e.fileOpener(source)
+}
 
-	return model.EndpointMessageID(strconv.FormatInt(int64(msg.ID), 10)), time.Unix(int64(msg.Date), 0), nil
+// fileOpener returns an opener that downloads the file from Telegram on demand.
+// Note that bot API only allows downloading files up to 20MB.
+func (e *EndpointTelegram) fileOpener(fileID string) model.AttachmentOpener {
+	return func(ctx context.Context) (io.ReadCloser, error) {
+		file, err := e.bot.GetFile(ctx, &tg.GetFileParams{
+			FileID: fileID,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to get Telegram file %s: %w", fileID, err)
+		}
+		return openRemoteFile(ctx, e.bot.FileDownloadLink(file))
+	}
 }
 
-func (e *EndpointTelegram) ApplyUpdateEdit(ctx context.Context, id model.EndpointMessageID, content *model.BridgeMessageContent) (time.Time, error) {
+// telegramMessageID parses the ID of a message sent by the bot, which always fits in 32 bits.
+func telegramMessageID(id model.EndpointMessageID) int {
 	msgID, _ := strconv.ParseInt(string(id), 10, 32)
-	msg, err := e.bot.EditMessageText(ctx, &tg.EditMessageTextParams{
-		ChatID:    e.channelID,
-		MessageID: int(msgID),
-		Text:      content.MDText,
+	return int(msgID)
+}
+
+// telegramLength counts characters of bridge Markdown as rendered for Telegram, which counts UTF-16 code units.
+func telegramLength(md string) int {
+	return len(utf16.Encode([]rune(renderTelegramText(md).text)))
+}
+
+// splitTelegramText splits bridge Markdown of content into pieces within the length limits of Telegram.
+// If there are attachments, the first piece is their caption, whose limit is lower than that of text messages.
+// The content warning is repeated in every piece, and counts towards the limits.
+func splitTelegramText(content *model.BridgeMessageContent) []string {
+	cw := 0
+	if content.SpoilerText != "" {
+		cw = len(utf16.Encode([]rune(telegramCWPrefix + content.SpoilerText + "\n\n")))
+	}
+	textLimit := max(telegramMaxTextLength-cw, 1)
+	if len(content.Attachments) == 0 {
+		return markdown.Split(content.MDText, textLimit, telegramLength)
+	}
+
+	pieces := markdown.Split(content.MDText, max(telegramMaxCaptionLength-cw, 1), telegramLength)
+	if len(pieces) == 1 {
+		return pieces
+	}
+	// The first piece is a prefix of the text, the rest is split again with the limit of text messages.
+	// Indentation of the line following the cut is kept, as it's significant in Markdown.
+	rest := content.MDText[len(pieces[0]):]
+	trimmed := strings.TrimLeftFunc(rest, unicode.IsSpace)
+	if i := strings.LastIndexByte(rest[:len(rest)-len(trimmed)], '\n'); i >= 0 {
+		trimmed = rest[i+1:]
+	}
+	return append(pieces[:1], markdown.Split(trimmed, textLimit, telegramLength)...)
+}
+
+// telegramMediaMessages returns the number of messages sendContent sends for attachments, and 1 if there are none.
+func telegramMediaMessages(attachments []*model.Attachment) int {
+	if len(attachments) <= 1 {
+		return 1
+	}
+	return min(len(attachments), telegramMaxMediaGroupSize)
+}
+
+// ApplyUpdateNew sends content as several messages replying to each other if it exceeds the length limits.
+// Attachments are sent with the first piece of text as caption, every message of an album is returned.
+func (e *EndpointTelegram) ApplyUpdateNew(ctx context.Context, content *model.BridgeMessageContent, replyTo model.EndpointMessageID) ([]model.EndpointMessageRevision, error) {
+	var reply *models.ReplyParameters
+	if replyTo != "" {
+		reply = &models.ReplyParameters{
+			MessageID: telegramMessageID(replyTo),
+			// The parent might have been deleted in the meantime, losing the link is better than losing the message.
+			AllowSendingWithoutReply: true,
+		}
+	}
+
+	var revisions []model.EndpointMessageRevision
+	for i, md := range splitTelegramText(content) {
+		var attachments []*model.Attachment
+		if i == 0 {
+			attachments = content.Attachments
+		}
+
+		msgs, err := e.sendText(ctx, md, content.SpoilerText, attachments, content.Sensitive, reply)
+		if err != nil {
+			deleteIncomplete(ctx, e, revisions)
+			return nil, classifyTelegramError(fmt.Errorf("failed to send message to Telegram: %w", err))
+		}
+
+		for _, msg := range msgs {
+			slog.Debug("Message sent to Telegram", "id", msg.ID)
+			e.recent.track(msg.ID)
+
+			revisions = append(revisions, model.EndpointMessageRevision{
+				ID:        model.EndpointMessageID(strconv.Itoa(msg.ID)),
+				Timestamp: time.Unix(int64(msg.Date), 0),
+			})
+		}
+		reply = &models.ReplyParameters{MessageID: msgs[len(msgs)-1].ID, AllowSendingWithoutReply: true}
+	}
+
+	return revisions, nil
+}
+
+// sendText sends bridge Markdown md with the content warning cw, as caption of attachments if there are any.
+// The raw Markdown is sent as plain text if Telegram rejects the formatting.
+func (e *EndpointTelegram) sendText(ctx context.Context, md, cw string, attachments []*model.Attachment, sensitive bool, reply *models.ReplyParameters) ([]*models.Message, error) {
+	text := withContentWarning(renderTelegramText(md), cw)
+	msgs, err := e.sendContent(ctx, attachments, sensitive, text, reply)
+	if err != nil && len(text.entities) > 0 && errors.Is(err, tg.ErrorBadRequest) {
+		slog.Warn("Telegram rejected formatted message, retrying as plain text", "err", err)
+		msgs, err = e.sendContent(ctx, attachments, sensitive, withContentWarning(telegramText{text: md}, cw), reply)
+	}
+	return msgs, err
+}
+
+// sendContent sends text as a single message, or as caption of attachments, which make an album if there are multiple.
+func (e *EndpointTelegram) sendContent(ctx context.Context, attachments []*model.Attachment, sensitive bool, text telegramText, reply *models.ReplyParameters) ([]*models.Message, error) {
+	var msg *models.Message
+	var err error
+	switch len(attachments) {
+	case 0:
+		msg, err = e.bot.SendMessage(ctx, &tg.SendMessageParams{
+			ChatID:          e.channelID,
+			Text:            text.text,
+			Entities:        text.entities,
+			ReplyParameters: reply,
+		})
+	case 1:
+		msg, err = e.sendAttachment(ctx, attachments[0], text, sensitive, reply)
+	default:
+		return e.sendMediaGroup(ctx, attachments, text, sensitive, reply)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return []*models.Message{msg}, nil
+}
+
+// sendAttachment sends a single attachment, which is hidden behind a spoiler if sensitive.
+// Telegram doesn't support spoilers for documents.
+func (e *EndpointTelegram) sendAttachment(ctx context.Context, attachment *model.Attachment, caption telegramText, sensitive bool, reply *models.ReplyParameters) (*models.Message, error) {
+	r, err := attachment.Open(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	file := &models.InputFileUpload{
+		Filename: attachmentFileName(attachment),
+		Data:     r,
+	}
+
+	switch attachment.Kind {
+	case model.AttachmentKindPhoto:
+		return e.bot.SendPhoto(ctx, &tg.SendPhotoParams{
+			ChatID:          e.channelID,
+			Photo:           file,
+			Caption:         caption.text,
+			CaptionEntities: caption.entities,
+			HasSpoiler:      sensitive,
+			ReplyParameters: reply,
+		})
+	case model.AttachmentKindVideo:
+		return e.bot.SendVideo(ctx, &tg.SendVideoParams{
+			ChatID:          e.channelID,
+			Video:           file,
+			Caption:         caption.text,
+			CaptionEntities: caption.entities,
+			HasSpoiler:      sensitive,
+			ReplyParameters: reply,
+		})
+	case model.AttachmentKindAnimation:
+		return e.bot.SendAnimation(ctx, &tg.SendAnimationParams{
+			ChatID:          e.channelID,
+			Animation:       file,
+			Caption:         caption.text,
+			CaptionEntities: caption.entities,
+			HasSpoiler:      sensitive,
+			ReplyParameters: reply,
+		})
+	default:
+		return e.bot.SendDocument(ctx, &tg.SendDocumentParams{
+			ChatID:          e.channelID,
+			Document:        file,
+			Caption:         caption.text,
+			CaptionEntities: caption.entities,
+			ReplyParameters: reply,
+		})
+	}
+}
+
+// sendMediaGroup sends multiple attachments as an album, and returns all messages of it, the first one carrying the caption.
+// Telegram doesn't allow mixing documents or animations with photos and videos,
+// so they are sent as documents in this case.
+func (e *EndpointTelegram) sendMediaGroup(ctx context.Context, attachments []*model.Attachment, caption telegramText, sensitive bool, reply *models.ReplyParameters) ([]*models.Message, error) {
+	if len(attachments) > telegramMaxMediaGroupSize {
+		slog.Warn("Too many attachments for a Telegram album, extra ones will be dropped", "count", len(attachments))
+		attachments = attachments[:telegramMaxMediaGroupSize]
+	}
+
+	visualOnly := true
+	for _, attachment := range attachments {
+		if attachment.Kind != model.AttachmentKindPhoto && attachment.Kind != model.AttachmentKindVideo {
+			visualOnly = false
+			break
+		}
+	}
+
+	media := make([]models.InputMedia, 0, len(attachments))
+	for i, attachment := range attachments {
+		r, err := attachment.Open(ctx)
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+
+		// Used as multipart field name, so it must be unique within the album.
+		name := fmt.Sprintf("%s%d", attachment.Kind, i)
+		var itemCaption telegramText
+		if i == 0 {
+			itemCaption = caption
+		}
+
+		switch {
+		case visualOnly && attachment.Kind == model.AttachmentKindPhoto:
+			media = append(media, &models.InputMediaPhoto{
+				Media:           "attach://" + name,
+				Caption:         itemCaption.text,
+				CaptionEntities: itemCaption.entities,
+				HasSpoiler:      sensitive,
+				MediaAttachment: r,
+			})
+		case visualOnly && attachment.Kind == model.AttachmentKindVideo:
+			media = append(media, &models.InputMediaVideo{
+				Media:           "attach://" + name,
+				Caption:         itemCaption.text,
+				CaptionEntities: itemCaption.entities,
+				HasSpoiler:      sensitive,
+				MediaAttachment: r,
+			})
+		default:
+			media = append(media, &models.InputMediaDocument{
+				Media:           "attach://" + name,
+				Caption:         itemCaption.text,
+				CaptionEntities: itemCaption.entities,
+				MediaAttachment: r,
+			})
+		}
+	}
+
+	msgs, err := e.bot.SendMediaGroup(ctx, &tg.SendMediaGroupParams{
+		ChatID:          e.channelID,
+		Media:           media,
+		ReplyParameters: reply,
 	})
+	if err != nil {
+		return nil, err
+	}
+	if len(msgs) == 0 {
+		return nil, fmt.Errorf("empty response from sendMediaGroup")
+	}
+
+	return msgs, nil
+}
+
+// ApplyUpdateEdit edits messages in place, sending or deleting trailing text messages if the number of pieces changes.
+// Messages of an album but the first one only hold media, and are left as they are. Their number is told from
+// attachments of content, which edits from Telegram albums lack, so trailing messages are only deleted for text content.
+func (e *EndpointTelegram) ApplyUpdateEdit(ctx context.Context, ids []model.EndpointMessageID, content *model.BridgeMessageContent) ([]model.EndpointMessageRevision, error) {
+	if len(ids) == 0 {
+		return nil, &PermanentError{Err: fmt.Errorf("no Telegram message to edit")}
+	}
 
+	pieces := splitTelegramText(content)
+	albumEnd := min(telegramMediaMessages(content.Attachments), len(ids))
+
+	// The first message carries the caption of attachments, if there are any.
+	timestamp, err := e.editText(ctx, ids[0], pieces[0], content.SpoilerText, len(content.Attachments) > 0)
 	if err != nil {
-		return time.Time{}, fmt.Errorf("failed to edit message in Telegram: %w", err)
+		return nil, classifyTelegramError(fmt.Errorf("failed to edit message in Telegram: %w", err))
+	}
+	var revisions []model.EndpointMessageRevision
+	for _, id := range ids[:albumEnd] {
+		revisions = append(revisions, model.EndpointMessageRevision{ID: id, Timestamp: timestamp})
 	}
 
-	slog.Debug("Message edited in Telegram", "id", msg.ID)
+	following := ids[albumEnd:]
+	for i, md := range pieces[1:] {
+		if i < len(following) {
+			timestamp, err := e.editText(ctx, following[i], md, content.SpoilerText, false)
+			if err != nil {
+				return nil, classifyTelegramError(fmt.Errorf("failed to edit message in Telegram: %w", err))
+			}
+			revisions = append(revisions, model.EndpointMessageRevision{ID: following[i], Timestamp: timestamp})
+			continue
+		}
+
+		reply := &models.ReplyParameters{MessageID: telegramMessageID(revisions[len(revisions)-1].ID), AllowSendingWithoutReply: true}
+		msgs, err := e.sendText(ctx, md, content.SpoilerText, nil, false, reply)
+		if err != nil {
+			return nil, classifyTelegramError(fmt.Errorf("failed to send message to Telegram: %w", err))
+		}
+		slog.Debug("Message sent to Telegram", "id", msgs[0].ID)
+		e.recent.track(msgs[0].ID)
+		revisions = append(revisions, model.EndpointMessageRevision{
+			ID:        model.EndpointMessageID(strconv.Itoa(msgs[0].ID)),
+			Timestamp: time.Unix(int64(msgs[0].Date), 0),
+		})
+	}
+
+	for _, id := range following[min(len(pieces)-1, len(following)):] {
+		if len(content.Attachments) > 0 {
+			revisions = append(revisions, model.EndpointMessageRevision{ID: id, Timestamp: timestamp})
+			continue
+		}
+		err := e.ApplyUpdateDelete(ctx, id)
+		if err != nil {
+			return nil, classifyTelegramError(err)
+		}
+	}
+
+	return revisions, nil
+}
+
+// editText replaces the text of a message, or its caption if it's a media message, and returns the time of the edit.
+// The raw Markdown is used as plain text if Telegram rejects the formatting.
+func (e *EndpointTelegram) editText(ctx context.Context, id model.EndpointMessageID, md, cw string, isMedia bool) (time.Time, error) {
+	text := withContentWarning(renderTelegramText(md), cw)
+	msg, err := e.editContent(ctx, telegramMessageID(id), isMedia, text)
+	if err != nil && len(text.entities) > 0 && errors.Is(err, tg.ErrorBadRequest) && !isTelegramNotModified(err) {
+		slog.Warn("Telegram rejected formatted message, retrying as plain text", "err", err)
+		msg, err = e.editContent(ctx, telegramMessageID(id), isMedia, withContentWarning(telegramText{text: md}, cw))
+	}
+	// Pieces of a split message that didn't change are rejected by Telegram.
+	if isTelegramNotModified(err) {
+		return time.Now(), nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
 
+	slog.Debug("Message edited in Telegram", "id", msg.ID)
 	return time.Unix(int64(msg.EditDate), 0), nil
 }
 
+// isTelegramNotModified tells whether an edit was rejected for leaving the message as it is.
+func isTelegramNotModified(err error) bool {
+	return errors.Is(err, tg.ErrorBadRequest) && strings.Contains(err.Error(), "message is not modified")
+}
+
+func (e *EndpointTelegram) editContent(ctx context.Context, msgID int, isMedia bool, text telegramText) (*models.Message, error) {
+	// Media messages only have captions, which must be edited with a dedicated method.
+	if isMedia {
+		return e.bot.EditMessageCaption(ctx, &tg.EditMessageCaptionParams{
+			ChatID:          e.channelID,
+			MessageID:       msgID,
+			Caption:         text.text,
+			CaptionEntities: text.entities,
+		})
+	}
+	return e.bot.EditMessageText(ctx, &tg.EditMessageTextParams{
+		ChatID:    e.channelID,
+		MessageID: msgID,
+		Text:      text.text,
+		Entities:  text.entities,
+	})
+}
+
 func (e *EndpointTelegram) ApplyUpdateDelete(ctx context.Context, id model.EndpointMessageID) error {
-	return ErrUnsupportedUpdate
+	msgID := telegramMessageID(id)
+
+	_, err := e.bot.DeleteMessage(ctx, &tg.DeleteMessageParams{
+		ChatID:    e.channelID,
+		MessageID: msgID,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete message in Telegram: %w", err)
+	}
+
+	slog.Debug("Message deleted in Telegram", "id", msgID)
+	e.recent.untrack(msgID)
+
+	return nil
+}
+
+// attachmentFileName returns a file name for uploading, as Telegram requires one for multipart attachments.
+func attachmentFileName(attachment *model.Attachment) string {
+	if attachment.FileName != "" {
+		return attachment.FileName
+	}
+	return attachment.Kind.String()
+}
+
+// classifyTelegramError tells retryable failures apart from permanent ones for the outbox.
+// Requests rejected by Telegram won't succeed by retrying, unlike network failures or server errors.
+func classifyTelegramError(err error) error {
+	var tooManyRequests *tg.TooManyRequestsError
+	switch {
+	case errors.As(err, &tooManyRequests):
+		return &RetryAfterError{RetryAfter: time.Duration(tooManyRequests.RetryAfter) * time.Second, Err: err}
+	case errors.Is(err, tg.ErrorBadRequest), errors.Is(err, tg.ErrorForbidden),
+		errors.Is(err, tg.ErrorUnauthorized), errors.Is(err, tg.ErrorNotFound):
+		return &PermanentError{Err: err}
+	default:
+		return err
+	}
 }
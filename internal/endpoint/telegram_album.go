@@ -0,0 +1,164 @@
+package endpoint
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-telegram/bot/models"
+	"github.com/merrkry/tele2don/internal/model"
+)
+
+// telegramAlbumWindow is how long to wait for more posts of an album after the last one.
+// Telegram delivers posts of an album right after each other, so a short window is enough.
+const telegramAlbumWindow = time.Second
+
+// telegramAlbumsKept is how many merged albums are remembered, to tell which album an edited post belongs to.
+const telegramAlbumsKept = 100
+
+// albumItem is a post of an album, converted on its own.
+type albumItem struct {
+	msgID  int
+	update *model.EndpointUpdate
+}
+
+// pendingAlbum collects posts of an album until no more of them arrive within telegramAlbumWindow.
+type pendingAlbum struct {
+	items []albumItem
+	timer *time.Timer
+}
+
+// albumBuffer groups posts sharing a media group ID, which are delivered as separate updates by Telegram.
+type albumBuffer struct {
+	mu     sync.Mutex
+	albums map[string]*pendingAlbum
+	// members maps posts of recently merged albums to the post identifying their album.
+	members map[int]int
+	// merged lists posts of recently merged albums, oldest first.
+	merged [][]int
+}
+
+// add buffers a converted post of the album groupID, and calls flush with the combined update once the album is complete.
+func (b *albumBuffer) add(groupID string, msgID int, update *model.EndpointUpdate, flush func(*model.EndpointUpdate)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.albums == nil {
+		b.albums = make(map[string]*pendingAlbum)
+	}
+	album, ok := b.albums[groupID]
+	if !ok {
+		album = &pendingAlbum{}
+		album.timer = time.AfterFunc(telegramAlbumWindow, func() {
+			b.mu.Lock()
+			items := album.items
+			delete(b.albums, groupID)
+			merged := mergeAlbum(items)
+			b.remember(items)
+			b.mu.Unlock()
+
+			flush(merged)
+		})
+		b.albums[groupID] = album
+	} else {
+		album.timer.Reset(telegramAlbumWindow)
+	}
+	album.items = append(album.items, albumItem{msgID: msgID, update: update})
+}
+
+// remember records posts of a merged album, forgetting the oldest album beyond telegramAlbumsKept. The caller must hold mu.
+func (b *albumBuffer) remember(items []albumItem) {
+	if b.members == nil {
+		b.members = make(map[int]int)
+	}
+	ids := make([]int, 0, len(items))
+	for _, item := range items {
+		b.members[item.msgID] = items[0].msgID
+		ids = append(ids, item.msgID)
+	}
+	b.merged = append(b.merged, ids)
+
+	if len(b.merged) > telegramAlbumsKept {
+		for _, id := range b.merged[0] {
+			delete(b.members, id)
+		}
+		b.merged = b.merged[1:]
+	}
+}
+
+// albumOf returns the post identifying the album msgID belongs to, or msgID itself if it's not part of a known album.
+func (b *albumBuffer) albumOf(msgID int) int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if id, ok := b.members[msgID]; ok {
+		return id
+	}
+	return msgID
+}
+
+// mergeAlbum combines posts of an album into one update, identified by its first post.
+// Only one post of an album carries the caption, which is usually but not always the first one.
+func mergeAlbum(items []albumItem) *model.EndpointUpdate {
+	slices.SortFunc(items, func(a, b albumItem) int { return cmp.Compare(a.msgID, b.msgID) })
+
+	first := items[0].update
+	merged := &model.EndpointUpdate{
+		Type:                    first.Type,
+		UniqueEndpointMessageID: first.UniqueEndpointMessageID,
+		Timestamp:               first.Timestamp,
+		Parent:                  first.Parent,
+		Content:                 &model.BridgeMessageContent{},
+	}
+	for _, item := range items {
+		content := item.update.Content
+		if merged.Content.MDText == "" && merged.Content.SpoilerText == "" {
+			merged.Content.MDText = content.MDText
+			merged.Content.SpoilerText = content.SpoilerText
+		}
+		merged.Content.Sensitive = merged.Content.Sensitive || content.Sensitive
+		merged.Content.Attachments = append(merged.Content.Attachments, content.Attachments...)
+		if merged.Parent == nil {
+			merged.Parent = item.update.Parent
+		}
+	}
+	return merged
+}
+
+// forwardUpdate converts an update and forwards it, holding back posts of albums until all of them arrived.
+// Edits of an album arrive for the post carrying the caption, they are forwarded as edits of the album
+// if it's still remembered. Posts following an album within the window might overtake it.
+func (e *EndpointTelegram) forwardUpdate(ctx context.Context, update *models.Update, updatesChan chan<- *model.EndpointUpdate) error {
+	convertedUpdate, err := e.convertUpdate(update)
+	if err != nil {
+		return err
+	}
+
+	send := func(convertedUpdate *model.EndpointUpdate) {
+		select {
+		case <-ctx.Done():
+		case updatesChan <- convertedUpdate:
+		}
+	}
+
+	if post := update.ChannelPost; post != nil && post.MediaGroupID != "" {
+		e.albums.add(post.MediaGroupID, post.ID, convertedUpdate, func(album *model.EndpointUpdate) {
+			id, _ := strconv.Atoi(string(album.ID))
+			e.recent.track(id)
+			send(album)
+		})
+		return nil
+	}
+
+	if update.ChannelPost != nil {
+		e.recent.track(update.ChannelPost.ID)
+	}
+	if post := update.EditedChannelPost; post != nil && post.MediaGroupID != "" {
+		convertedUpdate.ID = model.EndpointMessageID(strconv.Itoa(e.albums.albumOf(post.ID)))
+	}
+	send(convertedUpdate)
+	return nil
+}
@@ -0,0 +1,121 @@
+package endpoint
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-telegram/bot/models"
+	"github.com/merrkry/tele2don/internal/model"
+)
+
+func TestTelegramAlbumsAreMerged(t *testing.T) {
+	const channelID = -100
+	e := &EndpointTelegram{id: "telegram", channelID: channelID, recent: &recentMessages{capacity: 10}}
+
+	post := func(id int, groupID, caption string) *models.Update {
+		return &models.Update{ChannelPost: &models.Message{
+			ID:           id,
+			Chat:         models.Chat{ID: channelID},
+			Date:         1700000000,
+			MediaGroupID: groupID,
+			Caption:      caption,
+			Photo:        []models.PhotoSize{{FileID: "photo" + string(rune('0'+id))}},
+		}}
+	}
+
+	ctx := context.Background()
+	updates := make(chan *model.EndpointUpdate, 8)
+	for _, update := range []*models.Update{
+		post(2, "album", ""),
+		post(1, "album", "caption"),
+		post(3, "album", ""),
+		post(4, "", "single"),
+	} {
+		if err := e.forwardUpdate(ctx, update, updates); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Posts outside albums aren't held back.
+	single := <-updates
+	if single.ID != "4" || len(single.Content.Attachments) != 1 {
+		t.Errorf("first update = %s with %d attachments, want 4 with 1", single.ID, len(single.Content.Attachments))
+	}
+
+	var album *model.EndpointUpdate
+	select {
+	case album = <-updates:
+	case <-time.After(telegramAlbumWindow + 2*time.Second):
+		t.Fatal("album was never forwarded")
+	}
+	if album.Type != model.UpdateTypeNew || album.ID != "1" {
+		t.Errorf("album = %v %s, want new 1", album.Type, album.ID)
+	}
+	if album.Content.MDText != "caption" {
+		t.Errorf("album caption = %q, want %q", album.Content.MDText, "caption")
+	}
+	var sources []string
+	for _, attachment := range album.Content.Attachments {
+		sources = append(sources, attachment.Source)
+	}
+	if len(sources) != 3 || sources[0] != "photo1" || sources[1] != "photo2" || sources[2] != "photo3" {
+		t.Errorf("album attachments = %v, want photo1, photo2 and photo3", sources)
+	}
+
+	select {
+	case update := <-updates:
+		t.Errorf("unexpected update %s", update.ID)
+	case <-time.After(100 * time.Millisecond):
+	}
+	if got := e.recent.snapshot(); len(got) != 2 || got[0] != 4 || got[1] != 1 {
+		t.Errorf("tracked %v, want [4 1]", got)
+	}
+}
+
+func TestTelegramAlbumCaptionOnLaterPost(t *testing.T) {
+	const channelID = -100
+	e := &EndpointTelegram{id: "telegram", channelID: channelID, recent: &recentMessages{capacity: 10}}
+
+	post := func(id int, caption string) *models.Message {
+		return &models.Message{
+			ID:           id,
+			Chat:         models.Chat{ID: channelID},
+			Date:         1700000000,
+			EditDate:     1700000100,
+			MediaGroupID: "album",
+			Caption:      caption,
+			Photo:        []models.PhotoSize{{FileID: "photo" + string(rune('0'+id))}},
+		}
+	}
+
+	ctx := context.Background()
+	updates := make(chan *model.EndpointUpdate, 8)
+	for _, update := range []*models.Update{
+		{ChannelPost: post(1, "")},
+		{ChannelPost: post(2, "caption")},
+	} {
+		if err := e.forwardUpdate(ctx, update, updates); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var album *model.EndpointUpdate
+	select {
+	case album = <-updates:
+	case <-time.After(telegramAlbumWindow + 2*time.Second):
+		t.Fatal("album was never forwarded")
+	}
+	if album.ID != "1" || album.Content.MDText != "caption" {
+		t.Errorf("album = %s %q, want 1 %q", album.ID, album.Content.MDText, "caption")
+	}
+
+	// The caption is edited on the post carrying it, which is tracked as the album.
+	if err := e.forwardUpdate(ctx, &models.Update{EditedChannelPost: post(2, "edited")}, updates); err != nil {
+		t.Fatal(err)
+	}
+	edit := <-updates
+	if edit.Type != model.UpdateTypeEdit || edit.ID != "1" || edit.Content.MDText != "edited" {
+		t.Errorf("edit = %v %s %q, want edit of 1 %q", edit.Type, edit.ID, edit.Content.MDText, "edited")
+	}
+}
@@ -0,0 +1,154 @@
+package endpoint
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	tg "github.com/go-telegram/bot"
+)
+
+// telegramPollTimeout is how long a getUpdates long poll may take, it's also the default of go-telegram.
+const telegramPollTimeout = time.Minute
+
+// TelegramBots shares bots between Telegram endpoints with the same token.
+// Bot API only allows one getUpdates consumer per bot, so all channels of a bot are polled together,
+// and each endpoint picks updates of its own channel.
+type TelegramBots struct {
+	bots map[string]*telegramBot
+	mu   sync.Mutex
+}
+
+func NewTelegramBots() *TelegramBots {
+	return &TelegramBots{
+		bots: make(map[string]*telegramBot),
+	}
+}
+
+// get returns the bot for token, creating it on first use.
+// Updates of a bot are received either by long polling or by a webhook, so endpoints sharing it must agree on webhook.
+func (b *TelegramBots) get(token string, webhook EndpointConfigTelegramWebhook) (*telegramBot, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	bot, ok := b.bots[token]
+	if ok {
+		if bot.webhook != webhook {
+			return nil, fmt.Errorf("webhook config differs from other endpoints sharing the bot")
+		}
+		bot.addEndpoint()
+		return bot, nil
+	}
+	if webhook.URL != "" {
+		for _, other := range b.bots {
+			if other.webhook.URL != "" && other.webhook.Listen == webhook.Listen {
+				return nil, fmt.Errorf("webhook listen address %s is already used by another bot", webhook.Listen)
+			}
+		}
+	}
+
+	bot = &telegramBot{webhook: webhook, done: make(chan struct{})}
+	httpClient := &telegramHTTPClient{
+		client: &http.Client{Timeout: telegramPollTimeout},
+		status: &bot.status,
+	}
+	// Handlers run in the polling workers instead of detached goroutines,
+	// so that no handler is still sending updates after start returns.
+	opts := []tg.Option{tg.WithNotAsyncHandlers(), tg.WithHTTPClient(telegramPollTimeout, httpClient)}
+	if webhook.URL != "" {
+		// Without buffering, a webhook request only succeeds once a worker has taken its update,
+		// so Telegram redelivers updates that are left unprocessed on shutdown.
+		opts = append(opts, tg.WithWebhookSecretToken(webhook.SecretToken), tg.WithUpdatesChannelCap(0))
+	}
+	client, err := tg.New(token, opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize Telegram bot: %w", err)
+	}
+	bot.Bot = client
+	bot.addEndpoint()
+	b.bots[token] = bot
+
+	return bot, nil
+}
+
+type telegramBot struct {
+	*tg.Bot
+	webhook EndpointConfigTelegramWebhook
+	// status tracks API calls and polling of the bot, shared by its endpoints.
+	status statusTracker
+
+	mu sync.Mutex
+	// endpoints counts endpoints sharing the bot, ready those which registered their handler.
+	endpoints, ready int
+	started          bool
+	// done is closed once the bot stops receiving updates.
+	done chan struct{}
+}
+
+func (b *telegramBot) addEndpoint() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.endpoints++
+}
+
+// start receives updates until ctx is done, by webhook if configured, or by long polling otherwise.
+// It's called by every endpoint sharing the bot once its handler is registered. Updates are only received
+// after the last call, so that none is dropped for lack of a handler, and the others block until it returns.
+func (b *telegramBot) start(ctx context.Context) {
+	b.mu.Lock()
+	b.ready++
+	last := b.ready == b.endpoints
+	if last {
+		b.started = true
+	}
+	b.mu.Unlock()
+
+	if !last {
+		select {
+		case <-b.done:
+		case <-ctx.Done():
+			// Handlers might still be sending updates if receiving has started meanwhile.
+			b.mu.Lock()
+			started := b.started
+			b.mu.Unlock()
+			if started {
+				<-b.done
+			}
+		}
+		return
+	}
+	defer close(b.done)
+
+	if b.webhook.URL != "" {
+		b.startWebhook(ctx)
+		return
+	}
+
+	// getUpdates is refused while a webhook is set, e.g. left over from running in webhook mode before.
+	_, err := b.DeleteWebhook(ctx, &tg.DeleteWebhookParams{})
+	if err != nil && ctx.Err() == nil {
+		slog.Warn("Failed to delete Telegram webhook before polling", "err", err)
+	}
+	b.Start(ctx)
+}
+
+// telegramHTTPClient records successful requests of a bot, and finished long polls as heartbeats.
+type telegramHTTPClient struct {
+	client *http.Client
+	status *statusTracker
+}
+
+func (c *telegramHTTPClient) Do(req *http.Request) (*http.Response, error) {
+	resp, err := c.client.Do(req)
+	if err == nil && resp.StatusCode == http.StatusOK {
+		c.status.apiCallSucceeded()
+		if strings.HasSuffix(req.URL.Path, "/getUpdates") {
+			c.status.heartbeat()
+		}
+	}
+	return resp, err
+}
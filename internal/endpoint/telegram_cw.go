@@ -0,0 +1,71 @@
+package endpoint
+
+import (
+	"strings"
+	"unicode/utf16"
+
+	"github.com/go-telegram/bot/models"
+)
+
+// telegramCWPrefix starts the first line of a Telegram message carrying a content warning.
+// Telegram has no content warnings, so the message body is hidden in a spoiler after that line instead.
+const telegramCWPrefix = "CW: "
+
+// withContentWarning prepends the content warning line to text, and hides the rest in a spoiler.
+func withContentWarning(text telegramText, cw string) telegramText {
+	if cw == "" {
+		return text
+	}
+
+	prefix := telegramCWPrefix + cw + "\n\n"
+	shift := len(utf16.Encode([]rune(prefix)))
+
+	entities := make([]models.MessageEntity, 0, len(text.entities)+1)
+	entities = append(entities, models.MessageEntity{
+		Type:   models.MessageEntityTypeSpoiler,
+		Offset: shift,
+		Length: len(utf16.Encode([]rune(text.text))),
+	})
+	for _, entity := range text.entities {
+		entity.Offset += shift
+		entities = append(entities, entity)
+	}
+
+	return telegramText{text: prefix + text.text, entities: entities}
+}
+
+// splitContentWarning is the reverse of withContentWarning. It extracts the content warning from the first line of text,
+// and returns the rest with a spoiler covering it entirely removed. Text without a content warning is returned as is.
+func splitContentWarning(text string, entities []models.MessageEntity) (string, string, []models.MessageEntity) {
+	line, rest, ok := strings.Cut(text, "\n")
+	if !ok || !strings.HasPrefix(line, telegramCWPrefix) {
+		return "", text, entities
+	}
+	cw := strings.TrimSpace(strings.TrimPrefix(line, telegramCWPrefix))
+	rest = strings.TrimLeft(rest, "\n")
+	if cw == "" || rest == "" {
+		return "", text, entities
+	}
+
+	shift := len(utf16.Encode([]rune(text[:len(text)-len(rest)])))
+	length := len(utf16.Encode([]rune(rest)))
+
+	var restEntities []models.MessageEntity
+	for _, entity := range entities {
+		// Formatting of the content warning itself is dropped, as it's plain text on other platforms.
+		if entity.Offset+entity.Length <= shift {
+			continue
+		}
+		if entity.Offset < shift {
+			entity.Length -= shift - entity.Offset
+			entity.Offset = shift
+		}
+		entity.Offset -= shift
+		if entity.Type == models.MessageEntityTypeSpoiler && entity.Offset == 0 && entity.Length >= length {
+			continue
+		}
+		restEntities = append(restEntities, entity)
+	}
+
+	return cw, rest, restEntities
+}
@@ -0,0 +1,111 @@
+package endpoint
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/go-telegram/bot/models"
+)
+
+func TestContentWarning(t *testing.T) {
+	bold := models.MessageEntity{Type: models.MessageEntityTypeBold, Offset: 0, Length: 4}
+	text := telegramText{text: "body 😀", entities: []models.MessageEntity{bold}}
+
+	got := withContentWarning(text, "cw")
+	want := telegramText{
+		// The prefix "CW: cw\n\n" takes 8 UTF-16 code units, the body 7.
+		text: "CW: cw\n\nbody 😀",
+		entities: []models.MessageEntity{
+			{Type: models.MessageEntityTypeSpoiler, Offset: 8, Length: 7},
+			{Type: models.MessageEntityTypeBold, Offset: 8, Length: 4},
+		},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("withContentWarning() = %+v, want %+v", got, want)
+	}
+
+	cw, rest, entities := splitContentWarning(got.text, got.entities)
+	if cw != "cw" || rest != text.text || !reflect.DeepEqual(entities, text.entities) {
+		t.Errorf("splitContentWarning() = %q, %q, %+v, want the original text back", cw, rest, entities)
+	}
+
+	if got := withContentWarning(text, ""); !reflect.DeepEqual(got, text) {
+		t.Errorf("withContentWarning() without content warning = %+v, want text as is", got)
+	}
+}
+
+func TestSplitContentWarning(t *testing.T) {
+	tests := []struct {
+		name         string
+		text         string
+		entities     []models.MessageEntity
+		wantCW       string
+		wantText     string
+		wantEntities []models.MessageEntity
+	}{
+		{
+			name:     "no content warning",
+			text:     "hello\nworld",
+			wantText: "hello\nworld",
+		},
+		{
+			name:     "single line",
+			text:     "CW: only a warning",
+			wantText: "CW: only a warning",
+		},
+		{
+			name:     "empty warning",
+			text:     "CW: \n\nbody",
+			wantText: "CW: \n\nbody",
+		},
+		{
+			name:     "without spoiler",
+			text:     "CW: cw\nbody",
+			wantCW:   "cw",
+			wantText: "body",
+		},
+		{
+			name: "formatted warning",
+			text: "CW: cw\n\nbody",
+			entities: []models.MessageEntity{
+				{Type: models.MessageEntityTypeItalic, Offset: 0, Length: 6},
+				{Type: models.MessageEntityTypeSpoiler, Offset: 8, Length: 4},
+			},
+			wantCW:   "cw",
+			wantText: "body",
+		},
+		{
+			// A spoiler on part of the body is formatting of its own.
+			name:         "partial spoiler",
+			text:         "CW: cw\n\nbody text",
+			entities:     []models.MessageEntity{{Type: models.MessageEntityTypeSpoiler, Offset: 8, Length: 4}},
+			wantCW:       "cw",
+			wantText:     "body text",
+			wantEntities: []models.MessageEntity{{Type: models.MessageEntityTypeSpoiler, Offset: 0, Length: 4}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cw, text, entities := splitContentWarning(tt.text, tt.entities)
+			if cw != tt.wantCW || text != tt.wantText {
+				t.Errorf("splitContentWarning() = %q, %q, want %q, %q", cw, text, tt.wantCW, tt.wantText)
+			}
+			if tt.wantCW != "" && !reflect.DeepEqual(entities, tt.wantEntities) {
+				t.Errorf("entities = %+v, want %+v", entities, tt.wantEntities)
+			}
+		})
+	}
+}
+
+func TestTelegramConvertContentWarning(t *testing.T) {
+	e := &EndpointTelegram{}
+	content := e.convertMessage(&models.Message{
+		Caption:         "CW: cw\n\nbody",
+		CaptionEntities: []models.MessageEntity{{Type: models.MessageEntityTypeSpoiler, Offset: 8, Length: 4}},
+		HasMediaSpoiler: true,
+	})
+	if content.SpoilerText != "cw" || content.MDText != "body" || !content.Sensitive {
+		t.Errorf("convertMessage() = %q with content warning %q and sensitive %v", content.MDText, content.SpoilerText, content.Sensitive)
+	}
+}
@@ -0,0 +1,194 @@
+package endpoint
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	tg "github.com/go-telegram/bot"
+	"github.com/merrkry/tele2don/internal/model"
+)
+
+const (
+	defaultDeletionProbeInterval = 5 * time.Minute
+	defaultDeletionProbeWindow   = 50
+	// deletionProbeMinGap is the minimum delay between two probes, as each of them costs two API calls.
+	deletionProbeMinGap = time.Second
+)
+
+// recentMessages tracks IDs of recent channel posts, oldest first.
+// Bot API never notifies deletions of channel posts, so we probe these periodically instead.
+// Without a path, tracked posts are lost on restart, so deletions of posts older than the restart go unnoticed.
+type recentMessages struct {
+	ids      []int
+	capacity int
+	// path is the file keeping tracked posts across restarts, disabled if empty.
+	path string
+	mu   sync.Mutex
+}
+
+// loadRecentMessages loads posts tracked at path, a missing file tracks no posts.
+func loadRecentMessages(path string, capacity int) (*recentMessages, error) {
+	r := &recentMessages{capacity: capacity, path: path}
+	if path == "" {
+		return r, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tracked messages: %w", err)
+	}
+	err = json.Unmarshal(data, &r.ids)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode tracked messages %s: %w", path, err)
+	}
+	if len(r.ids) > r.capacity {
+		r.ids = r.ids[len(r.ids)-r.capacity:]
+	}
+	return r, nil
+}
+
+// save persists tracked posts if a path is set. The caller must hold mu.
+// Failures are only logged, tracking goes on in memory.
+func (r *recentMessages) save() {
+	if r.path == "" {
+		return
+	}
+	data, err := json.Marshal(r.ids)
+	if err == nil {
+		err = writeFileAtomic(r.path, data, 0o600)
+	}
+	if err != nil {
+		slog.Warn("Failed to save tracked Telegram messages", "path", r.path, "err", err)
+	}
+}
+
+func (r *recentMessages) track(id int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if slices.Contains(r.ids, id) {
+		return
+	}
+	r.ids = append(r.ids, id)
+	if len(r.ids) > r.capacity {
+		r.ids = r.ids[len(r.ids)-r.capacity:]
+	}
+	r.save()
+}
+
+func (r *recentMessages) untrack(id int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if !slices.Contains(r.ids, id) {
+		return
+	}
+	r.ids = slices.DeleteFunc(r.ids, func(i int) bool { return i == id })
+	r.save()
+}
+
+func (r *recentMessages) snapshot() []int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return slices.Clone(r.ids)
+}
+
+// probeDeletions periodically checks whether recent channel posts still exist.
+// A post is probed by forwarding it to the probe chat, and the forwarded copy is removed immediately.
+// Probes of a pass are spread over the interval, so that a large window doesn't burst API calls.
+func (e *EndpointTelegram) probeDeletions(ctx context.Context, updatesChan chan<- *model.EndpointUpdate) {
+	ticker := time.NewTicker(e.probeInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		ids := e.recent.snapshot()
+		for i, id := range ids {
+			if i > 0 {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(deletionProbeGap(e.probeInterval, len(ids))):
+				}
+			}
+
+			exists, err := e.probeMessage(ctx, id)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				slog.Warn("Failed to probe Telegram message", "id", id, "err", err)
+				continue
+			}
+			if exists {
+				continue
+			}
+
+			slog.Debug("Detected deleted Telegram message", "id", id)
+			e.recent.untrack(id)
+
+			update := &model.EndpointUpdate{
+				Type: model.UpdateTypeDelete,
+				UniqueEndpointMessageID: model.UniqueEndpointMessageID{
+					EID: e.id,
+					ID:  model.EndpointMessageID(strconv.Itoa(id)),
+				},
+				Timestamp: time.Now(),
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case updatesChan <- update:
+			}
+		}
+	}
+}
+
+// deletionProbeGap is the delay between probes for a pass over n posts to take about interval.
+func deletionProbeGap(interval time.Duration, n int) time.Duration {
+	return max(interval/time.Duration(n), deletionProbeMinGap)
+}
+
+func (e *EndpointTelegram) probeMessage(ctx context.Context, id int) (bool, error) {
+	forwarded, err := e.bot.ForwardMessage(ctx, &tg.ForwardMessageParams{
+		ChatID:              e.probeChatID,
+		FromChatID:          e.channelID,
+		MessageID:           id,
+		DisableNotification: true,
+	})
+	if err != nil {
+		if errors.Is(err, tg.ErrorBadRequest) && strings.Contains(err.Error(), "not found") {
+			return false, nil
+		}
+		return false, err
+	}
+
+	_, err = e.bot.DeleteMessage(ctx, &tg.DeleteMessageParams{
+		ChatID:    e.probeChatID,
+		MessageID: forwarded.ID,
+	})
+	if err != nil {
+		slog.Warn("Failed to clean up probe message", "id", forwarded.ID, "err", err)
+	}
+
+	return true, nil
+}
@@ -0,0 +1,83 @@
+package endpoint
+
+import (
+	"context"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/merrkry/tele2don/internal/model"
+)
+
+func TestRecentMessagesPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "probe.json")
+
+	r, err := loadRecentMessages(path, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, id := range []int{1, 2, 3, 4} {
+		r.track(id)
+	}
+	r.untrack(3)
+
+	// Tracked posts survive a restart, even with a smaller window.
+	r, err = loadRecentMessages(path, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := r.snapshot(); !slices.Equal(got, []int{4}) {
+		t.Errorf("loaded %v, want [4]", got)
+	}
+
+	r, err = loadRecentMessages(filepath.Join(t.TempDir(), "missing.json"), 3)
+	if err != nil || len(r.snapshot()) != 0 {
+		t.Errorf("missing store loaded %v, %v, want nothing", r.snapshot(), err)
+	}
+}
+
+func TestTelegramProbeDeletions(t *testing.T) {
+	f, srv := newFakeTelegram(t)
+	e := newTestTelegramEndpoint(t, srv)
+	e.probeChatID = -2002
+	e.probeInterval = 10 * time.Millisecond
+	e.recent.track(10)
+	e.recent.track(11)
+	f.mu.Lock()
+	f.deleted = map[int]bool{11: true}
+	f.mu.Unlock()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates := make(chan *model.EndpointUpdate, 1)
+	go e.probeDeletions(ctx, updates)
+
+	select {
+	case update := <-updates:
+		if update.Type != model.UpdateTypeDelete || update.ID != "11" {
+			t.Errorf("update = %v %s, want deletion of 11", update.Type, update.ID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("deletion was never detected")
+	}
+	cancel()
+
+	if got := e.recent.snapshot(); !slices.Equal(got, []int{10}) {
+		t.Errorf("tracked %v after deletion, want [10]", got)
+	}
+	for _, call := range f.calls() {
+		if call.method == "deleteMessage" && call.params["chat_id"] != "-2002" {
+			t.Errorf("deleted message in chat %s, want only probe copies", call.params["chat_id"])
+		}
+	}
+}
+
+func TestDeletionProbeGap(t *testing.T) {
+	if gap := deletionProbeGap(5*time.Minute, 50); gap != 6*time.Second {
+		t.Errorf("gap = %v, want probes spread over the interval", gap)
+	}
+	if gap := deletionProbeGap(time.Minute, 600); gap != deletionProbeMinGap {
+		t.Errorf("gap = %v, want at least %v", gap, deletionProbeMinGap)
+	}
+}
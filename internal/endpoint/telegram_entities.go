@@ -0,0 +1,454 @@
+package endpoint
+
+import (
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/go-telegram/bot/models"
+	"github.com/yuin/goldmark/util"
+)
+
+// entityNode is a node of the entity tree built from a flat, possibly overlapping, entity list.
+// Positions are counted in UTF-16 code units, as Telegram does.
+type entityNode struct {
+	entity   *models.MessageEntity // nil for plain text
+	start    int
+	end      int
+	children []*entityNode
+}
+
+// entitiesToMarkdown converts Telegram message text with entities to bridge Markdown.
+func entitiesToMarkdown(text string, entities []models.MessageEntity) string {
+	units := utf16.Encode([]rune(text))
+	tree := buildEntityTree(normalizeEntities(entities, len(units)), 0, len(units))
+
+	var b strings.Builder
+	for _, node := range tree {
+		renderEntityNode(&b, node, units)
+	}
+	return b.String()
+}
+
+// normalizeEntities clips entities to the text, merges formatting of the same type, and splits partially overlapping
+// entities, so that for any two entities, either they are disjoint or one contains another.
+// The result is sorted by offset, with outer entities first.
+func normalizeEntities(entities []models.MessageEntity, length int) []models.MessageEntity {
+	pending := make([]models.MessageEntity, 0, len(entities))
+	for _, entity := range entities {
+		end := min(entity.Offset+entity.Length, length)
+		if entity.Offset < 0 || entity.Offset >= end {
+			continue
+		}
+		entity.Length = end - entity.Offset
+		pending = append(pending, entity)
+	}
+	pending = mergeEntities(pending)
+
+	var result []models.MessageEntity
+	for len(pending) > 0 {
+		sortEntities(pending)
+		entity := pending[0]
+		pending = pending[1:]
+
+		// As entities are processed in order, only entities already accepted can start before this one.
+		for _, accepted := range result {
+			acceptedEnd := accepted.Offset + accepted.Length
+			if accepted.Offset < entity.Offset && entity.Offset < acceptedEnd && acceptedEnd < entity.Offset+entity.Length {
+				rest := entity
+				rest.Offset = acceptedEnd
+				rest.Length = entity.Offset + entity.Length - acceptedEnd
+				pending = append(pending, rest)
+				entity.Length = acceptedEnd - entity.Offset
+			}
+		}
+
+		result = append(result, entity)
+	}
+
+	sortEntities(result)
+	return result
+}
+
+// mergeableEntityTypes are formatting entities which can be merged when they overlap or touch.
+var mergeableEntityTypes = map[models.MessageEntityType]bool{
+	models.MessageEntityTypeBold:          true,
+	models.MessageEntityTypeItalic:        true,
+	models.MessageEntityTypeUnderline:     true,
+	models.MessageEntityTypeStrikethrough: true,
+	models.MessageEntityTypeSpoiler:       true,
+}
+
+// mergeEntities merges formatting entities of the same type which overlap or touch,
+// as they would be written as adjacent delimiters otherwise, e.g. **ab****cd**.
+func mergeEntities(entities []models.MessageEntity) []models.MessageEntity {
+	sortEntities(entities)
+
+	var result []models.MessageEntity
+	last := make(map[models.MessageEntityType]int)
+	for _, entity := range entities {
+		if i, ok := last[entity.Type]; ok && mergeableEntityTypes[entity.Type] {
+			merged := &result[i]
+			if entity.Offset <= merged.Offset+merged.Length {
+				merged.Length = max(merged.Length, entity.Offset+entity.Length-merged.Offset)
+				continue
+			}
+		}
+		result = append(result, entity)
+		last[entity.Type] = len(result) - 1
+	}
+	return result
+}
+
+func sortEntities(entities []models.MessageEntity) {
+	sort.SliceStable(entities, func(i, j int) bool {
+		if entities[i].Offset != entities[j].Offset {
+			return entities[i].Offset < entities[j].Offset
+		}
+		return entities[i].Length > entities[j].Length
+	})
+}
+
+// buildEntityTree builds the tree of normalized entities within [start, end).
+func buildEntityTree(entities []models.MessageEntity, start, end int) []*entityNode {
+	var nodes []*entityNode
+	pos := start
+
+	for i := 0; i < len(entities); {
+		entity := &entities[i]
+		entityEnd := entity.Offset + entity.Length
+
+		if entity.Offset > pos {
+			nodes = append(nodes, &entityNode{start: pos, end: entity.Offset})
+		}
+
+		j := i + 1
+		for j < len(entities) && entities[j].Offset < entityEnd {
+			j++
+		}
+
+		nodes = append(nodes, &entityNode{
+			entity:   entity,
+			start:    entity.Offset,
+			end:      entityEnd,
+			children: buildEntityTree(entities[i+1:j], entity.Offset, entityEnd),
+		})
+
+		pos = entityEnd
+		i = j
+	}
+
+	if pos < end {
+		nodes = append(nodes, &entityNode{start: pos, end: end})
+	}
+
+	return nodes
+}
+
+func renderEntityNode(b *strings.Builder, node *entityNode, units []uint16) {
+	raw := string(utf16.Decode(units[node.start:node.end]))
+
+	// Characters around the node, entities next to it are written with markup.
+	before, after := rune(unknownNeighbor), rune(unknownNeighbor)
+	if node.start == 0 {
+		before = 0
+	} else if units[node.start-1] == '\n' {
+		before = '\n'
+	}
+	if node.end == len(units) {
+		after = 0
+	} else if r := utf16.Decode(units[node.end:min(node.end+2, len(units))])[0]; r == '\n' || node.entity != nil {
+		after = r
+	}
+
+	if node.entity == nil {
+		b.WriteString(escapeMarkdown(raw, before, after))
+		return
+	}
+
+	renderChildren := func() string {
+		var inner strings.Builder
+		for _, child := range node.children {
+			renderEntityNode(&inner, child, units)
+		}
+		return inner.String()
+	}
+
+	switch node.entity.Type {
+	case models.MessageEntityTypeBold:
+		writeEmphasis(b, "**", renderChildren(), after)
+	case models.MessageEntityTypeItalic:
+		writeEmphasis(b, "*", renderChildren(), after)
+	case models.MessageEntityTypeStrikethrough:
+		writeInlineMark(b, "~~", renderChildren())
+	case models.MessageEntityTypeSpoiler:
+		writeInlineMark(b, "||", renderChildren())
+
+	case models.MessageEntityTypeCode:
+		writeInlineCode(b, raw)
+
+	case models.MessageEntityTypePre:
+		fence := strings.Repeat("`", max(3, longestRun(raw, '`')+1))
+		ensureNewline(b)
+		b.WriteString(fence + node.entity.Language + "\n")
+		b.WriteString(raw)
+		ensureNewline(b)
+		b.WriteString(fence + "\n")
+
+	case models.MessageEntityTypeBlockquote, models.MessageEntityTypeExpandableBlockquote:
+		inner := strings.TrimRight(renderChildren(), "\n")
+		ensureNewline(b)
+		b.WriteString("> " + strings.ReplaceAll(inner, "\n", "\n> ") + "\n")
+
+	case models.MessageEntityTypeTextLink:
+		writeLink(b, renderChildren(), node.entity.URL)
+	case models.MessageEntityTypeTextMention:
+		if node.entity.User == nil {
+			b.WriteString(renderChildren())
+			break
+		}
+		writeLink(b, renderChildren(), "tg://user?id="+strconv.FormatInt(node.entity.User.ID, 10))
+
+	case models.MessageEntityTypeURL, models.MessageEntityTypeEmail, models.MessageEntityTypeMention,
+		models.MessageEntityTypeHashtag, models.MessageEntityTypeCashtag, models.MessageEntityTypeBotCommand:
+		// These are recognized from plain text by most platforms, escaping would break them.
+		b.WriteString(raw)
+
+	default: // underline, custom emoji, phone number, etc. have no Markdown equivalent
+		b.WriteString(renderChildren())
+	}
+}
+
+// writeInlineMark wraps content with emphasis-like delimiters.
+// Delimiters adjacent to whitespace are not recognized by CommonMark, so surrounding whitespace is moved outside.
+func writeInlineMark(b *strings.Builder, mark string, content string) {
+	core := strings.TrimFunc(content, unicode.IsSpace)
+	if core == "" {
+		b.WriteString(content)
+		return
+	}
+	leading := content[:strings.Index(content, core)]
+	trailing := content[len(leading)+len(core):]
+	b.WriteString(leading + mark + core + mark + trailing)
+}
+
+// writeEmphasis wraps content with emphasis delimiters, mark being "*" or "**".
+// Delimiters right after the closing ones of a previous entity would be merged with them, e.g. in **ab*cd****ef*,
+// so underscores are used instead. Those can't close before a letter or digit though, as in **ab*cd***_ef_gh,
+// and the emphasis is dropped in that case, as there is no way to write it.
+func writeEmphasis(b *strings.Builder, mark string, content string, after rune) {
+	if !endsWithDelimiter(b.String(), '*') || strings.TrimLeftFunc(content, unicode.IsSpace) != content {
+		writeInlineMark(b, mark, content)
+		return
+	}
+
+	if strings.TrimRightFunc(content, unicode.IsSpace) == content && (unicode.IsLetter(after) || unicode.IsDigit(after)) {
+		b.WriteString(content)
+		return
+	}
+	writeInlineMark(b, strings.Repeat("_", len(mark)), content)
+}
+
+// endsWithDelimiter reports whether s ends with an unescaped delimiter c.
+func endsWithDelimiter(s string, c byte) bool {
+	if !strings.HasSuffix(s, string(c)) {
+		return false
+	}
+	backslashes := len(s) - 1 - len(strings.TrimRight(s[:len(s)-1], `\`))
+	return backslashes%2 == 0
+}
+
+func writeInlineCode(b *strings.Builder, content string) {
+	fence := strings.Repeat("`", longestRun(content, '`')+1)
+	if strings.HasPrefix(content, "`") || strings.HasSuffix(content, "`") {
+		content = " " + content + " "
+	}
+	b.WriteString(fence + content + fence)
+}
+
+var markdownURLEscaper = strings.NewReplacer(" ", "%20", "(", "%28", ")", "%29")
+
+func writeLink(b *strings.Builder, text string, url string) {
+	b.WriteString("[" + text + "](" + markdownURLEscaper.Replace(url) + ")")
+}
+
+// unknownNeighbor stands for characters around escaped text which are not known, e.g. markup written later.
+// It's punctuation, so that delimiters next to it are escaped.
+const unknownNeighbor = '*'
+
+// escapeMarkdown escapes plain text, so that it's not interpreted as bridge Markdown.
+// Some platforms show Markdown as is, so characters are only escaped where they would start markup,
+// e.g. snake_case, 2 * 3 or #hashtag are kept as is. before and after are the characters around s,
+// 0 at the boundaries of the message, or unknownNeighbor if they are not known.
+func escapeMarkdown(s string, before, after rune) string {
+	if before == 0 {
+		before = '\n'
+	}
+	if after == 0 {
+		after = '\n'
+	}
+	runes := []rune(s)
+	at := func(i int) rune {
+		switch {
+		case i < 0:
+			return before
+		case i >= len(runes):
+			return after
+		default:
+			return runes[i]
+		}
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(runes); {
+		// Block-level syntax only matters at the beginning of lines, after up to 3 spaces of indentation.
+		if at(i-1) == '\n' {
+			for n := 0; n < 3 && i < len(runes) && runes[i] == ' '; n++ {
+				b.WriteByte(' ')
+				i++
+			}
+			if i < len(runes) && startsMarkdownBlock(runes[i:], after) {
+				b.WriteString(`\` + string(runes[i]))
+				i++
+				continue
+			}
+			if i == len(runes) {
+				break
+			}
+		}
+
+		c := runes[i]
+		switch c {
+		case '\\':
+			// Backslashes only escape punctuation, or make hard line breaks.
+			if next := at(i + 1); next == '\n' || isASCIIPunct(next) {
+				b.WriteByte('\\')
+			}
+		case '`':
+			b.WriteByte('\\')
+		case '[':
+			if opensMarkdownLink(runes[i:], after) {
+				b.WriteByte('\\')
+			}
+		case '*', '_', '~', '|':
+			j := i
+			for j < len(runes) && runes[j] == c {
+				j++
+			}
+			run := string(runes[i:j])
+			if isMarkdownDelimiter(c, j-i, at(i-1), at(j)) {
+				run = `\` + strings.Join(strings.Split(run, ""), `\`)
+			}
+			b.WriteString(run)
+			i = j
+			continue
+		}
+		b.WriteRune(c)
+		i++
+	}
+	return b.String()
+}
+
+// startsMarkdownBlock reports whether line, at the beginning of a line, starts a block other than a paragraph.
+// Only block syntax unlikely in plain text is considered, e.g. lists starting with - are kept.
+func startsMarkdownBlock(line []rune, after rune) bool {
+	if end := slices.Index(line, '\n'); end >= 0 {
+		line = line[:end]
+		after = '\n'
+	}
+	run := 1
+	for run < len(line) && line[run] == line[0] {
+		run++
+	}
+	// Whether the line might continue after the run, i.e. the run isn't followed by whitespace.
+	followed := func() bool {
+		if run < len(line) {
+			return !unicode.IsSpace(line[run])
+		}
+		return after != '\n'
+	}
+
+	switch line[0] {
+	case '>':
+		return true
+	case '#':
+		return run <= 6 && !followed()
+	case '~':
+		return run >= 3
+	case '*', '_':
+		// Thematic breaks, and bullets of lists.
+		if line[0] == '*' && run == 1 && !followed() {
+			return true
+		}
+		count := 0
+		for _, r := range line {
+			switch r {
+			case line[0]:
+				count++
+			case ' ', '\t':
+			default:
+				return false
+			}
+		}
+		return count >= 3 && after == '\n'
+	}
+	return false
+}
+
+// opensMarkdownLink reports whether s, starting with [, might be a link or a link reference definition.
+func opensMarkdownLink(s []rune, after rune) bool {
+	end := slices.Index(s, ']')
+	if end < 0 || end == len(s)-1 {
+		// The closing bracket or what follows it might be written next.
+		return after != '\n'
+	}
+	next := s[end+1]
+	return next == '(' || next == '[' || next == ':'
+}
+
+// isMarkdownDelimiter reports whether a run of n delimiters c between before and after can open or close
+// emphasis, strikethrough or spoilers, following the flanking rules of CommonMark.
+func isMarkdownDelimiter(c rune, n int, before, after rune) bool {
+	switch {
+	case c == '~' && n > 2:
+		return false
+	case c == '|' && n != 2:
+		return false
+	}
+
+	beforeSpace, afterSpace := util.IsSpaceRune(before), util.IsSpaceRune(after)
+	beforePunct, afterPunct := util.IsPunctRune(before), util.IsPunctRune(after)
+	left := !afterSpace && (!afterPunct || beforeSpace || beforePunct)
+	right := !beforeSpace && (!beforePunct || afterSpace || afterPunct)
+	if c == '_' {
+		return (left && (!right || beforePunct)) || (right && (!left || afterPunct))
+	}
+	return left || right
+}
+
+func isASCIIPunct(r rune) bool {
+	return r < utf8.RuneSelf && unicode.IsPrint(r) && !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != ' '
+}
+
+func ensureNewline(b *strings.Builder) {
+	if b.Len() > 0 && !strings.HasSuffix(b.String(), "\n") {
+		b.WriteString("\n")
+	}
+}
+
+func longestRun(s string, c rune) int {
+	longest, current := 0, 0
+	for _, r := range s {
+		if r == c {
+			current++
+			longest = max(longest, current)
+		} else {
+			current = 0
+		}
+	}
+	return longest
+}
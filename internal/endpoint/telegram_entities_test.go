@@ -0,0 +1,252 @@
+package endpoint
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/go-telegram/bot/models"
+	"github.com/merrkry/tele2don/internal/markdown"
+)
+
+func entity(typ models.MessageEntityType, offset, length int) models.MessageEntity {
+	return models.MessageEntity{Type: typ, Offset: offset, Length: length}
+}
+
+func TestEntitiesToMarkdown(t *testing.T) {
+	const (
+		bold   = models.MessageEntityTypeBold
+		italic = models.MessageEntityTypeItalic
+		strike = models.MessageEntityTypeStrikethrough
+		code   = models.MessageEntityTypeCode
+	)
+
+	tests := []struct {
+		name     string
+		text     string
+		entities []models.MessageEntity
+		want     string
+	}{
+		{
+			name: "plain",
+			text: "hello world",
+			want: "hello world",
+		},
+		{
+			name:     "bold",
+			text:     "hello world",
+			entities: []models.MessageEntity{entity(bold, 6, 5)},
+			want:     "hello **world**",
+		},
+		{
+			name:     "nested",
+			text:     "bold and italic",
+			entities: []models.MessageEntity{entity(bold, 0, 15), entity(italic, 9, 6)},
+			want:     "**bold and *italic***",
+		},
+		{
+			name:     "whitespace outside delimiters",
+			text:     "a bold b",
+			entities: []models.MessageEntity{entity(bold, 1, 6)},
+			want:     "a **bold** b",
+		},
+		{
+			name:     "overlap",
+			text:     "ab cd ef",
+			entities: []models.MessageEntity{entity(bold, 0, 5), entity(italic, 3, 5)},
+			want:     "**ab *cd*** *ef*",
+		},
+		{
+			name:     "overlap without space",
+			text:     "abcdef",
+			entities: []models.MessageEntity{entity(bold, 0, 4), entity(italic, 2, 4)},
+			want:     "**ab*cd***_ef_",
+		},
+		{
+			name:     "overlap inside word",
+			text:     "abcdefgh",
+			entities: []models.MessageEntity{entity(bold, 0, 4), entity(italic, 2, 4)},
+			want:     "**ab*cd***efgh",
+		},
+		{
+			name:     "adjacent entities of the same type",
+			text:     "abcd",
+			entities: []models.MessageEntity{entity(bold, 0, 2), entity(bold, 2, 2)},
+			want:     "**abcd**",
+		},
+		{
+			name:     "overlapping entities of the same type",
+			text:     "abcdef",
+			entities: []models.MessageEntity{entity(strike, 0, 4), entity(strike, 2, 4)},
+			want:     "~~abcdef~~",
+		},
+		{
+			name:     "italic after bold",
+			text:     "abcd",
+			entities: []models.MessageEntity{entity(bold, 0, 2), entity(italic, 2, 2)},
+			want:     "**ab**_cd_",
+		},
+		{
+			name: "UTF-16 offsets",
+			// The emoji takes 2 code units.
+			text:     "😀 bold",
+			entities: []models.MessageEntity{entity(bold, 3, 4)},
+			want:     "😀 **bold**",
+		},
+		{
+			name:     "UTF-16 offsets in entity",
+			text:     "a😀b c",
+			entities: []models.MessageEntity{entity(italic, 0, 4)},
+			want:     "*a😀b* c",
+		},
+		{
+			name:     "entity past the end",
+			text:     "abc",
+			entities: []models.MessageEntity{entity(bold, 1, 10)},
+			want:     "a**bc**",
+		},
+		{
+			name:     "code",
+			text:     "run a*b",
+			entities: []models.MessageEntity{entity(code, 4, 3)},
+			want:     "run `a*b`",
+		},
+		{
+			name:     "code with backticks",
+			text:     "`x`",
+			entities: []models.MessageEntity{entity(code, 0, 3)},
+			want:     "`` `x` ``",
+		},
+		{
+			name:     "pre",
+			text:     "see\nfmt.Println()",
+			entities: []models.MessageEntity{{Type: models.MessageEntityTypePre, Offset: 4, Length: 13, Language: "go"}},
+			want:     "see\n```go\nfmt.Println()\n```\n",
+		},
+		{
+			name:     "text link",
+			text:     "a link",
+			entities: []models.MessageEntity{{Type: models.MessageEntityTypeTextLink, Offset: 2, Length: 4, URL: "https://example.com/a b"}},
+			want:     "a [link](https://example.com/a%20b)",
+		},
+		{
+			name:     "url is kept as is",
+			text:     "https://example.com/a_b_c",
+			entities: []models.MessageEntity{entity(models.MessageEntityTypeURL, 0, 25)},
+			want:     "https://example.com/a_b_c",
+		},
+		{
+			name:     "escaped next to entity",
+			text:     "a_b bold",
+			entities: []models.MessageEntity{entity(bold, 4, 4)},
+			want:     "a_b **bold**",
+		},
+		{
+			name:     "delimiter next to entity",
+			text:     "x* bold",
+			entities: []models.MessageEntity{entity(bold, 3, 4)},
+			want:     `x\* **bold**`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := entitiesToMarkdown(tt.text, tt.entities)
+			if got != tt.want {
+				t.Errorf("entitiesToMarkdown(%q) = %q, want %q", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEntitiesToMarkdownRendering(t *testing.T) {
+	const (
+		bold   = models.MessageEntityTypeBold
+		italic = models.MessageEntityTypeItalic
+	)
+
+	tests := []struct {
+		name     string
+		text     string
+		entities []models.MessageEntity
+		want     string
+	}{
+		{
+			name:     "overlap",
+			text:     "abcdef",
+			entities: []models.MessageEntity{entity(bold, 0, 4), entity(italic, 2, 4)},
+			want:     "<p><strong>ab<em>cd</em></strong><em>ef</em></p>",
+		},
+		{
+			name:     "reverse overlap",
+			text:     "abcdef",
+			entities: []models.MessageEntity{entity(italic, 0, 4), entity(bold, 2, 4)},
+			want:     "<p><em>ab<strong>cd</strong></em><strong>ef</strong></p>",
+		},
+		{
+			name: "plain text",
+			text: "snake_case, 2 * 3, *stars*, __init__, ~tilde~, ||pipes|| and [brackets](x)",
+			want: "<p>snake_case, 2 * 3, *stars*, __init__, ~tilde~, ||pipes|| and [brackets](x)</p>",
+		},
+		{
+			name: "block syntax",
+			text: "# title\n> quote\n* item\n***\n#hashtag",
+			want: "<p># title\n&gt; quote\n* item\n***\n#hashtag</p>",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			err := markdown.Markdown().Convert([]byte(entitiesToMarkdown(tt.text, tt.entities)), &buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.TrimSpace(buf.String()); got != tt.want {
+				t.Errorf("rendered %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEscapeMarkdown(t *testing.T) {
+	tests := []struct {
+		in   string
+		want string
+	}{
+		{"snake_case", "snake_case"},
+		{"__init__", `\_\_init\_\_`},
+		{"2 * 3", "2 * 3"},
+		{"a*b*c", `a\*b\*c`},
+		{"*stars*", `\*stars\*`},
+		{"**bold**", `\*\*bold\*\*`},
+		{"~~strike~~", `\~\~strike\~\~`},
+		{"~tilde~", `\~tilde\~`},
+		{"a ~ b", "a ~ b"},
+		{"||spoiler||", `\|\|spoiler\|\|`},
+		{"a | b || c", "a | b || c"},
+		{"[brackets]", "[brackets]"},
+		{"[link](x)", `\[link](x)`},
+		{"[ref]: x", `\[ref]: x`},
+		{"`code`", "\\`code\\`"},
+		{`C:\Users`, `C:\Users`},
+		{`a\*`, `a\\\*`},
+		{"#hashtag", "#hashtag"},
+		{"# heading", `\# heading`},
+		{"a\n## heading", "a\n\\## heading"},
+		{"> quote", `\> quote`},
+		{"  > quote", `  \> quote`},
+		{"a > b", "a > b"},
+		{"* item", `\* item`},
+		{"- item", "- item"},
+		{"***", `\*\*\*`},
+		{"___", `\_\_\_`},
+		{"~~~", `\~\~\~`},
+	}
+
+	for _, tt := range tests {
+		if got := escapeMarkdown(tt.in, 0, 0); got != tt.want {
+			t.Errorf("escapeMarkdown(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
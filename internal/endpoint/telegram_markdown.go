@@ -0,0 +1,241 @@
+package endpoint
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/go-telegram/bot/models"
+	"github.com/merrkry/tele2don/internal/markdown"
+	"github.com/yuin/goldmark/ast"
+	east "github.com/yuin/goldmark/extension/ast"
+	"github.com/yuin/goldmark/util"
+)
+
+// telegramText is a message text along with its formatting entities.
+type telegramText struct {
+	text     string
+	entities []models.MessageEntity
+}
+
+// renderTelegramText renders bridge Markdown for Telegram.
+// Formatting is best-effort, the raw Markdown is used as plain text if rendering fails.
+func renderTelegramText(md string) telegramText {
+	text, entities, err := markdownToEntities(md)
+	if err != nil {
+		slog.Warn("Failed to render markdown for Telegram, falling back to plain text", "err", err)
+		return telegramText{text: md}
+	}
+	return telegramText{text: text, entities: entities}
+}
+
+// telegramTextBuilder accumulates plain text and entities, tracking offsets in UTF-16 code units.
+type telegramTextBuilder struct {
+	source   []byte
+	text     strings.Builder
+	length   int
+	entities []models.MessageEntity
+	// Backslash escapes and entity references are not processed in code spans.
+	inCode bool
+}
+
+// markdownToEntities renders bridge Markdown into plain text with Telegram entities.
+func markdownToEntities(md string) (text string, entities []models.MessageEntity, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic while rendering markdown: %v", r)
+		}
+	}()
+
+	doc, source := markdown.Parse(md)
+	b := &telegramTextBuilder{source: source}
+	b.renderBlocks(doc, "\n\n")
+
+	return strings.TrimRight(b.text.String(), "\n"), b.entities, nil
+}
+
+func (b *telegramTextBuilder) write(s string) {
+	b.text.WriteString(s)
+	b.length += len(utf16.Encode([]rune(s)))
+}
+
+// wrap renders the content produced by f as an entity, and returns its index, or -1 if the content is empty.
+func (b *telegramTextBuilder) wrap(entity models.MessageEntity, f func()) int {
+	start := b.length
+	index := len(b.entities)
+	b.entities = append(b.entities, entity)
+
+	f()
+
+	if b.length == start {
+		b.entities = append(b.entities[:index], b.entities[index+1:]...)
+		return -1
+	}
+	b.entities[index].Offset = start
+	b.entities[index].Length = b.length - start
+	return index
+}
+
+func (b *telegramTextBuilder) renderBlocks(parent ast.Node, separator string) {
+	for n := parent.FirstChild(); n != nil; n = n.NextSibling() {
+		if n != parent.FirstChild() {
+			b.write(separator)
+		}
+		b.renderBlock(n)
+	}
+}
+
+func (b *telegramTextBuilder) renderBlock(n ast.Node) {
+	switch n := n.(type) {
+	case *ast.Paragraph, *ast.TextBlock:
+		b.renderInlines(n)
+
+	case *ast.Heading:
+		b.wrap(models.MessageEntity{Type: models.MessageEntityTypeBold}, func() {
+			b.renderInlines(n)
+		})
+
+	case *ast.ThematicBreak:
+		b.write("――――――――")
+
+	case *ast.FencedCodeBlock:
+		b.wrap(models.MessageEntity{
+			Type:     models.MessageEntityTypePre,
+			Language: string(n.Language(b.source)),
+		}, func() {
+			b.write(strings.TrimSuffix(b.lines(n), "\n"))
+		})
+
+	case *ast.CodeBlock:
+		b.wrap(models.MessageEntity{Type: models.MessageEntityTypePre}, func() {
+			b.write(strings.TrimSuffix(b.lines(n), "\n"))
+		})
+
+	case *ast.Blockquote:
+		b.wrap(models.MessageEntity{Type: models.MessageEntityTypeBlockquote}, func() {
+			b.renderBlocks(n, "\n\n")
+		})
+
+	case *ast.List:
+		index := n.Start
+		for item := n.FirstChild(); item != nil; item = item.NextSibling() {
+			if item != n.FirstChild() {
+				b.write("\n")
+			}
+			if n.IsOrdered() {
+				b.write(strconv.Itoa(index) + ". ")
+				index++
+			} else {
+				b.write("• ")
+			}
+			b.renderBlocks(item, "\n")
+		}
+
+	case *ast.HTMLBlock:
+		b.write(strings.TrimSuffix(b.lines(n), "\n"))
+
+	default:
+		if n.Type() == ast.TypeInline {
+			b.renderInline(n)
+		} else {
+			b.renderBlocks(n, "\n\n")
+		}
+	}
+}
+
+func (b *telegramTextBuilder) lines(n ast.Node) string {
+	var s strings.Builder
+	lines := n.Lines()
+	for i := 0; i < lines.Len(); i++ {
+		line := lines.At(i)
+		s.Write(line.Value(b.source))
+	}
+	return s.String()
+}
+
+func (b *telegramTextBuilder) renderInlines(parent ast.Node) {
+	for n := parent.FirstChild(); n != nil; n = n.NextSibling() {
+		b.renderInline(n)
+	}
+}
+
+func (b *telegramTextBuilder) renderInline(n ast.Node) {
+	switch n := n.(type) {
+	case *ast.Text:
+		value := n.Segment.Value(b.source)
+		if !b.inCode {
+			value = util.UnescapePunctuations(value)
+			value = util.ResolveNumericReferences(value)
+			value = util.ResolveEntityNames(value)
+		}
+		b.write(string(value))
+		if n.SoftLineBreak() || n.HardLineBreak() {
+			b.write("\n")
+		}
+
+	case *ast.String:
+		b.write(string(n.Value))
+
+	case *ast.Emphasis:
+		entityType := models.MessageEntityTypeItalic
+		if n.Level >= 2 {
+			entityType = models.MessageEntityTypeBold
+		}
+		b.wrap(models.MessageEntity{Type: entityType}, func() {
+			b.renderInlines(n)
+		})
+
+	case *east.Strikethrough:
+		b.wrap(models.MessageEntity{Type: models.MessageEntityTypeStrikethrough}, func() {
+			b.renderInlines(n)
+		})
+
+	case *markdown.Spoiler:
+		b.wrap(models.MessageEntity{Type: models.MessageEntityTypeSpoiler}, func() {
+			b.renderInlines(n)
+		})
+
+	case *ast.CodeSpan:
+		b.wrap(models.MessageEntity{Type: models.MessageEntityTypeCode}, func() {
+			b.inCode = true
+			b.renderInlines(n)
+			b.inCode = false
+		})
+
+	case *ast.Link:
+		b.renderLink(n, string(n.Destination))
+
+	case *ast.Image:
+		b.renderLink(n, string(n.Destination))
+
+	case *ast.AutoLink:
+		// Telegram detects URLs and emails in plain text by itself.
+		b.write(string(n.Label(b.source)))
+
+	case *ast.RawHTML:
+		for i := 0; i < n.Segments.Len(); i++ {
+			segment := n.Segments.At(i)
+			b.write(string(segment.Value(b.source)))
+		}
+
+	default:
+		b.renderInlines(n)
+	}
+}
+
+func (b *telegramTextBuilder) renderLink(n ast.Node, destination string) {
+	start := b.text.Len()
+	index := b.wrap(models.MessageEntity{
+		Type: models.MessageEntityTypeTextLink,
+		URL:  destination,
+	}, func() {
+		b.renderInlines(n)
+	})
+
+	// Links whose text is the URL itself, e.g. converted from Mastodon HTML, are better left for Telegram to detect.
+	if index >= 0 && b.text.String()[start:] == destination {
+		b.entities = append(b.entities[:index], b.entities[index+1:]...)
+	}
+}
@@ -0,0 +1,406 @@
+package endpoint
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode"
+	"unicode/utf16"
+
+	tg "github.com/go-telegram/bot"
+	"github.com/merrkry/tele2don/internal/model"
+)
+
+const testTelegramChannelID = -1001
+
+// telegramRequest is a Bot API call received by fakeTelegram.
+type telegramRequest struct {
+	method string
+	params map[string]string
+}
+
+// fakeTelegram implements the Bot API methods used to post to a channel.
+type fakeTelegram struct {
+	t *testing.T
+
+	mu       sync.Mutex
+	requests []telegramRequest
+	nextID   int
+	// unmodified messages are rejected by edits, like Telegram does when the content doesn't change.
+	unmodified map[int]bool
+	// deleted messages can't be forwarded anymore.
+	deleted map[int]bool
+	// updates are returned by the first getUpdates, later ones block until the request ends.
+	updates []any
+	polled  bool
+}
+
+func newFakeTelegram(t *testing.T) (*fakeTelegram, *httptest.Server) {
+	f := &fakeTelegram{t: t, nextID: 100}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, srv
+}
+
+func (f *fakeTelegram) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	method := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+	req := telegramRequest{method: method, params: make(map[string]string)}
+	if err := r.ParseMultipartForm(10 << 20); err == nil {
+		for key, values := range r.MultipartForm.Value {
+			req.params[key] = values[0]
+		}
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, req)
+
+	if method == "getUpdates" && f.polled {
+		f.mu.Unlock()
+		<-r.Context().Done()
+		f.mu.Lock()
+		return
+	}
+
+	message := func(id int, edited bool) map[string]any {
+		msg := map[string]any{"message_id": id, "date": 1700000000, "chat": map[string]any{"id": testTelegramChannelID, "type": "channel"}}
+		if edited {
+			msg["edit_date"] = 1700000100
+		}
+		return msg
+	}
+	var result any
+	switch method {
+	case "sendMessage", "sendPhoto", "sendVideo", "sendAnimation", "sendDocument":
+		f.nextID++
+		result = message(f.nextID, false)
+	case "sendMediaGroup":
+		var media []json.RawMessage
+		if err := json.Unmarshal([]byte(req.params["media"]), &media); err != nil {
+			f.t.Errorf("invalid media of sendMediaGroup: %v", err)
+		}
+		var msgs []any
+		for range media {
+			f.nextID++
+			msgs = append(msgs, message(f.nextID, false))
+		}
+		result = msgs
+	case "editMessageText", "editMessageCaption":
+		id := 0
+		json.Unmarshal([]byte(req.params["message_id"]), &id)
+		if f.unmodified[id] {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]any{"ok": false, "error_code": 400, "description": "Bad Request: message is not modified"})
+			return
+		}
+		result = message(id, true)
+	case "forwardMessage":
+		id := 0
+		json.Unmarshal([]byte(req.params["message_id"]), &id)
+		if f.deleted[id] {
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]any{"ok": false, "error_code": 400, "description": "Bad Request: message to forward not found"})
+			return
+		}
+		f.nextID++
+		result = message(f.nextID, false)
+	case "deleteMessage", "deleteWebhook":
+		result = true
+	case "getUpdates":
+		f.polled = true
+		result = f.updates
+	default:
+		f.t.Errorf("unexpected Bot API call %s", method)
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"ok": true, "result": result})
+}
+
+func (f *fakeTelegram) calls() []telegramRequest {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]telegramRequest(nil), f.requests...)
+}
+
+func newTestTelegramEndpoint(t *testing.T, srv *httptest.Server) *EndpointTelegram {
+	t.Helper()
+	client, err := tg.New("123:token", tg.WithServerURL(srv.URL), tg.WithSkipGetMe())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &EndpointTelegram{
+		id:        "telegram",
+		bot:       &telegramBot{Bot: client},
+		channelID: testTelegramChannelID,
+		recent:    &recentMessages{capacity: 50},
+	}
+}
+
+func TestSharedTelegramBotWaitsForAllEndpoints(t *testing.T) {
+	const otherChannelID = -1002
+	f, srv := newFakeTelegram(t)
+	post := func(updateID int, chatID int64) map[string]any {
+		return map[string]any{"update_id": updateID, "channel_post": map[string]any{
+			"message_id": updateID, "date": 1700000000, "text": "hello", "chat": map[string]any{"id": chatID, "type": "channel"},
+		}}
+	}
+	f.updates = []any{post(1, testTelegramChannelID), post(2, otherChannelID)}
+
+	client, err := tg.New("123:token", tg.WithServerURL(srv.URL), tg.WithSkipGetMe(), tg.WithNotAsyncHandlers())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bot := &telegramBot{Bot: client, done: make(chan struct{})}
+	endpoint := func(id model.EndpointID, channelID int64) *EndpointTelegram {
+		bot.addEndpoint()
+		return &EndpointTelegram{id: id, bot: bot, channelID: channelID, recent: &recentMessages{capacity: 10}}
+	}
+	first, second := endpoint("first", testTelegramChannelID), endpoint("second", otherChannelID)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	updates := make(chan *model.EndpointUpdate, 4)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go first.ListenUpdates(ctx, updates, &wg)
+	// Polling must not start before the second endpoint has registered its handler.
+	time.Sleep(100 * time.Millisecond)
+	go second.ListenUpdates(ctx, updates, &wg)
+
+	received := make(map[model.EndpointID]bool)
+	for range 2 {
+		select {
+		case update := <-updates:
+			received[update.EID] = true
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received updates of %v, want both endpoints", received)
+		}
+	}
+	if !received["first"] || !received["second"] {
+		t.Errorf("received updates of %v, want both endpoints", received)
+	}
+
+	cancel()
+	wg.Wait()
+}
+
+// testFile is the content of an attachment, go-telegram expects it to be a pointer like response bodies are.
+type testFile struct {
+	*strings.Reader
+}
+
+func (f *testFile) Close() error { return nil }
+
+func testAttachment(kind model.AttachmentKind, name string) *model.Attachment {
+	return &model.Attachment{
+		Kind:     kind,
+		FileName: name,
+		Open: func(context.Context) (io.ReadCloser, error) {
+			return &testFile{strings.NewReader("data")}, nil
+		},
+	}
+}
+
+func TestTelegramAlbumRevisions(t *testing.T) {
+	f, srv := newFakeTelegram(t)
+	e := newTestTelegramEndpoint(t, srv)
+	ctx := context.Background()
+
+	content := &model.BridgeMessageContent{
+		MDText: "caption",
+		Attachments: []*model.Attachment{
+			testAttachment(model.AttachmentKindPhoto, "a.jpg"),
+			testAttachment(model.AttachmentKindPhoto, "b.jpg"),
+			testAttachment(model.AttachmentKindVideo, "c.mp4"),
+		},
+	}
+	revisions, err := e.ApplyUpdateNew(ctx, content, "")
+	if err != nil {
+		t.Fatalf("ApplyUpdateNew: %v", err)
+	}
+	var ids []model.EndpointMessageID
+	for _, revision := range revisions {
+		ids = append(ids, revision.ID)
+	}
+	if len(ids) != 3 || ids[0] != "101" || ids[1] != "102" || ids[2] != "103" {
+		t.Fatalf("revisions = %v, want every message of the album", ids)
+	}
+	if got := e.recent.snapshot(); len(got) != 3 {
+		t.Errorf("tracked %v, want every message of the album", got)
+	}
+
+	revisions, err = e.ApplyUpdateEdit(ctx, ids, &model.BridgeMessageContent{MDText: "edited", Attachments: content.Attachments})
+	if err != nil {
+		t.Fatalf("ApplyUpdateEdit: %v", err)
+	}
+	if len(revisions) != 3 {
+		t.Errorf("edit returned %d revisions, want 3", len(revisions))
+	}
+
+	calls := f.calls()
+	if len(calls) != 2 || calls[0].method != "sendMediaGroup" || calls[1].method != "editMessageCaption" {
+		t.Fatalf("calls = %v, want sendMediaGroup and editMessageCaption", calls)
+	}
+	if calls[1].params["message_id"] != "101" || calls[1].params["caption"] != "edited" {
+		t.Errorf("edited %v, want caption of 101", calls[1].params)
+	}
+}
+
+func TestSplitTelegramText(t *testing.T) {
+	md := longMarkdownText(9000)
+
+	for _, tt := range []struct {
+		name         string
+		content      *model.BridgeMessageContent
+		firstLimit   int
+		minimumCount int
+	}{
+		{"text", &model.BridgeMessageContent{MDText: md}, telegramMaxTextLength, 3},
+		{"caption", &model.BridgeMessageContent{MDText: md, Attachments: []*model.Attachment{{}}}, telegramMaxCaptionLength, 3},
+		{"content warning", &model.BridgeMessageContent{MDText: md, SpoilerText: "cw"}, telegramMaxTextLength, 3},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			pieces := splitTelegramText(tt.content)
+			if len(pieces) < tt.minimumCount {
+				t.Fatalf("split into %d pieces, want at least %d", len(pieces), tt.minimumCount)
+			}
+			var total int
+			for i, piece := range pieces {
+				limit := telegramMaxTextLength
+				if i == 0 {
+					limit = tt.firstLimit
+				}
+				text := withContentWarning(renderTelegramText(piece), tt.content.SpoilerText).text
+				if length := len(utf16.Encode([]rune(text))); length > limit {
+					t.Errorf("piece %d is %d characters long, want at most %d", i, length, limit)
+				}
+				if strings.TrimLeftFunc(piece, unicode.IsSpace) != piece {
+					t.Errorf("piece %d starts with whitespace", i)
+				}
+				total += len(piece)
+			}
+			// Only whitespace between pieces is dropped, a space and a blank line at most.
+			if total < len(md)-len(pieces)*3 {
+				t.Errorf("pieces hold %d bytes, want all of the %d bytes of text", total, len(md))
+			}
+		})
+	}
+
+	if pieces := splitTelegramText(&model.BridgeMessageContent{MDText: "short"}); len(pieces) != 1 || pieces[0] != "short" {
+		t.Errorf("short text split into %q", pieces)
+	}
+}
+
+func TestTelegramLength(t *testing.T) {
+	tests := []struct {
+		md   string
+		want int
+	}{
+		{"plain", 5},
+		{"**bold** [link](https://example.com)", 9},
+		// Astral characters take 2 UTF-16 code units.
+		{"漢字 😀", 5},
+	}
+
+	for _, tt := range tests {
+		if got := telegramLength(tt.md); got != tt.want {
+			t.Errorf("telegramLength(%q) = %d, want %d", tt.md, got, tt.want)
+		}
+	}
+}
+
+func TestTelegramSplitMessages(t *testing.T) {
+	f, srv := newFakeTelegram(t)
+	e := newTestTelegramEndpoint(t, srv)
+	ctx := context.Background()
+
+	revisions, err := e.ApplyUpdateNew(ctx, &model.BridgeMessageContent{MDText: longMarkdownText(9000)}, "50")
+	if err != nil {
+		t.Fatalf("ApplyUpdateNew: %v", err)
+	}
+	calls := f.calls()
+	if len(revisions) != 3 || len(calls) != 3 {
+		t.Fatalf("sent %d messages with %d revisions, want 3", len(calls), len(revisions))
+	}
+	for i, call := range calls {
+		var reply struct {
+			MessageID int `json:"message_id"`
+		}
+		json.Unmarshal([]byte(call.params["reply_parameters"]), &reply)
+		want := 50
+		if i > 0 {
+			want = telegramMessageID(revisions[i-1].ID)
+		}
+		if call.method != "sendMessage" || reply.MessageID != want {
+			t.Errorf("message %d sent by %s in reply to %d, want sendMessage in reply to %d", i, call.method, reply.MessageID, want)
+		}
+	}
+
+	// Unchanged pieces are rejected by Telegram, which isn't a failure.
+	ids := []model.EndpointMessageID{revisions[0].ID, revisions[1].ID, revisions[2].ID}
+	f.mu.Lock()
+	f.unmodified = map[int]bool{telegramMessageID(ids[0]): true}
+	f.mu.Unlock()
+	revisions, err = e.ApplyUpdateEdit(ctx, ids, &model.BridgeMessageContent{MDText: "short"})
+	if err != nil {
+		t.Fatalf("ApplyUpdateEdit: %v", err)
+	}
+	if len(revisions) != 1 || revisions[0].ID != ids[0] {
+		t.Errorf("revisions = %+v, want only %s", revisions, ids[0])
+	}
+	calls = f.calls()[3:]
+	want := []string{"editMessageText", "deleteMessage", "deleteMessage"}
+	if len(calls) != len(want) {
+		t.Fatalf("calls = %v, want %v", calls, want)
+	}
+	for i, call := range calls {
+		if call.method != want[i] {
+			t.Errorf("call %d = %s, want %s", i, call.method, want[i])
+		}
+	}
+	if got := e.recent.snapshot(); len(got) != 1 {
+		t.Errorf("tracked %v after deleting trailing messages, want 1 message", got)
+	}
+}
+
+func TestTelegramSplitCaption(t *testing.T) {
+	f, srv := newFakeTelegram(t)
+	e := newTestTelegramEndpoint(t, srv)
+	ctx := context.Background()
+
+	photo := testAttachment(model.AttachmentKindPhoto, "a.jpg")
+	revisions, err := e.ApplyUpdateNew(ctx, &model.BridgeMessageContent{MDText: longMarkdownText(3000), Attachments: []*model.Attachment{photo}}, "")
+	if err != nil {
+		t.Fatalf("ApplyUpdateNew: %v", err)
+	}
+	calls := f.calls()
+	if len(revisions) != 2 || len(calls) != 2 || calls[0].method != "sendPhoto" || calls[1].method != "sendMessage" {
+		t.Fatalf("calls = %v, want sendPhoto with caption followed by sendMessage", calls)
+	}
+	if length := len(utf16.Encode([]rune(calls[0].params["caption"]))); length > telegramMaxCaptionLength {
+		t.Errorf("caption is %d characters long", length)
+	}
+
+	// Growing the text sends more messages, replying to the last one.
+	ids := []model.EndpointMessageID{revisions[0].ID, revisions[1].ID}
+	revisions, err = e.ApplyUpdateEdit(ctx, ids, &model.BridgeMessageContent{MDText: longMarkdownText(9000), Attachments: []*model.Attachment{photo}})
+	if err != nil {
+		t.Fatalf("ApplyUpdateEdit: %v", err)
+	}
+	calls = f.calls()[2:]
+	if len(revisions) < 3 || revisions[0].ID != ids[0] || revisions[1].ID != ids[1] {
+		t.Fatalf("revisions = %+v, want %v followed by new messages", revisions, ids)
+	}
+	if calls[0].method != "editMessageCaption" || calls[1].method != "editMessageText" || calls[2].method != "sendMessage" {
+		t.Errorf("calls = %v, want editMessageCaption, editMessageText and sendMessage", calls)
+	}
+}
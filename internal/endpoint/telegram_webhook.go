@@ -0,0 +1,179 @@
+package endpoint
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	tg "github.com/go-telegram/bot"
+)
+
+const (
+	telegramWebhookMinBackoff = time.Second
+	telegramWebhookMaxBackoff = 5 * time.Minute
+	// telegramWebhookCheckInterval is how often the registered webhook is checked with getWebhookInfo.
+	// Successful checks count as heartbeats, as channels might be quiet for much longer.
+	telegramWebhookCheckInterval = time.Minute
+	// telegramWebhookShutdownTimeout bounds waiting for requests in flight, and deleting the webhook on shutdown.
+	telegramWebhookShutdownTimeout = 10 * time.Second
+)
+
+// startWebhook serves updates pushed by Telegram until ctx is done.
+// Requests in flight are completed before returning, so that updates acknowledged to Telegram are all handled.
+func (b *telegramBot) startWebhook(ctx context.Context) {
+	mux := http.NewServeMux()
+	mux.Handle(b.webhook.Path, b.webhookHandler())
+	server := &http.Server{
+		Addr:              b.webhook.Listen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	// Workers outlive ctx until the server is shut down, as requests in flight wait for them to take updates.
+	workersCtx, stopWorkers := context.WithCancel(context.WithoutCancel(ctx))
+	// A failed server stops the webhook, so that the listener shows up as exited in health checks.
+	monitorCtx, stopMonitor := context.WithCancel(ctx)
+	defer stopMonitor()
+	serverDone := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		b.StartWebhook(workersCtx)
+	}()
+	go func() {
+		defer wg.Done()
+		b.monitorWebhook(monitorCtx)
+	}()
+	go func() {
+		defer close(serverDone)
+		slog.Info("Serving Telegram webhook", "listen", b.webhook.Listen, "path", b.webhook.Path)
+		err := server.ListenAndServe()
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Telegram webhook server failed", "listen", b.webhook.Listen, "err", err)
+		}
+	}()
+
+	select {
+	case <-ctx.Done():
+	case <-serverDone:
+	}
+	stopMonitor()
+	shutdownCtx, cancel := context.WithTimeout(context.WithoutCancel(ctx), telegramWebhookShutdownTimeout)
+	defer cancel()
+	err := server.Shutdown(shutdownCtx)
+	if err != nil {
+		slog.Warn("Failed to shut down Telegram webhook server gracefully", "err", err)
+	}
+	<-serverDone
+	stopWorkers()
+	wg.Wait()
+
+	if b.webhook.DeleteOnShutdown {
+		_, err = b.DeleteWebhook(shutdownCtx, &tg.DeleteWebhookParams{})
+		if err != nil {
+			slog.Warn("Failed to delete Telegram webhook", "err", err)
+		} else {
+			slog.Info("Deleted Telegram webhook")
+		}
+	}
+}
+
+// webhookHandler checks the secret token before passing requests to go-telegram,
+// which would acknowledge forged requests with 200 instead of rejecting them.
+func (b *telegramBot) webhookHandler() http.Handler {
+	handler := b.WebhookHandler()
+	secret := []byte(b.webhook.SecretToken)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		token := []byte(r.Header.Get("X-Telegram-Bot-Api-Secret-Token"))
+		if subtle.ConstantTimeCompare(token, secret) != 1 {
+			http.Error(w, "invalid secret token", http.StatusUnauthorized)
+			return
+		}
+
+		b.status.heartbeat()
+		handler(w, r)
+	})
+}
+
+// monitorWebhook registers the webhook, and periodically checks that it's still registered,
+// e.g. not replaced by another instance, registering it again otherwise.
+func (b *telegramBot) monitorWebhook(ctx context.Context) {
+	retry := &backoff{min: telegramWebhookMinBackoff, max: telegramWebhookMaxBackoff}
+	registered := false
+	// Errors from before startup are not ours to report.
+	lastErrorDate := int(time.Now().Unix())
+	for {
+		var err error
+		if !registered {
+			err = b.registerWebhook(ctx)
+			registered = err == nil
+		} else {
+			registered, err = b.checkWebhook(ctx, &lastErrorDate)
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		delay := telegramWebhookCheckInterval
+		if err != nil {
+			delay = retry.next()
+			slog.Warn("Failed to set up Telegram webhook, retrying", "delay", delay, "err", err)
+		} else if !registered {
+			slog.Warn("Telegram webhook is no longer registered, registering it again")
+			continue
+		} else {
+			retry.reset()
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+func (b *telegramBot) registerWebhook(ctx context.Context) error {
+	_, err := b.SetWebhook(ctx, &tg.SetWebhookParams{
+		URL:         b.webhook.URL,
+		SecretToken: b.webhook.SecretToken,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set Telegram webhook: %w", err)
+	}
+
+	slog.Info("Registered Telegram webhook", "url", b.webhook.URL)
+	b.status.heartbeat()
+	return nil
+}
+
+// checkWebhook reports whether our webhook is still registered, and logs delivery errors reported by Telegram
+// that are newer than lastErrorDate.
+func (b *telegramBot) checkWebhook(ctx context.Context, lastErrorDate *int) (bool, error) {
+	info, err := b.GetWebhookInfo(ctx)
+	if err != nil {
+		return true, fmt.Errorf("failed to get Telegram webhook info: %w", err)
+	}
+	if info.URL != b.webhook.URL {
+		return false, nil
+	}
+
+	if info.LastErrorDate > *lastErrorDate {
+		*lastErrorDate = info.LastErrorDate
+		slog.Warn("Telegram failed to deliver updates to webhook",
+			"at", time.Unix(int64(info.LastErrorDate), 0), "err", info.LastErrorMessage, "pending", info.PendingUpdateCount)
+	}
+	b.status.heartbeat()
+	return true, nil
+}
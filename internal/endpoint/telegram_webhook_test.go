@@ -0,0 +1,114 @@
+package endpoint
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	tg "github.com/go-telegram/bot"
+	"github.com/go-telegram/bot/models"
+)
+
+func TestTelegramWebhookSecretToken(t *testing.T) {
+	const secret = "s3cret"
+	received := make(chan *models.Update, 1)
+	client, err := tg.New("123:token", tg.WithSkipGetMe(), tg.WithNotAsyncHandlers(),
+		tg.WithWebhookSecretToken(secret), tg.WithUpdatesChannelCap(0),
+		tg.WithDefaultHandler(func(ctx context.Context, bot *tg.Bot, update *models.Update) {
+			received <- update
+		}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bot := &telegramBot{Bot: client, webhook: EndpointConfigTelegramWebhook{SecretToken: secret}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go bot.StartWebhook(ctx)
+	handler := bot.webhookHandler()
+
+	tests := []struct {
+		name     string
+		method   string
+		token    string
+		wantCode int
+	}{
+		{"valid", http.MethodPost, secret, http.StatusOK},
+		{"missing token", http.MethodPost, "", http.StatusUnauthorized},
+		{"wrong token", http.MethodPost, "wrong!", http.StatusUnauthorized},
+		{"token prefix", http.MethodPost, secret[:3], http.StatusUnauthorized},
+		{"token with suffix", http.MethodPost, secret + "x", http.StatusUnauthorized},
+		{"wrong method", http.MethodGet, secret, http.StatusMethodNotAllowed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, "/webhook", strings.NewReader(`{"update_id":1,"channel_post":{"message_id":1,"date":1700000000,"chat":{"id":1,"type":"channel"}}}`))
+			if tt.token != "" {
+				req.Header.Set("X-Telegram-Bot-Api-Secret-Token", tt.token)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.wantCode {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantCode)
+			}
+
+			if tt.wantCode != http.StatusOK {
+				select {
+				case <-received:
+					t.Error("rejected update was handled")
+				case <-time.After(50 * time.Millisecond):
+				}
+				return
+			}
+			select {
+			case update := <-received:
+				if update.ChannelPost == nil || update.ChannelPost.ID != 1 {
+					t.Errorf("handled update %+v", update)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("accepted update wasn't handled")
+			}
+			if bot.status.status().LastHeartbeat.IsZero() {
+				t.Error("accepted update isn't recorded as heartbeat")
+			}
+		})
+	}
+}
+
+func TestTelegramWebhookConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   EndpointConfigTelegramWebhook
+		wantErr  string
+		wantPath string
+	}{
+		{"valid", EndpointConfigTelegramWebhook{URL: "https://example.com/hook", Listen: ":8443", SecretToken: "a-Z_0"}, "", "/hook"},
+		{"root path", EndpointConfigTelegramWebhook{URL: "https://example.com", Listen: ":8443", SecretToken: "token"}, "", "/"},
+		{"missing token", EndpointConfigTelegramWebhook{URL: "https://example.com/hook", Listen: ":8443"}, "secret_token", ""},
+		{"invalid token", EndpointConfigTelegramWebhook{URL: "https://example.com/hook", Listen: ":8443", SecretToken: "not valid!"}, "secret_token", ""},
+		{"long token", EndpointConfigTelegramWebhook{URL: "https://example.com/hook", Listen: ":8443", SecretToken: strings.Repeat("a", 257)}, "secret_token", ""},
+		{"http", EndpointConfigTelegramWebhook{URL: "http://example.com/hook", Listen: ":8443", SecretToken: "token"}, "url", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := tt.config.validate()
+			if tt.wantErr == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if tt.config.Path != tt.wantPath {
+					t.Errorf("path = %q, want %q", tt.config.Path, tt.wantPath)
+				}
+				return
+			}
+			if err == nil || !strings.HasPrefix(err.Error(), tt.wantErr+":") {
+				t.Errorf("validate() = %v, want an error about %s", err, tt.wantErr)
+			}
+		})
+	}
+}
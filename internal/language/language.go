@@ -0,0 +1,37 @@
+// Package language identifies the natural language of bridge messages offline.
+package language
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/abadojack/whatlanggo"
+	"github.com/merrkry/tele2don/internal/markdown"
+	"github.com/merrkry/tele2don/internal/model"
+)
+
+// DefaultConfidence is the default minimum confidence of detected languages.
+// Confidence is the margin over the second likely language, so it's rather low even for clear prose.
+const DefaultConfidence = 0.3
+
+// urlPattern matches bare URLs, which are noise for detection.
+var urlPattern = regexp.MustCompile(`https?://\S+`)
+
+// Detect returns the ISO 639-1 code of the language of content.
+// It returns an empty string if the language is detected with confidence below minConfidence, e.g. for mixed languages.
+func Detect(content *model.BridgeMessageContent, minConfidence float64) string {
+	text := markdown.PlainText(content.MDText)
+	if content.SpoilerText != "" {
+		text = content.SpoilerText + "\n" + text
+	}
+	text = strings.TrimSpace(urlPattern.ReplaceAllString(text, ""))
+	if text == "" {
+		return ""
+	}
+
+	info := whatlanggo.Detect(text)
+	if info.Confidence < minConfidence {
+		return ""
+	}
+	return info.Lang.Iso6391()
+}
@@ -0,0 +1,81 @@
+package language
+
+import (
+	"testing"
+
+	"github.com/merrkry/tele2don/internal/model"
+)
+
+func TestDetect(t *testing.T) {
+	tests := []struct {
+		name          string
+		content       model.BridgeMessageContent
+		minConfidence float64
+		want          string
+	}{
+		{
+			name:          "english",
+			content:       model.BridgeMessageContent{MDText: "The quick brown fox jumps over the lazy dog while the farmer watches from the house."},
+			minConfidence: DefaultConfidence,
+			want:          "en",
+		},
+		{
+			name:          "german",
+			content:       model.BridgeMessageContent{MDText: "Der schnelle braune Fuchs springt über den faulen Hund, während der Bauer zuschaut."},
+			minConfidence: DefaultConfidence,
+			want:          "de",
+		},
+		{
+			name:          "japanese",
+			content:       model.BridgeMessageContent{MDText: "今日はとても良い天気ですね。散歩に行きましょう。"},
+			minConfidence: DefaultConfidence,
+			want:          "ja",
+		},
+		{
+			name:          "markup and links are ignored",
+			content:       model.BridgeMessageContent{MDText: "**Bonjour** à tous, je suis [très content](https://example.com/the/quick/brown/fox) de vous voir `the lazy dog` https://example.com/over/the/house"},
+			minConfidence: DefaultConfidence,
+			want:          "fr",
+		},
+		{
+			name:          "content warning",
+			content:       model.BridgeMessageContent{SpoilerText: "Bonjour à tous, je suis très content de vous voir aujourd'hui."},
+			minConfidence: DefaultConfidence,
+			want:          "fr",
+		},
+		{
+			name:          "mixed languages",
+			content:       model.BridgeMessageContent{MDText: "hello bonjour hola ciao"},
+			minConfidence: DefaultConfidence,
+		},
+		{
+			name:          "too short",
+			content:       model.BridgeMessageContent{MDText: "ok"},
+			minConfidence: DefaultConfidence,
+		},
+		{
+			name:          "only a link",
+			content:       model.BridgeMessageContent{MDText: "https://example.com/the/quick/brown/fox"},
+			minConfidence: 0,
+		},
+		{
+			name:          "below a higher threshold",
+			content:       model.BridgeMessageContent{MDText: "The quick brown fox jumps over the lazy dog while the farmer watches from the house."},
+			minConfidence: 0.9,
+		},
+		{
+			name:          "any guess without a threshold",
+			content:       model.BridgeMessageContent{MDText: "hello bonjour hola ciao"},
+			minConfidence: 0,
+			want:          "ny",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Detect(&tt.content, tt.minConfidence); got != tt.want {
+				t.Errorf("Detect() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,30 @@
+// Package markdown implements the Markdown dialect used by bridge messages.
+//
+// It's CommonMark, extended with GFM strikethrough (~~text~~) and Telegram-style spoilers (||text||).
+package markdown
+
+import (
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/ast"
+	"github.com/yuin/goldmark/extension"
+	"github.com/yuin/goldmark/text"
+)
+
+var md = goldmark.New(
+	goldmark.WithExtensions(
+		extension.Strikethrough,
+		SpoilerExtension,
+	),
+)
+
+// Parse parses bridge Markdown into goldmark AST.
+// The returned source must be used to resolve text segments of the nodes.
+func Parse(s string) (ast.Node, []byte) {
+	source := []byte(s)
+	return md.Parser().Parse(text.NewReader(source)), source
+}
+
+// Markdown returns the goldmark instance configured with the bridge dialect.
+func Markdown() goldmark.Markdown {
+	return md
+}
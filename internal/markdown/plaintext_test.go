@@ -0,0 +1,27 @@
+package markdown
+
+import "testing"
+
+func TestPlainText(t *testing.T) {
+	tests := []struct {
+		name string
+		in   string
+		want string
+	}{
+		{"plain", "hello world", "hello world"},
+		{"inline markup", "**bold** *italic* ~~strike~~ ||spoiler||", "bold italic strike spoiler"},
+		{"link", "[label](https://example.com)", "label"},
+		{"autolink", "see <https://example.com>", "see"},
+		{"code", "run `go test`\n\n```\ncode block\n```", "run"},
+		{"blocks", "# title\n\nparagraph\n\n- item", "title\nparagraph\nitem"},
+		{"line breaks", "first\nsecond", "first\nsecond"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := PlainText(tt.in); got != tt.want {
+				t.Errorf("PlainText(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
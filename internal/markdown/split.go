@@ -0,0 +1,197 @@
+package markdown
+
+import (
+	"slices"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/yuin/goldmark/ast"
+)
+
+type cutPriority int
+
+const (
+	cutWord cutPriority = iota + 1
+	cutSentence
+	cutBlock
+)
+
+// cut is a candidate position to split the text at.
+// The current piece ends at end, and the next one begins at next, whitespace in between is dropped.
+type cut struct {
+	end, next int
+	priority  cutPriority
+}
+
+// Split splits bridge Markdown into pieces no longer than limit, as measured by length.
+// Pieces are cut between blocks if possible, then between lines or sentences, then between words.
+// Cuts never fall inside inline markup (e.g. emphasis, links) or code blocks,
+// unless a single word exceeds the limit, in which case it's cut at the limit.
+// At least one piece is returned, even for empty text.
+func Split(s string, limit int, length func(string) int) []string {
+	if length(s) <= limit {
+		return []string{s}
+	}
+
+	cuts := findCuts(s)
+
+	var pieces []string
+	start := 0
+	for start < len(s) {
+		if length(s[start:]) <= limit {
+			pieces = append(pieces, s[start:])
+			break
+		}
+
+		best := cut{}
+		for _, c := range cuts {
+			if c.end <= start {
+				continue
+			}
+			piece := strings.TrimRightFunc(s[start:c.end], unicode.IsSpace)
+			if length(piece) > limit {
+				break
+			}
+			if piece != "" && c.priority >= best.priority {
+				best = c
+			}
+		}
+		if best.priority == 0 {
+			best = hardCut(s, start, limit, length)
+		}
+
+		pieces = append(pieces, strings.TrimRightFunc(s[start:best.end], unicode.IsSpace))
+		start = best.next
+	}
+
+	return pieces
+}
+
+// findCuts returns candidate cuts in s, ordered by position.
+func findCuts(s string) []cut {
+	unsafe := unsafeSpans(s)
+	isSafe := func(i int) bool {
+		for _, span := range unsafe {
+			if span[0] <= i && i < span[1] {
+				return false
+			}
+		}
+		return true
+	}
+
+	var cuts []cut
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		if !unicode.IsSpace(r) {
+			i += size
+			continue
+		}
+
+		// Take the whole run of whitespace as a single cut.
+		j, newlines := i, 0
+		for j < len(s) {
+			r, size := utf8.DecodeRuneInString(s[j:])
+			if !unicode.IsSpace(r) {
+				break
+			}
+			if r == '\n' {
+				newlines++
+			}
+			j += size
+		}
+
+		priority := cutWord
+		switch {
+		case newlines >= 2:
+			priority = cutBlock
+		case newlines == 1:
+			priority = cutSentence
+		case isSentenceEnd(s[:i]):
+			priority = cutSentence
+		}
+		// Keep indentation of the next line, it's significant in Markdown.
+		next := j
+		if newlines > 0 {
+			next = i + strings.LastIndexByte(s[i:j], '\n') + 1
+		}
+
+		if isSafe(i) {
+			cuts = append(cuts, cut{end: i, next: next, priority: priority})
+		}
+		i = j
+	}
+
+	return cuts
+}
+
+func isSentenceEnd(s string) bool {
+	r, _ := utf8.DecodeLastRuneInString(s)
+	return strings.ContainsRune(".!?…。！？", r)
+}
+
+// hardCut cuts as many runes as possible into the piece, it's the last resort for overlong words.
+func hardCut(s string, start, limit int, length func(string) int) cut {
+	end := start
+	for end < len(s) {
+		_, size := utf8.DecodeRuneInString(s[end:])
+		if end > start && length(s[start:end+size]) > limit {
+			break
+		}
+		end += size
+	}
+	return cut{end: end, next: end}
+}
+
+// unsafeSpans returns byte ranges of s that must not be split, i.e. inline markup and code blocks.
+func unsafeSpans(s string) [][2]int {
+	doc, _ := Parse(s)
+
+	var spans [][2]int
+	ast.Walk(doc, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		if !entering {
+			return ast.WalkContinue, nil
+		}
+
+		switch n.Kind() {
+		case ast.KindCodeBlock, ast.KindFencedCodeBlock, ast.KindHTMLBlock:
+			lines := n.Lines()
+			if lines.Len() > 0 {
+				// Also cover the newlines after the opening fence and before the closing one.
+				spans = append(spans, [2]int{lines.At(0).Start - 1, lines.At(lines.Len() - 1).Stop})
+			}
+			return ast.WalkSkipChildren, nil
+		case ast.KindText:
+			return ast.WalkContinue, nil
+		}
+
+		if n.Type() == ast.TypeInline {
+			if span, ok := textSpan(n); ok {
+				spans = append(spans, span)
+			}
+			return ast.WalkSkipChildren, nil
+		}
+
+		return ast.WalkContinue, nil
+	})
+
+	return spans
+}
+
+// textSpan returns the byte range covered by text descendants of n.
+func textSpan(n ast.Node) ([2]int, bool) {
+	span := [2]int{-1, -1}
+	ast.Walk(n, func(n ast.Node, entering bool) (ast.WalkStatus, error) {
+		text, ok := n.(*ast.Text)
+		if !entering || !ok {
+			return ast.WalkContinue, nil
+		}
+		if span[0] < 0 || text.Segment.Start < span[0] {
+			span[0] = text.Segment.Start
+		}
+		span[1] = max(span[1], text.Segment.Stop)
+		return ast.WalkContinue, nil
+	})
+
+	return span, !slices.Contains(span[:], -1)
+}
@@ -0,0 +1,139 @@
+package markdown
+
+import (
+	"slices"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestSplit(t *testing.T) {
+	runes := utf8.RuneCountInString
+	bytes := func(s string) int { return len(s) }
+
+	tests := []struct {
+		name   string
+		in     string
+		limit  int
+		length func(string) int
+		want   []string
+	}{
+		{
+			name:   "within limit",
+			in:     "short text",
+			limit:  10,
+			length: runes,
+			want:   []string{"short text"},
+		},
+		{
+			name:   "empty",
+			in:     "",
+			limit:  10,
+			length: runes,
+			want:   []string{""},
+		},
+		{
+			name:   "between paragraphs",
+			in:     "first paragraph. still first\n\nsecond",
+			limit:  30,
+			length: runes,
+			want:   []string{"first paragraph. still first", "second"},
+		},
+		{
+			name:   "between sentences",
+			in:     "One sentence. Another sentence here",
+			limit:  25,
+			length: runes,
+			want:   []string{"One sentence.", "Another sentence here"},
+		},
+		{
+			name:   "between words",
+			in:     "aaa bbb ccc ddd",
+			limit:  8,
+			length: runes,
+			want:   []string{"aaa bbb", "ccc ddd"},
+		},
+		{
+			name:   "indentation is kept",
+			in:     "item one\n  nested item",
+			limit:  13,
+			length: runes,
+			want:   []string{"item one", "  nested item"},
+		},
+		{
+			name:   "link straddling the limit",
+			in:     "see [a link](https://x.co) now",
+			limit:  25,
+			length: runes,
+			want:   []string{"see", "[a link](https://x.co)", "now"},
+		},
+		{
+			name:   "emphasis straddling the limit",
+			in:     "aa **bold words** bb",
+			limit:  16,
+			length: runes,
+			want:   []string{"aa", "**bold words**", "bb"},
+		},
+		{
+			name:   "code fence straddling the limit",
+			in:     "intro\n```\ncode line\nmore code\n```\noutro",
+			limit:  32,
+			length: runes,
+			want:   []string{"intro", "```\ncode line\nmore code\n```", "outro"},
+		},
+		{
+			name:   "markup longer than the limit",
+			in:     "**bold words**",
+			limit:  8,
+			length: runes,
+			want:   []string{"**bold w", "ords**"},
+		},
+		{
+			name:   "word longer than the limit",
+			in:     "abcdefghij xy",
+			limit:  4,
+			length: runes,
+			want:   []string{"abcd", "efgh", "ij", "xy"},
+		},
+		{
+			name:   "multi-byte runes",
+			in:     "漢字漢字",
+			limit:  3,
+			length: runes,
+			want:   []string{"漢字漢", "字"},
+		},
+		{
+			name:   "limit smaller than a rune",
+			in:     "漢字",
+			limit:  2,
+			length: bytes,
+			want:   []string{"漢", "字"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := Split(tt.in, tt.limit, tt.length)
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("Split(%q, %d) = %q, want %q", tt.in, tt.limit, got, tt.want)
+			}
+		})
+	}
+}
+
+// TestSplitWithinLimit checks that pieces of long text fit, and that nothing but whitespace between them is lost.
+func TestSplitWithinLimit(t *testing.T) {
+	text := strings.Repeat("Lorem ipsum **dolor** sit amet, [consectetur](https://example.com) adipiscing elit. ", 40)
+	for _, limit := range []int{1, 7, 50, 500} {
+		pieces := Split(text, limit, utf8.RuneCountInString)
+		for i, piece := range pieces {
+			// Markup longer than the limit can't be kept whole.
+			if n := utf8.RuneCountInString(piece); n > max(limit, len("[consectetur](https://example.com)")) {
+				t.Errorf("piece %d of limit %d has %d characters", i, limit, n)
+			}
+		}
+		if got, want := strings.Join(strings.Fields(strings.Join(pieces, "")), ""), strings.Join(strings.Fields(text), ""); got != want {
+			t.Errorf("pieces of limit %d don't add up to the text", limit)
+		}
+	}
+}
@@ -0,0 +1,95 @@
+// Package metrics defines Prometheus metrics of the bridge.
+package metrics
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "tele2don"
+
+// Registry holds all metrics of the bridge, along with Go runtime and process metrics.
+var Registry = prometheus.NewRegistry()
+
+var (
+	UpdatesReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "updates_received_total",
+		Help:      "Updates received from endpoints.",
+	}, []string{"endpoint", "type"})
+
+	// UpdatesDropped counts updates not bridged within a route, because they are duplicated or refer to unknown messages.
+	UpdatesDropped = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "updates_dropped_total",
+		Help:      "Updates dropped without being bridged.",
+	}, []string{"route", "endpoint", "reason"})
+
+	LastEvent = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "last_event_timestamp_seconds",
+		Help:      "Unix time of the last update received from the endpoint.",
+	}, []string{"endpoint"})
+
+	DeliveriesAttempted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "deliveries_attempted_total",
+		Help:      "Attempts to deliver updates to target endpoints, including retries.",
+	}, []string{"target", "type"})
+
+	DeliveriesSucceeded = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "deliveries_succeeded_total",
+		Help:      "Successful deliveries of updates to target endpoints.",
+	}, []string{"target", "type"})
+
+	DeliveriesFailed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "deliveries_failed_total",
+		Help:      "Failed deliveries of updates to target endpoints.",
+	}, []string{"target", "type"})
+
+	DeliveryLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "delivery_duration_seconds",
+		Help:      "Time taken by attempts to deliver updates to target endpoints.",
+		Buckets:   []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60},
+	}, []string{"target", "type"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		UpdatesReceived,
+		UpdatesDropped,
+		LastEvent,
+		DeliveriesAttempted,
+		DeliveriesSucceeded,
+		DeliveriesFailed,
+		DeliveryLatency,
+	)
+}
+
+// NewGaugeFunc registers a gauge whose value is read from f on every scrape.
+// The returned function unregisters it.
+func NewGaugeFunc(name, help string, f func() float64) func() {
+	gauge := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      name,
+		Help:      help,
+	}, f)
+	Registry.MustRegister(gauge)
+
+	return func() {
+		Registry.Unregister(gauge)
+	}
+}
+
+// Handler serves metrics in Prometheus text format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
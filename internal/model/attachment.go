@@ -0,0 +1,49 @@
+package model
+
+import (
+	"context"
+	"io"
+)
+
+type AttachmentKind int
+
+const (
+	AttachmentKindPhoto AttachmentKind = iota + 1 // start from 1 to avoid confusion with zero value
+	AttachmentKindVideo
+	AttachmentKindAnimation
+	AttachmentKindDocument
+)
+
+func (k AttachmentKind) String() string {
+	switch k {
+	case AttachmentKindPhoto:
+		return "photo"
+	case AttachmentKindVideo:
+		return "video"
+	case AttachmentKindAnimation:
+		return "animation"
+	case AttachmentKindDocument:
+		return "document"
+	default:
+		return "unknown"
+	}
+}
+
+// AttachmentOpener opens the attachment data for reading.
+// Caller is responsible for closing the returned reader.
+type AttachmentOpener func(ctx context.Context) (io.ReadCloser, error)
+
+// Attachment is an endpoint-independent media attachment.
+// Data is opened lazily, so files are only downloaded when another endpoint actually needs them.
+type Attachment struct {
+	Kind     AttachmentKind
+	MIMEType string
+	// Size in bytes, 0 if unknown.
+	Size     int64
+	AltText  string
+	FileName string
+	// Source is an endpoint-specific reference to the file, e.g. file ID or URL,
+	// so that Open can be recreated by the source endpoint after the attachment is persisted.
+	Source string
+	Open   AttachmentOpener `json:"-"`
+}
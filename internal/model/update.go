@@ -6,11 +6,47 @@ import (
 )
 
 type BridgeMessageContent struct {
-	MDText string
-	// TODO: attachments
+	// MDText is the message body in bridge Markdown, see package markdown for the dialect.
+	MDText      string
+	Attachments []*Attachment
+
+	// Visibility is the audience of the message, empty if the source platform has no such concept.
+	Visibility Visibility
+	// SpoilerText is the content warning shown in place of the hidden message body, empty if there is none.
+	SpoilerText string
+	// Sensitive marks attachments to be hidden until revealed.
+	Sensitive bool
+	// Language is the ISO 639 code of the message language, empty if unknown to the source platform.
+	Language string
+}
+
+// Visibility is the audience of a message, following Mastodon.
+type Visibility string
+
+const (
+	VisibilityPublic   Visibility = "public"
+	VisibilityUnlisted Visibility = "unlisted"
+	VisibilityPrivate  Visibility = "private"
+	VisibilityDirect   Visibility = "direct"
+)
+
+// Valid reports whether v is one of the known visibilities.
+func (v Visibility) Valid() bool {
+	switch v {
+	case VisibilityPublic, VisibilityUnlisted, VisibilityPrivate, VisibilityDirect:
+		return true
+	default:
+		return false
+	}
 }
 
-type EndpointID int
+// EndpointID is the name of an endpoint in config.
+// It's also used as the key of endpoint messages in persistent cache, so it should be stable.
+type EndpointID string
+
+// RouteID is the name of a route in config.
+// Each route bridges its own set of endpoints, and has its own ID space in cache.
+type RouteID string
 
 // EndpointMessageID is a unique identifier for endpoint messages in the context of a specific endpoint.
 // We use string for better compatibility.
@@ -22,14 +58,20 @@ type UniqueEndpointMessageID struct {
 	ID  EndpointMessageID
 }
 
+// EndpointMessageRevision is an endpoint message sent by the bridge, along with the timestamp responded by platform API.
+type EndpointMessageRevision struct {
+	ID        EndpointMessageID
+	Timestamp time.Time
+}
+
 func (i UniqueEndpointMessageID) Format(f fmt.State, verb rune) {
 	switch verb {
 	case 's':
-		fmt.Fprintf(f, "%d:%s", i.EID, i.ID)
+		fmt.Fprintf(f, "%s:%s", i.EID, i.ID)
 	case 'q':
-		fmt.Fprintf(f, "%d:%q", i.EID, i.ID)
+		fmt.Fprintf(f, "%s:%q", i.EID, i.ID)
 	default:
-		fmt.Fprintf(f, "UniqueEndpointMessageID{EID: %d, ID: %v}", i.EID, i.ID)
+		fmt.Fprintf(f, "UniqueEndpointMessageID{EID: %s, ID: %v}", i.EID, i.ID)
 	}
 }
 
@@ -41,6 +83,19 @@ const (
 	UpdateTypeDelete
 )
 
+func (t EndpointUpdateType) String() string {
+	switch t {
+	case UpdateTypeNew:
+		return "new"
+	case UpdateTypeEdit:
+		return "edit"
+	case UpdateTypeDelete:
+		return "delete"
+	default:
+		return "unknown"
+	}
+}
+
 // EndpointUpdate is an abstraction of an update received from an endpoint.
 // It can be either new message, edition or deletion.
 type EndpointUpdate struct {
@@ -48,6 +103,8 @@ type EndpointUpdate struct {
 	UniqueEndpointMessageID
 	Content   *BridgeMessageContent
 	Timestamp time.Time
+	// Parent is the message replied to on the same endpoint, it's nil if the message is not a reply.
+	Parent *UniqueEndpointMessageID
 }
 
 type BridgeMessageID int64
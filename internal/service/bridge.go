@@ -5,126 +5,373 @@ import (
 	"errors"
 	"fmt"
 	"log/slog"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/merrkry/tele2don/internal/endpoint"
+	"github.com/merrkry/tele2don/internal/metrics"
 	"github.com/merrkry/tele2don/internal/model"
 )
 
 type BridgeService struct {
 	Cache     BridgeCache
+	Outbox    Outbox
 	Config    *BridgeConfig
+	Endpoints map[model.EndpointID]Endpoint
+	Routes    []*BridgeRoute
+
+	// routesByEndpoint demultiplexes endpoint updates to routes.
+	routesByEndpoint map[model.EndpointID][]*BridgeRoute
+	targets          map[model.EndpointID]*deliveryTarget
+	deliveryLocks    deliveryLocks
+	inFlight         inFlightDeliveries
+	// abandoned counts updates lost during shutdown.
+	abandoned atomic.Int64
+}
+
+// BridgeRoute bridges messages between a subset of endpoints, independently of other routes.
+type BridgeRoute struct {
+	ID        model.RouteID
 	Endpoints []Endpoint
 }
 
-// LoadBridgeService loads configuration and initializes the BridgeService.
-func LoadBridgeService(ctx context.Context) (*BridgeService, error) {
+// LoadBridgeService loads configuration from configPath and initializes the BridgeService.
+func LoadBridgeService(ctx context.Context, configPath string) (*BridgeService, error) {
+	cfg, err := LoadConfig(configPath)
+	if err != nil {
+		return nil, err
+	}
+
 	s := &BridgeService{
-		Cache:  NewBridgeCache(),
-		Config: LoadDevConfig(),
+		Config:           cfg,
+		Endpoints:        make(map[model.EndpointID]Endpoint),
+		routesByEndpoint: make(map[model.EndpointID][]*BridgeRoute),
+		targets:          make(map[model.EndpointID]*deliveryTarget),
+	}
+
+	s.Cache, err = LoadBridgeCache(&s.Config.Cache)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load cache: %w", err)
+	}
+	s.Outbox, err = LoadOutbox(&s.Config.Cache)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load outbox: %w", err)
 	}
 
-	for id, endpointConfig := range s.Config.Endpoints {
-		id := model.EndpointID(id)
+	// Endpoints are set up once, even if they are shared by multiple routes.
+	telegramBots := endpoint.NewTelegramBots()
+	for _, endpointConfig := range s.Config.Endpoints {
+		id := model.EndpointID(endpointConfig.Name)
 		var ep Endpoint
 		switch endpointConfig.Type {
 		case endpoint.EndpointTypeMastodon:
 			ep = endpoint.NewEndpointMastodon(id)
 		case endpoint.EndpointTypeTelegram:
-			ep = endpoint.NewEndpointTelegram(id, endpointConfig.Telegram.ChannelID)
+			ep = endpoint.NewEndpointTelegram(id, endpointConfig.Telegram.ChannelID, telegramBots)
+		case endpoint.EndpointTypeMatrix:
+			ep = endpoint.NewEndpointMatrix(id)
+		case endpoint.EndpointTypeBluesky:
+			ep = endpoint.NewEndpointBluesky(id)
+		case endpoint.EndpointTypeMisskey:
+			ep = endpoint.NewEndpointMisskey(id)
+		case endpoint.EndpointTypeDiscord:
+			ep = endpoint.NewEndpointDiscord(id)
+		case endpoint.EndpointTypeFeed:
+			ep = endpoint.NewEndpointFeed(id)
 		default:
 			return nil, fmt.Errorf("unsupported endpoint type %s", endpointConfig.Type)
 		}
 		err := ep.Initialize(ctx, endpointConfig)
 		if err != nil {
-			return nil, fmt.Errorf("failed to initialize endpoint %d: %w", id, err)
+			return nil, fmt.Errorf("failed to initialize endpoint %s: %w", id, err)
+		}
+		s.Endpoints[id] = ep
+		s.targets[id] = &deliveryTarget{}
+	}
+
+	for _, routeConfig := range s.Config.Routes {
+		route := &BridgeRoute{
+			ID: model.RouteID(routeConfig.Name),
 		}
-		s.Endpoints = append(s.Endpoints, ep)
+		for _, name := range routeConfig.Endpoints {
+			id := model.EndpointID(name)
+			route.Endpoints = append(route.Endpoints, s.Endpoints[id])
+			s.routesByEndpoint[id] = append(s.routesByEndpoint[id], route)
+		}
+		s.Routes = append(s.Routes, route)
 	}
 
 	return s, nil
 }
 
-func (s *BridgeService) Start(ctx context.Context) {
+// Start runs the bridge until ctx is done, then shuts down gracefully.
+// Listeners are stopped first, and updates already received are still applied.
+// Deliveries get ShutdownGracePeriod to finish, after which they are aborted and kept in the outbox.
+// It returns an error if any update was abandoned, i.e. lost for good, or the cache failed to close.
+func (s *BridgeService) Start(ctx context.Context) error {
+	// Deliveries outlive ctx until the grace period is over.
+	deliveryCtx, abort := context.WithCancel(context.WithoutCancel(ctx))
+	defer abort()
+
 	updatesChan := make(chan *model.EndpointUpdate, 128)
-	defer close(updatesChan)
 
-	var wg sync.WaitGroup
-	wg.Add(len(s.Endpoints))
+	defer metrics.NewGaugeFunc("updates_queued", "Updates received but not yet dispatched to workers.", func() float64 {
+		return float64(len(updatesChan))
+	})()
+	defer metrics.NewGaugeFunc("cache_bridge_messages", "Bridge messages tracked in cache.", func() float64 {
+		count, err := s.Cache.CountBridgeMessages()
+		if err != nil {
+			slog.Error("Failed to count bridge messages", "err", err)
+		}
+		return float64(count)
+	})()
+	if s.Config.HTTP.Listen != "" {
+		stopHTTP, err := s.serveHTTP(s.Config.HTTP.Listen)
+		if err != nil {
+			return err
+		}
+		defer stopHTTP()
+	}
 
+	var listenWg, outboxWg sync.WaitGroup
 	for _, endpoint := range s.Endpoints {
 		slog.Info("Starting endpoint", "eid", endpoint.ID())
-		go endpoint.ListenUpdates(ctx, updatesChan, &wg)
+		switch ep := endpoint.(type) {
+		case Listener:
+			listenWg.Add(1)
+			go ep.ListenUpdates(ctx, updatesChan, &listenWg)
+		case Runner:
+			listenWg.Add(1)
+			go ep.Run(ctx, &listenWg)
+		}
+
+		outboxWg.Add(1)
+		go func() {
+			defer outboxWg.Done()
+			s.runOutbox(ctx, deliveryCtx, endpoint.ID())
+		}()
 	}
 
-	// This can be further parallelized with multiple workers.
-	go s.HandleEndpointUpdates(ctx, updatesChan)
+	handlerDone := make(chan struct{})
+	go func() {
+		defer close(handlerDone)
+		s.HandleEndpointUpdates(deliveryCtx, updatesChan)
+	}()
 
-	wg.Wait()
+	<-ctx.Done()
+	slog.Info("Shutting down, waiting for deliveries in flight", "gracePeriod", time.Duration(s.Config.ShutdownGracePeriod))
+
+	drained := make(chan struct{})
+	go func() {
+		defer close(drained)
+		listenWg.Wait()
+		// Nobody sends updates anymore, the handler returns once it applied the remaining ones.
+		close(updatesChan)
+		<-handlerDone
+		outboxWg.Wait()
+	}()
+
+	grace := time.NewTimer(time.Duration(s.Config.ShutdownGracePeriod))
+	defer grace.Stop()
+	select {
+	case <-drained:
+	case <-grace.C:
+		slog.Warn("Shutdown grace period is over, aborting deliveries in flight")
+		abort()
+		<-drained
+	}
+
+	return s.close()
 }
 
+// close flushes and closes the cache and the outbox, and reports updates abandoned during shutdown.
+func (s *BridgeService) close() error {
+	abandoned := s.abandoned.Load()
+	// Deliveries waiting for retry are lost along with the memory outbox.
+	if s.Config.Cache.Type == CacheTypeMemory {
+		deliveries, err := s.Outbox.List()
+		if err == nil {
+			abandoned += int64(len(deliveries))
+		}
+	}
+
+	var errs []error
+	if abandoned > 0 {
+		errs = append(errs, fmt.Errorf("%d updates abandoned during shutdown", abandoned))
+	}
+	err := s.Outbox.Close()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("failed to close outbox: %w", err))
+	}
+	err = s.Cache.Close()
+	if err != nil {
+		errs = append(errs, fmt.Errorf("failed to close cache: %w", err))
+	}
+
+	return errors.Join(errs...)
+}
+
+// routeUpdate is an update to apply within a route, whose bridge message is already resolved.
+type routeUpdate struct {
+	route  *BridgeRoute
+	update *model.EndpointUpdate
+	bid    model.BridgeMessageID
+	flight *inFlightUpdate
+}
+
+// HandleEndpointUpdates resolves bridge messages of updates in the order they are received,
+// so that an edit never misses the message created by the update just before it.
+// Updates are then applied by a pool of workers, keyed by bridge message ID,
+// so that updates of the same message are applied in order while unrelated messages proceed in parallel.
+// Updates of an endpoint are held back while deliveries to it are in flight, so that echoes of messages
+// just posted by the bridge are found in cache instead of being bridged back as new messages.
+// Updates of other endpoints keep flowing meanwhile.
 func (s *BridgeService) HandleEndpointUpdates(ctx context.Context, updatesChan <-chan *model.EndpointUpdate) {
-	for {
+	var wg sync.WaitGroup
+	workers := make([]chan *routeUpdate, s.Config.Workers)
+	for i := range workers {
+		workers[i] = make(chan *routeUpdate, 16)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.runWorker(ctx, workers[i])
+		}()
+	}
+
+	dispatch := func(update *model.EndpointUpdate) {
+		for _, route := range s.routesByEndpoint[update.EID] {
+			bid, routed, ok := s.queryOrCreateBridgeMessage(route, update)
+			if !ok {
+				continue
+			}
+			var targets []model.EndpointID
+			for _, endpoint := range route.Endpoints {
+				if endpoint.ID() != update.EID {
+					targets = append(targets, endpoint.ID())
+				}
+			}
+			flight := s.inFlight.begin(bid, routed.Type, targets)
+			workers[int(bid)%len(workers)] <- &routeUpdate{route: route, update: routed, bid: bid, flight: flight}
+		}
+	}
+
+	// held keeps updates of endpoints with deliveries in flight, in the order they were received.
+	held := make(map[model.EndpointID][]*model.EndpointUpdate)
+	release := func() {
+		for eid, queue := range held {
+			for len(queue) > 0 && !s.inFlight.busy(eid) {
+				dispatch(queue[0])
+				queue = queue[1:]
+			}
+			if len(queue) == 0 {
+				delete(held, eid)
+			} else {
+				held[eid] = queue
+			}
+		}
+	}
+
+	// Updates are applied until updatesChan is closed, even after ctx is done,
+	// so that deliveries aborted by shutdown are kept in the outbox instead of being dropped.
+	for updatesChan != nil || len(held) > 0 {
 		select {
-		case <-ctx.Done():
-			return
-		case update := <-updatesChan:
+		case update, ok := <-updatesChan:
+			if !ok {
+				updatesChan = nil
+				continue
+			}
 			if update == nil {
 				continue
 			}
+			metrics.UpdatesReceived.WithLabelValues(string(update.EID), update.Type.String()).Inc()
+			metrics.LastEvent.WithLabelValues(string(update.EID)).SetToCurrentTime()
 
-			bid, ok := s.queryOrCreateBridgeMessage(update)
-			if !ok {
+			if len(held[update.EID]) > 0 || s.inFlight.busy(update.EID) {
+				held[update.EID] = append(held[update.EID], update)
 				continue
 			}
+			dispatch(update)
 
-			slog.Debug("Processing endpoint update", "bid", bid, "uniqueID", update.UniqueEndpointMessageID, "type", update.Type, "timestamp", update.Timestamp)
+		case <-s.inFlight.idle():
+			release()
+		}
+	}
 
-			switch update.Type {
-			case model.UpdateTypeNew:
-				s.applyUpdateNew(ctx, update, bid)
+	for _, worker := range workers {
+		close(worker)
+	}
+	wg.Wait()
+}
 
-			case model.UpdateTypeEdit:
-				s.applyUpdateEdit(ctx, update, bid)
+func (s *BridgeService) runWorker(ctx context.Context, updates <-chan *routeUpdate) {
+	for u := range updates {
+		s.handleRouteUpdate(ctx, u.route, u.update, u.bid, u.flight)
+		u.flight.finish()
+	}
+}
 
-			case model.UpdateTypeDelete:
-				slog.Error("Message deletion not supported yet.")
+func (s *BridgeService) handleRouteUpdate(ctx context.Context, route *BridgeRoute, update *model.EndpointUpdate, bid model.BridgeMessageID, flight *inFlightUpdate) {
+	slog.Debug("Processing endpoint update", "route", route.ID, "bid", bid, "uniqueID", update.UniqueEndpointMessageID, "type", update.Type, "timestamp", update.Timestamp)
 
-			default:
-				panic(fmt.Sprintf("Unknown update type %d for %q", update.Type, update.UniqueEndpointMessageID))
-			}
-		}
+	switch update.Type {
+	case model.UpdateTypeNew:
+		s.applyUpdateNew(ctx, route, update, bid, flight)
+
+	case model.UpdateTypeEdit:
+		s.applyUpdateEdit(ctx, route, update, bid, flight)
+
+	case model.UpdateTypeDelete:
+		s.applyUpdateDelete(ctx, route, update, bid, flight)
+
+	default:
+		panic(fmt.Sprintf("Unknown update type %d for %q", update.Type, update.UniqueEndpointMessageID))
 	}
 }
 
 // queryOrCreateBridgeMessage queries the cache for an existing bridge message ID or creates a new one if it doesn't exist.
-// The second return value only indicates if the message should be processed further.
+// It returns the update to apply, and whether the message should be processed further.
+// Messages received again as new ones, e.g. fetched by backfill after reconnecting, are applied as edits
+// if they changed since they were bridged, and dropped otherwise.
 // In case of invalid internal state, query/create will fail, it will panic.
-func (s *BridgeService) queryOrCreateBridgeMessage(update *model.EndpointUpdate) (model.BridgeMessageID, bool) {
+func (s *BridgeService) queryOrCreateBridgeMessage(route *BridgeRoute, update *model.EndpointUpdate) (model.BridgeMessageID, *model.EndpointUpdate, bool) {
 	var bid model.BridgeMessageID
 
-	time, err := s.Cache.QueryRevision(update.UniqueEndpointMessageID)
+	time, err := s.Cache.QueryRevision(route.ID, update.UniqueEndpointMessageID)
 	if err == nil {
-		if time.Equal(update.Timestamp) { // Already tracked message
-			return 0, false
+		if time.Equal(update.Timestamp) || (update.Type == model.UpdateTypeNew && update.Timestamp.Before(time)) { // Already tracked message
+			metrics.UpdatesDropped.WithLabelValues(string(route.ID), string(update.EID), "duplicate").Inc()
+			return 0, nil, false
 		}
-		bid, err = s.Cache.QueryBridgeMessageID(update.UniqueEndpointMessageID)
+		if update.Type == model.UpdateTypeNew {
+			edit := *update
+			edit.Type = model.UpdateTypeEdit
+			// The parent is only used when creating messages.
+			edit.Parent = nil
+			update = &edit
+		}
+		bid, err = s.Cache.QueryBridgeMessageID(route.ID, update.UniqueEndpointMessageID)
 		if err != nil {
 			panic(fmt.Sprintf("Failed to query bridge message ID for %q: %v", update.UniqueEndpointMessageID, err))
 		}
-		err = s.Cache.UpdateEndpointMessage(update.UniqueEndpointMessageID, update.Timestamp)
+		err = s.Cache.UpdateEndpointMessage(route.ID, update.UniqueEndpointMessageID, update.Timestamp)
 		if err != nil {
 			panic(fmt.Sprintf("Failed to update endpoint message for %q: %v", update.UniqueEndpointMessageID, err))
 		}
 	} else if errors.Is(err, ErrMessageNotFound) {
 		if update.Type == model.UpdateTypeNew {
-			bid = s.Cache.NewBridgeMessage()
-			err := s.Cache.CreateEndpointMessage(update.UniqueEndpointMessageID, bid, update.Timestamp)
+			bid, err = s.Cache.NewBridgeMessage()
+			if err != nil {
+				panic(fmt.Sprintf("Failed to create bridge message for %q: %v", update.UniqueEndpointMessageID, err))
+			}
+			err = s.Cache.CreateEndpointMessage(route.ID, update.UniqueEndpointMessageID, bid, update.Timestamp)
 			if err != nil {
 				panic(fmt.Sprintf("Failed to create endpoint message for %q: %v", update.UniqueEndpointMessageID, err))
 			}
 		} else { // Message is older than our state, ignore it
-			return 0, false
+			metrics.UpdatesDropped.WithLabelValues(string(route.ID), string(update.EID), "unknown_message").Inc()
+			return 0, nil, false
 		}
 	} else {
 		panic(fmt.Sprintf("Failed to query revision for %q: %v", update.UniqueEndpointMessageID, err))
@@ -134,57 +381,131 @@ func (s *BridgeService) queryOrCreateBridgeMessage(update *model.EndpointUpdate)
 		panic(fmt.Sprintf("Failed to retrieve or generate bridge message ID for %q", update.UniqueEndpointMessageID))
 	}
 
-	return bid, true
+	return bid, update, true
 }
 
-func (s *BridgeService) applyUpdateNew(ctx context.Context, update *model.EndpointUpdate, bid model.BridgeMessageID) {
-	for eid, endpoint := range s.Endpoints {
-		if endpoint.ID() == update.EID {
-			continue
+func (s *BridgeService) applyUpdateNew(ctx context.Context, route *BridgeRoute, update *model.EndpointUpdate, bid model.BridgeMessageID, flight *inFlightUpdate) {
+	// Wait for the parent to be bridged, which might be handled by another worker, so that the reply can be threaded.
+	// The parent was dispatched before, so this never waits for the worker itself.
+	if update.Parent != nil {
+		parentBid, err := s.Cache.QueryBridgeMessageID(route.ID, *update.Parent)
+		if err == nil {
+			s.inFlight.waitNew(parentBid)
 		}
-		eid := model.EndpointID(eid)
+	}
 
-		updateCtx, cancel := context.WithTimeout(ctx, s.Config.RequestTimeout)
-		defer cancel()
+	s.deliverAll(ctx, route, update, bid, flight)
+}
 
-		id, rev, err := endpoint.ApplyUpdateNew(updateCtx, update.Content)
-		if err != nil {
-			slog.Error("Failed to apply update to endpoint", "eid", endpoint.ID(), "err", err)
+// deliverAll delivers update to other endpoints of route concurrently, so that a slow endpoint doesn't hold up the others.
+// Each target is marked as finished in flight as soon as its own delivery is.
+func (s *BridgeService) deliverAll(ctx context.Context, route *BridgeRoute, update *model.EndpointUpdate, bid model.BridgeMessageID, flight *inFlightUpdate) {
+	var wg sync.WaitGroup
+	for _, endpoint := range route.Endpoints {
+		if endpoint.ID() == update.EID {
 			continue
 		}
-		err = s.Cache.CreateEndpointMessage(model.UniqueEndpointMessageID{
-			EID: eid,
-			ID:  id,
-		}, bid, rev)
-		if err != nil {
-			panic(fmt.Sprintf("Failed to create endpoint message for %q: %v", id, err))
-		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.deliver(ctx, route, endpoint.ID(), bid, update)
+			flight.finishTarget(endpoint.ID())
+		}()
 	}
+	wg.Wait()
 }
 
-func (s *BridgeService) applyUpdateEdit(ctx context.Context, update *model.EndpointUpdate, bid model.BridgeMessageID) {
-	associatedMessages, err := s.Cache.QueryEndpointMessages(bid)
-	if err != nil {
-		panic(fmt.Sprintf("Failed to query associated messages for bridge message ID %d: %v", bid, err))
+// queryParentMessages returns all endpoint messages bridged from the parent of update, so that replies are bridged as replies.
+// It returns nil if update is not a reply, or its parent is not tracked in cache.
+func (s *BridgeService) queryParentMessages(route *BridgeRoute, update *model.EndpointUpdate) []model.UniqueEndpointMessageID {
+	if update.Parent == nil {
+		return nil
 	}
 
-	for _, uniqueID := range associatedMessages {
-		if uniqueID.EID == update.UniqueEndpointMessageID.EID {
-			continue
-		}
+	parentBid, err := s.Cache.QueryBridgeMessageID(route.ID, *update.Parent)
+	if errors.Is(err, ErrMessageNotFound) {
+		slog.Debug("Parent message is not bridged, sending as a standalone message", "uniqueID", update.UniqueEndpointMessageID, "parent", *update.Parent)
+		return nil
+	} else if err != nil {
+		panic(fmt.Sprintf("Failed to query bridge message ID for parent %q: %v", *update.Parent, err))
+	}
 
-		ctx, cancel := context.WithTimeout(ctx, s.Config.RequestTimeout)
-		defer cancel()
+	parentMessages, err := s.Cache.QueryEndpointMessages(parentBid)
+	if errors.Is(err, ErrMessageNotFound) { // Parent deleted concurrently
+		return nil
+	} else if err != nil {
+		panic(fmt.Sprintf("Failed to query associated messages for bridge message ID %d: %v", parentBid, err))
+	}
 
-		rev, err := s.Endpoints[uniqueID.EID].ApplyUpdateEdit(ctx, uniqueID.ID, update.Content)
-		if err != nil {
-			slog.Error("Failed to apply update edit to endpoint", "eid", uniqueID.EID, "id", uniqueID.ID, "err", err)
-			continue
+	return parentMessages
+}
+
+func (s *BridgeService) applyUpdateEdit(ctx context.Context, route *BridgeRoute, update *model.EndpointUpdate, bid model.BridgeMessageID, flight *inFlightUpdate) {
+	// Content of a single part can't be merged back into the whole message.
+	if len(s.queryTargetMessages(bid, update.EID)) > 1 {
+		slog.Warn("Ignoring edit of a split message", "bid", bid, "uniqueID", update.UniqueEndpointMessageID)
+		return
+	}
+
+	s.deliverAll(ctx, route, update, bid, flight)
+}
+
+// syncEditedMessages updates cache with messages of an endpoint after edition.
+// Content might be split differently after edition, so messages might have been added or removed.
+func (s *BridgeService) syncEditedMessages(route *BridgeRoute, bid model.BridgeMessageID, eid model.EndpointID, ids []model.EndpointMessageID, revisions []model.EndpointMessageRevision) {
+	edited := make(map[model.EndpointMessageID]bool)
+	for _, revision := range revisions {
+		uniqueID := model.UniqueEndpointMessageID{
+			EID: eid,
+			ID:  revision.ID,
 		}
 
-		err = s.Cache.UpdateEndpointMessage(uniqueID, rev)
+		var err error
+		if slices.Contains(ids, revision.ID) {
+			err = s.Cache.UpdateEndpointMessage(route.ID, uniqueID, revision.Timestamp)
+		} else {
+			err = s.Cache.CreateEndpointMessage(route.ID, uniqueID, bid, revision.Timestamp)
+		}
 		if err != nil {
 			panic(fmt.Sprintf("Failed to update endpoint message for %q: %v", uniqueID, err))
 		}
+		edited[revision.ID] = true
+	}
+
+	for _, id := range ids {
+		if edited[id] {
+			continue
+		}
+		uniqueID := model.UniqueEndpointMessageID{
+			EID: eid,
+			ID:  id,
+		}
+		err := s.Cache.DeleteEndpointMessage(route.ID, uniqueID)
+		if err != nil {
+			panic(fmt.Sprintf("Failed to delete endpoint message for %q: %v", uniqueID, err))
+		}
 	}
 }
+
+// applyUpdateDelete deletes messages of bid on every endpoint, including other parts of a split source message.
+// Failed deletions are queued in the outbox, bid is only dropped once none is pending.
+func (s *BridgeService) applyUpdateDelete(ctx context.Context, route *BridgeRoute, update *model.EndpointUpdate, bid model.BridgeMessageID, flight *inFlightUpdate) {
+	// The source message is gone, so that its deletion echoed back is a no-op.
+	err := s.Cache.DeleteEndpointMessage(route.ID, update.UniqueEndpointMessageID)
+	if err != nil && !errors.Is(err, ErrMessageNotFound) {
+		panic(fmt.Sprintf("Failed to delete endpoint message for %q: %v", update.UniqueEndpointMessageID, err))
+	}
+
+	var wg sync.WaitGroup
+	for _, endpoint := range route.Endpoints {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.deliver(ctx, route, endpoint.ID(), bid, update)
+			flight.finishTarget(endpoint.ID())
+		}()
+	}
+	wg.Wait()
+
+	s.finishDeletion(route, bid)
+}
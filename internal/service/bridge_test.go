@@ -0,0 +1,316 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/merrkry/tele2don/internal/config"
+	"github.com/merrkry/tele2don/internal/endpoint"
+	"github.com/merrkry/tele2don/internal/model"
+)
+
+// fakeEndpoint records messages posted to it, and echoes them back like streaming APIs do,
+// before ApplyUpdateNew returns.
+type fakeEndpoint struct {
+	id      model.EndpointID
+	updates chan<- *model.EndpointUpdate
+	delay   time.Duration
+	// err fails every delivery if set.
+	err error
+	// block holds deliveries until it's closed, if set.
+	block chan struct{}
+	// deleteErr fails every deletion if set.
+	deleteErr error
+
+	mu      sync.Mutex
+	nextID  int
+	posted  []*model.BridgeMessageContent
+	edited  []*model.BridgeMessageContent
+	replies map[model.EndpointMessageID]model.EndpointMessageID
+	deleted []model.EndpointMessageID
+	echoed  int
+}
+
+func (e *fakeEndpoint) ID() model.EndpointID { return e.id }
+
+func (e *fakeEndpoint) Initialize(context.Context, *endpoint.EndpointConfig) error { return nil }
+
+func (e *fakeEndpoint) ApplyUpdateNew(ctx context.Context, content *model.BridgeMessageContent, replyTo model.EndpointMessageID) ([]model.EndpointMessageRevision, error) {
+	if e.err != nil {
+		return nil, e.err
+	}
+	if e.block != nil {
+		select {
+		case <-e.block:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	e.mu.Lock()
+	e.nextID++
+	id := model.EndpointMessageID(fmt.Sprint(e.nextID))
+	e.posted = append(e.posted, content)
+	e.replies[id] = replyTo
+	e.mu.Unlock()
+
+	now := time.Now()
+	e.updates <- &model.EndpointUpdate{
+		Type:                    model.UpdateTypeNew,
+		UniqueEndpointMessageID: model.UniqueEndpointMessageID{EID: e.id, ID: id},
+		Content:                 content,
+		Timestamp:               now,
+	}
+	e.mu.Lock()
+	e.echoed++
+	e.mu.Unlock()
+	time.Sleep(e.delay)
+
+	return []model.EndpointMessageRevision{{ID: id, Timestamp: now}}, nil
+}
+
+func (e *fakeEndpoint) ApplyUpdateEdit(ctx context.Context, ids []model.EndpointMessageID, content *model.BridgeMessageContent) ([]model.EndpointMessageRevision, error) {
+	if e.err != nil {
+		return nil, e.err
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.edited = append(e.edited, content)
+	revisions := make([]model.EndpointMessageRevision, 0, len(ids))
+	for _, id := range ids {
+		revisions = append(revisions, model.EndpointMessageRevision{ID: id, Timestamp: time.Now()})
+	}
+	return revisions, nil
+}
+
+func (e *fakeEndpoint) ApplyUpdateDelete(ctx context.Context, id model.EndpointMessageID) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.deleteErr != nil {
+		return e.deleteErr
+	}
+	e.deleted = append(e.deleted, id)
+	return nil
+}
+
+func (e *fakeEndpoint) Status() endpoint.Status { return endpoint.Status{} }
+
+func (e *fakeEndpoint) postedCount() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return len(e.posted)
+}
+
+// waitEchoes waits until n messages posted to e were echoed, so that updates can be closed afterwards.
+func (e *fakeEndpoint) waitEchoes(t *testing.T, n int) {
+	t.Helper()
+	var echoed int
+	for range 100 {
+		e.mu.Lock()
+		echoed = e.echoed
+		e.mu.Unlock()
+		if echoed >= n {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("%d messages were echoed by %s, want %d", echoed, e.id, n)
+}
+
+func newTestBridge(t *testing.T, updates chan<- *model.EndpointUpdate, eids ...model.EndpointID) (*BridgeService, map[model.EndpointID]*fakeEndpoint) {
+	t.Helper()
+
+	s := &BridgeService{
+		Cache:  NewBridgeCache(),
+		Outbox: NewOutbox(),
+		Config: &BridgeConfig{
+			RequestTimeout: config.Duration(time.Second),
+			MediaTimeout:   config.Duration(time.Minute),
+			Workers:        4,
+		},
+		Endpoints:        make(map[model.EndpointID]Endpoint),
+		routesByEndpoint: make(map[model.EndpointID][]*BridgeRoute),
+		targets:          make(map[model.EndpointID]*deliveryTarget),
+	}
+	fakes := make(map[model.EndpointID]*fakeEndpoint)
+	route := &BridgeRoute{ID: "test"}
+	for _, eid := range eids {
+		fake := &fakeEndpoint{
+			id:      eid,
+			updates: updates,
+			delay:   50 * time.Millisecond,
+			replies: make(map[model.EndpointMessageID]model.EndpointMessageID),
+		}
+		fakes[eid] = fake
+		s.Endpoints[eid] = fake
+		s.targets[eid] = &deliveryTarget{}
+		route.Endpoints = append(route.Endpoints, fake)
+		s.routesByEndpoint[eid] = []*BridgeRoute{route}
+	}
+	s.Routes = []*BridgeRoute{route}
+
+	return s, fakes
+}
+
+func TestEchoesAreNotBridgedBack(t *testing.T) {
+	updates := make(chan *model.EndpointUpdate, 16)
+	s, fakes := newTestBridge(t, updates, "a", "b")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.HandleEndpointUpdates(context.Background(), updates)
+	}()
+
+	updates <- &model.EndpointUpdate{
+		Type:                    model.UpdateTypeNew,
+		UniqueEndpointMessageID: model.UniqueEndpointMessageID{EID: "a", ID: "source"},
+		Content:                 &model.BridgeMessageContent{MDText: "hello"},
+		Timestamp:               time.Now(),
+	}
+
+	// Updates left are still handled after close.
+	fakes["b"].waitEchoes(t, 1)
+	close(updates)
+	<-done
+
+	if got := fakes["b"].postedCount(); got != 1 {
+		t.Errorf("posted %d messages to b, want 1", got)
+	}
+	if got := fakes["a"].postedCount(); got != 0 {
+		t.Errorf("echo of b was bridged back to a %d times", got)
+	}
+}
+
+func TestSlowEndpointDoesNotHoldUpOthers(t *testing.T) {
+	updates := make(chan *model.EndpointUpdate, 16)
+	s, fakes := newTestBridge(t, updates, "x", "y", "z")
+	// The stuck delivery must not time out during the test.
+	s.Config.RequestTimeout = config.Duration(time.Minute)
+	fakes["x"].block = make(chan struct{})
+	unblock := sync.OnceFunc(func() { close(fakes["x"].block) })
+	defer unblock()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.HandleEndpointUpdates(context.Background(), updates)
+	}()
+
+	post := func(eid model.EndpointID, id model.EndpointMessageID) {
+		updates <- &model.EndpointUpdate{
+			Type:                    model.UpdateTypeNew,
+			UniqueEndpointMessageID: model.UniqueEndpointMessageID{EID: eid, ID: id},
+			Content:                 &model.BridgeMessageContent{MDText: string(id)},
+			Timestamp:               time.Now(),
+		}
+	}
+	// The delivery to x is stuck, so updates of x are held back until it finishes.
+	post("z", "first")
+	fakes["y"].waitEchoes(t, 1)
+	post("x", "held")
+	// An unrelated update of y goes through meanwhile.
+	post("y", "unrelated")
+	fakes["z"].waitEchoes(t, 1)
+	if got := fakes["z"].postedCount(); got != 1 {
+		t.Errorf("posted %d messages to z while x is stuck, want 1", got)
+	}
+
+	unblock()
+	fakes["z"].waitEchoes(t, 2)
+	close(updates)
+	<-done
+
+	z := fakes["z"]
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	if len(z.posted) != 2 || z.posted[0].MDText != "unrelated" || z.posted[1].MDText != "held" {
+		t.Errorf("posted %v to z, want the unrelated message followed by the held one", z.posted)
+	}
+}
+
+func TestRepliesWaitForParent(t *testing.T) {
+	updates := make(chan *model.EndpointUpdate, 16)
+	s, fakes := newTestBridge(t, updates, "a", "b")
+	fakes["b"].delay = 200 * time.Millisecond
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.HandleEndpointUpdates(context.Background(), updates)
+	}()
+
+	parent := model.UniqueEndpointMessageID{EID: "a", ID: "parent"}
+	updates <- &model.EndpointUpdate{
+		Type:                    model.UpdateTypeNew,
+		UniqueEndpointMessageID: parent,
+		Content:                 &model.BridgeMessageContent{MDText: "parent"},
+		Timestamp:               time.Now(),
+	}
+	updates <- &model.EndpointUpdate{
+		Type:                    model.UpdateTypeNew,
+		UniqueEndpointMessageID: model.UniqueEndpointMessageID{EID: "a", ID: "reply"},
+		Content:                 &model.BridgeMessageContent{MDText: "reply"},
+		Timestamp:               time.Now(),
+		Parent:                  &parent,
+	}
+
+	fakes["b"].waitEchoes(t, 2)
+	close(updates)
+	<-done
+
+	b := fakes["b"]
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.posted) != 2 {
+		t.Fatalf("posted %d messages to b, want 2", len(b.posted))
+	}
+	if replyTo := b.replies["2"]; replyTo != "1" {
+		t.Errorf("reply posted in reply to %q, want %q", replyTo, "1")
+	}
+}
+
+func TestRefetchedMessagesAreAppliedAsEdits(t *testing.T) {
+	updates := make(chan *model.EndpointUpdate, 16)
+	s, fakes := newTestBridge(t, updates, "a", "b")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.HandleEndpointUpdates(context.Background(), updates)
+	}()
+
+	created := time.Now().Add(-time.Hour)
+	edited := created.Add(time.Minute)
+	status := func(text string, timestamp time.Time) *model.EndpointUpdate {
+		return &model.EndpointUpdate{
+			Type:                    model.UpdateTypeNew,
+			UniqueEndpointMessageID: model.UniqueEndpointMessageID{EID: "a", ID: "status"},
+			Content:                 &model.BridgeMessageContent{MDText: text},
+			Timestamp:               timestamp,
+		}
+	}
+	updates <- status("original", created)
+	fakes["b"].waitEchoes(t, 1)
+
+	// Fetched again by backfill, unchanged, then edited while disconnected, then stale again.
+	updates <- status("original", created)
+	updates <- status("edited", edited)
+	updates <- status("original", created)
+	close(updates)
+	<-done
+
+	b := fakes["b"]
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.posted) != 1 {
+		t.Errorf("posted %d messages to b, want 1", len(b.posted))
+	}
+	if len(b.edited) != 1 || b.edited[0].MDText != "edited" {
+		t.Errorf("edits of b = %v, want the edited content once", b.edited)
+	}
+}
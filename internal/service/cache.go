@@ -2,6 +2,8 @@ package service
 
 import (
 	"errors"
+	"fmt"
+	"slices"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -14,42 +16,70 @@ var (
 	ErrMessageAlreadyExists = errors.New("message already exists in cache")
 )
 
+// BridgeCache tracks endpoint messages of each bridge message.
+// Endpoint messages are scoped by route, as an endpoint can be shared by multiple routes,
+// while bridge message IDs are unique across routes.
 type BridgeCache interface {
-	QueryRevision(m.UniqueEndpointMessageID) (time.Time, error)
-	QueryBridgeMessageID(m.UniqueEndpointMessageID) (m.BridgeMessageID, error)
-	NewBridgeMessage() m.BridgeMessageID
-	CreateEndpointMessage(m.UniqueEndpointMessageID, m.BridgeMessageID, time.Time) error
-	UpdateEndpointMessage(m.UniqueEndpointMessageID, time.Time) error
+	QueryRevision(m.RouteID, m.UniqueEndpointMessageID) (time.Time, error)
+	QueryBridgeMessageID(m.RouteID, m.UniqueEndpointMessageID) (m.BridgeMessageID, error)
+	NewBridgeMessage() (m.BridgeMessageID, error)
+	CreateEndpointMessage(m.RouteID, m.UniqueEndpointMessageID, m.BridgeMessageID, time.Time) error
+	UpdateEndpointMessage(m.RouteID, m.UniqueEndpointMessageID, time.Time) error
+	// DeleteEndpointMessage removes a single endpoint message, keeping the bridge message and its other endpoint messages.
+	DeleteEndpointMessage(m.RouteID, m.UniqueEndpointMessageID) error
 	QueryEndpointMessages(m.BridgeMessageID) ([]m.UniqueEndpointMessageID, error)
+	// DeleteBridgeMessage removes the bridge message along with all associated endpoint messages.
+	DeleteBridgeMessage(m.BridgeMessageID) error
+	// CountBridgeMessages returns the number of bridge messages tracked.
+	CountBridgeMessages() (int, error)
+	// Close flushes pending writes and releases the underlying storage.
+	Close() error
+}
+
+// LoadBridgeCache creates the BridgeCache implementation chosen in config.
+func LoadBridgeCache(cfg *CacheConfig) (BridgeCache, error) {
+	switch cfg.Type {
+	case CacheTypeMemory:
+		return NewBridgeCache(), nil
+	case CacheTypeSQLite:
+		return NewSQLiteBridgeCache(cfg.SQLitePath)
+	default:
+		return nil, fmt.Errorf("unsupported cache type %s", cfg.Type)
+	}
 }
 
 func NewBridgeCache() BridgeCache {
 	return &nativeMemoryCache{
-		associatedMessages: make(map[m.BridgeMessageID][]m.UniqueEndpointMessageID),
-		endpointMessages:   make(map[m.UniqueEndpointMessageID]*cachedEndpointMessage),
+		associatedMessages: make(map[m.BridgeMessageID][]routeMessageID),
+		endpointMessages:   make(map[routeMessageID]*cachedEndpointMessage),
 	}
 }
 
 // TODO: cache expiration
 type nativeMemoryCache struct {
-	associatedMessages map[m.BridgeMessageID][]m.UniqueEndpointMessageID
-	endpointMessages   map[m.UniqueEndpointMessageID]*cachedEndpointMessage
+	associatedMessages map[m.BridgeMessageID][]routeMessageID
+	endpointMessages   map[routeMessageID]*cachedEndpointMessage
 
 	idCounter int64
-	// We might have multiple bridge goroutine in the future.
+	// Accessed concurrently by bridge workers.
 	mu sync.RWMutex
 }
 
+type routeMessageID struct {
+	route m.RouteID
+	m.UniqueEndpointMessageID
+}
+
 type cachedEndpointMessage struct {
 	rev time.Time
 	bid m.BridgeMessageID
 }
 
-func (c *nativeMemoryCache) QueryRevision(id m.UniqueEndpointMessageID) (time.Time, error) {
+func (c *nativeMemoryCache) QueryRevision(route m.RouteID, id m.UniqueEndpointMessageID) (time.Time, error) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
-	msg, ok := c.endpointMessages[id]
+	msg, ok := c.endpointMessages[routeMessageID{route, id}]
 	if ok {
 		return msg.rev, nil
 	} else {
@@ -57,11 +87,11 @@ func (c *nativeMemoryCache) QueryRevision(id m.UniqueEndpointMessageID) (time.Ti
 	}
 }
 
-func (c *nativeMemoryCache) QueryBridgeMessageID(id m.UniqueEndpointMessageID) (m.BridgeMessageID, error) {
+func (c *nativeMemoryCache) QueryBridgeMessageID(route m.RouteID, id m.UniqueEndpointMessageID) (m.BridgeMessageID, error) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
-	msg, ok := c.endpointMessages[id]
+	msg, ok := c.endpointMessages[routeMessageID{route, id}]
 	if ok {
 		return msg.bid, nil
 	} else {
@@ -69,33 +99,38 @@ func (c *nativeMemoryCache) QueryBridgeMessageID(id m.UniqueEndpointMessageID) (
 	}
 }
 
-func (c *nativeMemoryCache) NewBridgeMessage() m.BridgeMessageID {
+func (c *nativeMemoryCache) NewBridgeMessage() (m.BridgeMessageID, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	bid := m.BridgeMessageID(atomic.AddInt64(&c.idCounter, 1))
-	c.associatedMessages[bid] = []m.UniqueEndpointMessageID{}
-	return bid
+	c.associatedMessages[bid] = []routeMessageID{}
+	return bid, nil
 }
 
-func (c *nativeMemoryCache) CreateEndpointMessage(emid m.UniqueEndpointMessageID, bmid m.BridgeMessageID, rev time.Time) error {
+func (c *nativeMemoryCache) CreateEndpointMessage(route m.RouteID, emid m.UniqueEndpointMessageID, bmid m.BridgeMessageID, rev time.Time) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	// TOOD: internal status validation
-
-	c.endpointMessages[emid] = &cachedEndpointMessage{
+	key := routeMessageID{route, emid}
+	if _, ok := c.endpointMessages[key]; ok {
+		return ErrMessageAlreadyExists
+	}
+	c.endpointMessages[key] = &cachedEndpointMessage{
 		rev: rev,
 		bid: bmid,
 	}
 
-	c.associatedMessages[bmid] = append(c.associatedMessages[bmid], emid)
+	c.associatedMessages[bmid] = append(c.associatedMessages[bmid], key)
 
 	return nil
 }
 
-func (c *nativeMemoryCache) UpdateEndpointMessage(emid m.UniqueEndpointMessageID, rev time.Time) error {
+func (c *nativeMemoryCache) UpdateEndpointMessage(route m.RouteID, emid m.UniqueEndpointMessageID, rev time.Time) error {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	msg, ok := c.endpointMessages[emid]
+	msg, ok := c.endpointMessages[routeMessageID{route, emid}]
 	if !ok {
 		return ErrMessageNotFound
 	}
@@ -108,14 +143,63 @@ func (c *nativeMemoryCache) UpdateEndpointMessage(emid m.UniqueEndpointMessageID
 	return nil
 }
 
+func (c *nativeMemoryCache) DeleteEndpointMessage(route m.RouteID, emid m.UniqueEndpointMessageID) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := routeMessageID{route, emid}
+	msg, ok := c.endpointMessages[key]
+	if !ok {
+		return ErrMessageNotFound
+	}
+
+	delete(c.endpointMessages, key)
+	c.associatedMessages[msg.bid] = slices.DeleteFunc(c.associatedMessages[msg.bid], func(k routeMessageID) bool { return k == key })
+
+	return nil
+}
+
 func (c *nativeMemoryCache) QueryEndpointMessages(bid m.BridgeMessageID) ([]m.UniqueEndpointMessageID, error) {
 	c.mu.RLock()
 	defer c.mu.RUnlock()
 
-	msgs, ok := c.associatedMessages[bid]
+	keys, ok := c.associatedMessages[bid]
 	if !ok {
 		return nil, ErrMessageNotFound
 	}
 
+	msgs := make([]m.UniqueEndpointMessageID, 0, len(keys))
+	for _, key := range keys {
+		msgs = append(msgs, key.UniqueEndpointMessageID)
+	}
+
 	return msgs, nil
 }
+
+func (c *nativeMemoryCache) DeleteBridgeMessage(bid m.BridgeMessageID) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	keys, ok := c.associatedMessages[bid]
+	if !ok {
+		return ErrMessageNotFound
+	}
+
+	for _, key := range keys {
+		delete(c.endpointMessages, key)
+	}
+	delete(c.associatedMessages, bid)
+
+	return nil
+}
+
+func (c *nativeMemoryCache) CountBridgeMessages() (int, error) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	return len(c.associatedMessages), nil
+}
+
+func (c *nativeMemoryCache) Close() error {
+	return nil
+}
@@ -0,0 +1,345 @@
+package service
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"sync"
+	"time"
+
+	m "github.com/merrkry/tele2don/internal/model"
+
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// sqliteMigrations are applied in order, PRAGMA user_version records how many of them have been applied.
+// Never modify existing entries, append new ones instead.
+var sqliteMigrations = []string{
+	`CREATE TABLE bridge_messages (
+		id INTEGER PRIMARY KEY AUTOINCREMENT
+	);
+	CREATE TABLE endpoint_messages (
+		endpoint_id       INTEGER NOT NULL,
+		message_id        TEXT    NOT NULL,
+		bridge_message_id INTEGER NOT NULL REFERENCES bridge_messages (id) ON DELETE CASCADE,
+		revision          INTEGER NOT NULL,
+		PRIMARY KEY (endpoint_id, message_id)
+	);
+	CREATE INDEX endpoint_messages_bridge_message_id ON endpoint_messages (bridge_message_id);`,
+	// Scope endpoint messages by route, and identify endpoints by name.
+	// Existing rows belong to the implicit default route, whose endpoints are named by their index in config.
+	`CREATE TABLE endpoint_messages_new (
+		route_id          TEXT    NOT NULL,
+		endpoint_id       TEXT    NOT NULL,
+		message_id        TEXT    NOT NULL,
+		bridge_message_id INTEGER NOT NULL REFERENCES bridge_messages (id) ON DELETE CASCADE,
+		revision          INTEGER NOT NULL,
+		PRIMARY KEY (route_id, endpoint_id, message_id)
+	);
+	INSERT INTO endpoint_messages_new (route_id, endpoint_id, message_id, bridge_message_id, revision)
+		SELECT 'default', CAST(endpoint_id AS TEXT), message_id, bridge_message_id, revision
+		FROM endpoint_messages ORDER BY rowid;
+	DROP TABLE endpoint_messages;
+	ALTER TABLE endpoint_messages_new RENAME TO endpoint_messages;
+	CREATE INDEX endpoint_messages_bridge_message_id ON endpoint_messages (bridge_message_id);`,
+	// Outbox of failed deliveries, see sqliteOutbox.
+	`CREATE TABLE outbox (
+		id                INTEGER PRIMARY KEY AUTOINCREMENT,
+		route_id          TEXT    NOT NULL,
+		target_id         TEXT    NOT NULL,
+		bridge_message_id INTEGER NOT NULL REFERENCES bridge_messages (id) ON DELETE CASCADE,
+		payload           TEXT    NOT NULL,
+		attempts          INTEGER NOT NULL,
+		next_attempt      INTEGER NOT NULL,
+		last_error        TEXT    NOT NULL,
+		dead              INTEGER NOT NULL,
+		UNIQUE (bridge_message_id, target_id)
+	);
+	CREATE INDEX outbox_target_id_next_attempt ON outbox (target_id, next_attempt);`,
+}
+
+// sqliteCache is a persistent BridgeCache, so message mappings survive restarts.
+// Revisions are stored as unix nanoseconds.
+type sqliteCache struct {
+	db *sql.DB
+}
+
+func NewSQLiteBridgeCache(path string) (BridgeCache, error) {
+	db, err := openSQLite(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sqliteCache{db: db}, nil
+}
+
+// sharedSQLite is a database opened by both the cache and the outbox.
+type sharedSQLite struct {
+	db   *sql.DB
+	refs int
+}
+
+// sqliteDBs are the databases open in the process by path, shared so that the cache and the outbox
+// don't compete for locks of the same file.
+var sqliteDBs = struct {
+	mu  sync.Mutex
+	dbs map[string]*sharedSQLite
+}{dbs: make(map[string]*sharedSQLite)}
+
+// openSQLite opens the database at path, and migrates it to the latest schema.
+// It's shared with other callers in the process until each of them calls closeSQLite.
+func openSQLite(path string) (*sql.DB, error) {
+	key, err := filepath.Abs(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sqlite database %s: %w", path, err)
+	}
+
+	sqliteDBs.mu.Lock()
+	defer sqliteDBs.mu.Unlock()
+
+	if shared, ok := sqliteDBs.dbs[key]; ok {
+		shared.refs++
+		return shared.db, nil
+	}
+
+	// Foreign keys are disabled by default in SQLite, and the setting is per connection.
+	dsn := "file:" + url.PathEscape(path) + "?_pragma=foreign_keys(1)&_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open sqlite database %s: %w", path, err)
+	}
+	// Writes are serialized by SQLite anyway, a single connection makes them wait in turn instead of failing as busy.
+	db.SetMaxOpenConns(1)
+
+	err = migrateSQLite(db)
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to migrate sqlite database %s: %w", path, err)
+	}
+
+	sqliteDBs.dbs[key] = &sharedSQLite{db: db, refs: 1}
+	return db, nil
+}
+
+// closeSQLite releases db opened by openSQLite, and closes it once nobody else uses it.
+func closeSQLite(db *sql.DB) error {
+	sqliteDBs.mu.Lock()
+	defer sqliteDBs.mu.Unlock()
+
+	for key, shared := range sqliteDBs.dbs {
+		if shared.db != db {
+			continue
+		}
+		shared.refs--
+		if shared.refs > 0 {
+			return nil
+		}
+		delete(sqliteDBs.dbs, key)
+		break
+	}
+
+	return db.Close()
+}
+
+// isUniqueViolation reports whether err is caused by a UNIQUE or PRIMARY KEY constraint.
+func isUniqueViolation(err error) bool {
+	var sqliteErr *sqlite.Error
+	if !errors.As(err, &sqliteErr) {
+		return false
+	}
+	return sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE || sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY
+}
+
+func migrateSQLite(db *sql.DB) error {
+	var version int
+	err := db.QueryRow("PRAGMA user_version").Scan(&version)
+	if err != nil {
+		return err
+	}
+
+	if version > len(sqliteMigrations) {
+		return fmt.Errorf("database schema version %d is newer than supported version %d", version, len(sqliteMigrations))
+	}
+
+	for i := version; i < len(sqliteMigrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(sqliteMigrations[i])
+		if err == nil {
+			// PRAGMA doesn't support placeholders.
+			_, err = tx.Exec(fmt.Sprintf("PRAGMA user_version = %d", i+1))
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (c *sqliteCache) QueryRevision(route m.RouteID, id m.UniqueEndpointMessageID) (time.Time, error) {
+	var rev int64
+	err := c.db.QueryRow(
+		"SELECT revision FROM endpoint_messages WHERE route_id = ? AND endpoint_id = ? AND message_id = ?",
+		route, id.EID, id.ID,
+	).Scan(&rev)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, ErrMessageNotFound
+	} else if err != nil {
+		return time.Time{}, err
+	}
+
+	return time.Unix(0, rev), nil
+}
+
+func (c *sqliteCache) QueryBridgeMessageID(route m.RouteID, id m.UniqueEndpointMessageID) (m.BridgeMessageID, error) {
+	var bid int64
+	err := c.db.QueryRow(
+		"SELECT bridge_message_id FROM endpoint_messages WHERE route_id = ? AND endpoint_id = ? AND message_id = ?",
+		route, id.EID, id.ID,
+	).Scan(&bid)
+	if errors.Is(err, sql.ErrNoRows) {
+		return m.BridgeMessageID(0), ErrMessageNotFound
+	} else if err != nil {
+		return m.BridgeMessageID(0), err
+	}
+
+	return m.BridgeMessageID(bid), nil
+}
+
+func (c *sqliteCache) NewBridgeMessage() (m.BridgeMessageID, error) {
+	res, err := c.db.Exec("INSERT INTO bridge_messages DEFAULT VALUES")
+	if err != nil {
+		return m.BridgeMessageID(0), err
+	}
+
+	bid, err := res.LastInsertId()
+	if err != nil {
+		return m.BridgeMessageID(0), err
+	}
+
+	return m.BridgeMessageID(bid), nil
+}
+
+func (c *sqliteCache) CreateEndpointMessage(route m.RouteID, emid m.UniqueEndpointMessageID, bmid m.BridgeMessageID, rev time.Time) error {
+	_, err := c.db.Exec(
+		"INSERT INTO endpoint_messages (route_id, endpoint_id, message_id, bridge_message_id, revision) VALUES (?, ?, ?, ?, ?)",
+		route, emid.EID, emid.ID, bmid, rev.UnixNano(),
+	)
+	if isUniqueViolation(err) {
+		return ErrMessageAlreadyExists
+	}
+	return err
+}
+
+func (c *sqliteCache) UpdateEndpointMessage(route m.RouteID, emid m.UniqueEndpointMessageID, rev time.Time) error {
+	res, err := c.db.Exec(
+		"UPDATE endpoint_messages SET revision = max(revision, ?) WHERE route_id = ? AND endpoint_id = ? AND message_id = ?",
+		rev.UnixNano(), route, emid.EID, emid.ID,
+	)
+	if err != nil {
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrMessageNotFound
+	}
+
+	return nil
+}
+
+func (c *sqliteCache) DeleteEndpointMessage(route m.RouteID, emid m.UniqueEndpointMessageID) error {
+	res, err := c.db.Exec(
+		"DELETE FROM endpoint_messages WHERE route_id = ? AND endpoint_id = ? AND message_id = ?",
+		route, emid.EID, emid.ID,
+	)
+	if err != nil {
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrMessageNotFound
+	}
+
+	return nil
+}
+
+func (c *sqliteCache) QueryEndpointMessages(bid m.BridgeMessageID) ([]m.UniqueEndpointMessageID, error) {
+	var exists bool
+	err := c.db.QueryRow("SELECT EXISTS (SELECT 1 FROM bridge_messages WHERE id = ?)", bid).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, ErrMessageNotFound
+	}
+
+	rows, err := c.db.Query(
+		"SELECT endpoint_id, message_id FROM endpoint_messages WHERE bridge_message_id = ? ORDER BY rowid",
+		bid,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	msgs := []m.UniqueEndpointMessageID{}
+	for rows.Next() {
+		var id m.UniqueEndpointMessageID
+		err = rows.Scan(&id.EID, &id.ID)
+		if err != nil {
+			return nil, err
+		}
+		msgs = append(msgs, id)
+	}
+
+	return msgs, rows.Err()
+}
+
+func (c *sqliteCache) DeleteBridgeMessage(bid m.BridgeMessageID) error {
+	// Associated endpoint messages are removed by ON DELETE CASCADE.
+	res, err := c.db.Exec("DELETE FROM bridge_messages WHERE id = ?", bid)
+	if err != nil {
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrMessageNotFound
+	}
+
+	return nil
+}
+
+func (c *sqliteCache) CountBridgeMessages() (int, error) {
+	var count int
+	err := c.db.QueryRow("SELECT COUNT(*) FROM bridge_messages").Scan(&count)
+	return count, err
+}
+
+func (c *sqliteCache) Close() error {
+	return closeSQLite(c.db)
+}
@@ -0,0 +1,417 @@
+package service
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	m "github.com/merrkry/tele2don/internal/model"
+)
+
+// cacheConformance checks the behavior every BridgeCache implementation must share.
+func cacheConformance(t *testing.T, newCache func(t *testing.T) BridgeCache) {
+	t.Helper()
+
+	msg := func(eid, id string) m.UniqueEndpointMessageID {
+		return m.UniqueEndpointMessageID{EID: m.EndpointID(eid), ID: m.EndpointMessageID(id)}
+	}
+	rev := func(n int64) time.Time {
+		return time.Unix(1700000000, n)
+	}
+	mustBridgeMessage := func(t *testing.T, c BridgeCache) m.BridgeMessageID {
+		t.Helper()
+		bid, err := c.NewBridgeMessage()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return bid
+	}
+	mustCreate := func(t *testing.T, c BridgeCache, route m.RouteID, id m.UniqueEndpointMessageID, bid m.BridgeMessageID, r time.Time) {
+		t.Helper()
+		err := c.CreateEndpointMessage(route, id, bid, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	wantMessages := func(t *testing.T, c BridgeCache, bid m.BridgeMessageID, want ...m.UniqueEndpointMessageID) {
+		t.Helper()
+		got, err := c.QueryEndpointMessages(bid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(got, want) {
+			t.Errorf("QueryEndpointMessages(%d) = %v, want %v", bid, got, want)
+		}
+	}
+
+	t.Run("unknown messages", func(t *testing.T) {
+		c := newCache(t)
+		_, err := c.QueryRevision("r", msg("a", "1"))
+		if !errors.Is(err, ErrMessageNotFound) {
+			t.Errorf("QueryRevision: got %v, want ErrMessageNotFound", err)
+		}
+		_, err = c.QueryBridgeMessageID("r", msg("a", "1"))
+		if !errors.Is(err, ErrMessageNotFound) {
+			t.Errorf("QueryBridgeMessageID: got %v, want ErrMessageNotFound", err)
+		}
+		err = c.UpdateEndpointMessage("r", msg("a", "1"), rev(0))
+		if !errors.Is(err, ErrMessageNotFound) {
+			t.Errorf("UpdateEndpointMessage: got %v, want ErrMessageNotFound", err)
+		}
+		err = c.DeleteEndpointMessage("r", msg("a", "1"))
+		if !errors.Is(err, ErrMessageNotFound) {
+			t.Errorf("DeleteEndpointMessage: got %v, want ErrMessageNotFound", err)
+		}
+		_, err = c.QueryEndpointMessages(42)
+		if !errors.Is(err, ErrMessageNotFound) {
+			t.Errorf("QueryEndpointMessages: got %v, want ErrMessageNotFound", err)
+		}
+		err = c.DeleteBridgeMessage(42)
+		if !errors.Is(err, ErrMessageNotFound) {
+			t.Errorf("DeleteBridgeMessage: got %v, want ErrMessageNotFound", err)
+		}
+	})
+
+	t.Run("new bridge messages", func(t *testing.T) {
+		c := newCache(t)
+		first := mustBridgeMessage(t, c)
+		second := mustBridgeMessage(t, c)
+		if first == 0 || second == 0 || first == second {
+			t.Errorf("NewBridgeMessage returned %d and %d, want distinct non-zero IDs", first, second)
+		}
+		// A bridge message exists before any endpoint message is sent.
+		wantMessages(t, c, first)
+
+		count, err := c.CountBridgeMessages()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 2 {
+			t.Errorf("CountBridgeMessages() = %d, want 2", count)
+		}
+	})
+
+	t.Run("create and query", func(t *testing.T) {
+		c := newCache(t)
+		bid := mustBridgeMessage(t, c)
+		mustCreate(t, c, "r", msg("a", "1"), bid, rev(1))
+		mustCreate(t, c, "r", msg("b", "2"), bid, rev(2))
+		mustCreate(t, c, "r", msg("b", "3"), bid, rev(3))
+
+		got, err := c.QueryRevision("r", msg("b", "2"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got.Equal(rev(2)) {
+			t.Errorf("QueryRevision() = %v, want %v", got, rev(2))
+		}
+		gotBid, err := c.QueryBridgeMessageID("r", msg("b", "3"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if gotBid != bid {
+			t.Errorf("QueryBridgeMessageID() = %d, want %d", gotBid, bid)
+		}
+		// Messages are returned in the order they were created, so that split messages keep their order.
+		wantMessages(t, c, bid, msg("a", "1"), msg("b", "2"), msg("b", "3"))
+
+		err = c.CreateEndpointMessage("r", msg("a", "1"), bid, rev(4))
+		if !errors.Is(err, ErrMessageAlreadyExists) {
+			t.Errorf("CreateEndpointMessage of existing message: got %v, want ErrMessageAlreadyExists", err)
+		}
+	})
+
+	t.Run("routes", func(t *testing.T) {
+		c := newCache(t)
+		first := mustBridgeMessage(t, c)
+		second := mustBridgeMessage(t, c)
+		// The same endpoint message is tracked by each route on its own.
+		mustCreate(t, c, "r1", msg("a", "1"), first, rev(1))
+		mustCreate(t, c, "r2", msg("a", "1"), second, rev(2))
+
+		for route, want := range map[m.RouteID]m.BridgeMessageID{"r1": first, "r2": second} {
+			got, err := c.QueryBridgeMessageID(route, msg("a", "1"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != want {
+				t.Errorf("QueryBridgeMessageID(%s) = %d, want %d", route, got, want)
+			}
+		}
+		_, err := c.QueryRevision("r3", msg("a", "1"))
+		if !errors.Is(err, ErrMessageNotFound) {
+			t.Errorf("QueryRevision of another route: got %v, want ErrMessageNotFound", err)
+		}
+	})
+
+	t.Run("update revision", func(t *testing.T) {
+		c := newCache(t)
+		bid := mustBridgeMessage(t, c)
+		mustCreate(t, c, "r", msg("a", "1"), bid, rev(5))
+
+		err := c.UpdateEndpointMessage("r", msg("a", "1"), rev(7))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Revisions never go back, updates might arrive out of order.
+		err = c.UpdateEndpointMessage("r", msg("a", "1"), rev(6))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := c.QueryRevision("r", msg("a", "1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got.Equal(rev(7)) {
+			t.Errorf("QueryRevision() = %v, want %v", got, rev(7))
+		}
+	})
+
+	t.Run("delete endpoint message", func(t *testing.T) {
+		c := newCache(t)
+		bid := mustBridgeMessage(t, c)
+		mustCreate(t, c, "r", msg("a", "1"), bid, rev(1))
+		mustCreate(t, c, "r", msg("b", "2"), bid, rev(2))
+
+		err := c.DeleteEndpointMessage("r", msg("b", "2"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantMessages(t, c, bid, msg("a", "1"))
+		_, err = c.QueryRevision("r", msg("b", "2"))
+		if !errors.Is(err, ErrMessageNotFound) {
+			t.Errorf("QueryRevision of deleted message: got %v, want ErrMessageNotFound", err)
+		}
+
+		// The bridge message is kept even without endpoint messages.
+		err = c.DeleteEndpointMessage("r", msg("a", "1"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		wantMessages(t, c, bid)
+	})
+
+	t.Run("delete bridge message", func(t *testing.T) {
+		c := newCache(t)
+		bid := mustBridgeMessage(t, c)
+		other := mustBridgeMessage(t, c)
+		mustCreate(t, c, "r", msg("a", "1"), bid, rev(1))
+		mustCreate(t, c, "r", msg("b", "2"), bid, rev(2))
+		mustCreate(t, c, "r", msg("a", "3"), other, rev(3))
+
+		err := c.DeleteBridgeMessage(bid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = c.QueryEndpointMessages(bid)
+		if !errors.Is(err, ErrMessageNotFound) {
+			t.Errorf("QueryEndpointMessages of deleted bridge message: got %v, want ErrMessageNotFound", err)
+		}
+		for _, id := range []m.UniqueEndpointMessageID{msg("a", "1"), msg("b", "2")} {
+			_, err = c.QueryBridgeMessageID("r", id)
+			if !errors.Is(err, ErrMessageNotFound) {
+				t.Errorf("QueryBridgeMessageID(%s) of deleted bridge message: got %v, want ErrMessageNotFound", id, err)
+			}
+		}
+		wantMessages(t, c, other, msg("a", "3"))
+
+		count, err := c.CountBridgeMessages()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if count != 1 {
+			t.Errorf("CountBridgeMessages() = %d, want 1", count)
+		}
+	})
+}
+
+func TestMemoryCache(t *testing.T) {
+	cacheConformance(t, func(t *testing.T) BridgeCache {
+		return NewBridgeCache()
+	})
+}
+
+func newTestSQLiteCache(t *testing.T, path string) BridgeCache {
+	t.Helper()
+	c, err := NewSQLiteBridgeCache(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+func TestSQLiteCache(t *testing.T) {
+	cacheConformance(t, func(t *testing.T) BridgeCache {
+		return newTestSQLiteCache(t, filepath.Join(t.TempDir(), "cache.db"))
+	})
+}
+
+func TestSQLiteCachePersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.db")
+	id := m.UniqueEndpointMessageID{EID: "a", ID: "1"}
+
+	c, err := NewSQLiteBridgeCache(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bid, err := c.NewBridgeMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.CreateEndpointMessage("r", id, bid, time.Unix(0, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c = newTestSQLiteCache(t, path)
+	got, err := c.QueryBridgeMessageID("r", id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != bid {
+		t.Errorf("QueryBridgeMessageID() after reopening = %d, want %d", got, bid)
+	}
+}
+
+func TestSQLiteCacheSharedWithOutbox(t *testing.T) {
+	// Characters with a meaning in URIs are escaped in the DSN.
+	path := filepath.Join(t.TempDir(), "cache #1?.db")
+	c, err := NewSQLiteBridgeCache(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o, err := NewSQLiteOutbox(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+	if _, err := os.Stat(path); err != nil {
+		t.Fatalf("database not created at %s: %v", path, err)
+	}
+
+	// Writes of the cache and the outbox don't fail as busy.
+	var wg sync.WaitGroup
+	errs := make(chan error, 100)
+	for i := range 50 {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			bid, err := c.NewBridgeMessage()
+			if err == nil {
+				err = c.CreateEndpointMessage("r", m.UniqueEndpointMessageID{EID: "a", ID: m.EndpointMessageID(fmt.Sprint(i))}, bid, time.Now())
+			}
+			if err == nil {
+				err = o.Enqueue(&Delivery{Route: "r", Target: "b", BID: bid, Update: &m.EndpointUpdate{}})
+			}
+			errs <- err
+		}()
+		go func() {
+			defer wg.Done()
+			_, err := o.List()
+			errs <- err
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Closing the cache leaves the outbox usable.
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	deliveries, err := o.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deliveries) != 50 {
+		t.Errorf("listed %d deliveries, want 50", len(deliveries))
+	}
+	if err := o.Enqueue(&Delivery{Route: "r", Target: "b", BID: deliveries[0].BID, Update: &m.EndpointUpdate{}}); err == nil {
+		t.Error("Enqueue of a second delivery of the same message to the same target succeeded")
+	}
+}
+
+func TestSQLiteCacheMigration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.db")
+
+	// A database written before routes existed, where endpoints were identified by their index in config.
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, stmt := range []string{
+		sqliteMigrations[0],
+		"PRAGMA user_version = 1",
+		"INSERT INTO bridge_messages (id) VALUES (7)",
+		"INSERT INTO endpoint_messages (endpoint_id, message_id, bridge_message_id, revision) VALUES (0, '100', 7, 5)",
+		"INSERT INTO endpoint_messages (endpoint_id, message_id, bridge_message_id, revision) VALUES (1, '200', 7, 6)",
+	} {
+		_, err = db.Exec(stmt)
+		if err != nil {
+			t.Fatalf("%s: %v", stmt, err)
+		}
+	}
+	err = db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := newTestSQLiteCache(t, path)
+	msgs, err := c.QueryEndpointMessages(7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []m.UniqueEndpointMessageID{{EID: "0", ID: "100"}, {EID: "1", ID: "200"}}
+	if !slices.Equal(msgs, want) {
+		t.Errorf("QueryEndpointMessages() = %v, want %v", msgs, want)
+	}
+	revision, err := c.QueryRevision(defaultRouteName, want[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !revision.Equal(time.Unix(0, 6)) {
+		t.Errorf("QueryRevision() = %v, want %v", revision, time.Unix(0, 6))
+	}
+
+	// The migrated database behaves like a new one.
+	bid, err := c.NewBridgeMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bid <= 7 {
+		t.Errorf("NewBridgeMessage() = %d, want an ID after existing ones", bid)
+	}
+}
+
+func TestSQLiteCacheNewerSchema(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cache.db")
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("PRAGMA user_version = 1000")
+	if err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	_, err = NewSQLiteBridgeCache(path)
+	if err == nil {
+		t.Error("NewSQLiteBridgeCache succeeded on a database of a newer version")
+	}
+}
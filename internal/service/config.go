@@ -1,42 +1,197 @@
 package service
 
 import (
-	"net/url"
-	"os"
+	"errors"
+	"fmt"
+	"net"
 	"strconv"
 	"time"
 
+	"github.com/merrkry/tele2don/internal/config"
 	"github.com/merrkry/tele2don/internal/endpoint"
 )
 
+type CacheType string
+
+const (
+	CacheTypeMemory CacheType = "memory"
+	CacheTypeSQLite CacheType = "sqlite"
+)
+
+type CacheConfig struct {
+	Type       CacheType `json:"type"`
+	SQLitePath string    `json:"sqlite_path"`
+}
+
+// HTTPConfig enables an HTTP listener serving Prometheus metrics at /metrics, and health checks at /healthz and /readyz.
+type HTTPConfig struct {
+	// Listen is the address to listen on, e.g. "127.0.0.1:9464". The listener is disabled if empty.
+	Listen string `json:"listen"`
+	// StaleAfter is how long an endpoint listener may go without heartbeat before the bridge is reported unready.
+	StaleAfter config.Duration `json:"stale_after"`
+}
+
+// defaultRouteName is used when no route is configured, so that all endpoints are bridged together.
+const defaultRouteName = "default"
+
+// RouteConfig defines an independent bridge between a set of endpoints.
+type RouteConfig struct {
+	Name      string   `json:"name"`
+	Endpoints []string `json:"endpoints"`
+}
+
 type BridgeConfig struct {
 	Endpoints      []*endpoint.EndpointConfig `json:"endpoints"`
-	RequestTimeout time.Duration
+	Routes         []*RouteConfig             `json:"routes"`
+	Cache          CacheConfig                `json:"cache"`
+	HTTP           HTTPConfig                 `json:"http"`
+	RequestTimeout config.Duration            `json:"request_timeout"`
+	// MediaTimeout replaces RequestTimeout for deliveries with attachments, as transferring media takes a while.
+	MediaTimeout config.Duration `json:"media_timeout"`
+	// Workers is the number of bridge messages processed in parallel.
+	Workers int `json:"workers"`
+	// ShutdownGracePeriod is how long deliveries in flight may take to finish on shutdown.
+	ShutdownGracePeriod config.Duration `json:"shutdown_grace_period"`
 }
 
-// LoadDevConfig returns a temporary config for debug only
-func LoadDevConfig() *BridgeConfig {
-	mastodonURL, _ := url.Parse(os.Getenv("MASTODON_SERVER"))
-	telegramChannelID, _ := strconv.ParseInt(os.Getenv("TELEGRAM_CHANNEL_ID"), 10, 64)
-	return &BridgeConfig{
-		Endpoints: []*endpoint.EndpointConfig{
-			{
-				Type: endpoint.EndpointTypeMastodon,
-				Mastodon: &endpoint.EndpointConfigMastodon{
-					InstanceURL:  *mastodonURL,
-					ClientID:     os.Getenv("MASTODON_CLIENT_ID"),
-					ClientSecret: os.Getenv("MASTODON_CLIENT_SECRET"),
-					AccessToken:  os.Getenv("MASTODON_ACCESS_TOKEN"),
-				},
-			},
-			{
-				Type: endpoint.EndpointTypeTelegram,
-				Telegram: &endpoint.EndpointConfigTelegram{
-					BotToken:  os.Getenv("TELEGRAM_BOT_TOKEN"),
-					ChannelID: telegramChannelID,
-				},
-			},
+// LoadConfig reads BridgeConfig from a TOML, YAML or JSON file, and validates it.
+func LoadConfig(path string) (*BridgeConfig, error) {
+	cfg := &BridgeConfig{
+		Cache: CacheConfig{
+			Type: CacheTypeMemory,
+		},
+		RequestTimeout:      config.Duration(10 * time.Second),
+		MediaTimeout:        config.Duration(5 * time.Minute),
+		Workers:             8,
+		ShutdownGracePeriod: config.Duration(30 * time.Second),
+		HTTP: HTTPConfig{
+			StaleAfter: config.Duration(5 * time.Minute),
 		},
-		RequestTimeout: 10 * time.Second,
 	}
+
+	err := config.Load(path, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config: %w", err)
+	}
+
+	cfg.applyDefaults()
+
+	err = cfg.validate()
+	if err != nil {
+		return nil, fmt.Errorf("invalid config: %w", err)
+	}
+
+	return cfg, nil
+}
+
+func (c *BridgeConfig) applyDefaults() {
+	for i, endpointConfig := range c.Endpoints {
+		if endpointConfig != nil && endpointConfig.Name == "" {
+			endpointConfig.Name = strconv.Itoa(i)
+		}
+	}
+
+	if len(c.Routes) == 0 {
+		route := &RouteConfig{Name: defaultRouteName}
+		for _, endpointConfig := range c.Endpoints {
+			if endpointConfig != nil {
+				route.Endpoints = append(route.Endpoints, endpointConfig.Name)
+			}
+		}
+		c.Routes = []*RouteConfig{route}
+	}
+}
+
+func (c *BridgeConfig) validate() error {
+	if len(c.Endpoints) < 2 {
+		return errors.New("endpoints: at least 2 endpoints are required")
+	}
+	endpointNames := make(map[string]bool)
+	endpointTargets := make(map[string]string)
+	for i, endpointConfig := range c.Endpoints {
+		if endpointConfig == nil {
+			return fmt.Errorf("endpoints[%d]: must not be empty", i)
+		}
+		if endpointNames[endpointConfig.Name] {
+			return fmt.Errorf("endpoints[%d].name: duplicated name %q", i, endpointConfig.Name)
+		}
+		endpointNames[endpointConfig.Name] = true
+		err := endpointConfig.Validate()
+		if err != nil {
+			return fmt.Errorf("endpoints[%d].%w", i, err)
+		}
+		// The same chat or account should be a single endpoint referenced by multiple routes instead.
+		target := endpointConfig.Target()
+		if name, ok := endpointTargets[target]; ok {
+			return fmt.Errorf("endpoints[%d]: same %s target as endpoint %q", i, endpointConfig.Type, name)
+		}
+		endpointTargets[target] = endpointConfig.Name
+	}
+
+	usedEndpoints := make(map[string]bool)
+	routeNames := make(map[string]bool)
+	for i, route := range c.Routes {
+		if route == nil || route.Name == "" {
+			return fmt.Errorf("routes[%d].name: required", i)
+		}
+		if routeNames[route.Name] {
+			return fmt.Errorf("routes[%d].name: duplicated name %q", i, route.Name)
+		}
+		routeNames[route.Name] = true
+
+		if len(route.Endpoints) < 2 {
+			return fmt.Errorf("routes[%d].endpoints: at least 2 endpoints are required", i)
+		}
+		routeEndpoints := make(map[string]bool)
+		for j, name := range route.Endpoints {
+			if !endpointNames[name] {
+				return fmt.Errorf("routes[%d].endpoints[%d]: unknown endpoint %q", i, j, name)
+			}
+			if routeEndpoints[name] {
+				return fmt.Errorf("routes[%d].endpoints[%d]: duplicated endpoint %q", i, j, name)
+			}
+			routeEndpoints[name] = true
+			usedEndpoints[name] = true
+		}
+	}
+	for i, endpointConfig := range c.Endpoints {
+		if !usedEndpoints[endpointConfig.Name] {
+			return fmt.Errorf("endpoints[%d]: endpoint %q is not used by any route", i, endpointConfig.Name)
+		}
+	}
+
+	switch c.Cache.Type {
+	case CacheTypeMemory:
+	case CacheTypeSQLite:
+		if c.Cache.SQLitePath == "" {
+			return errors.New("cache.sqlite_path: required for cache type sqlite")
+		}
+	default:
+		return fmt.Errorf("cache.type: unsupported cache type %q", c.Cache.Type)
+	}
+
+	if c.HTTP.Listen != "" {
+		_, _, err := net.SplitHostPort(c.HTTP.Listen)
+		if err != nil {
+			return fmt.Errorf("http.listen: %w", err)
+		}
+	}
+	if c.HTTP.StaleAfter <= 0 {
+		return errors.New("http.stale_after: must be positive")
+	}
+
+	if c.RequestTimeout <= 0 {
+		return errors.New("request_timeout: must be positive")
+	}
+	if c.MediaTimeout <= 0 {
+		return errors.New("media_timeout: must be positive")
+	}
+	if c.Workers <= 0 {
+		return errors.New("workers: must be positive")
+	}
+	if c.ShutdownGracePeriod < 0 {
+		return errors.New("shutdown_grace_period: must not be negative")
+	}
+
+	return nil
 }
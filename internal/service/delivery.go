@@ -0,0 +1,568 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/merrkry/tele2don/internal/endpoint"
+	"github.com/merrkry/tele2don/internal/metrics"
+	"github.com/merrkry/tele2don/internal/model"
+)
+
+const (
+	outboxPollInterval = 5 * time.Second
+	outboxMinBackoff   = 10 * time.Second
+	outboxMaxBackoff   = time.Hour
+	// Deliveries are moved to dead letters after this many failed attempts. Rate limited attempts don't count.
+	outboxMaxAttempts = 10
+)
+
+// deliveryTarget tracks the rate limit of an endpoint.
+// Deliveries are queued without being attempted until pausedUntil.
+type deliveryTarget struct {
+	mu          sync.Mutex
+	pausedUntil time.Time
+}
+
+func (t *deliveryTarget) paused() (time.Time, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.pausedUntil, time.Now().Before(t.pausedUntil)
+}
+
+func (t *deliveryTarget) pause(until time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pausedUntil = until
+}
+
+// deliveryKey identifies deliveries of a bridge message to a target.
+type deliveryKey struct {
+	bid    model.BridgeMessageID
+	target model.EndpointID
+}
+
+// deliveryLocks serializes deliveries of the same bridge message to the same target,
+// so that retries don't race with updates handled meanwhile. Unrelated deliveries proceed concurrently.
+type deliveryLocks struct {
+	mu    sync.Mutex
+	locks map[deliveryKey]*deliveryLock
+}
+
+type deliveryLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// lock locks key, and returns the function to unlock it. Locks are dropped once nobody holds or waits for them.
+func (l *deliveryLocks) lock(key deliveryKey) func() {
+	l.mu.Lock()
+	if l.locks == nil {
+		l.locks = make(map[deliveryKey]*deliveryLock)
+	}
+	entry, ok := l.locks[key]
+	if !ok {
+		entry = &deliveryLock{}
+		l.locks[key] = entry
+	}
+	entry.refs++
+	l.mu.Unlock()
+
+	entry.mu.Lock()
+	return func() {
+		entry.mu.Unlock()
+
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		entry.refs--
+		if entry.refs == 0 {
+			delete(l.locks, key)
+		}
+	}
+}
+
+// inFlightDeliveries tracks updates handed to workers or retried from the outbox that are not finished yet.
+// Messages posted by a delivery are only recorded in cache once it finishes, until then their echoes
+// can't be told apart from new messages, and replies to them can't be threaded.
+type inFlightDeliveries struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+	// targets counts deliveries to each endpoint.
+	targets map[model.EndpointID]int
+	// news counts deliveries of new bridge messages.
+	news map[model.BridgeMessageID]int
+	// idleChan is signaled when no more deliveries to an endpoint are in flight.
+	idleChan chan struct{}
+}
+
+func (f *inFlightDeliveries) init() {
+	if f.cond == nil {
+		f.cond = sync.NewCond(&f.mu)
+		f.targets = make(map[model.EndpointID]int)
+		f.news = make(map[model.BridgeMessageID]int)
+		f.idleChan = make(chan struct{}, 1)
+	}
+}
+
+// inFlightUpdate is an update handed to a worker, whose deliveries to each target might finish at different times.
+type inFlightUpdate struct {
+	f          *inFlightDeliveries
+	bid        model.BridgeMessageID
+	updateType model.EndpointUpdateType
+	// targets are the endpoints the update is still being delivered to, guarded by f.mu.
+	targets []model.EndpointID
+}
+
+// begin marks bid as being delivered to targets, until the returned update is finished.
+func (f *inFlightDeliveries) begin(bid model.BridgeMessageID, updateType model.EndpointUpdateType, targets []model.EndpointID) *inFlightUpdate {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.init()
+
+	for _, target := range targets {
+		f.targets[target]++
+	}
+	if updateType == model.UpdateTypeNew {
+		f.news[bid]++
+	}
+
+	return &inFlightUpdate{f: f, bid: bid, updateType: updateType, targets: slices.Clone(targets)}
+}
+
+// finishTarget marks the delivery to target as finished, so that updates of target are no longer held back by it.
+// It does nothing on a nil update, e.g. for deliveries not dispatched through HandleEndpointUpdates.
+func (u *inFlightUpdate) finishTarget(target model.EndpointID) {
+	if u == nil {
+		return
+	}
+	u.f.mu.Lock()
+	defer u.f.mu.Unlock()
+
+	i := slices.Index(u.targets, target)
+	if i < 0 {
+		return
+	}
+	u.targets = slices.Delete(u.targets, i, i+1)
+	u.f.release(target)
+}
+
+// finish marks the update as finished, along with deliveries to targets not finished yet.
+func (u *inFlightUpdate) finish() {
+	u.f.mu.Lock()
+	defer u.f.mu.Unlock()
+
+	for _, target := range u.targets {
+		u.f.release(target)
+	}
+	u.targets = nil
+	if u.updateType == model.UpdateTypeNew {
+		u.f.news[u.bid]--
+		if u.f.news[u.bid] == 0 {
+			delete(u.f.news, u.bid)
+		}
+	}
+	u.f.cond.Broadcast()
+}
+
+// release counts a delivery to target as finished. The caller must hold mu.
+func (f *inFlightDeliveries) release(target model.EndpointID) {
+	f.targets[target]--
+	if f.targets[target] > 0 {
+		return
+	}
+	delete(f.targets, target)
+	select {
+	case f.idleChan <- struct{}{}:
+	default:
+	}
+}
+
+// busy reports whether a delivery to target is in flight.
+func (f *inFlightDeliveries) busy(target model.EndpointID) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.init()
+
+	return f.targets[target] > 0
+}
+
+// idle returns a channel receiving a value whenever an endpoint might have become idle.
+// Signals are coalesced, so receivers should check every endpoint they wait for.
+func (f *inFlightDeliveries) idle() <-chan struct{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.init()
+
+	return f.idleChan
+}
+
+// waitNew blocks until bid is no longer being delivered as a new message.
+func (f *inFlightDeliveries) waitNew(bid model.BridgeMessageID) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.init()
+
+	for f.news[bid] > 0 {
+		f.cond.Wait()
+	}
+}
+
+// deliver applies an update to target, and queues it in the outbox if that fails.
+func (s *BridgeService) deliver(ctx context.Context, route *BridgeRoute, target model.EndpointID, bid model.BridgeMessageID, update *model.EndpointUpdate) {
+	defer s.deliveryLocks.lock(deliveryKey{bid, target})()
+
+	// Later updates wait behind a pending delivery, which is sent with the latest content.
+	// A deletion supersedes it instead, unless it's a deletion as well.
+	pending, err := s.Outbox.Pending(bid, target)
+	if err == nil && update.Type == model.UpdateTypeDelete && pending.Update.Type != model.UpdateTypeDelete {
+		err = s.Outbox.Remove(pending.ID)
+		if err != nil && !errors.Is(err, ErrDeliveryNotFound) {
+			panic(fmt.Sprintf("Failed to remove delivery %d: %v", pending.ID, err))
+		}
+		err = ErrDeliveryNotFound
+	}
+	if err == nil {
+		if update.Type == model.UpdateTypeEdit && pending.Update.Type != model.UpdateTypeDelete {
+			pendingUpdate := *pending.Update
+			pendingUpdate.Content = update.Content
+			pendingUpdate.Timestamp = update.Timestamp
+			pending.Update = &pendingUpdate
+			s.updateDelivery(pending)
+		}
+		return
+	} else if !errors.Is(err, ErrDeliveryNotFound) {
+		panic(fmt.Sprintf("Failed to query pending delivery of bridge message %d to %s: %v", bid, target, err))
+	}
+
+	// Nothing to edit or delete if the message was never bridged to target.
+	if update.Type != model.UpdateTypeNew && len(s.queryTargetMessages(bid, target)) == 0 {
+		return
+	}
+
+	d := &Delivery{
+		Route:  route.ID,
+		Target: target,
+		BID:    bid,
+		Update: update,
+	}
+	if until, ok := s.targets[target].paused(); ok {
+		d.NextAttempt = until
+		d.LastError = "endpoint is rate limited"
+		s.updateDelivery(d)
+		return
+	}
+
+	err = s.attemptDelivery(ctx, route, d)
+	if err != nil {
+		s.handleDeliveryFailure(ctx, d, err)
+	}
+}
+
+// attemptDelivery applies d, recording metrics of the attempt.
+func (s *BridgeService) attemptDelivery(ctx context.Context, route *BridgeRoute, d *Delivery) error {
+	labels := []string{string(d.Target), d.Update.Type.String()}
+	metrics.DeliveriesAttempted.WithLabelValues(labels...).Inc()
+	start := time.Now()
+
+	err := s.applyDelivery(ctx, route, d)
+
+	metrics.DeliveryLatency.WithLabelValues(labels...).Observe(time.Since(start).Seconds())
+	if err != nil {
+		metrics.DeliveriesFailed.WithLabelValues(labels...).Inc()
+	} else {
+		metrics.DeliveriesSucceeded.WithLabelValues(labels...).Inc()
+	}
+	return err
+}
+
+// deliveryTimeout bounds applying update, which includes transferring its attachments if it's a new message.
+// Edits keep attachments as they are, so they only take a few requests.
+func (s *BridgeService) deliveryTimeout(update *model.EndpointUpdate) time.Duration {
+	if update.Type == model.UpdateTypeNew && update.Content != nil && len(update.Content.Attachments) > 0 {
+		return time.Duration(s.Config.MediaTimeout)
+	}
+	return time.Duration(s.Config.RequestTimeout)
+}
+
+// applyDelivery applies the update of d to its target, and records the resulting messages in cache.
+// The reply target and the messages to edit are resolved now, as they might have changed since the update was received.
+func (s *BridgeService) applyDelivery(ctx context.Context, route *BridgeRoute, d *Delivery) error {
+	ep := s.Endpoints[d.Target]
+
+	err := s.restoreAttachments(d.Update)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.deliveryTimeout(d.Update))
+	defer cancel()
+
+	switch d.Update.Type {
+	case model.UpdateTypeNew:
+		// If the parent was split into multiple messages, reply to the last one to continue the thread.
+		var replyTo model.EndpointMessageID
+		for _, uniqueID := range s.queryParentMessages(route, d.Update) {
+			if uniqueID.EID == d.Target {
+				replyTo = uniqueID.ID
+			}
+		}
+
+		revisions, err := ep.ApplyUpdateNew(ctx, d.Update.Content, replyTo)
+		if err != nil {
+			return err
+		}
+		for _, revision := range revisions {
+			err = s.Cache.CreateEndpointMessage(route.ID, model.UniqueEndpointMessageID{
+				EID: d.Target,
+				ID:  revision.ID,
+			}, d.BID, revision.Timestamp)
+			if err != nil {
+				panic(fmt.Sprintf("Failed to create endpoint message for %q: %v", revision.ID, err))
+			}
+		}
+
+	case model.UpdateTypeEdit:
+		ids := s.queryTargetMessages(d.BID, d.Target)
+		if len(ids) == 0 {
+			return &endpoint.PermanentError{Err: fmt.Errorf("no message of bridge message %d to edit on %s", d.BID, d.Target)}
+		}
+
+		revisions, err := ep.ApplyUpdateEdit(ctx, ids, d.Update.Content)
+		if err != nil {
+			return err
+		}
+		s.syncEditedMessages(route, d.BID, d.Target, ids, revisions)
+
+	case model.UpdateTypeDelete:
+		// Deleted messages are forgotten one by one, so that a retry only deletes those left.
+		for _, id := range s.queryTargetMessages(d.BID, d.Target) {
+			err = ep.ApplyUpdateDelete(ctx, id)
+			if err != nil {
+				return err
+			}
+			uniqueID := model.UniqueEndpointMessageID{EID: d.Target, ID: id}
+			err = s.Cache.DeleteEndpointMessage(route.ID, uniqueID)
+			if err != nil && !errors.Is(err, ErrMessageNotFound) {
+				panic(fmt.Sprintf("Failed to delete endpoint message for %q: %v", uniqueID, err))
+			}
+		}
+
+	default:
+		return &endpoint.PermanentError{Err: fmt.Errorf("unsupported delivery of update type %d", d.Update.Type)}
+	}
+
+	return nil
+}
+
+// restoreAttachments recreates attachment openers lost when the update was persisted, through the source endpoint.
+func (s *BridgeService) restoreAttachments(update *model.EndpointUpdate) error {
+	if update.Content == nil {
+		return nil
+	}
+
+	for _, attachment := range update.Content.Attachments {
+		if attachment.Open != nil {
+			continue
+		}
+		source, ok := s.Endpoints[update.EID].(Listener)
+		if !ok {
+			return &endpoint.PermanentError{Err: fmt.Errorf("source endpoint %s of attachment is no longer configured", update.EID)}
+		}
+		attachment.Open = source.AttachmentOpener(attachment.Source)
+	}
+
+	return nil
+}
+
+// queryTargetMessages returns messages of target bridged from bid, in the order they were sent.
+func (s *BridgeService) queryTargetMessages(bid model.BridgeMessageID, target model.EndpointID) []model.EndpointMessageID {
+	associatedMessages, err := s.Cache.QueryEndpointMessages(bid)
+	if errors.Is(err, ErrMessageNotFound) { // Deleted while the update was queued
+		return nil
+	} else if err != nil {
+		panic(fmt.Sprintf("Failed to query associated messages for bridge message ID %d: %v", bid, err))
+	}
+
+	var ids []model.EndpointMessageID
+	for _, uniqueID := range associatedMessages {
+		if uniqueID.EID == target {
+			ids = append(ids, uniqueID.ID)
+		}
+	}
+	return ids
+}
+
+// handleDeliveryFailure schedules the next attempt of d, or moves it to dead letters if it can't succeed.
+func (s *BridgeService) handleDeliveryFailure(ctx context.Context, d *Delivery, err error) {
+	d.LastError = err.Error()
+
+	var retryAfter *endpoint.RetryAfterError
+	var permanent *endpoint.PermanentError
+	switch {
+	case ctx.Err() != nil:
+		// Not the fault of the endpoint, retry right after restart.
+		d.NextAttempt = time.Now()
+		slog.Warn("Delivery aborted by shutdown, kept in outbox", "eid", d.Target, "bid", d.BID)
+
+	case errors.As(err, &retryAfter):
+		delay := retryAfter.RetryAfter
+		if delay <= 0 {
+			delay = outboxBackoff(d.Attempts)
+		}
+		d.NextAttempt = time.Now().Add(delay)
+		s.targets[d.Target].pause(d.NextAttempt)
+		slog.Warn("Endpoint is rate limited, delivery postponed", "eid", d.Target, "bid", d.BID, "delay", delay, "err", err)
+
+	case errors.As(err, &permanent):
+		d.Attempts++
+		d.Dead = true
+		slog.Error("Delivery failed permanently, moved to dead letters", "eid", d.Target, "bid", d.BID, "err", err)
+
+	default:
+		d.Attempts++
+		if d.Attempts >= outboxMaxAttempts {
+			d.Dead = true
+			slog.Error("Delivery failed too many times, moved to dead letters", "eid", d.Target, "bid", d.BID, "attempts", d.Attempts, "err", err)
+			break
+		}
+		d.NextAttempt = time.Now().Add(outboxBackoff(d.Attempts))
+		slog.Warn("Delivery failed, will retry", "eid", d.Target, "bid", d.BID, "attempts", d.Attempts, "next", d.NextAttempt, "err", err)
+	}
+
+	s.updateDelivery(d)
+}
+
+// updateDelivery stores d in the outbox, enqueuing it if it's new.
+func (s *BridgeService) updateDelivery(d *Delivery) {
+	var err error
+	if d.ID == 0 {
+		err = s.Outbox.Enqueue(d)
+	} else {
+		err = s.Outbox.Update(d)
+	}
+	// The delivery might have been discarded from the CLI in the meantime.
+	if err != nil && !errors.Is(err, ErrDeliveryNotFound) {
+		panic(fmt.Sprintf("Failed to store delivery of bridge message %d to %s: %v", d.BID, d.Target, err))
+	}
+}
+
+// outboxBackoff returns the delay before the next attempt after the given number of failed ones.
+func outboxBackoff(attempts int) time.Duration {
+	if attempts > 16 { // avoid overflow
+		return outboxMaxBackoff
+	}
+	return min(outboxMinBackoff<<max(attempts-1, 0), outboxMaxBackoff)
+}
+
+// runOutbox retries due deliveries to target periodically, until pollCtx is done.
+// Deliveries in flight are only aborted once ctx is done.
+func (s *BridgeService) runOutbox(pollCtx, ctx context.Context, target model.EndpointID) {
+	ticker := time.NewTicker(outboxPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-pollCtx.Done():
+			return
+		case <-ticker.C:
+			s.flushOutbox(pollCtx, ctx, target)
+		}
+	}
+}
+
+func (s *BridgeService) flushOutbox(pollCtx, ctx context.Context, target model.EndpointID) {
+	due, err := s.Outbox.Due(target, time.Now())
+	if err != nil {
+		panic(fmt.Sprintf("Failed to query due deliveries to %s: %v", target, err))
+	}
+
+	for _, d := range due {
+		if pollCtx.Err() != nil || !s.retryDelivery(ctx, d) {
+			return
+		}
+	}
+}
+
+// retryDelivery attempts a queued delivery, it returns false if target is rate limited and further attempts should wait.
+func (s *BridgeService) retryDelivery(ctx context.Context, due *Delivery) bool {
+	defer s.deliveryLocks.lock(deliveryKey{due.BID, due.Target})()
+
+	t := s.targets[due.Target]
+	if _, ok := t.paused(); ok {
+		return false
+	}
+
+	// Reload the delivery, as it might have been edited or dropped while waiting for the lock.
+	d, err := s.Outbox.Get(due.ID)
+	if errors.Is(err, ErrDeliveryNotFound) {
+		return true
+	} else if err != nil {
+		panic(fmt.Sprintf("Failed to query delivery %d: %v", due.ID, err))
+	}
+	if d.Dead {
+		return true
+	}
+
+	route := s.route(d.Route)
+	if route == nil {
+		err = &endpoint.PermanentError{Err: fmt.Errorf("route %s is no longer configured", d.Route)}
+	} else {
+		flight := s.inFlight.begin(d.BID, d.Update.Type, []model.EndpointID{d.Target})
+		err = s.attemptDelivery(ctx, route, d)
+		flight.finish()
+	}
+	if err != nil {
+		s.handleDeliveryFailure(ctx, d, err)
+		_, paused := t.paused()
+		return !paused
+	}
+
+	slog.Info("Queued delivery succeeded", "eid", d.Target, "bid", d.BID, "attempts", d.Attempts+1)
+	err = s.Outbox.Remove(d.ID)
+	if err != nil && !errors.Is(err, ErrDeliveryNotFound) {
+		panic(fmt.Sprintf("Failed to remove delivery %d: %v", d.ID, err))
+	}
+	if d.Update.Type == model.UpdateTypeDelete {
+		s.finishDeletion(route, d.BID)
+	}
+	return true
+}
+
+// finishDeletion drops bid once no deletion of it is pending on any endpoint of route.
+// Dead deletions keep it along with the messages they failed to delete, so that they can still be replayed.
+func (s *BridgeService) finishDeletion(route *BridgeRoute, bid model.BridgeMessageID) {
+	for _, ep := range route.Endpoints {
+		d, err := s.Outbox.Pending(bid, ep.ID())
+		if errors.Is(err, ErrDeliveryNotFound) {
+			continue
+		} else if err != nil {
+			panic(fmt.Sprintf("Failed to query pending delivery of bridge message %d to %s: %v", bid, ep.ID(), err))
+		}
+		if d.Update.Type == model.UpdateTypeDelete {
+			return
+		}
+	}
+
+	err := s.Outbox.DropBridgeMessage(bid)
+	if err != nil {
+		panic(fmt.Sprintf("Failed to drop deliveries of bridge message %d: %v", bid, err))
+	}
+	err = s.Cache.DeleteBridgeMessage(bid)
+	if err != nil && !errors.Is(err, ErrMessageNotFound) {
+		panic(fmt.Sprintf("Failed to delete bridge message %d: %v", bid, err))
+	}
+}
+
+func (s *BridgeService) route(id model.RouteID) *BridgeRoute {
+	for _, route := range s.Routes {
+		if route.ID == id {
+			return route
+		}
+	}
+	return nil
+}
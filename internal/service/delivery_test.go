@@ -0,0 +1,144 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/merrkry/tele2don/internal/metrics"
+	"github.com/merrkry/tele2don/internal/model"
+)
+
+func TestDeliveryMetrics(t *testing.T) {
+	updates := make(chan *model.EndpointUpdate, 16)
+	s, fakes := newTestBridge(t, updates, "source", "metrics-ok", "metrics-failing")
+	fakes["metrics-ok"].delay = 0
+	fakes["metrics-failing"].err = errors.New("unavailable")
+	route := s.Routes[0]
+
+	counters := func(target string) [3]float64 {
+		return [3]float64{
+			testutil.ToFloat64(metrics.DeliveriesAttempted.WithLabelValues(target, "new")),
+			testutil.ToFloat64(metrics.DeliveriesSucceeded.WithLabelValues(target, "new")),
+			testutil.ToFloat64(metrics.DeliveriesFailed.WithLabelValues(target, "new")),
+		}
+	}
+	okBefore, failingBefore := counters("metrics-ok"), counters("metrics-failing")
+
+	bid, err := s.Cache.NewBridgeMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	update := &model.EndpointUpdate{
+		Type:                    model.UpdateTypeNew,
+		UniqueEndpointMessageID: model.UniqueEndpointMessageID{EID: "source", ID: "1"},
+		Content:                 &model.BridgeMessageContent{MDText: "hello"},
+		Timestamp:               time.Now(),
+	}
+	s.deliverAll(context.Background(), route, update, bid, nil)
+
+	// Attempted, succeeded and failed deliveries.
+	if got, want := counters("metrics-ok"), [3]float64{okBefore[0] + 1, okBefore[1] + 1, okBefore[2]}; got != want {
+		t.Errorf("counters of successful delivery = %v, want %v", got, want)
+	}
+	if got, want := counters("metrics-failing"), [3]float64{failingBefore[0] + 1, failingBefore[1], failingBefore[2] + 1}; got != want {
+		t.Errorf("counters of failed delivery = %v, want %v", got, want)
+	}
+
+	// The failed delivery is queued for retry.
+	if _, err := s.Outbox.Pending(bid, "metrics-failing"); err != nil {
+		t.Errorf("failed delivery is not pending in outbox: %v", err)
+	}
+
+	// Metrics are exposed by the handler.
+	recorder := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := io.ReadAll(recorder.Body)
+	for _, want := range []string{
+		`tele2don_deliveries_succeeded_total{target="metrics-ok",type="new"}`,
+		`tele2don_deliveries_failed_total{target="metrics-failing",type="new"}`,
+		`tele2don_delivery_duration_seconds_count{target="metrics-ok",type="new"}`,
+	} {
+		if !strings.Contains(string(body), want) {
+			t.Errorf("scraped metrics don't contain %s", want)
+		}
+	}
+}
+
+func TestFailedDeletionsAreQueued(t *testing.T) {
+	s, fakes := newTestBridge(t, nil, "source", "deleted", "failing")
+	fakes["failing"].deleteErr = errors.New("unavailable")
+	route := s.Routes[0]
+
+	bid, err := s.Cache.NewBridgeMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := model.UniqueEndpointMessageID{EID: "source", ID: "1"}
+	for _, uniqueID := range []model.UniqueEndpointMessageID{source, {EID: "deleted", ID: "2"}, {EID: "failing", ID: "3"}} {
+		err = s.Cache.CreateEndpointMessage(route.ID, uniqueID, bid, time.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	update := &model.EndpointUpdate{Type: model.UpdateTypeDelete, UniqueEndpointMessageID: source, Timestamp: time.Now()}
+	s.applyUpdateDelete(context.Background(), route, update, bid, nil)
+
+	// The mapping is kept for the failed deletion only.
+	messages, err := s.Cache.QueryEndpointMessages(bid)
+	if err != nil {
+		t.Fatalf("bridge message dropped while a deletion is pending: %v", err)
+	}
+	if len(messages) != 1 || messages[0].EID != "failing" {
+		t.Errorf("messages left = %v, want the one of failing", messages)
+	}
+	d, err := s.Outbox.Pending(bid, "failing")
+	if err != nil {
+		t.Fatalf("failed deletion is not pending in outbox: %v", err)
+	}
+	if d.Update.Type != model.UpdateTypeDelete {
+		t.Errorf("pending delivery has type %s, want delete", d.Update.Type)
+	}
+
+	fakes["failing"].deleteErr = nil
+	if !s.retryDelivery(context.Background(), d) {
+		t.Fatal("retry of deletion reported rate limiting")
+	}
+	if got := fakes["failing"].deleted; len(got) != 1 || got[0] != "3" {
+		t.Errorf("deleted %v on failing, want [3]", got)
+	}
+	if _, err := s.Cache.QueryEndpointMessages(bid); !errors.Is(err, ErrMessageNotFound) {
+		t.Errorf("bridge message kept after deletions succeeded, err = %v", err)
+	}
+	if _, err := s.Outbox.Pending(bid, "failing"); !errors.Is(err, ErrDeliveryNotFound) {
+		t.Errorf("deletion still pending after it succeeded, err = %v", err)
+	}
+}
+
+func TestDeliveryTimeout(t *testing.T) {
+	s, _ := newTestBridge(t, nil)
+	media := &model.BridgeMessageContent{Attachments: []*model.Attachment{{Kind: model.AttachmentKindVideo}}}
+
+	tests := []struct {
+		name   string
+		update *model.EndpointUpdate
+		want   time.Duration
+	}{
+		{"text", &model.EndpointUpdate{Type: model.UpdateTypeNew, Content: &model.BridgeMessageContent{MDText: "text"}}, time.Second},
+		{"media", &model.EndpointUpdate{Type: model.UpdateTypeNew, Content: media}, time.Minute},
+		{"media edit", &model.EndpointUpdate{Type: model.UpdateTypeEdit, Content: media}, time.Second},
+		{"delete", &model.EndpointUpdate{Type: model.UpdateTypeDelete}, time.Second},
+	}
+	for _, tt := range tests {
+		if got := s.deliveryTimeout(tt.update); got != tt.want {
+			t.Errorf("%s: deliveryTimeout = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
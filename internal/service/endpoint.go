@@ -3,7 +3,6 @@ package service
 import (
 	"context"
 	"sync"
-	"time"
 
 	"github.com/merrkry/tele2don/internal/endpoint"
 	"github.com/merrkry/tele2don/internal/model"
@@ -15,16 +14,38 @@ type Endpoint interface {
 	// Initialize validates the configuration, and initializes platform-specific APIs.
 	Initialize(ctx context.Context, cfg *endpoint.EndpointConfig) error
 
+	// ApplyUpdate sends new message to the endpoint, and returns the sent messages in order.
+	// Content might be split into multiple messages if it exceeds platform limits.
+	// The message is sent as a reply to replyTo, unless it's empty.
+	// Errors should be wrapped in endpoint.RetryAfterError or endpoint.PermanentError if known,
+	// other errors are retried with backoff.
+	ApplyUpdateNew(ctx context.Context, content *model.BridgeMessageContent, replyTo model.EndpointMessageID) ([]model.EndpointMessageRevision, error)
+
+	// ApplyUpdateEdit applies message edition to the messages sent by ApplyUpdateNew, in the same order.
+	// It returns the messages after edition, which might be more or fewer than ids if content is split differently.
+	ApplyUpdateEdit(ctx context.Context, ids []model.EndpointMessageID, content *model.BridgeMessageContent) ([]model.EndpointMessageRevision, error)
+
+	// ApplyUpdateDelete applies message deletion to the endpoint.
+	ApplyUpdateDelete(ctx context.Context, id model.EndpointMessageID) error
+
+	// Status reports the health of the endpoint, it's called concurrently with other methods.
+	Status() endpoint.Status
+}
+
+// Listener is implemented by endpoints whose messages are bridged to other endpoints.
+// Endpoints not implementing it are write-only, they only receive messages bridged from others.
+type Listener interface {
 	// ListenUpdates starts endpoint worker to listen for platform updates.
 	// Endpoint should convert platform-specific updates to model.EndpointUpdate.
 	ListenUpdates(ctx context.Context, updatesChan chan<- *model.EndpointUpdate, wg *sync.WaitGroup)
 
-	// ApplyUpdate sends new message to the endpoint, and returns the timestamp responded by platform API.
-	ApplyUpdateNew(ctx context.Context, content *model.BridgeMessageContent) (model.EndpointMessageID, time.Time, error)
-
-	// ApplyUpdateEdit applies message deletion to the endpoint, and returns the timestamp responded by platform API.
-	ApplyUpdateEdit(ctx context.Context, id model.EndpointMessageID, content *model.BridgeMessageContent) (time.Time, error)
+	// AttachmentOpener recreates the opener of an attachment received from this endpoint by its source,
+	// as openers are lost when content is persisted in the outbox.
+	AttachmentOpener(source string) model.AttachmentOpener
+}
 
-	// ApplyUpdateDelete applies message deletion to the endpoint, and returns the timestamp responded by platform API.
-	ApplyUpdateDelete(ctx context.Context, id model.EndpointMessageID) error
+// Runner is implemented by write-only endpoints with work of their own, e.g. serving a feed.
+type Runner interface {
+	// Run does the work of the endpoint until ctx is done.
+	Run(ctx context.Context, wg *sync.WaitGroup)
 }
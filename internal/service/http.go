@@ -0,0 +1,115 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/merrkry/tele2don/internal/metrics"
+	"github.com/merrkry/tele2don/internal/model"
+)
+
+// serveHTTP serves metrics and health checks at addr in the background, and returns the function to stop serving.
+func (s *BridgeService) serveHTTP(addr string) (func(), error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /metrics", metrics.Handler())
+	mux.HandleFunc("GET /healthz", s.handleHealth(false))
+	mux.HandleFunc("GET /readyz", s.handleHealth(true))
+	server := &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("HTTP server failed", "err", err)
+		}
+	}()
+	slog.Info("Serving metrics and health checks", "addr", listener.Addr())
+
+	return func() {
+		server.Close()
+	}, nil
+}
+
+type healthResponse struct {
+	Healthy   bool                                 `json:"healthy"`
+	Endpoints map[model.EndpointID]*endpointHealth `json:"endpoints"`
+}
+
+type endpointHealth struct {
+	Healthy          bool       `json:"healthy"`
+	Problem          string     `json:"problem,omitempty"`
+	Initialized      bool       `json:"initialized"`
+	Listening        bool       `json:"listening"`
+	WriteOnly        bool       `json:"write_only,omitempty"`
+	LastAPICall      *time.Time `json:"last_api_call,omitempty"`
+	LastHeartbeat    *time.Time `json:"last_heartbeat,omitempty"`
+	SinceHeartbeatMs *int64     `json:"since_heartbeat_ms,omitempty"`
+}
+
+// handleHealth reports the state of every endpoint.
+// Liveness only fails if a listener, or the runner of a write-only endpoint, has exited, which can't recover without restart.
+// Readiness also fails if a listener is stale, e.g. a stream silently dropped or polling got stuck.
+func (s *BridgeService) handleHealth(readiness bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		now := time.Now()
+		staleAfter := time.Duration(s.Config.HTTP.StaleAfter)
+
+		resp := &healthResponse{
+			Healthy:   true,
+			Endpoints: make(map[model.EndpointID]*endpointHealth),
+		}
+		for id, ep := range s.Endpoints {
+			status := ep.Status()
+			_, listens := ep.(Listener)
+			_, runs := ep.(Runner)
+			health := &endpointHealth{
+				Initialized: status.Initialized,
+				Listening:   status.Listening,
+				WriteOnly:   !listens,
+			}
+			if !status.LastAPICall.IsZero() {
+				health.LastAPICall = &status.LastAPICall
+			}
+			if !status.LastHeartbeat.IsZero() {
+				health.LastHeartbeat = &status.LastHeartbeat
+				since := now.Sub(status.LastHeartbeat).Milliseconds()
+				health.SinceHeartbeatMs = &since
+			}
+
+			exited := !status.Listening && !status.LastHeartbeat.IsZero()
+			switch {
+			case !status.Initialized:
+				health.Problem = "not initialized"
+			case exited:
+				health.Problem = "listener exited"
+			case (listens || runs) && !status.Listening:
+				health.Problem = "listener not started"
+			// Write-only endpoints have nothing to listen to, so they never become stale.
+			case listens && now.Sub(status.LastHeartbeat) > staleAfter:
+				health.Problem = fmt.Sprintf("no heartbeat for %s", now.Sub(status.LastHeartbeat).Round(time.Second))
+			}
+
+			// Liveness tolerates problems that may resolve by themselves.
+			health.Healthy = health.Problem == "" || (!readiness && !exited)
+			resp.Healthy = resp.Healthy && health.Healthy
+			resp.Endpoints[id] = health
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if !resp.Healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(resp)
+	}
+}
@@ -0,0 +1,110 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/merrkry/tele2don/internal/config"
+	"github.com/merrkry/tele2don/internal/endpoint"
+	"github.com/merrkry/tele2don/internal/model"
+)
+
+// statusEndpoint is a write-only endpoint reporting a fixed status.
+type statusEndpoint struct {
+	*fakeEndpoint
+	status endpoint.Status
+}
+
+func (e *statusEndpoint) Status() endpoint.Status { return e.status }
+
+type statusListener struct{ statusEndpoint }
+
+func (e *statusListener) ListenUpdates(ctx context.Context, updatesChan chan<- *model.EndpointUpdate, wg *sync.WaitGroup) {
+	wg.Done()
+}
+
+func (e *statusListener) AttachmentOpener(source string) model.AttachmentOpener { return nil }
+
+type statusRunner struct{ statusEndpoint }
+
+func (e *statusRunner) Run(ctx context.Context, wg *sync.WaitGroup) { wg.Done() }
+
+func TestHealth(t *testing.T) {
+	now := time.Now()
+	running := endpoint.Status{Initialized: true, Listening: true, LastHeartbeat: now}
+
+	tests := []struct {
+		name        string
+		listener    bool
+		runner      bool
+		status      endpoint.Status
+		wantProblem string
+		wantLive    bool
+		wantReady   bool
+	}{
+		{"listening", true, false, running, "", true, true},
+		{"not initialized", true, false, endpoint.Status{}, "not initialized", true, false},
+		{"not started", true, false, endpoint.Status{Initialized: true}, "listener not started", true, false},
+		{"stale", true, false, endpoint.Status{Initialized: true, Listening: true, LastHeartbeat: now.Add(-10 * time.Minute)}, "no heartbeat for 10m0s", true, false},
+		{"exited", true, false, endpoint.Status{Initialized: true, LastHeartbeat: now}, "listener exited", false, false},
+		{"write-only", false, false, endpoint.Status{Initialized: true}, "", true, true},
+		{"runner running", false, true, running, "", true, true},
+		{"runner not started", false, true, endpoint.Status{Initialized: true}, "listener not started", true, false},
+		{"runner exited", false, true, endpoint.Status{Initialized: true, LastHeartbeat: now}, "listener exited", false, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			base := statusEndpoint{fakeEndpoint: &fakeEndpoint{id: "ep"}, status: tt.status}
+			var ep Endpoint = &base
+			switch {
+			case tt.listener:
+				ep = &statusListener{base}
+			case tt.runner:
+				ep = &statusRunner{base}
+			}
+			healthy := &statusListener{statusEndpoint{fakeEndpoint: &fakeEndpoint{id: "healthy"}, status: running}}
+			s := &BridgeService{
+				Config:    &BridgeConfig{HTTP: HTTPConfig{StaleAfter: config.Duration(5 * time.Minute)}},
+				Endpoints: map[model.EndpointID]Endpoint{"ep": ep, "healthy": healthy},
+			}
+
+			for _, check := range []struct {
+				readiness bool
+				want      bool
+			}{{false, tt.wantLive}, {true, tt.wantReady}} {
+				rec := httptest.NewRecorder()
+				s.handleHealth(check.readiness)(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+				wantCode := http.StatusOK
+				if !check.want {
+					wantCode = http.StatusServiceUnavailable
+				}
+				if rec.Code != wantCode {
+					t.Errorf("readiness %v: status = %d, want %d", check.readiness, rec.Code, wantCode)
+				}
+
+				var resp healthResponse
+				err := json.NewDecoder(rec.Body).Decode(&resp)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got := resp.Endpoints["ep"]
+				if resp.Healthy != check.want || got.Healthy != check.want || got.Problem != tt.wantProblem {
+					t.Errorf("readiness %v: healthy %v, endpoint %+v, want %v with problem %q", check.readiness, resp.Healthy, got, check.want, tt.wantProblem)
+				}
+				if got.WriteOnly == tt.listener {
+					t.Errorf("readiness %v: write-only = %v", check.readiness, got.WriteOnly)
+				}
+				if !resp.Endpoints["healthy"].Healthy {
+					t.Errorf("readiness %v: healthy endpoint reported unhealthy", check.readiness)
+				}
+			}
+		})
+	}
+}
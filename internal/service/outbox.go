@@ -0,0 +1,177 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"slices"
+	"sync"
+	"time"
+
+	m "github.com/merrkry/tele2don/internal/model"
+)
+
+var ErrDeliveryNotFound = errors.New("delivery not found in outbox")
+
+type DeliveryID int64
+
+// Delivery is an update that failed to be applied to a target endpoint, and waits in the outbox to be retried.
+// Dead deliveries failed permanently, they are kept until replayed or discarded manually.
+type Delivery struct {
+	ID     DeliveryID
+	Route  m.RouteID
+	Target m.EndpointID
+	BID    m.BridgeMessageID
+	// Update is the source update, either new message or edition.
+	// Its content is replaced by later editions while the delivery is pending.
+	Update *m.EndpointUpdate
+
+	Attempts    int
+	NextAttempt time.Time
+	LastError   string
+	Dead        bool
+}
+
+// Outbox persists pending deliveries of each target endpoint.
+// There's at most one delivery for a bridge message and a target, which carries the latest content.
+type Outbox interface {
+	// Enqueue adds a delivery and assigns its ID.
+	Enqueue(*Delivery) error
+	Get(DeliveryID) (*Delivery, error)
+	Update(*Delivery) error
+	Remove(DeliveryID) error
+	// Pending returns the delivery of a bridge message to target, including dead ones.
+	Pending(m.BridgeMessageID, m.EndpointID) (*Delivery, error)
+	// Due returns deliveries to target that should be attempted at now, oldest first.
+	Due(m.EndpointID, time.Time) ([]*Delivery, error)
+	// List returns all deliveries, oldest first.
+	List() ([]*Delivery, error)
+	// DropBridgeMessage removes all deliveries of a bridge message.
+	DropBridgeMessage(m.BridgeMessageID) error
+	Close() error
+}
+
+// LoadOutbox creates the Outbox implementation matching the cache chosen in config,
+// so that deliveries are persisted along with the message mappings they refer to.
+func LoadOutbox(cfg *CacheConfig) (Outbox, error) {
+	switch cfg.Type {
+	case CacheTypeMemory:
+		return NewOutbox(), nil
+	case CacheTypeSQLite:
+		return NewSQLiteOutbox(cfg.SQLitePath)
+	default:
+		return nil, fmt.Errorf("unsupported cache type %s", cfg.Type)
+	}
+}
+
+func NewOutbox() Outbox {
+	return &nativeMemoryOutbox{
+		deliveries: make(map[DeliveryID]*Delivery),
+	}
+}
+
+type nativeMemoryOutbox struct {
+	deliveries map[DeliveryID]*Delivery
+	idCounter  DeliveryID
+	mu         sync.Mutex
+}
+
+// Deliveries are copied in and out, so that callers can't modify stored ones without Update.
+func copyDelivery(d *Delivery) *Delivery {
+	c := *d
+	return &c
+}
+
+func (o *nativeMemoryOutbox) Enqueue(d *Delivery) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	o.idCounter++
+	d.ID = o.idCounter
+	o.deliveries[d.ID] = copyDelivery(d)
+
+	return nil
+}
+
+func (o *nativeMemoryOutbox) Get(id DeliveryID) (*Delivery, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	d, ok := o.deliveries[id]
+	if !ok {
+		return nil, ErrDeliveryNotFound
+	}
+	return copyDelivery(d), nil
+}
+
+func (o *nativeMemoryOutbox) Update(d *Delivery) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if _, ok := o.deliveries[d.ID]; !ok {
+		return ErrDeliveryNotFound
+	}
+	o.deliveries[d.ID] = copyDelivery(d)
+
+	return nil
+}
+
+func (o *nativeMemoryOutbox) Remove(id DeliveryID) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	if _, ok := o.deliveries[id]; !ok {
+		return ErrDeliveryNotFound
+	}
+	delete(o.deliveries, id)
+
+	return nil
+}
+
+func (o *nativeMemoryOutbox) Pending(bid m.BridgeMessageID, target m.EndpointID) (*Delivery, error) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	for _, d := range o.deliveries {
+		if d.BID == bid && d.Target == target {
+			return copyDelivery(d), nil
+		}
+	}
+	return nil, ErrDeliveryNotFound
+}
+
+func (o *nativeMemoryOutbox) Due(target m.EndpointID, now time.Time) ([]*Delivery, error) {
+	return o.filter(func(d *Delivery) bool {
+		return d.Target == target && !d.Dead && !d.NextAttempt.After(now)
+	}), nil
+}
+
+func (o *nativeMemoryOutbox) List() ([]*Delivery, error) {
+	return o.filter(func(d *Delivery) bool { return true }), nil
+}
+
+func (o *nativeMemoryOutbox) filter(keep func(*Delivery) bool) []*Delivery {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	var deliveries []*Delivery
+	for _, id := range slices.Sorted(maps.Keys(o.deliveries)) {
+		if d := o.deliveries[id]; keep(d) {
+			deliveries = append(deliveries, copyDelivery(d))
+		}
+	}
+	return deliveries
+}
+
+func (o *nativeMemoryOutbox) DropBridgeMessage(bid m.BridgeMessageID) error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	maps.DeleteFunc(o.deliveries, func(_ DeliveryID, d *Delivery) bool { return d.BID == bid })
+
+	return nil
+}
+
+func (o *nativeMemoryOutbox) Close() error {
+	return nil
+}
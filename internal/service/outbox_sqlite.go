@@ -0,0 +1,157 @@
+package service
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	m "github.com/merrkry/tele2don/internal/model"
+)
+
+// sqliteOutbox is a persistent Outbox, sharing the database handle of sqliteCache.
+// Updates are stored as JSON, with attachments referring to their source instead of the data.
+// Deliveries are removed along with their bridge message by ON DELETE CASCADE.
+type sqliteOutbox struct {
+	db *sql.DB
+}
+
+func NewSQLiteOutbox(path string) (Outbox, error) {
+	db, err := openSQLite(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sqliteOutbox{db: db}, nil
+}
+
+const sqliteOutboxColumns = "id, route_id, target_id, bridge_message_id, payload, attempts, next_attempt, last_error, dead"
+
+func (o *sqliteOutbox) Enqueue(d *Delivery) error {
+	payload, err := json.Marshal(d.Update)
+	if err != nil {
+		return err
+	}
+
+	res, err := o.db.Exec(
+		"INSERT INTO outbox (route_id, target_id, bridge_message_id, payload, attempts, next_attempt, last_error, dead) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+		d.Route, d.Target, d.BID, string(payload), d.Attempts, d.NextAttempt.UnixNano(), d.LastError, d.Dead,
+	)
+	if isUniqueViolation(err) {
+		return fmt.Errorf("delivery of bridge message %d to %s already exists", d.BID, d.Target)
+	} else if err != nil {
+		return err
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	d.ID = DeliveryID(id)
+
+	return nil
+}
+
+func (o *sqliteOutbox) Get(id DeliveryID) (*Delivery, error) {
+	return o.queryOne("SELECT "+sqliteOutboxColumns+" FROM outbox WHERE id = ?", id)
+}
+
+func (o *sqliteOutbox) Update(d *Delivery) error {
+	payload, err := json.Marshal(d.Update)
+	if err != nil {
+		return err
+	}
+
+	res, err := o.db.Exec(
+		"UPDATE outbox SET payload = ?, attempts = ?, next_attempt = ?, last_error = ?, dead = ? WHERE id = ?",
+		string(payload), d.Attempts, d.NextAttempt.UnixNano(), d.LastError, d.Dead, d.ID,
+	)
+	if err != nil {
+		return err
+	}
+
+	return checkDeliveryAffected(res)
+}
+
+func (o *sqliteOutbox) Remove(id DeliveryID) error {
+	res, err := o.db.Exec("DELETE FROM outbox WHERE id = ?", id)
+	if err != nil {
+		return err
+	}
+
+	return checkDeliveryAffected(res)
+}
+
+func (o *sqliteOutbox) Pending(bid m.BridgeMessageID, target m.EndpointID) (*Delivery, error) {
+	return o.queryOne("SELECT "+sqliteOutboxColumns+" FROM outbox WHERE bridge_message_id = ? AND target_id = ?", bid, target)
+}
+
+func (o *sqliteOutbox) Due(target m.EndpointID, now time.Time) ([]*Delivery, error) {
+	return o.query("SELECT "+sqliteOutboxColumns+" FROM outbox WHERE target_id = ? AND dead = 0 AND next_attempt <= ? ORDER BY id", target, now.UnixNano())
+}
+
+func (o *sqliteOutbox) List() ([]*Delivery, error) {
+	return o.query("SELECT " + sqliteOutboxColumns + " FROM outbox ORDER BY id")
+}
+
+func (o *sqliteOutbox) DropBridgeMessage(bid m.BridgeMessageID) error {
+	_, err := o.db.Exec("DELETE FROM outbox WHERE bridge_message_id = ?", bid)
+	return err
+}
+
+func (o *sqliteOutbox) Close() error {
+	return closeSQLite(o.db)
+}
+
+func (o *sqliteOutbox) queryOne(query string, args ...any) (*Delivery, error) {
+	deliveries, err := o.query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	if len(deliveries) == 0 {
+		return nil, ErrDeliveryNotFound
+	}
+
+	return deliveries[0], nil
+}
+
+func (o *sqliteOutbox) query(query string, args ...any) ([]*Delivery, error) {
+	rows, err := o.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var deliveries []*Delivery
+	for rows.Next() {
+		d := &Delivery{}
+		var payload string
+		var nextAttempt int64
+		err = rows.Scan(&d.ID, &d.Route, &d.Target, &d.BID, &payload, &d.Attempts, &nextAttempt, &d.LastError, &d.Dead)
+		if err != nil {
+			return nil, err
+		}
+		d.NextAttempt = time.Unix(0, nextAttempt)
+
+		err = json.Unmarshal([]byte(payload), &d.Update)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode delivery %d: %w", d.ID, err)
+		}
+
+		deliveries = append(deliveries, d)
+	}
+
+	return deliveries, rows.Err()
+}
+
+func checkDeliveryAffected(res sql.Result) error {
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return ErrDeliveryNotFound
+	}
+
+	return nil
+}